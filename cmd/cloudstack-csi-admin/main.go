@@ -0,0 +1,189 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+// Small utility providing recovery operations on the CloudStack
+// volumes managed by the CloudStack CSI driver.
+//
+// To get usage information:
+//
+//	cloudstack-csi-admin -h
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/admin"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// Version is set by the build process.
+var version = ""
+
+func usage() {
+	baseName := path.Base(os.Args[0])
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n\n", baseName)
+	fmt.Fprintln(os.Stderr, "Commands:")
+	fmt.Fprintln(os.Stderr, "  delete-volume-by-name  Delete a CloudStack volume given its name")
+	fmt.Fprintln(os.Stderr, "  extract-snapshot       Get a download URL for a CloudStack snapshot")
+	fmt.Fprintln(os.Stderr, "  find-volume-by-pv      Find the CloudStack volume of a Kubernetes PersistentVolume")
+	fmt.Fprintln(os.Stderr, "  version                Show version")
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' to get the options of a command.\n", baseName)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+	case "delete-volume-by-name":
+		err = deleteVolumeByName(args)
+	case "extract-snapshot":
+		err = extractSnapshot(args)
+	case "find-volume-by-pv":
+		err = findVolumeByPV(args)
+	case "version":
+		fmt.Println(path.Base(os.Args[0]), version) //nolint:forbidigo
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+}
+
+func newConnector(cloudstackconfig string) (cloud.Interface, error) {
+	config, err := cloud.ReadConfig(cloudstackconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return cloud.New(config), nil
+}
+
+// confirm asks the user for a confirmation on the standard input.
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question) //nolint:forbidigo
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+
+	return answer == "y" || answer == "yes"
+}
+
+func deleteVolumeByName(args []string) error {
+	fs := flag.NewFlagSet("delete-volume-by-name", flag.ExitOnError)
+	cloudstackconfig := fs.String("cloudstackconfig", "./cloud-config", "CloudStack configuration file")
+	name := fs.String("name", "", "Name of the CloudStack volume to delete")
+	dryRun := fs.Bool("dry-run", true, "Only show the volume that would be deleted")
+	force := fs.Bool("force", false, "Detach the volume first if it is still attached to a VM")
+	yes := fs.Bool("yes", false, "Do not ask for confirmation")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	connector, err := newConnector(*cloudstackconfig)
+	if err != nil {
+		return fmt.Errorf("cannot create CloudStack client: %w", err)
+	}
+
+	ctx := context.Background()
+	vol, err := admin.FindVolumeByName(ctx, connector, *name)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found volume %s: id=%s zone=%s size=%d attachedTo=%q", vol.Name, vol.ID, vol.ZoneID, vol.Size, vol.VirtualMachineID)
+
+	if *dryRun {
+		log.Println("Dry run: volume not deleted. Use -dry-run=false to delete it.")
+
+		return nil
+	}
+	if !*yes && !confirm(fmt.Sprintf("Delete volume %s (%s)?", vol.Name, vol.ID)) {
+		log.Println("Aborted")
+
+		return nil
+	}
+
+	if err := admin.DeleteVolume(ctx, connector, vol, *force); err != nil {
+		return err
+	}
+	log.Printf("Volume %s (%s) deleted", vol.Name, vol.ID)
+
+	return nil
+}
+
+func extractSnapshot(args []string) error {
+	fs := flag.NewFlagSet("extract-snapshot", flag.ExitOnError)
+	cloudstackconfig := fs.String("cloudstackconfig", "./cloud-config", "CloudStack configuration file")
+	id := fs.String("id", "", "ID of the CloudStack snapshot to extract")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	connector, err := newConnector(*cloudstackconfig)
+	if err != nil {
+		return fmt.Errorf("cannot create CloudStack client: %w", err)
+	}
+
+	log.Printf("Extracting snapshot %s, this may take a while...", *id)
+	url, err := admin.ExtractSnapshot(context.Background(), connector, *id)
+	if err != nil {
+		return err
+	}
+	fmt.Println(url) //nolint:forbidigo
+
+	return nil
+}
+
+func findVolumeByPV(args []string) error {
+	fs := flag.NewFlagSet("find-volume-by-pv", flag.ExitOnError)
+	cloudstackconfig := fs.String("cloudstackconfig", "./cloud-config", "CloudStack configuration file")
+	pvName := fs.String("pv", "", "Name of the Kubernetes PersistentVolume")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	connector, err := newConnector(*cloudstackconfig)
+	if err != nil {
+		return fmt.Errorf("cannot create CloudStack client: %w", err)
+	}
+
+	vol, err := admin.FindVolumeByPVName(context.Background(), connector, *pvName)
+	if err != nil {
+		return err
+	}
+	log.Printf("Found volume %s: id=%s zone=%s size=%d attachedTo=%q", vol.Name, vol.ID, vol.ZoneID, vol.Size, vol.VirtualMachineID)
+
+	return nil
+}
@@ -110,9 +110,21 @@ func main() {
 		klog.FlushAndExit(klog.ExitFlushTimeout, 1)
 	}
 	logger.Info("Successfully read CloudStack configuration", "cloudstackconfig", options.CloudStackConfig)
+	if config.UserAgent == "" {
+		config.UserAgent = driver.UserAgent()
+	}
 
 	ctx := klog.NewContext(context.Background(), logger)
+	// Only the controller exits on a wrong API URL: the node plugins must
+	// keep serving the volumes already mounted during a CloudStack outage.
+	if err := cloud.CheckAPIURL(ctx, config); err != nil {
+		logger.Error(err, "Cannot reach CloudStack API")
+		if options.Mode == driver.ControllerMode {
+			klog.FlushAndExit(klog.ExitFlushTimeout, 1)
+		}
+	}
 	csConnector := cloud.New(config)
+	options.CloudStack = config
 
 	d, err := driver.New(ctx, csConnector, &options, nil)
 	if err != nil {
@@ -41,6 +41,9 @@ var (
 	namePrefix       = flag.String("namePrefix", "cloudstack-", "")
 	deleteUnused     = flag.Bool("delete", false, "Delete")
 	volumeExpansion  = flag.Bool("volumeExpansion", false, "VolumeExpansion")
+	extraLabels      = flag.String("labels", "", "Comma-separated key=value labels set on the storage classes, e.g. tier=gold")
+	annotations      = flag.String("annotations", "", "Comma-separated key=value annotations set on the storage classes")
+	defaultOffering  = flag.String("defaultOffering", "", "Name or ID of the disk offering whose storage class is the default of the cluster")
 	showVersion      = flag.Bool("version", false, "Show version")
 
 	// Version is set by the build process.
@@ -65,6 +68,9 @@ func main() {
 		NamePrefix:       *namePrefix,
 		Delete:           *deleteUnused,
 		VolumeExpansion:  *volumeExpansion,
+		Labels:           *extraLabels,
+		Annotations:      *annotations,
+		DefaultOffering:  *defaultOffering,
 	})
 	if err != nil {
 		log.Fatalf("Error: %v", err)
@@ -0,0 +1,45 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// ExtractSnapshot extracts a CloudStack snapshot and returns the URL
+// it can be downloaded from.
+func ExtractSnapshot(ctx context.Context, connector cloud.Interface, snapshotID string) (string, error) {
+	if snapshotID == "" {
+		return "", errors.New("snapshot ID is empty")
+	}
+	url, err := connector.ExtractSnapshot(ctx, snapshotID)
+	switch {
+	case errors.Is(err, cloud.ErrNotFound):
+		return "", fmt.Errorf("no snapshot with ID %s", snapshotID)
+	case err != nil:
+		return "", fmt.Errorf("cannot extract snapshot %s: %w", snapshotID, err)
+	}
+
+	return url, nil
+}
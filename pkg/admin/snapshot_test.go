@@ -0,0 +1,57 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package admin
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+func TestExtractSnapshot(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+
+	vol, err := FindVolumeByName(ctx, connector, fakeVolumeName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	snap, err := connector.CreateSnapshot(ctx, vol.ID, "snap-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	url, err := ExtractSnapshot(ctx, connector, snap.ID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !strings.HasPrefix(url, "https://") || !strings.Contains(url, snap.ID) {
+		t.Errorf("Unexpected URL for snapshot %s: %s", snap.ID, url)
+	}
+
+	if _, err := ExtractSnapshot(ctx, connector, "does-not-exist"); err == nil {
+		t.Error("Expected an error for an unknown snapshot")
+	}
+	if _, err := ExtractSnapshot(ctx, connector, ""); err == nil {
+		t.Error("Expected an error for an empty snapshot ID")
+	}
+}
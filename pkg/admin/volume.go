@@ -0,0 +1,89 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// ErrVolumeAttached is returned when trying to delete a volume
+// which is still attached to a virtual machine.
+var ErrVolumeAttached = errors.New("volume is attached to a virtual machine")
+
+// FindVolumeByName looks up a CloudStack volume by its name.
+func FindVolumeByName(ctx context.Context, connector cloud.Interface, name string) (*cloud.Volume, error) {
+	if name == "" {
+		return nil, errors.New("volume name is empty")
+	}
+	vol, err := connector.GetVolumeByName(ctx, name)
+	switch {
+	case errors.Is(err, cloud.ErrNotFound):
+		return nil, fmt.Errorf("no volume named %s", name)
+	case errors.Is(err, cloud.ErrTooManyResults):
+		return nil, fmt.Errorf("several volumes named %s, refusing to choose one", name)
+	case err != nil:
+		return nil, fmt.Errorf("cannot look up volume %s: %w", name, err)
+	}
+
+	return vol, nil
+}
+
+// FindVolumeByPVName looks up a CloudStack volume by the name of its
+// Kubernetes PersistentVolume, as tagged by the driver.
+func FindVolumeByPVName(ctx context.Context, connector cloud.Interface, pvName string) (*cloud.Volume, error) {
+	if pvName == "" {
+		return nil, errors.New("PersistentVolume name is empty")
+	}
+	vol, err := connector.GetVolumeByTag(ctx, cloud.PVNameTagKey, pvName)
+	switch {
+	case errors.Is(err, cloud.ErrNotFound):
+		return nil, fmt.Errorf("no volume tagged with PersistentVolume %s", pvName)
+	case errors.Is(err, cloud.ErrTooManyResults):
+		return nil, fmt.Errorf("several volumes tagged with PersistentVolume %s", pvName)
+	case err != nil:
+		return nil, fmt.Errorf("cannot look up volume of PersistentVolume %s: %w", pvName, err)
+	}
+
+	return vol, nil
+}
+
+// DeleteVolume deletes the given volume. A volume still attached to a
+// virtual machine is only deleted if force is true, in which case it is
+// detached first.
+func DeleteVolume(ctx context.Context, connector cloud.Interface, vol *cloud.Volume, force bool) error {
+	if vol.VirtualMachineID != "" {
+		if !force {
+			return fmt.Errorf("volume %s (%s) is attached to VM %s: %w", vol.Name, vol.ID, vol.VirtualMachineID, ErrVolumeAttached)
+		}
+		if err := connector.DetachVolume(ctx, vol.ID); err != nil {
+			return fmt.Errorf("cannot detach volume %s (%s) from VM %s: %w", vol.Name, vol.ID, vol.VirtualMachineID, err)
+		}
+	}
+
+	if err := connector.DeleteVolume(ctx, vol.ID); err != nil {
+		return fmt.Errorf("cannot delete volume %s (%s): %w", vol.Name, vol.ID, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,120 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package admin
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+const (
+	fakeVolumeName = "vol-1"
+	fakeNodeID     = "0d7107a3-94d2-44e7-89b8-8930881309a5"
+)
+
+func TestFindVolumeByName(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+
+	vol, err := FindVolumeByName(ctx, connector, fakeVolumeName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if vol.Name != fakeVolumeName {
+		t.Errorf("Expected volume %s, got %s", fakeVolumeName, vol.Name)
+	}
+
+	if _, err := FindVolumeByName(ctx, connector, "does-not-exist"); err == nil {
+		t.Error("Expected an error for an unknown volume")
+	}
+}
+
+func TestDeleteVolume(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+
+	vol, err := FindVolumeByName(ctx, connector, fakeVolumeName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := DeleteVolume(ctx, connector, vol, false); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := connector.GetVolumeByName(ctx, fakeVolumeName); !errors.Is(err, cloud.ErrNotFound) {
+		t.Errorf("Expected volume to be deleted, got %v", err)
+	}
+}
+
+func TestDeleteVolumeAttached(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+
+	vol, err := FindVolumeByName(ctx, connector, fakeVolumeName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := connector.AttachVolume(ctx, vol.ID, fakeNodeID); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vol, _ = FindVolumeByName(ctx, connector, fakeVolumeName)
+
+	if err := DeleteVolume(ctx, connector, vol, false); !errors.Is(err, ErrVolumeAttached) {
+		t.Fatalf("Expected ErrVolumeAttached, got %v", err)
+	}
+	if _, err := connector.GetVolumeByName(ctx, fakeVolumeName); err != nil {
+		t.Fatalf("Expected attached volume to be kept, got %v", err)
+	}
+
+	if err := DeleteVolume(ctx, connector, vol, true); err != nil {
+		t.Fatalf("Unexpected error with force: %v", err)
+	}
+	if _, err := connector.GetVolumeByName(ctx, fakeVolumeName); !errors.Is(err, cloud.ErrNotFound) {
+		t.Errorf("Expected volume to be deleted, got %v", err)
+	}
+}
+
+func TestFindVolumeByPVName(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+
+	vol, err := FindVolumeByName(ctx, connector, fakeVolumeName)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := connector.CreateTags(ctx, cloud.ResourceTypeVolume, vol.ID, map[string]string{cloud.PVNameTagKey: "pv-1"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	found, err := FindVolumeByPVName(ctx, connector, "pv-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if found.ID != vol.ID {
+		t.Errorf("Expected volume %s, got %s", vol.ID, found.ID)
+	}
+
+	if _, err := FindVolumeByPVName(ctx, connector, "pv-2"); err == nil {
+		t.Error("Expected an error for an unknown PersistentVolume")
+	}
+}
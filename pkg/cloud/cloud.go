@@ -24,6 +24,7 @@ package cloud
 import (
 	"context"
 	"errors"
+	"sync"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
 )
@@ -34,23 +35,43 @@ import (
 type Interface interface {
 	GetNodeInfo(ctx context.Context, vmName string) (*VM, error)
 	GetVMByID(ctx context.Context, vmID string) (*VM, error)
+	GetHostClusterID(ctx context.Context, hostID string) (string, error)
 
 	ListZonesID(ctx context.Context) ([]string, error)
+	GetZoneIDByName(ctx context.Context, name string) (string, error)
+
+	GetCloudStackVersion(ctx context.Context) (string, error)
+
+	GetDiskOffering(ctx context.Context, diskOfferingID string) (*DiskOffering, error)
+	GetZoneCapacity(ctx context.Context, zoneID string) (int64, error)
+	GetAvailableCapacity(ctx context.Context, zoneID, diskOfferingID string, mode CapacityMode) (int64, error)
+	GetStorageClusterIDs(ctx context.Context, zoneID, diskOfferingID string) ([]string, error)
 
 	GetVolumeByID(ctx context.Context, volumeID string) (*Volume, error)
 	GetVolumeByName(ctx context.Context, name string) (*Volume, error)
-	CreateVolume(ctx context.Context, diskOfferingID, zoneID, name string, sizeInGB int64) (string, error)
+	ListVolumesByName(ctx context.Context, name string) ([]*Volume, error)
+	GetVolumeByTag(ctx context.Context, key, value string) (*Volume, error)
+	ListVolumes(ctx context.Context, volumeID string, pageSize, page int) ([]*Volume, error)
+	ListVolumesForVM(ctx context.Context, vmID string) ([]*Volume, error)
+	FindUnattachedVolume(ctx context.Context, pvc, diskOfferingID, zoneID, projectID string, sizeInGB int64) (*Volume, error)
+	CreateVolume(ctx context.Context, opts *VolumeOptions) (string, error)
 	DeleteVolume(ctx context.Context, id string) error
 	AttachVolume(ctx context.Context, volumeID, vmID string) (string, error)
+	AttachVolumeAtDevice(ctx context.Context, volumeID, vmID, deviceID string) (string, error)
 	DetachVolume(ctx context.Context, volumeID string) error
 	ExpandVolume(ctx context.Context, volumeID string, newSizeInGB int64) error
 
-	CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, projectID, snapshotID string, sizeInGB int64) (*Volume, error)
+	CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, diskOfferingID, projectID, snapshotID string, sizeInGB int64) (*Volume, error)
+	CloneVolume(ctx context.Context, sourceVolumeID string, opts *VolumeOptions) (*Volume, error)
+	CreateTags(ctx context.Context, resourceType, resourceID string, tags map[string]string) error
 	GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error)
 	GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error)
 	CreateSnapshot(ctx context.Context, volumeID, name string) (*Snapshot, error)
 	DeleteSnapshot(ctx context.Context, snapshotID string) error
+	TagSnapshot(ctx context.Context, snapshotID string, tags map[string]string) error
+	GetSnapshotTags(ctx context.Context, snapshotID string) (map[string]string, error)
 	ListSnapshots(ctx context.Context, volumeID, snapshotID string) ([]*Snapshot, error)
+	ExtractSnapshot(ctx context.Context, snapshotID string) (string, error)
 }
 
 // Volume represents a CloudStack volume.
@@ -68,6 +89,52 @@ type Volume struct {
 
 	VirtualMachineID string
 	DeviceID         string
+
+	// State is the CloudStack state of the volume, e.g. Ready or Destroy.
+	State string
+
+	Tags map[string]string
+}
+
+// DiskOffering represents a CloudStack disk offering.
+type DiskOffering struct {
+	ID   string
+	Name string
+
+	// IsCustomized is true if the size is supplied at volume creation.
+	IsCustomized bool
+	// DiskSize in GB, for offerings that are not customized.
+	DiskSize int64
+	// DiskSizeStrict is true if volumes cannot be resized beyond DiskSize.
+	DiskSizeStrict bool
+	// StorageTags select the storage pools of the volumes.
+	StorageTags []string
+	// Encrypt is true if the volumes are encrypted (CloudStack 4.18+).
+	Encrypt bool
+	// IsCustomizedIops is true if the IOPS are supplied at volume creation.
+	IsCustomizedIops bool
+	// LocalStorage is true if the volumes are on the local storage of hosts.
+	LocalStorage bool
+}
+
+// VolumeOptions are the properties of a new volume.
+type VolumeOptions struct {
+	Name           string
+	DiskOfferingID string
+	ZoneID         string
+	// ProjectID is the project of the volume, or the project of the
+	// configuration if empty.
+	ProjectID string
+
+	// SizeInGB is not passed if 0, as required by disk offerings with a fixed size.
+	SizeInGB int64
+	// MinIops and MaxIops are the IOPS of the volumes of custom IOPS disk
+	// offerings, not passed if 0.
+	MinIops int64
+	MaxIops int64
+
+	// HostID is the host whose local storage holds the volume, if not empty.
+	HostID string
 }
 
 type Snapshot struct {
@@ -81,12 +148,60 @@ type Snapshot struct {
 
 	VolumeID  string
 	CreatedAt string
+
+	// State is the CloudStack state of the snapshot, e.g. BackingUp or BackedUp.
+	State string
+
+	Tags map[string]string
+}
+
+// SnapshotStateBackedUp is the state of a snapshot which is usable.
+const SnapshotStateBackedUp = "BackedUp"
+
+// IsReady returns true if the snapshot is backed up, and can be used.
+// Snapshots without a state, as returned by some CloudStack versions, are
+// only listed once their creation job completed, and are ready.
+func (s *Snapshot) IsReady() bool {
+	return s.State == SnapshotStateBackedUp || s.State == ""
+}
+
+// IsManaged returns true if the snapshot was created by the driver.
+func (s *Snapshot) IsManaged() bool {
+	return s.Tags[ManagedByTagKey] == ManagedByTagValue
 }
 
 // VM represents a CloudStack Virtual Machine.
 type VM struct {
 	ID     string
 	ZoneID string
+	State  string
+	// HostID is the host running the VM, empty if it is stopped.
+	HostID string
+}
+
+// Tags set on the volumes created by the driver.
+const (
+	ManagedByTagKey   = "created-by"
+	ManagedByTagValue = "csi.cloudstack.apache.org"
+
+	// PVNameTagKey holds the name of the Kubernetes PersistentVolume.
+	PVNameTagKey = "pv-name"
+	// CSINameTagKey holds the name of the volume in the CSI CreateVolume
+	// request, which CloudStack may truncate in the volume name.
+	CSINameTagKey = "csi-name"
+	// PVCTagKey holds the namespaced name of the Kubernetes PersistentVolumeClaim.
+	PVCTagKey = "kubernetes.io/pvc"
+)
+
+// CloudStack resource types of the tagged resources.
+const (
+	ResourceTypeVolume   = "Volume"
+	ResourceTypeSnapshot = "Snapshot"
+)
+
+// IsManaged returns true if the volume was created by the driver.
+func (v *Volume) IsManaged() bool {
+	return v.Tags[ManagedByTagKey] == ManagedByTagValue
 }
 
 // Specific errors.
@@ -94,17 +209,55 @@ var (
 	ErrNotFound       = errors.New("not found")
 	ErrTooManyResults = errors.New("too many results")
 	ErrAlreadyExists  = errors.New("already exists")
+	// ErrInvalidID is returned for an empty or malformed resource ID.
+	ErrInvalidID = errors.New("invalid ID")
 )
 
 // client is the implementation of Interface.
 type client struct {
 	*cloudstack.CloudStackClient
 	projectID string
+	listAll   bool
+	domainID  string
+	zones     *zoneCache
+	retrier   *retrier
+
+	// maxListedSnapshots caps the snapshots fetched when listing all of them,
+	// 0 if unlimited.
+	maxListedSnapshots int
+
+	// clusterID prefixes the CloudStack names of snapshots, if not empty.
+	clusterID string
+
+	versionMu sync.Mutex
+	version   string
 }
 
 // New creates a new cloud connector, given its configuration.
 func New(config *Config) Interface {
-	csClient := cloudstack.NewAsyncClient(config.APIURL, config.APIKey, config.SecretKey, config.VerifySSL)
+	var options []cloudstack.ClientOption
+	if config.UserAgent != "" {
+		options = append(options, cloudstack.WithHTTPClient(newHTTPClient(config.VerifySSL, config.UserAgent)))
+	}
+	csClient := cloudstack.NewAsyncClient(config.APIURL, config.APIKey, config.SecretKey, config.VerifySSL, options...)
+
+	maxListedSnapshots := config.MaxListedSnapshots
+	switch {
+	case maxListedSnapshots == 0:
+		maxListedSnapshots = DefaultMaxListedSnapshots
+	case maxListedSnapshots < 0:
+		maxListedSnapshots = 0
+	}
+
+	return &client{
+		CloudStackClient: csClient,
+		projectID:        config.ProjectID,
+		listAll:          config.ListAll,
+		domainID:         config.DomainID,
+		zones:            newZoneCache(config.ZoneCacheTTL),
+		retrier:          newRetrier(config.MaxRetries, config.RetryBaseDelay),
 
-	return &client{csClient, config.ProjectID}
+		maxListedSnapshots: maxListedSnapshots,
+		clusterID:          config.ClusterID,
+	}
 }
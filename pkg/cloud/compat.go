@@ -0,0 +1,133 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// numericFields are the numeric fields of volumes and snapshots, which some
+// CloudStack versions return as strings (e.g. "deviceid": "1").
+var numericFields = []string{"deviceid", "size", "virtualsize", "physicalsize"}
+
+// compatListKeys are the keys of the items of the listings normalized by
+// compatTransport, by API command.
+var compatListKeys = map[string]string{
+	"listVolumes":   "volume",
+	"listSnapshots": "snapshot",
+}
+
+// compatTransport normalizes the responses of the volume and snapshot
+// listings, so that cloudstack-go decodes them whatever the CloudStack version.
+type compatTransport struct {
+	base http.RoundTripper
+}
+
+func (t *compatTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	listKey, ok := compatListKeys[req.URL.Query().Get("command")]
+	if !ok {
+		return resp, nil
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = normalizeNumericFields(body, listKey)
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+	return resp, nil
+}
+
+// normalizeNumericFields converts the numeric fields of the listed items
+// returned as strings to numbers, dropping those which are not integers
+// (e.g. empty). The body is returned unchanged if it has none.
+func normalizeNumericFields(body []byte, listKey string) []byte {
+	var response map[string]map[string]json.RawMessage
+	if err := json.Unmarshal(body, &response); err != nil {
+		return body
+	}
+
+	changed := false
+	for _, fields := range response {
+		var items []map[string]json.RawMessage
+		if err := json.Unmarshal(fields[listKey], &items); err != nil {
+			continue
+		}
+		itemsChanged := false
+		for _, item := range items {
+			for _, field := range numericFields {
+				var value string
+				if err := json.Unmarshal(item[field], &value); err != nil {
+					// Absent, or already a number.
+					continue
+				}
+				itemsChanged = true
+				if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+					item[field] = json.RawMessage(strconv.FormatInt(n, 10))
+				} else {
+					delete(item, field)
+				}
+			}
+		}
+		if !itemsChanged {
+			continue
+		}
+		normalized, err := json.Marshal(items)
+		if err != nil {
+			return body
+		}
+		fields[listKey] = normalized
+		changed = true
+	}
+	if !changed {
+		return body
+	}
+
+	normalized, err := json.Marshal(response)
+	if err != nil {
+		return body
+	}
+
+	return normalized
+}
+
+// firstNonZero returns the first non-zero size, for sizes reported in
+// different fields depending on the CloudStack version.
+func firstNonZero(sizes ...int64) int64 {
+	for _, size := range sizes {
+		if size != 0 {
+			return size
+		}
+	}
+
+	return 0
+}
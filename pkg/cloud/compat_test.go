@@ -0,0 +1,92 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompatResponses(t *testing.T) {
+	cases := []struct {
+		name      string
+		volumes   string
+		snapshots string
+	}{
+		{
+			"numbers",
+			`{"listvolumesresponse":{"count":1,"volume":[{"id":"6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","size":10737418240,"deviceid":1,"virtualmachineid":"vm-1"}]}}`,
+			`{"listsnapshotsresponse":{"count":1,"snapshot":[{"id":"snapshot-1","volumeid":"6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","virtualsize":10737418240,"physicalsize":1073741824}]}}`,
+		},
+		{
+			"strings and alternate sizes",
+			`{"listvolumesresponse":{"count":1,"volume":[{"id":"6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","size":"","physicalsize":"10737418240","deviceid":"1","virtualmachineid":"vm-1"}]}}`,
+			`{"listsnapshotsresponse":{"count":1,"snapshot":[{"id":"snapshot-1","volumeid":"6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","physicalsize":"10737418240"}]}}`,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Query().Get("command") {
+				case "listVolumes":
+					_, _ = w.Write([]byte(c.volumes))
+				case "listSnapshots":
+					_, _ = w.Write([]byte(c.snapshots))
+				default:
+					t.Errorf("Unexpected command %s", r.URL.Query().Get("command"))
+				}
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, UserAgent: "test"})
+			vol, err := connector.GetVolumeByID(context.Background(), "6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if vol.Size != 10737418240 {
+				t.Errorf("Expected volume size 10737418240, got %d", vol.Size)
+			}
+			if vol.DeviceID != "1" {
+				t.Errorf("Expected device ID 1, got %q", vol.DeviceID)
+			}
+
+			snapshot, err := connector.GetSnapshotByID(context.Background(), "snapshot-1")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if snapshot.Size != 10737418240 {
+				t.Errorf("Expected snapshot size 10737418240, got %d", snapshot.Size)
+			}
+		})
+	}
+}
+
+func TestNormalizeNumericFields(t *testing.T) {
+	body := []byte(`{"listvolumesresponse":{"count":1,"volume":[{"id":"6f1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","size":1}]}}`)
+	if normalized := normalizeNumericFields(body, "volume"); string(normalized) != string(body) {
+		t.Errorf("Expected body unchanged, got %s", normalized)
+	}
+	if normalized := normalizeNumericFields([]byte("not json"), "volume"); string(normalized) != "not json" {
+		t.Errorf("Expected invalid body unchanged, got %s", normalized)
+	}
+}
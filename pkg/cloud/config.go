@@ -20,7 +20,13 @@
 package cloud
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"time"
 
 	gcfg "gopkg.in/gcfg.v1"
 )
@@ -32,20 +38,66 @@ type Config struct {
 	SecretKey string
 	VerifySSL bool
 	ProjectID string
+
+	// ListAll makes snapshot listings include the resources of all the
+	// accounts the API key has access to, optionally restricted to DomainID.
+	ListAll  bool
+	DomainID string
+
+	// ZoneCacheTTL is how long the list of zones is cached.
+	// 0 means DefaultZoneCacheTTL, a negative value disables the cache.
+	ZoneCacheTTL time.Duration
+
+	// MaxRetries is the number of retries of the volume operations failing
+	// with a transient error. 0 means DefaultMaxRetries, a negative value
+	// disables the retries.
+	MaxRetries int
+	// RetryBaseDelay is the delay before the first retry, doubled at each
+	// retry. 0 means DefaultRetryBaseDelay.
+	RetryBaseDelay time.Duration
+
+	// UserAgent is the User-Agent header of the requests to the CloudStack
+	// API. The default of cloudstack-go is used if empty.
+	UserAgent string
+
+	// MaxListedSnapshots caps the number of snapshots fetched when listing
+	// all the snapshots. 0 means DefaultMaxListedSnapshots, a negative value
+	// disables the cap.
+	MaxListedSnapshots int
+
+	// ClusterID identifies the cluster in the CloudStack names of its
+	// snapshots, "<ClusterID>-<name>", when several clusters share an account.
+	ClusterID string
 }
 
+// DefaultZoneCacheTTL is the default duration the list of zones is cached.
+const DefaultZoneCacheTTL = 60 * time.Second
+
+// DefaultMaxListedSnapshots is the default cap of the number of snapshots
+// fetched when listing all the snapshots.
+const DefaultMaxListedSnapshots = 10000
+
 // csConfig wraps the config for the CloudStack cloud provider.
 // It is taken from https://github.com/apache/cloudstack-kubernetes-provider
 // in order to have the same config in cloudstack-kubernetes-provider
 // and in this cloudstack-csi-driver.
 type csConfig struct {
 	Global struct {
-		APIURL      string `gcfg:"api-url"`
-		APIKey      string `gcfg:"api-key"`
-		SecretKey   string `gcfg:"secret-key"`
-		SSLNoVerify bool   `gcfg:"ssl-no-verify"`
-		ProjectID   string `gcfg:"project-id"`
-		Zone        string `gcfg:"zone"`
+		APIURL         string `gcfg:"api-url"`
+		APIKey         string `gcfg:"api-key"`
+		SecretKey      string `gcfg:"secret-key"`
+		SSLNoVerify    bool   `gcfg:"ssl-no-verify"`
+		ProjectID      string `gcfg:"project-id"`
+		Zone           string `gcfg:"zone"`
+		ListAll        bool   `gcfg:"list-all"`
+		DomainID       string `gcfg:"domain-id"`
+		ZoneCacheTTL   string `gcfg:"zone-cache-ttl"`
+		MaxRetries     int    `gcfg:"max-retries"`
+		RetryBaseDelay string `gcfg:"retry-base-delay"`
+		UserAgent      string `gcfg:"user-agent"`
+
+		MaxListedSnapshots int    `gcfg:"max-listed-snapshots"`
+		ClusterID          string `gcfg:"cluster-id"`
 	}
 }
 
@@ -57,11 +109,118 @@ func ReadConfig(configFilePath string) (*Config, error) {
 		return nil, fmt.Errorf("could not parse CloudStack config: %w", err)
 	}
 
+	var zoneCacheTTL time.Duration
+	if cfg.Global.ZoneCacheTTL != "" {
+		var err error
+		if zoneCacheTTL, err = time.ParseDuration(cfg.Global.ZoneCacheTTL); err != nil {
+			return nil, fmt.Errorf("invalid zone-cache-ttl in CloudStack config: %w", err)
+		}
+	}
+
+	var retryBaseDelay time.Duration
+	if cfg.Global.RetryBaseDelay != "" {
+		var err error
+		if retryBaseDelay, err = time.ParseDuration(cfg.Global.RetryBaseDelay); err != nil {
+			return nil, fmt.Errorf("invalid retry-base-delay in CloudStack config: %w", err)
+		}
+	}
+
+	if err := validateAPIURL(cfg.Global.APIURL); err != nil {
+		return nil, fmt.Errorf("invalid api-url in CloudStack config: %w", err)
+	}
+
 	return &Config{
-		APIURL:    cfg.Global.APIURL,
-		APIKey:    cfg.Global.APIKey,
-		ProjectID: cfg.Global.ProjectID,
-		SecretKey: cfg.Global.SecretKey,
-		VerifySSL: !cfg.Global.SSLNoVerify,
+		APIURL:         cfg.Global.APIURL,
+		APIKey:         cfg.Global.APIKey,
+		ProjectID:      cfg.Global.ProjectID,
+		SecretKey:      cfg.Global.SecretKey,
+		VerifySSL:      !cfg.Global.SSLNoVerify,
+		ListAll:        cfg.Global.ListAll,
+		DomainID:       cfg.Global.DomainID,
+		ZoneCacheTTL:   zoneCacheTTL,
+		MaxRetries:     cfg.Global.MaxRetries,
+		RetryBaseDelay: retryBaseDelay,
+		UserAgent:      cfg.Global.UserAgent,
+
+		MaxListedSnapshots: cfg.Global.MaxListedSnapshots,
+		ClusterID:          cfg.Global.ClusterID,
 	}, nil
 }
+
+// Keys of the CSI secrets holding per-request CloudStack credentials.
+// They match the keys of the CloudStack configuration file.
+const (
+	SecretAPIURL      = "api-url"
+	SecretAPIKey      = "api-key"
+	SecretSecretKey   = "secret-key"
+	SecretSSLNoVerify = "ssl-no-verify"
+	SecretProjectID   = "project-id"
+)
+
+// ConfigFromSecrets builds a Config from the CloudStack credentials
+// passed in CSI secrets, replacing those of a copy of base, whose other
+// settings (e.g. retries, cluster ID) are kept. It returns nil if the
+// secrets hold no credentials.
+func ConfigFromSecrets(secrets map[string]string, base *Config) (*Config, error) {
+	apiURL, apiKey, secretKey := secrets[SecretAPIURL], secrets[SecretAPIKey], secrets[SecretSecretKey]
+	if apiURL == "" && apiKey == "" && secretKey == "" {
+		return nil, nil //nolint:nilnil
+	}
+	if apiURL == "" || apiKey == "" || secretKey == "" {
+		return nil, fmt.Errorf("secrets must contain all of %s, %s and %s", SecretAPIURL, SecretAPIKey, SecretSecretKey)
+	}
+
+	if err := validateAPIURL(apiURL); err != nil {
+		return nil, fmt.Errorf("invalid %s in secrets: %w", SecretAPIURL, err)
+	}
+
+	sslNoVerify := false
+	if v, ok := secrets[SecretSSLNoVerify]; ok {
+		var err error
+		if sslNoVerify, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.New("invalid " + SecretSSLNoVerify + " value in secrets")
+		}
+	}
+
+	config := &Config{}
+	if base != nil {
+		*config = *base
+	}
+	config.APIURL = apiURL
+	config.APIKey = apiKey
+	config.SecretKey = secretKey
+	config.VerifySSL = !sslNoVerify
+	config.ProjectID = secrets[SecretProjectID]
+
+	return config, nil
+}
+
+// validateAPIURL checks that the CloudStack API URL is an absolute HTTP(S)
+// URL. Its path is used as is, e.g. /client/api or the path a gateway in
+// front of CloudStack routes to the API.
+func validateAPIURL(apiURL string) error {
+	u, err := url.Parse(apiURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%q is not an HTTP or HTTPS URL", apiURL)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", apiURL)
+	}
+
+	return nil
+}
+
+// Hash returns a hash identifying the configuration, which can be used
+// as a cache key without keeping the credentials themselves.
+func (c *Config) Hash() string {
+	h := sha256.New()
+	for _, v := range []string{c.APIURL, c.APIKey, c.SecretKey, strconv.FormatBool(c.VerifySSL), c.ProjectID} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,63 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+
+	"k8s.io/klog/v2"
+)
+
+// diskOfferingStorageTypeLocal is the storage type of the disk offerings
+// whose volumes are on the local storage of hosts.
+const diskOfferingStorageTypeLocal = "local"
+
+func (c *client) GetDiskOffering(ctx context.Context, diskOfferingID string) (*DiskOffering, error) {
+	logger := klog.FromContext(ctx)
+	p := c.DiskOffering.NewListDiskOfferingsParams()
+	p.SetId(diskOfferingID)
+	logger.V(2).Info("CloudStack API call", "command", "ListDiskOfferings", "params", map[string]string{
+		"id": diskOfferingID,
+	})
+	l, err := c.DiskOffering.ListDiskOfferings(p)
+	if err != nil {
+		return nil, err
+	}
+	if l.Count == 0 {
+		return nil, ErrNotFound
+	}
+	if l.Count > 1 {
+		return nil, ErrTooManyResults
+	}
+	offering := l.DiskOfferings[0]
+
+	return &DiskOffering{
+		ID:             offering.Id,
+		Name:           offering.Name,
+		IsCustomized:   offering.Iscustomized,
+		DiskSize:       offering.Disksize,
+		DiskSizeStrict: offering.Disksizestrictness,
+		StorageTags:    parseStorageTags(offering.Tags),
+		Encrypt:        offering.Encrypt,
+
+		IsCustomizedIops: offering.Iscustomizediops,
+		LocalStorage:     offering.Storagetype == diskOfferingStorageTypeLocal,
+	}, nil
+}
@@ -24,6 +24,11 @@ package fake
 import (
 	"context"
 	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/hashicorp/go-uuid"
 
@@ -31,7 +36,19 @@ import (
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/util"
 )
 
-const zoneID = "a1887604-237c-4212-a9cd-94620b7880fa"
+const (
+	zoneID   = "a1887604-237c-4212-a9cd-94620b7880fa"
+	zoneName = "zone-1"
+
+	hostID    = "5b2f7a3e-6c2d-4f7e-9a0b-3c4d5e6f7a8b"
+	clusterID = "8e1d3c5b-2a4f-4b6d-8c0e-1f2a3b4c5d6e"
+)
+
+// cloudStackVersion is the version of the fake CloudStack management server.
+const cloudStackVersion = "4.19.0.0"
+
+// volumeStateReady is the state of the volumes of the fake connector.
+const volumeStateReady = "Ready"
 
 type fakeConnector struct {
 	node            *cloud.VM
@@ -39,6 +56,8 @@ type fakeConnector struct {
 	volumesByName   map[string]cloud.Volume
 	snapshotsByID   map[string]*cloud.Snapshot
 	snapshotsByName map[string][]*cloud.Snapshot
+	snapshotTags    map[string]map[string]string
+	diskOfferings   map[string]cloud.DiskOffering
 }
 
 // New returns a new fake implementation of the
@@ -52,10 +71,30 @@ func New() cloud.Interface {
 		ZoneID:           zoneID,
 		VirtualMachineID: "",
 		DeviceID:         "",
+		State:            volumeStateReady,
 	}
 	node := &cloud.VM{
 		ID:     "0d7107a3-94d2-44e7-89b8-8930881309a5",
 		ZoneID: zoneID,
+		State:  "Running",
+		HostID: hostID,
+	}
+
+	diskOffering := cloud.DiskOffering{
+		ID:           "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+		Name:         "custom",
+		IsCustomized: true,
+	}
+	fixedDiskOffering := cloud.DiskOffering{
+		ID:       "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e",
+		Name:     "fixed-10GB",
+		DiskSize: 10,
+	}
+	localDiskOffering := cloud.DiskOffering{
+		ID:           "3c5a1e2b-7d4f-4a9e-8b6c-0d1e2f3a4b5c",
+		Name:         "custom-local",
+		IsCustomized: true,
+		LocalStorage: true,
 	}
 
 	snapshotsByID := make(map[string]*cloud.Snapshot)
@@ -67,6 +106,12 @@ func New() cloud.Interface {
 		volumesByName:   map[string]cloud.Volume{volume.Name: volume},
 		snapshotsByID:   snapshotsByID,
 		snapshotsByName: snapshotsByName,
+		snapshotTags:    make(map[string]map[string]string),
+		diskOfferings: map[string]cloud.DiskOffering{
+			diskOffering.ID:      diskOffering,
+			fixedDiskOffering.ID: fixedDiskOffering,
+			localDiskOffering.ID: localDiskOffering,
+		},
 	}
 }
 
@@ -78,6 +123,18 @@ func (f *fakeConnector) GetVMByID(_ context.Context, vmID string) (*cloud.VM, er
 	return nil, cloud.ErrNotFound
 }
 
+func (f *fakeConnector) GetHostClusterID(_ context.Context, id string) (string, error) {
+	if id != hostID {
+		return "", cloud.ErrNotFound
+	}
+
+	return clusterID, nil
+}
+
+func (f *fakeConnector) GetCloudStackVersion(_ context.Context) (string, error) {
+	return cloudStackVersion, nil
+}
+
 func (f *fakeConnector) GetNodeInfo(_ context.Context, _ string) (*cloud.VM, error) {
 	return f.node, nil
 }
@@ -86,9 +143,58 @@ func (f *fakeConnector) ListZonesID(_ context.Context) ([]string, error) {
 	return []string{zoneID}, nil
 }
 
+func (f *fakeConnector) GetZoneIDByName(_ context.Context, name string) (string, error) {
+	if name != zoneName {
+		return "", cloud.ErrNotFound
+	}
+
+	return zoneID, nil
+}
+
+func (f *fakeConnector) GetZoneCapacity(_ context.Context, zone string) (int64, error) {
+	if zone != zoneID {
+		return 0, cloud.ErrNotFound
+	}
+
+	return util.GigaBytesToBytes(1024), nil
+}
+
+func (f *fakeConnector) GetStorageClusterIDs(_ context.Context, _, diskOfferingID string) ([]string, error) {
+	if _, ok := f.diskOfferings[diskOfferingID]; !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	// The storage of the fake disk offerings is zone-wide.
+	return nil, nil
+}
+
+func (f *fakeConnector) GetAvailableCapacity(_ context.Context, zone, diskOfferingID string, _ cloud.CapacityMode) (int64, error) {
+	if diskOfferingID != "" {
+		if _, ok := f.diskOfferings[diskOfferingID]; !ok {
+			return 0, cloud.ErrNotFound
+		}
+	}
+	if zone != zoneID {
+		// No storage pool in the zone.
+		return 0, nil
+	}
+
+	return util.GigaBytesToBytes(1024), nil
+}
+
+func (f *fakeConnector) GetDiskOffering(_ context.Context, diskOfferingID string) (*cloud.DiskOffering, error) {
+	offering, ok := f.diskOfferings[diskOfferingID]
+	if !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	return &offering, nil
+}
+
 func (f *fakeConnector) GetVolumeByID(_ context.Context, volumeID string) (*cloud.Volume, error) {
-	if volumeID == "" {
-		return nil, errors.New("invalid volume ID: empty string")
+	// CloudStack volume IDs are UUIDs.
+	if _, err := uuid.ParseUUID(volumeID); err != nil {
+		return nil, fmt.Errorf("%w: volume ID %q", cloud.ErrInvalidID, volumeID)
 	}
 	vol, ok := f.volumesByID[volumeID]
 	if ok {
@@ -110,14 +216,98 @@ func (f *fakeConnector) GetVolumeByName(_ context.Context, name string) (*cloud.
 	return nil, cloud.ErrNotFound
 }
 
-func (f *fakeConnector) CreateVolume(_ context.Context, diskOfferingID, zoneID, name string, sizeInGB int64) (string, error) {
+func (f *fakeConnector) ListVolumesByName(_ context.Context, name string) ([]*cloud.Volume, error) {
+	vols := make([]*cloud.Volume, 0, 1)
+	if vol, ok := f.volumesByName[name]; ok {
+		vols = append(vols, &vol)
+	}
+
+	return vols, nil
+}
+
+func (f *fakeConnector) GetVolumeByTag(_ context.Context, key, value string) (*cloud.Volume, error) {
+	var found *cloud.Volume
+	for _, vol := range f.volumesByID {
+		if vol.Tags[key] != value {
+			continue
+		}
+		if found != nil {
+			return nil, cloud.ErrTooManyResults
+		}
+		found = &vol
+	}
+	if found == nil {
+		return nil, cloud.ErrNotFound
+	}
+
+	return found, nil
+}
+
+// ListVolumes returns a page of the volumes, sorted by ID.
+func (f *fakeConnector) ListVolumes(_ context.Context, volumeID string, pageSize, page int) ([]*cloud.Volume, error) {
+	vols := make([]*cloud.Volume, 0, len(f.volumesByID))
+	for _, vol := range f.volumesByID {
+		if volumeID == "" || vol.ID == volumeID {
+			vols = append(vols, &vol)
+		}
+	}
+	slices.SortFunc(vols, func(a, b *cloud.Volume) int { return strings.Compare(a.ID, b.ID) })
+	if pageSize <= 0 {
+		return vols, nil
+	}
+	start := min((max(page, 1)-1)*pageSize, len(vols))
+	end := min(start+pageSize, len(vols))
+
+	return vols[start:end], nil
+}
+
+func (f *fakeConnector) ListVolumesForVM(_ context.Context, vmID string) ([]*cloud.Volume, error) {
+	vols := make([]*cloud.Volume, 0)
+	for _, vol := range f.volumesByID {
+		if vol.VirtualMachineID == vmID {
+			vols = append(vols, &vol)
+		}
+	}
+
+	return vols, nil
+}
+
+// FindUnattachedVolume returns the unattached volume with the lowest ID
+// tagged with the PersistentVolumeClaim, matching the disk offering, zone,
+// project (if any) and size, and not tagged with a CSI name.
+func (f *fakeConnector) FindUnattachedVolume(ctx context.Context, pvc, diskOfferingID, zoneID, projectID string, sizeInGB int64) (*cloud.Volume, error) {
+	vols, _ := f.ListVolumes(ctx, "", 0, 0)
+	for _, vol := range vols {
+		if vol.Tags[cloud.PVCTagKey] == pvc && (projectID == "" || vol.ProjectID == projectID) &&
+			vol.DiskOfferingID == diskOfferingID && vol.ZoneID == zoneID && vol.State == volumeStateReady &&
+			vol.VirtualMachineID == "" && vol.Size == util.GigaBytesToBytes(sizeInGB) && vol.Tags[cloud.CSINameTagKey] == "" {
+			return vol, nil
+		}
+	}
+
+	return nil, cloud.ErrNotFound
+}
+
+func (f *fakeConnector) CreateVolume(_ context.Context, opts *cloud.VolumeOptions) (string, error) {
+	if opts.HostID != "" && opts.HostID != hostID {
+		return "", cloud.ErrNotFound
+	}
+	sizeInGB := opts.SizeInGB
+	if offering, ok := f.diskOfferings[opts.DiskOfferingID]; ok && !offering.IsCustomized {
+		if sizeInGB > 0 {
+			return "", errors.New("size cannot be specified with a fixed size disk offering")
+		}
+		sizeInGB = offering.DiskSize
+	}
 	id, _ := uuid.GenerateUUID()
 	vol := cloud.Volume{
 		ID:             id,
-		Name:           name,
+		Name:           opts.Name,
 		Size:           util.GigaBytesToBytes(sizeInGB),
-		DiskOfferingID: diskOfferingID,
-		ZoneID:         zoneID,
+		DiskOfferingID: opts.DiskOfferingID,
+		ProjectID:      opts.ProjectID,
+		ZoneID:         opts.ZoneID,
+		State:          volumeStateReady,
 	}
 	f.volumesByID[vol.ID] = vol
 	f.volumesByName[vol.Name] = vol
@@ -125,6 +315,22 @@ func (f *fakeConnector) CreateVolume(_ context.Context, diskOfferingID, zoneID,
 	return vol.ID, nil
 }
 
+func (f *fakeConnector) tagVolume(volumeID string, tags map[string]string) error {
+	vol, ok := f.volumesByID[volumeID]
+	if !ok {
+		return cloud.ErrNotFound
+	}
+	vol.Tags = maps.Clone(vol.Tags)
+	if vol.Tags == nil {
+		vol.Tags = make(map[string]string)
+	}
+	maps.Copy(vol.Tags, tags)
+	f.volumesByID[volumeID] = vol
+	f.volumesByName[vol.Name] = vol
+
+	return nil
+}
+
 func (f *fakeConnector) DeleteVolume(_ context.Context, id string) error {
 	if vol, ok := f.volumesByID[id]; ok {
 		name := vol.Name
@@ -135,11 +341,56 @@ func (f *fakeConnector) DeleteVolume(_ context.Context, id string) error {
 	return nil
 }
 
-func (f *fakeConnector) AttachVolume(_ context.Context, _, _ string) (string, error) {
-	return "1", nil
+func (f *fakeConnector) AttachVolume(ctx context.Context, volumeID, vmID string) (string, error) {
+	return f.AttachVolumeAtDevice(ctx, volumeID, vmID, "")
 }
 
-func (f *fakeConnector) DetachVolume(_ context.Context, _ string) error {
+func (f *fakeConnector) AttachVolumeAtDevice(_ context.Context, volumeID, vmID, deviceID string) (string, error) {
+	vol, ok := f.volumesByID[volumeID]
+	if !ok {
+		return "", cloud.ErrNotFound
+	}
+	if deviceID == "" {
+		deviceID = f.nextDeviceID(vmID)
+	}
+	vol.VirtualMachineID = vmID
+	vol.DeviceID = deviceID
+	f.volumesByID[volumeID] = vol
+	f.volumesByName[vol.Name] = vol
+
+	return vol.DeviceID, nil
+}
+
+// nextDeviceID returns the lowest device ID, starting from 1,
+// not used by a volume attached to the VM.
+func (f *fakeConnector) nextDeviceID(vmID string) string {
+	used := make(map[string]bool)
+	for _, vol := range f.volumesByID {
+		if vol.VirtualMachineID == vmID {
+			used[vol.DeviceID] = true
+		}
+	}
+	id := 1
+	for used[strconv.Itoa(id)] {
+		id++
+	}
+
+	return strconv.Itoa(id)
+}
+
+// DetachVolume detaches a volume, doing nothing if it is already detached,
+// as CloudStack does for the driver. It fails with ErrNotFound if the
+// volume does not exist.
+func (f *fakeConnector) DetachVolume(_ context.Context, volumeID string) error {
+	vol, ok := f.volumesByID[volumeID]
+	if !ok {
+		return cloud.ErrNotFound
+	}
+	vol.VirtualMachineID = ""
+	vol.DeviceID = ""
+	f.volumesByID[volumeID] = vol
+	f.volumesByName[vol.Name] = vol
+
 	return nil
 }
 
@@ -158,13 +409,22 @@ func (f *fakeConnector) ExpandVolume(_ context.Context, volumeID string, newSize
 	return cloud.ErrNotFound
 }
 
-func (f *fakeConnector) CreateVolumeFromSnapshot(_ context.Context, zoneID, name, _, _ string, sizeInGB int64) (*cloud.Volume, error) {
+func (f *fakeConnector) CreateVolumeFromSnapshot(_ context.Context, zoneID, name, diskOfferingID, projectID, _ string, sizeInGB int64) (*cloud.Volume, error) {
+	if offering, ok := f.diskOfferings[diskOfferingID]; ok && !offering.IsCustomized {
+		if sizeInGB > 0 {
+			return nil, errors.New("size cannot be specified with a fixed size disk offering")
+		}
+		sizeInGB = offering.DiskSize
+	}
+	id, _ := uuid.GenerateUUID()
 	vol := &cloud.Volume{
-		ID:             "fake-vol-from-snap-" + name,
+		ID:             id,
 		Name:           name,
 		Size:           util.GigaBytesToBytes(sizeInGB),
-		DiskOfferingID: "fake-disk-offering",
+		DiskOfferingID: diskOfferingID,
+		ProjectID:      projectID,
 		ZoneID:         zoneID,
+		State:          volumeStateReady,
 	}
 	f.volumesByID[vol.ID] = *vol
 	f.volumesByName[vol.Name] = *vol
@@ -172,7 +432,18 @@ func (f *fakeConnector) CreateVolumeFromSnapshot(_ context.Context, zoneID, name
 	return vol, nil
 }
 
-func (f *fakeConnector) CreateSnapshot(_ context.Context, volumeID, name string) (*cloud.Snapshot, error) {
+func (f *fakeConnector) CloneVolume(ctx context.Context, sourceVolumeID string, opts *cloud.VolumeOptions) (*cloud.Volume, error) {
+	if _, ok := f.volumesByID[sourceVolumeID]; !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	return f.CreateVolumeFromSnapshot(ctx, opts.ZoneID, opts.Name, opts.DiskOfferingID, opts.ProjectID, "", opts.SizeInGB)
+}
+
+func (f *fakeConnector) CreateSnapshot(ctx context.Context, volumeID, name string) (*cloud.Snapshot, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	if name == "" {
 		return nil, errors.New("invalid snapshot name: empty string")
 	}
@@ -192,7 +463,10 @@ func (f *fakeConnector) CreateSnapshot(_ context.Context, volumeID, name string)
 		DomainID:  "fake-domain",
 		ZoneID:    zoneID,
 		VolumeID:  volumeID,
+		Size:      f.volumesByID[volumeID].Size,
 		CreatedAt: "2025-07-07T16:13:06-0700",
+		State:     cloud.SnapshotStateBackedUp,
+		Tags:      map[string]string{cloud.ManagedByTagKey: cloud.ManagedByTagValue},
 	}
 	f.snapshotsByID[newSnap.ID] = newSnap
 	f.snapshotsByName[name] = append(f.snapshotsByName[name], newSnap)
@@ -275,3 +549,42 @@ func (f *fakeConnector) DeleteSnapshot(_ context.Context, snapshotID string) err
 
 	return nil
 }
+
+func (f *fakeConnector) CreateTags(ctx context.Context, resourceType, resourceID string, tags map[string]string) error {
+	switch resourceType {
+	case cloud.ResourceTypeVolume:
+		return f.tagVolume(resourceID, tags)
+	case cloud.ResourceTypeSnapshot:
+		return f.TagSnapshot(ctx, resourceID, tags)
+	default:
+		return fmt.Errorf("unsupported resource type %s", resourceType)
+	}
+}
+
+func (f *fakeConnector) TagSnapshot(_ context.Context, snapshotID string, tags map[string]string) error {
+	if _, ok := f.snapshotsByID[snapshotID]; !ok {
+		return cloud.ErrNotFound
+	}
+	if f.snapshotTags[snapshotID] == nil {
+		f.snapshotTags[snapshotID] = make(map[string]string)
+	}
+	maps.Copy(f.snapshotTags[snapshotID], tags)
+
+	return nil
+}
+
+func (f *fakeConnector) GetSnapshotTags(_ context.Context, snapshotID string) (map[string]string, error) {
+	if _, ok := f.snapshotsByID[snapshotID]; !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	return maps.Clone(f.snapshotTags[snapshotID]), nil
+}
+
+func (f *fakeConnector) ExtractSnapshot(_ context.Context, snapshotID string) (string, error) {
+	if _, ok := f.snapshotsByID[snapshotID]; !ok {
+		return "", cloud.ErrNotFound
+	}
+
+	return "https://secondary.example.com/snapshots/" + snapshotID + ".qcow2", nil
+}
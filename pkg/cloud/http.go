@@ -0,0 +1,85 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// httpTimeout is the timeout of the requests to the CloudStack API,
+// as set by cloudstack-go on its default HTTP client.
+const httpTimeout = 60 * time.Second
+
+// userAgentTransport sets the User-Agent header of the requests, so that
+// CloudStack administrators can tell the driver traffic apart in their logs.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+
+	return t.base.RoundTrip(req)
+}
+
+// newHTTPClient returns the HTTP client of the CloudStack API, sending
+// the given User-Agent header and normalizing the responses of listings.
+func newHTTPClient(verifySSL bool, userAgent string) *http.Client {
+	transport, _ := http.DefaultTransport.(*http.Transport)
+	transport = transport.Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: !verifySSL} //nolint:gosec
+
+	return &http.Client{
+		Transport: &userAgentTransport{
+			base:      &compatTransport{base: transport},
+			userAgent: userAgent,
+		},
+		Timeout: httpTimeout,
+	}
+}
+
+// CheckAPIURL checks that the CloudStack API of the configuration is
+// reachable, at startup. Any HTTP response but Not Found is accepted, since
+// an unauthenticated request is rejected by CloudStack; Not Found means the
+// URL does not route to the API, e.g. a wrong path behind a gateway.
+func CheckAPIURL(ctx context.Context, config *Config) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, config.APIURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := newHTTPClient(config.VerifySSL, config.UserAgent).Do(req)
+	if err != nil {
+		return fmt.Errorf("CloudStack API %s is not reachable: %w", config.APIURL, err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("CloudStack API not found at %s: %s", config.APIURL, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAgent(t *testing.T) {
+	cases := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{"configured", "csi.cloudstack.apache.org/v1.2.3", "csi.cloudstack.apache.org/v1.2.3"},
+		{"default", "", "Go-http-client/1.1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var userAgent string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				userAgent = r.Header.Get("User-Agent")
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = w.Write([]byte(`{"listcapabilitiesresponse":{"capability":{"cloudstackversion":"4.19.0.0"}}}`))
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, UserAgent: c.userAgent})
+			version, err := connector.GetCloudStackVersion(context.Background())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if version != "4.19.0.0" {
+				t.Errorf("Expected version 4.19.0.0, got %q", version)
+			}
+			if userAgent != c.expected {
+				t.Errorf("Expected User-Agent %q, got %q", c.expected, userAgent)
+			}
+		})
+	}
+}
+
+func TestAPIURLPathPrefix(t *testing.T) {
+	const apiPath = "/gateway/cloudstack/api"
+	mux := http.NewServeMux()
+	mux.HandleFunc(apiPath, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.RawQuery == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"listcapabilitiesresponse":{"capability":{"cloudstackversion":"4.19.0.0"}}}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	ctx := context.Background()
+	config := &Config{APIURL: server.URL + apiPath, UserAgent: "test"}
+	if err := CheckAPIURL(ctx, config); err != nil {
+		t.Fatalf("Unexpected error checking %s: %v", config.APIURL, err)
+	}
+	version, err := New(config).GetCloudStackVersion(ctx)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if version != "4.19.0.0" {
+		t.Errorf("Expected version 4.19.0.0, got %q", version)
+	}
+
+	if err := CheckAPIURL(ctx, &Config{APIURL: server.URL + "/client/api"}); err == nil {
+		t.Errorf("Expected an error for an API URL not routed to the API")
+	}
+}
+
+func TestValidateAPIURL(t *testing.T) {
+	cases := []struct {
+		apiURL      string
+		expectError bool
+	}{
+		{"https://cloudstack.example.com/client/api", false},
+		{"http://gateway.example.com:8080/tenants/42/cloudstack", false},
+		{"cloudstack.example.com/client/api", true},
+		{"ftp://cloudstack.example.com/client/api", true},
+		{"https:///client/api", true},
+	}
+	for _, c := range cases {
+		if err := validateAPIURL(c.apiURL); (err != nil) != c.expectError {
+			t.Errorf("validateAPIURL(%q): expected error %v, got %v", c.apiURL, c.expectError, err)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// DefaultMaxRetries is the default number of retries of a CloudStack API
+	// call failing with a transient error.
+	DefaultMaxRetries = 3
+	// DefaultRetryBaseDelay is the default delay before the first retry,
+	// doubled at each retry.
+	DefaultRetryBaseDelay = time.Second
+
+	// invalidParameterValueErrorCode is the CloudStack exception error code
+	// of InvalidParameterValueException, which retrying cannot fix.
+	invalidParameterValueErrorCode = 4350
+
+	// accountResourceLimitErrorCode is the CloudStack API error code of
+	// exceeded resource limits, of accounts and domains alike.
+	accountResourceLimitErrorCode = 534
+)
+
+// LimitScope is the scope of an exceeded CloudStack resource limit.
+type LimitScope string
+
+const (
+	LimitScopeAccount LimitScope = "account"
+	LimitScopeDomain  LimitScope = "domain"
+	// LimitScopeUnknown is the scope of a limit error without a known message.
+	LimitScopeUnknown LimitScope = "unknown"
+)
+
+// Error codes are reported by cloudstack-go as text, either in the error of
+// a failed API call or in the JSON result of a failed asynchronous job.
+var (
+	apiErrorRegexp       = regexp.MustCompile(`CloudStack API error (\d+) \(CSExceptionErrorCode: (\d+)\)`)
+	jobErrorCodeRegexp   = regexp.MustCompile(`"errorcode"\s*:\s*(\d+)`)
+	jobCSErrorCodeRegexp = regexp.MustCompile(`"cserrorcode"\s*:\s*(\d+)`)
+
+	// The messages of exceeded limits name the account, with its domain,
+	// or only the domain, e.g. "Maximum number of resources of type 'volume'
+	// for account name=admin in domain id=1 has been exceeded." or "Maximum
+	// amount of resources of type = 'primary_storage' for domain id=2 is
+	// exceeded".
+	resourceLimitRegexp = regexp.MustCompile(`Maximum (?:number|amount) of resources of type.*? for (account|domain)\b`)
+)
+
+// retrier retries CloudStack API calls failing with transient errors,
+// e.g. while the management server is under maintenance.
+type retrier struct {
+	maxRetries int
+	baseDelay  time.Duration
+}
+
+// newRetrier creates a retrier. A zero maxRetries or baseDelay means the
+// default value, a negative maxRetries disables the retries.
+func newRetrier(maxRetries int, baseDelay time.Duration) *retrier {
+	if maxRetries == 0 {
+		maxRetries = DefaultMaxRetries
+	}
+	if baseDelay <= 0 {
+		baseDelay = DefaultRetryBaseDelay
+	}
+
+	return &retrier{
+		maxRetries: max(maxRetries, 0),
+		baseDelay:  baseDelay,
+	}
+}
+
+// do calls fn, retrying with exponential backoff as long as it fails with a
+// retryable error. The last error is returned if all attempts fail.
+func (r *retrier) do(ctx context.Context, command string, fn func() error) error {
+	return r.retry(ctx, command, fn, isRetryableError)
+}
+
+// doCreate is do for the calls creating a resource, e.g. a volume, which
+// are only retried if the connection was refused: CloudStack may have
+// created the resource before failing with a server error, and a retry
+// would create it twice.
+func (r *retrier) doCreate(ctx context.Context, command string, fn func() error) error {
+	return r.retry(ctx, command, fn, isConnectionRefused)
+}
+
+func (r *retrier) retry(ctx context.Context, command string, fn func() error, retryable func(error) bool) error {
+	logger := klog.FromContext(ctx)
+	backoff := wait.Backoff{
+		Duration: r.baseDelay,
+		Factor:   2,
+		Steps:    r.maxRetries + 1,
+	}
+
+	var lastErr error
+	attempt := 0
+	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(context.Context) (bool, error) {
+		attempt++
+		lastErr = fn()
+		if lastErr == nil {
+			return true, nil
+		}
+		if !retryable(lastErr) {
+			return false, lastErr
+		}
+		logger.Error(lastErr, "CloudStack API call failed with a transient error", "command", command, "attempt", attempt)
+
+		return false, nil
+	})
+	if wait.Interrupted(err) && lastErr != nil {
+		return lastErr
+	}
+
+	return err
+}
+
+// isRetryableError returns true if a CloudStack API call failed with an
+// error worth retrying: the management server, or the proxy in front of it,
+// was unavailable or timed out, or refused the connection. Other server
+// errors, e.g. 530, are permanent, and client timeouts are not retried, as
+// the call may have been processed.
+func isRetryableError(err error) bool {
+	if code, _, ok := apiErrorCodes(err); ok {
+		return code == http.StatusServiceUnavailable || code == http.StatusGatewayTimeout
+	}
+
+	return isConnectionRefused(err)
+}
+
+// isConnectionRefused returns true if a CloudStack API call failed before
+// reaching the management server.
+func isConnectionRefused(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// ResourceLimitScope returns the scope of the resource limit exceeded by a
+// CloudStack API call, and false if the call did not fail because of a limit.
+func ResourceLimitScope(err error) (LimitScope, bool) {
+	if err == nil {
+		return "", false
+	}
+	if m := resourceLimitRegexp.FindStringSubmatch(err.Error()); m != nil {
+		return LimitScope(m[1]), true
+	}
+	if code, _, ok := apiErrorCodes(err); ok && code == accountResourceLimitErrorCode {
+		return LimitScopeUnknown, true
+	}
+
+	return "", false
+}
+
+// apiErrorCodes returns the HTTP and CloudStack exception error codes of a
+// CloudStack API error.
+func apiErrorCodes(err error) (int, int, bool) {
+	msg := err.Error()
+	if m := apiErrorRegexp.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		csCode, _ := strconv.Atoi(m[2])
+
+		return code, csCode, true
+	}
+	if m := jobErrorCodeRegexp.FindStringSubmatch(msg); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		csCode := 0
+		if m := jobCSErrorCodeRegexp.FindStringSubmatch(msg); m != nil {
+			csCode, _ = strconv.Atoi(m[1])
+		}
+
+		return code, csCode, true
+	}
+
+	return 0, 0, false
+}
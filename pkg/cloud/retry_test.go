@@ -0,0 +1,130 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestIsRetryableError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"unavailable", errors.New("CloudStack API error 503 (CSExceptionErrorCode: 9999): Service Unavailable"), true},
+		{"gateway timeout", errors.New("CloudStack API error 504 (CSExceptionErrorCode: 9999): Gateway Timeout"), true},
+		{"server error", errors.New("CloudStack API error 530 (CSExceptionErrorCode: 9999): resource is unreachable"), false},
+		{"invalid parameter", errors.New("CloudStack API error 530 (CSExceptionErrorCode: 4350): Invalid parameter size"), false},
+		{"client error", errors.New("CloudStack API error 431 (CSExceptionErrorCode: 9999): Unable to execute API command"), false},
+		{"failed job", errors.New(`Undefined error: {"cserrorcode":4250,"errorcode":530,"errortext":"Host is unreachable"}`), false},
+		{"unavailable job", errors.New(`Undefined error: {"cserrorcode":9999,"errorcode":503,"errortext":"Service Unavailable"}`), true},
+		{"failed job with invalid parameter", errors.New(`Undefined error: {"cserrorcode":4350,"errorcode":530,"errortext":"Invalid device ID"}`), false},
+		{"resource limit", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'volume' for account name=admin in domain id=1 has been exceeded."), false},
+		{"connection refused", &url.Error{Op: "Get", URL: "https://cloudstack", Err: fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)}, true},
+		{"other", errors.New("volume not found"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isRetryableError(c.err); got != c.expected {
+				t.Errorf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestResourceLimitScope(t *testing.T) {
+	cases := []struct {
+		name          string
+		err           error
+		expectedScope LimitScope
+		expectedOK    bool
+	}{
+		{"account limit", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'volume' for account name=admin in domain id=1 has been exceeded."), LimitScopeAccount, true},
+		{"domain limit", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'volume' for domain id=2 has been exceeded."), LimitScopeDomain, true},
+		{"account storage limit of failed job", errors.New(`Undefined error: {"cserrorcode":4370,"errorcode":534,"errortext":"Maximum amount of resources of type = 'primary_storage' for account = 'admin' in domain = 'ROOT' is exceeded: Account Resource Limit = 100 GiB"}`), LimitScopeAccount, true},
+		{"domain storage limit of failed job", errors.New(`Undefined error: {"cserrorcode":4370,"errorcode":534,"errortext":"Maximum amount of resources of type = 'primary_storage' for domain id=2 is exceeded: Domain Resource Limit = 100 GiB"}`), LimitScopeDomain, true},
+		{"unknown limit message", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Resource limit exceeded"), LimitScopeUnknown, true},
+		{"other error", errors.New("CloudStack API error 530 (CSExceptionErrorCode: 9999): resource is unreachable"), "", false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			scope, ok := ResourceLimitScope(c.err)
+			if scope != c.expectedScope || ok != c.expectedOK {
+				t.Errorf("Expected %q, %v, got %q, %v", c.expectedScope, c.expectedOK, scope, ok)
+			}
+		})
+	}
+}
+
+func TestRetrier(t *testing.T) {
+	transientErr := errors.New("CloudStack API error 503 (CSExceptionErrorCode: 9999): Service Unavailable")
+	terminalErr := errors.New("CloudStack API error 431 (CSExceptionErrorCode: 4350): Invalid parameter")
+	refusedErr := &url.Error{Op: "Get", URL: "https://cloudstack", Err: fmt.Errorf("dial tcp: %w", syscall.ECONNREFUSED)}
+
+	cases := []struct {
+		name          string
+		create        bool
+		maxRetries    int
+		errs          []error
+		expectedErr   error
+		expectedCalls int
+	}{
+		{"success", false, 3, nil, nil, 1},
+		{"transient then success", false, 3, []error{transientErr, transientErr}, nil, 3},
+		{"terminal", false, 3, []error{terminalErr}, terminalErr, 1},
+		{"retries exhausted", false, 2, []error{transientErr, transientErr, transientErr, transientErr}, transientErr, 3},
+		{"disabled", false, -1, []error{transientErr}, transientErr, 1},
+		{"create with server error", true, 3, []error{transientErr}, transientErr, 1},
+		{"create with refused connection", true, 3, []error{refusedErr, refusedErr}, nil, 3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r := newRetrier(c.maxRetries, time.Millisecond)
+			calls := 0
+			fn := func() error {
+				calls++
+				if calls <= len(c.errs) {
+					return c.errs[calls-1]
+				}
+
+				return nil
+			}
+			var err error
+			if c.create {
+				err = r.doCreate(context.Background(), "Test", fn)
+			} else {
+				err = r.do(context.Background(), "Test", fn)
+			}
+			if !errors.Is(err, c.expectedErr) {
+				t.Errorf("Expected error %v, got %v", c.expectedErr, err)
+			}
+			if calls != c.expectedCalls {
+				t.Errorf("Expected %d calls, got %d", c.expectedCalls, calls)
+			}
+		})
+	}
+}
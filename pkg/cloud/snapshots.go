@@ -21,26 +21,38 @@ package cloud
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/apache/cloudstack-go/v2/cloudstack"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 )
 
+const (
+	// extractSnapshotTimeout bounds the wait for a snapshot extraction.
+	extractSnapshotTimeout = 30 * time.Minute
+	// extractSnapshotPollInterval is the interval between two checks of the extraction job.
+	extractSnapshotPollInterval = 5 * time.Second
+	// listSnapshotsPageSize is the page size used to list all the snapshots.
+	listSnapshotsPageSize = 500
+)
+
 func (c *client) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snapshot, error) {
 	logger := klog.FromContext(ctx)
-	p := c.Snapshot.NewListSnapshotsParams()
+	p := c.newListSnapshotsParams()
 	if snapshotID != "" {
 		p.SetId(snapshotID)
 	}
-	if c.projectID != "" {
-		p.SetProjectid(c.projectID)
-	}
-	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", map[string]string{
-		"id":        snapshotID,
-		"projectid": c.projectID,
-	})
+	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", c.listSnapshotsLogParams(map[string]string{
+		"id": snapshotID,
+	}))
 	l, err := c.Snapshot.ListSnapshots(p)
 	if err != nil {
 		return nil, err
@@ -54,11 +66,14 @@ func (c *client) GetSnapshotByID(ctx context.Context, snapshotID string) (*Snaps
 	snapshot := l.Snapshots[0]
 	s := Snapshot{
 		ID:        snapshot.Id,
-		Name:      snapshot.Name,
+		Name:      c.csiSnapshotName(snapshot.Name),
 		DomainID:  snapshot.Domainid,
 		ProjectID: snapshot.Projectid,
 		ZoneID:    snapshot.Zoneid,
 		VolumeID:  snapshot.Volumeid,
+		Size:      firstNonZero(snapshot.Virtualsize, snapshot.Physicalsize),
+		State:     snapshot.State,
+		Tags:      snapshotTags(snapshot.Tags),
 	}
 
 	return &s, nil
@@ -68,6 +83,7 @@ func (c *client) CreateSnapshot(ctx context.Context, volumeID, name string) (*Sn
 	logger := klog.FromContext(ctx)
 	p := c.Snapshot.NewCreateSnapshotParams(volumeID)
 	if name != "" {
+		name = c.snapshotName(name)
 		p.SetName(name)
 	}
 	logger.V(2).Info("CloudStack API call", "command", "CreateSnapshot", "params", map[string]string{
@@ -75,25 +91,126 @@ func (c *client) CreateSnapshot(ctx context.Context, volumeID, name string) (*Sn
 		"name":     name,
 	})
 
-	snapshot, err := c.Snapshot.CreateSnapshot(p)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Error %v", err)
+	// The CloudStack client waits for the completion of the job regardless
+	// of ctx, so the wait is given up when ctx is done.
+	done := make(chan createSnapshotResult, 1)
+	go func() {
+		snapshot, err := c.Snapshot.CreateSnapshot(p)
+		done <- createSnapshotResult{snapshot, err}
+	}()
+
+	var snapshot *cloudstack.CreateSnapshotResponse
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, status.Errorf(codes.Internal, "Error %v", r.err)
+		}
+		snapshot = r.snapshot
+	case <-ctx.Done():
+		c.abandonSnapshot(ctx, volumeID, name, done)
+
+		return nil, fmt.Errorf("snapshot of volume %s not created in time: %w", volumeID, ctx.Err())
 	}
+	c.tagManagedSnapshot(ctx, snapshot.Id)
 
 	snap := Snapshot{
 		ID:        snapshot.Id,
-		Name:      snapshot.Name,
-		Size:      snapshot.Virtualsize,
+		Name:      c.csiSnapshotName(snapshot.Name),
+		Size:      firstNonZero(snapshot.Virtualsize, snapshot.Physicalsize),
 		DomainID:  snapshot.Domainid,
 		ProjectID: snapshot.Projectid,
 		ZoneID:    snapshot.Zoneid,
 		VolumeID:  snapshot.Volumeid,
+		State:     snapshot.State,
 		CreatedAt: snapshot.Created,
+		Tags:      snapshotTags(snapshot.Tags),
 	}
+	snap.Tags[ManagedByTagKey] = ManagedByTagValue
 
 	return &snap, nil
 }
 
+// tagManagedSnapshot marks a snapshot as managed by the driver, to tell it
+// apart from snapshots taken outside of the driver, e.g. in the CloudStack UI.
+// Failing to tag is not fatal: the snapshot is usable all the same.
+func (c *client) tagManagedSnapshot(ctx context.Context, snapshotID string) {
+	err := c.CreateTags(ctx, ResourceTypeSnapshot, snapshotID, map[string]string{
+		ManagedByTagKey: ManagedByTagValue,
+	})
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Cannot tag snapshot as managed by the driver", "snapshotID", snapshotID)
+	}
+}
+
+// snapshotTags returns the tags of a snapshot as a map.
+func snapshotTags(tags []cloudstack.Tags) map[string]string {
+	m := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		m[tag.Key] = tag.Value
+	}
+
+	return m
+}
+
+type createSnapshotResult struct {
+	snapshot *cloudstack.CreateSnapshotResponse
+	err      error
+}
+
+// abandonSnapshot deletes, on a best-effort basis, a snapshot whose creation
+// was given up, so that it is not left behind: right away if CloudStack
+// already lists it, or else once its creation completes.
+func (c *client) abandonSnapshot(ctx context.Context, volumeID, name string, done <-chan createSnapshotResult) {
+	logger := klog.FromContext(ctx)
+	ctx = context.WithoutCancel(ctx)
+
+	deleteSnapshot := func(snapshotID string) bool {
+		logger.Info("Deleting snapshot whose creation was given up", "snapshotID", snapshotID, "volumeID", volumeID)
+		err := c.DeleteSnapshot(ctx, snapshotID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			logger.Error(err, "Cannot delete snapshot whose creation was given up", "snapshotID", snapshotID)
+
+			return false
+		}
+
+		return true
+	}
+
+	if name != "" {
+		if snapshot, err := c.findCreatedSnapshot(ctx, volumeID, name); err == nil && snapshot != "" && deleteSnapshot(snapshot) {
+			return
+		}
+	}
+	go func() {
+		if r := <-done; r.err == nil {
+			deleteSnapshot(r.snapshot.Id)
+		}
+	}()
+}
+
+// findCreatedSnapshot returns the ID of the snapshot of the volume with the
+// given CloudStack name, or "" if none.
+func (c *client) findCreatedSnapshot(ctx context.Context, volumeID, name string) (string, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Snapshot.NewListSnapshotsParams()
+	p.SetVolumeid(volumeID)
+	p.SetName(name)
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", map[string]string{
+		"volumeid":  volumeID,
+		"name":      name,
+		"projectid": c.projectID,
+	})
+	l, err := c.Snapshot.ListSnapshots(p)
+	if err != nil || l.Count == 0 {
+		return "", err
+	}
+
+	return l.Snapshots[0].Id, nil
+}
+
 func (c *client) DeleteSnapshot(_ context.Context, snapshotID string) error {
 	p := c.Snapshot.NewDeleteSnapshotParams(snapshotID)
 	_, err := c.Snapshot.DeleteSnapshot(p)
@@ -105,20 +222,49 @@ func (c *client) DeleteSnapshot(_ context.Context, snapshotID string) error {
 	return err
 }
 
+// TagSnapshot sets tags on a snapshot.
+func (c *client) TagSnapshot(ctx context.Context, snapshotID string, tags map[string]string) error {
+	return c.CreateTags(ctx, ResourceTypeSnapshot, snapshotID, tags)
+}
+
+// GetSnapshotTags returns the tags of a snapshot.
+func (c *client) GetSnapshotTags(ctx context.Context, snapshotID string) (map[string]string, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Resourcetags.NewListTagsParams()
+	p.SetResourceid(snapshotID)
+	p.SetResourcetype(ResourceTypeSnapshot)
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	logger.V(2).Info("CloudStack API call", "command", "ListTags", "params", map[string]string{
+		"resourceid":   snapshotID,
+		"resourcetype": ResourceTypeSnapshot,
+		"projectid":    c.projectID,
+	})
+	l, err := c.Resourcetags.ListTags(p)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(l.Tags))
+	for _, tag := range l.Tags {
+		tags[tag.Key] = tag.Value
+	}
+
+	return tags, nil
+}
+
 func (c *client) GetSnapshotByName(ctx context.Context, name string) (*Snapshot, error) {
 	logger := klog.FromContext(ctx)
 	if name == "" {
 		return nil, ErrNotFound
 	}
-	p := c.Snapshot.NewListSnapshotsParams()
+	name = c.snapshotName(name)
+	p := c.newListSnapshotsParams()
 	p.SetName(name)
-	if c.projectID != "" {
-		p.SetProjectid(c.projectID)
-	}
-	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", map[string]string{
-		"name":      name,
-		"projectid": c.projectID,
-	})
+	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", c.listSnapshotsLogParams(map[string]string{
+		"name": name,
+	}))
 	l, err := c.Snapshot.ListSnapshots(p)
 	if err != nil {
 		return nil, err
@@ -132,34 +278,37 @@ func (c *client) GetSnapshotByName(ctx context.Context, name string) (*Snapshot,
 	snapshot := l.Snapshots[0]
 	s := Snapshot{
 		ID:        snapshot.Id,
-		Name:      snapshot.Name,
+		Name:      c.csiSnapshotName(snapshot.Name),
 		DomainID:  snapshot.Domainid,
 		ProjectID: snapshot.Projectid,
 		ZoneID:    snapshot.Zoneid,
 		VolumeID:  snapshot.Volumeid,
+		Size:      firstNonZero(snapshot.Virtualsize, snapshot.Physicalsize),
+		State:     snapshot.State,
 		CreatedAt: snapshot.Created,
+		Tags:      snapshotTags(snapshot.Tags),
 	}
 
 	return &s, nil
 }
 
 func (c *client) ListSnapshots(ctx context.Context, volumeID, snapshotID string) ([]*Snapshot, error) {
+	if volumeID == "" && snapshotID == "" {
+		return c.listAllSnapshots(ctx)
+	}
+
 	logger := klog.FromContext(ctx)
-	p := c.Snapshot.NewListSnapshotsParams()
+	p := c.newListSnapshotsParams()
 	if snapshotID != "" {
 		p.SetId(snapshotID)
 	}
 	if volumeID != "" {
 		p.SetVolumeid(volumeID)
 	}
-	if c.projectID != "" {
-		p.SetProjectid(c.projectID)
-	}
-	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", map[string]string{
-		"id":        snapshotID,
-		"volumeid":  volumeID,
-		"projectid": c.projectID,
-	})
+	logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", c.listSnapshotsLogParams(map[string]string{
+		"id":       snapshotID,
+		"volumeid": volumeID,
+	}))
 	l, err := c.Snapshot.ListSnapshots(p)
 	if err != nil {
 		return nil, err
@@ -169,18 +318,176 @@ func (c *client) ListSnapshots(ctx context.Context, volumeID, snapshotID string)
 	}
 	result := make([]*Snapshot, 0, l.Count)
 	for _, snapshot := range l.Snapshots {
-		s := &Snapshot{
-			ID:        snapshot.Id,
-			Name:      snapshot.Name,
-			Size:      snapshot.Virtualsize,
-			DomainID:  snapshot.Domainid,
-			ProjectID: snapshot.Projectid,
-			ZoneID:    snapshot.Zoneid,
-			VolumeID:  snapshot.Volumeid,
-			CreatedAt: snapshot.Created,
-		}
-		result = append(result, s)
+		result = append(result, c.toSnapshot(snapshot))
 	}
 
 	return result, nil
 }
+
+// listAllSnapshots lists all the snapshots page by page, stopping at the
+// maxListedSnapshots first ones.
+func (c *client) listAllSnapshots(ctx context.Context) ([]*Snapshot, error) {
+	logger := klog.FromContext(ctx)
+	result := make([]*Snapshot, 0)
+	for page := 1; ; page++ {
+		p := c.newListSnapshotsParams()
+		p.SetPagesize(listSnapshotsPageSize)
+		p.SetPage(page)
+		logger.V(2).Info("CloudStack API call", "command", "ListSnapshots", "params", c.listSnapshotsLogParams(map[string]string{
+			"pagesize": strconv.Itoa(listSnapshotsPageSize),
+			"page":     strconv.Itoa(page),
+		}))
+		l, err := c.Snapshot.ListSnapshots(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, snapshot := range l.Snapshots {
+			if c.maxListedSnapshots > 0 && len(result) == c.maxListedSnapshots {
+				logger.Info("Too many snapshots, listing truncated", "maxListedSnapshots", c.maxListedSnapshots)
+
+				return result, nil
+			}
+			result = append(result, c.toSnapshot(snapshot))
+		}
+		if len(l.Snapshots) < listSnapshotsPageSize {
+			return result, nil
+		}
+	}
+}
+
+func (c *client) toSnapshot(snapshot *cloudstack.Snapshot) *Snapshot {
+	return &Snapshot{
+		ID:        snapshot.Id,
+		Name:      c.csiSnapshotName(snapshot.Name),
+		Size:      firstNonZero(snapshot.Virtualsize, snapshot.Physicalsize),
+		DomainID:  snapshot.Domainid,
+		ProjectID: snapshot.Projectid,
+		ZoneID:    snapshot.Zoneid,
+		VolumeID:  snapshot.Volumeid,
+		State:     snapshot.State,
+		CreatedAt: snapshot.Created,
+		Tags:      snapshotTags(snapshot.Tags),
+	}
+}
+
+// snapshotName returns the CloudStack name of a snapshot, prefixed with
+// the cluster ID if set.
+func (c *client) snapshotName(name string) string {
+	if c.clusterID == "" {
+		return name
+	}
+
+	return c.clusterID + "-" + name
+}
+
+// csiSnapshotName returns the name of a snapshot without the cluster ID
+// prefix of its CloudStack name.
+func (c *client) csiSnapshotName(name string) string {
+	if c.clusterID == "" {
+		return name
+	}
+
+	return strings.TrimPrefix(name, c.clusterID+"-")
+}
+
+// newListSnapshotsParams returns the parameters of a snapshot listing,
+// scoped to the project, or to all the accounts of the domain if listall
+// is enabled in the configuration.
+func (c *client) newListSnapshotsParams() *cloudstack.ListSnapshotsParams {
+	p := c.Snapshot.NewListSnapshotsParams()
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	if c.listAll {
+		p.SetListall(true)
+		if c.domainID != "" {
+			p.SetDomainid(c.domainID)
+		}
+	}
+
+	return p
+}
+
+// listSnapshotsLogParams adds the scoping parameters of a snapshot listing
+// to params, for logging.
+func (c *client) listSnapshotsLogParams(params map[string]string) map[string]string {
+	params["projectid"] = c.projectID
+	if c.listAll {
+		params["listall"] = "true"
+		params["domainid"] = c.domainID
+	}
+
+	return params
+}
+
+// ExtractSnapshot extracts a snapshot to a downloadable URL, and returns the URL.
+func (c *client) ExtractSnapshot(ctx context.Context, snapshotID string) (string, error) {
+	logger := klog.FromContext(ctx)
+	snapshot, err := c.GetSnapshotByID(ctx, snapshotID)
+	if err != nil {
+		return "", err
+	}
+
+	// extractSnapshot is not wrapped by cloudstack-go.
+	custom, ok := c.Custom.(*cloudstack.CustomService)
+	if !ok {
+		return "", errors.New("custom CloudStack requests not supported")
+	}
+	p := &cloudstack.CustomServiceParams{}
+	p.SetParam("id", snapshotID)
+	p.SetParam("zoneid", snapshot.ZoneID)
+	logger.V(2).Info("CloudStack API call", "command", "ExtractSnapshot", "params", map[string]string{
+		"id":     snapshotID,
+		"zoneid": snapshot.ZoneID,
+	})
+	var job struct {
+		JobID string `json:"jobid"`
+	}
+	if err := custom.CustomRequest("extractSnapshot", p, &job); err != nil {
+		return "", fmt.Errorf("cannot extract snapshot %s: %w", snapshotID, err)
+	}
+
+	// Wait for the extraction job, which may take long for big snapshots.
+	var url string
+	err = wait.PollUntilContextTimeout(ctx, extractSnapshotPollInterval, extractSnapshotTimeout, true, func(context.Context) (bool, error) {
+		r, err := c.Asyncjob.QueryAsyncJobResult(c.Asyncjob.NewQueryAsyncJobResultParams(job.JobID))
+		if err != nil {
+			return false, err
+		}
+		switch r.Jobstatus {
+		case 0: // Pending
+			return false, nil
+		case 1: // Succeeded
+			url, err = extractURL(r.Jobresult)
+
+			return true, err
+		default:
+			return false, fmt.Errorf("extraction job %s failed: %s", job.JobID, string(r.Jobresult))
+		}
+	})
+	if wait.Interrupted(err) {
+		return "", fmt.Errorf("snapshot %s not extracted within %v", snapshotID, extractSnapshotTimeout)
+	} else if err != nil {
+		return "", fmt.Errorf("cannot extract snapshot %s: %w", snapshotID, err)
+	}
+
+	return url, nil
+}
+
+// extractURL returns the URL from the result of an extraction job,
+// e.g. {"snapshot": {"url": "https://..."}}.
+func extractURL(jobResult json.RawMessage) (string, error) {
+	var result map[string]struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(jobResult, &result); err != nil {
+		return "", fmt.Errorf("cannot parse extraction result: %w", err)
+	}
+	for _, r := range result {
+		if r.URL != "" {
+			return r.URL, nil
+		}
+	}
+
+	return "", errors.New("no URL in extraction result")
+}
@@ -0,0 +1,281 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+)
+
+func TestNewListSnapshotsParams(t *testing.T) {
+	cases := []struct {
+		name             string
+		config           Config
+		expectedListAll  bool
+		expectedDomainID string
+	}{
+		{"default", Config{}, false, ""},
+		{"listall", Config{ListAll: true}, true, ""},
+		{"listall in domain", Config{ListAll: true, DomainID: "domain-1"}, true, "domain-1"},
+		{"domain without listall", Config{DomainID: "domain-1"}, false, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.config.APIURL = "https://cloudstack.example.com/client/api"
+			cl, _ := New(&c.config).(*client)
+
+			p := cl.newListSnapshotsParams()
+			if listAll, _ := p.GetListall(); listAll != c.expectedListAll {
+				t.Errorf("Expected listall %v, got %v", c.expectedListAll, listAll)
+			}
+			if domainID, _ := p.GetDomainid(); domainID != c.expectedDomainID {
+				t.Errorf("Expected domainid %q, got %q", c.expectedDomainID, domainID)
+			}
+		})
+	}
+}
+
+func TestNewListSnapshotsParamsProject(t *testing.T) {
+	cl := &client{
+		CloudStackClient: cloudstack.NewAsyncClient("https://cloudstack.example.com/client/api", "", "", true),
+		projectID:        "project-1",
+		listAll:          true,
+	}
+
+	p := cl.newListSnapshotsParams()
+	if projectID, _ := p.GetProjectid(); projectID != "project-1" {
+		t.Errorf("Expected projectid project-1, got %q", projectID)
+	}
+	if listAll, _ := p.GetListall(); !listAll {
+		t.Error("Expected listall to be set")
+	}
+}
+
+func TestListAllSnapshots(t *testing.T) {
+	const total = 1200
+	cases := []struct {
+		name             string
+		maxSnapshots     int
+		volumeID         string
+		expectedCount    int
+		expectedRequests int
+	}{
+		{"default cap", 0, "", total, 3},
+		{"capped", 600, "", 600, 2},
+		{"cap disabled", -1, "", total, 3},
+		{"volume snapshots not paginated", 600, "volume-1", total, 1},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			requests := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				first, last := 0, total
+				if pageSize, _ := strconv.Atoi(r.URL.Query().Get("pagesize")); pageSize > 0 {
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					first, last = (page-1)*pageSize, min(page*pageSize, total)
+				}
+				snapshots := make([]map[string]string, 0, last-first)
+				for i := first; i < last; i++ {
+					snapshots = append(snapshots, map[string]string{"id": fmt.Sprintf("snapshot-%d", i)})
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"listsnapshotsresponse": map[string]any{"count": total, "snapshot": snapshots},
+				})
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, MaxListedSnapshots: c.maxSnapshots})
+			snapshots, err := connector.ListSnapshots(context.Background(), c.volumeID, "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(snapshots) != c.expectedCount {
+				t.Errorf("Expected %d snapshots, got %d", c.expectedCount, len(snapshots))
+			}
+			if requests != c.expectedRequests {
+				t.Errorf("Expected %d requests, got %d", c.expectedRequests, requests)
+			}
+		})
+	}
+}
+
+func TestGetSnapshotByNameClusterID(t *testing.T) {
+	cases := []struct {
+		name         string
+		clusterID    string
+		expectedName string
+	}{
+		{"no cluster ID", "", "snap-1"},
+		{"cluster ID", "cluster-1", "cluster-1-snap-1"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				name := r.URL.Query().Get("name")
+				if name != c.expectedName {
+					t.Errorf("Expected CloudStack name %s, got %s", c.expectedName, name)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"listsnapshotsresponse": map[string]any{
+						"count":    1,
+						"snapshot": []map[string]string{{"id": "snapshot-1", "name": name}},
+					},
+				})
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, ClusterID: c.clusterID})
+			snapshot, err := connector.GetSnapshotByName(context.Background(), "snap-1")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if snapshot.Name != "snap-1" {
+				t.Errorf("Expected snapshot name snap-1, got %s", snapshot.Name)
+			}
+		})
+	}
+}
+
+func TestGetSnapshotTags(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("command") != "listTags" || q.Get("resourceid") != "snapshot-1" || q.Get("resourcetype") != "Snapshot" {
+			t.Errorf("Unexpected request %v", q)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"listtagsresponse": map[string]any{
+				"count": 2,
+				"tag": []map[string]string{
+					{"key": "cost-center", "value": "42", "resourceid": "snapshot-1"},
+					{"key": "team", "value": "storage", "resourceid": "snapshot-1"},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+
+	connector := New(&Config{APIURL: server.URL})
+	tags, err := connector.GetSnapshotTags(context.Background(), "snapshot-1")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(tags) != 2 || tags["cost-center"] != "42" || tags["team"] != "storage" {
+		t.Errorf("Unexpected tags %v", tags)
+	}
+}
+
+func TestListSnapshotsManaged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"listsnapshotsresponse": map[string]any{
+				"count": 2,
+				"snapshot": []map[string]any{
+					{"id": "snapshot-1", "tags": []map[string]string{{"key": ManagedByTagKey, "value": ManagedByTagValue}}},
+					{"id": "snapshot-2", "tags": []map[string]string{{"key": "team", "value": "storage"}}},
+				},
+			},
+		})
+	}))
+	defer server.Close()
+
+	connector := New(&Config{APIURL: server.URL})
+	snapshots, err := connector.ListSnapshots(context.Background(), "volume-1", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(snapshots) != 2 {
+		t.Fatalf("Expected 2 snapshots, got %d", len(snapshots))
+	}
+	if !snapshots[0].IsManaged() {
+		t.Errorf("Expected snapshot %s to be managed, tags %v", snapshots[0].ID, snapshots[0].Tags)
+	}
+	if snapshots[1].IsManaged() || snapshots[1].Tags["team"] != "storage" {
+		t.Errorf("Expected snapshot %s to be unmanaged, tags %v", snapshots[1].ID, snapshots[1].Tags)
+	}
+}
+
+func TestCreateSnapshotTimeout(t *testing.T) {
+	var mu sync.Mutex
+	var deleted []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var resp map[string]any
+		switch q.Get("command") {
+		case "createSnapshot":
+			resp = map[string]any{"createsnapshotresponse": map[string]any{"jobid": "job-create", "id": "snapshot-1"}}
+		case "listSnapshots":
+			if q.Get("volumeid") != "volume-1" || q.Get("name") != "snap-1" {
+				t.Errorf("Unexpected request %v", q)
+			}
+			resp = map[string]any{"listsnapshotsresponse": map[string]any{
+				"count":    1,
+				"snapshot": []map[string]string{{"id": "snapshot-1", "name": "snap-1", "state": "Creating"}},
+			}}
+		case "deleteSnapshot":
+			mu.Lock()
+			deleted = append(deleted, q.Get("id"))
+			mu.Unlock()
+			resp = map[string]any{"deletesnapshotresponse": map[string]any{"jobid": "job-delete"}}
+		case "queryAsyncJobResult":
+			// The creation job never completes.
+			result := map[string]any{"jobid": q.Get("jobid"), "jobstatus": 0}
+			if q.Get("jobid") == "job-delete" {
+				result["jobstatus"] = 1
+				result["jobresult"] = map[string]any{"success": true}
+			}
+			resp = map[string]any{"queryasyncjobresultresponse": result}
+		default:
+			t.Errorf("Unexpected request %v", q)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	connector := New(&Config{APIURL: server.URL})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err := connector.CreateSnapshot(ctx, "volume-1", "snap-1")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected DeadlineExceeded, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(deleted, []string{"snapshot-1"}) {
+		t.Errorf("Expected snapshot-1 to be deleted, got %v", deleted)
+	}
+}
@@ -0,0 +1,212 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"k8s.io/klog/v2"
+)
+
+// storagePoolStateUp is the state of the storage pools in service.
+const storagePoolStateUp = "Up"
+
+// storagePoolScopeZone is the scope of the zone-wide storage pools,
+// accessible from all the hosts of their zone.
+const storagePoolScopeZone = "ZONE"
+
+// storagePoolScopeHost is the scope of the local storage pools of hosts.
+const storagePoolScopeHost = "HOST"
+
+// CapacityMode is how the available capacity of a storage pool is computed.
+type CapacityMode string
+
+// Capacity modes.
+const (
+	// CapacityAllocated is the size of the pool not allocated to volumes.
+	CapacityAllocated CapacityMode = "allocated"
+	// CapacityPhysical is the physical free space of the pool, whatever the
+	// size allocated to thin provisioned volumes.
+	CapacityPhysical CapacityMode = "physical"
+	// CapacityOvercommit is the size of the pool multiplied by its
+	// overprovisioning factor, not allocated to volumes.
+	CapacityOvercommit CapacityMode = "overcommit"
+)
+
+// GetAvailableCapacity returns the primary storage capacity, in bytes,
+// still available for volumes of the disk offering in the zone, i.e. in the
+// storage pools having the storage tags of the offering, computed according
+// to mode. All storage pools of the zone are considered if diskOfferingID
+// is empty.
+func (c *client) GetAvailableCapacity(ctx context.Context, zoneID, diskOfferingID string, mode CapacityMode) (int64, error) {
+	pools, err := c.listOfferingStoragePools(ctx, zoneID, diskOfferingID)
+	if err != nil {
+		return 0, err
+	}
+
+	var available int64
+	for _, pool := range pools {
+		available += poolAvailableCapacity(pool, mode)
+	}
+
+	return available, nil
+}
+
+// poolAvailableCapacity returns the available capacity of a storage pool,
+// in bytes, computed according to mode.
+func poolAvailableCapacity(pool *cloudstack.StoragePool, mode CapacityMode) int64 {
+	total, used := pool.Disksizetotal, pool.Disksizeallocated
+	switch mode {
+	case CapacityPhysical:
+		used = pool.Disksizeused
+	case CapacityOvercommit:
+		// The factor is 1 for thick provisioned pools, or if unknown.
+		if factor, err := strconv.ParseFloat(pool.Overprovisionfactor, 64); err == nil && factor > 1 {
+			total = int64(float64(total) * factor)
+		}
+	case CapacityAllocated:
+	}
+	if total <= used {
+		return 0
+	}
+
+	return total - used
+}
+
+// GetStorageClusterIDs returns the IDs of the clusters whose hosts can
+// access the volumes of the disk offering in the zone, i.e. the clusters
+// of its cluster-wide and host-wide storage pools. It returns nil if the
+// storage of the offering is zone-wide, or unknown.
+func (c *client) GetStorageClusterIDs(ctx context.Context, zoneID, diskOfferingID string) ([]string, error) {
+	pools, err := c.listOfferingStoragePools(ctx, zoneID, diskOfferingID)
+	if err != nil {
+		return nil, err
+	}
+
+	var clusterIDs []string
+	for _, pool := range pools {
+		if pool.Scope == storagePoolScopeZone || pool.Clusterid == "" {
+			return nil, nil
+		}
+		if !slices.Contains(clusterIDs, pool.Clusterid) {
+			clusterIDs = append(clusterIDs, pool.Clusterid)
+		}
+	}
+
+	return clusterIDs, nil
+}
+
+// hostLocalStoragePool returns the ID of the local storage pool of a host of
+// the zone having the storage tags of the disk offering. CloudStack sets the
+// address of the local storage pools to the address of their host.
+func (c *client) hostLocalStoragePool(ctx context.Context, zoneID, hostID, diskOfferingID string) (string, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Host.NewListHostsParams()
+	p.SetId(hostID)
+	p.SetZoneid(zoneID)
+	logger.V(2).Info("CloudStack API call", "command", "ListHosts", "params", map[string]string{
+		"id":     hostID,
+		"zoneid": zoneID,
+	})
+	l, err := c.Host.ListHosts(p)
+	if err != nil {
+		return "", err
+	}
+	if l.Count == 0 {
+		return "", fmt.Errorf("host %s in zone %s: %w", hostID, zoneID, ErrNotFound)
+	}
+	host := l.Hosts[0]
+
+	pools, err := c.listOfferingStoragePools(ctx, zoneID, diskOfferingID)
+	if err != nil {
+		return "", err
+	}
+	for _, pool := range pools {
+		if pool.Scope == storagePoolScopeHost && pool.Clusterid == host.Clusterid && pool.Ipaddress == host.Ipaddress {
+			return pool.Id, nil
+		}
+	}
+
+	return "", fmt.Errorf("local storage pool of host %s for disk offering %s: %w", hostID, diskOfferingID, ErrNotFound)
+}
+
+// listOfferingStoragePools returns the storage pools in service in the
+// zone having the storage tags of the disk offering. All the storage pools
+// in service of the zone are returned if diskOfferingID is empty.
+func (c *client) listOfferingStoragePools(ctx context.Context, zoneID, diskOfferingID string) ([]*cloudstack.StoragePool, error) {
+	var storageTags []string
+	if diskOfferingID != "" {
+		offering, err := c.GetDiskOffering(ctx, diskOfferingID)
+		if err != nil {
+			return nil, err
+		}
+		storageTags = offering.StorageTags
+	}
+
+	logger := klog.FromContext(ctx)
+	p := c.Pool.NewListStoragePoolsParams()
+	p.SetZoneid(zoneID)
+	logger.V(2).Info("CloudStack API call", "command", "ListStoragePools", "params", map[string]string{
+		"zoneid": zoneID,
+	})
+	r, err := c.Pool.ListStoragePools(p)
+	if err != nil {
+		return nil, err
+	}
+
+	pools := make([]*cloudstack.StoragePool, 0, len(r.StoragePools))
+	for _, pool := range r.StoragePools {
+		if pool.State == storagePoolStateUp && hasStorageTags(pool.Tags, storageTags) {
+			pools = append(pools, pool)
+		}
+	}
+
+	return pools, nil
+}
+
+// parseStorageTags parses comma-separated CloudStack storage tags.
+func parseStorageTags(tags string) []string {
+	result := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			result = append(result, tag)
+		}
+	}
+
+	return result
+}
+
+// hasStorageTags returns true if the comma-separated tags of a storage
+// pool include all the required tags.
+func hasStorageTags(poolTags string, required []string) bool {
+	tags := parseStorageTags(poolTags)
+	for _, tag := range required {
+		if !slices.Contains(tags, tag) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,126 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestHasStorageTags(t *testing.T) {
+	cases := []struct {
+		poolTags string
+		required []string
+		expected bool
+	}{
+		{"", nil, true},
+		{"ssd,fast", nil, true},
+		{"ssd,fast", []string{"ssd"}, true},
+		{"ssd, fast", []string{"fast", "ssd"}, true},
+		{"ssd", []string{"ssd", "fast"}, false},
+		{"", []string{"ssd"}, false},
+	}
+	for _, c := range cases {
+		if got := hasStorageTags(c.poolTags, c.required); got != c.expected {
+			t.Errorf("hasStorageTags(%q, %v): expected %v, got %v", c.poolTags, c.required, c.expected, got)
+		}
+	}
+}
+
+func TestGetStorageClusterIDs(t *testing.T) {
+	cases := []struct {
+		name     string
+		pools    []map[string]string
+		expected []string
+	}{
+		{"zone-wide", []map[string]string{
+			{"id": "pool-1", "state": "Up", "scope": "ZONE"},
+			{"id": "pool-2", "state": "Up", "scope": "CLUSTER", "clusterid": "cluster-1"},
+		}, nil},
+		{"cluster-wide", []map[string]string{
+			{"id": "pool-1", "state": "Up", "scope": "CLUSTER", "clusterid": "cluster-1"},
+			{"id": "pool-2", "state": "Up", "scope": "HOST", "clusterid": "cluster-2"},
+			{"id": "pool-3", "state": "Up", "scope": "CLUSTER", "clusterid": "cluster-1"},
+			{"id": "pool-4", "state": "Maintenance", "scope": "ZONE"},
+		}, []string{"cluster-1", "cluster-2"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(map[string]any{
+					"liststoragepoolsresponse": map[string]any{"count": len(c.pools), "storagepool": c.pools},
+				})
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL})
+			clusterIDs, err := connector.GetStorageClusterIDs(context.Background(), "zone-1", "")
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(clusterIDs, c.expected) {
+				t.Errorf("Expected clusters %v, got %v", c.expected, clusterIDs)
+			}
+		})
+	}
+}
+
+func TestGetAvailableCapacityModes(t *testing.T) {
+	const gib = 1 << 30
+	pools := []map[string]any{
+		// Thin provisioned pool: 100 GiB, 150 GiB allocated, 40 GiB used.
+		{"id": "pool-1", "state": "Up", "disksizetotal": 100 * gib, "disksizeallocated": 150 * gib, "disksizeused": 40 * gib, "overprovisionfactor": "2.0"},
+		// Thick provisioned pool: 100 GiB, 30 GiB allocated and used.
+		{"id": "pool-2", "state": "Up", "disksizetotal": 100 * gib, "disksizeallocated": 30 * gib, "disksizeused": 30 * gib, "overprovisionfactor": "1"},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"liststoragepoolsresponse": map[string]any{"count": len(pools), "storagepool": pools},
+		})
+	}))
+	defer server.Close()
+
+	cases := []struct {
+		mode     CapacityMode
+		expected int64
+	}{
+		{CapacityAllocated, 70 * gib},
+		{CapacityPhysical, 130 * gib},
+		{CapacityOvercommit, 120 * gib},
+	}
+	connector := New(&Config{APIURL: server.URL})
+	for _, c := range cases {
+		t.Run(string(c.mode), func(t *testing.T) {
+			available, err := connector.GetAvailableCapacity(context.Background(), "zone-1", "", c.mode)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if available != c.expected {
+				t.Errorf("Expected %d GiB available, got %d GiB", c.expected/gib, available/gib)
+			}
+		})
+	}
+}
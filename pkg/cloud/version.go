@@ -0,0 +1,102 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"k8s.io/klog/v2"
+)
+
+// MinEncryptionVersion is the first CloudStack version encrypting volumes.
+const MinEncryptionVersion = "4.18"
+
+// GetCloudStackVersion returns the version of the CloudStack management
+// server, e.g. 4.19.0.0. It is cached once fetched.
+func (c *client) GetCloudStackVersion(ctx context.Context) (string, error) {
+	c.versionMu.Lock()
+	defer c.versionMu.Unlock()
+	if c.version != "" {
+		return c.version, nil
+	}
+
+	logger := klog.FromContext(ctx)
+	p := c.Configuration.NewListCapabilitiesParams()
+	logger.V(2).Info("CloudStack API call", "command", "ListCapabilities", "params", map[string]string{})
+	r, err := c.Configuration.ListCapabilities(p)
+	if err != nil {
+		return "", err
+	}
+	if r.Capabilities == nil {
+		return "", ErrNotFound
+	}
+	c.version = r.Capabilities.Cloudstackversion
+
+	return c.version, nil
+}
+
+// VersionAtLeast returns true if the CloudStack version is the given
+// minimum version or a later one, comparing their dotted numeric parts
+// (e.g. 4.19.0.0 is at least 4.18). It returns false for unparsable versions.
+func VersionAtLeast(version, minimum string) bool {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	m, ok := parseVersion(minimum)
+	if !ok {
+		return false
+	}
+	for i := range max(len(v), len(m)) {
+		var vi, mi int
+		if i < len(v) {
+			vi = v[i]
+		}
+		if i < len(m) {
+			mi = m[i]
+		}
+		if vi != mi {
+			return vi > mi
+		}
+	}
+
+	return true
+}
+
+// parseVersion parses a version such as 4.19.0.0 or 4.19.0.0-SNAPSHOT.
+func parseVersion(version string) ([]int, bool) {
+	version, _, _ = strings.Cut(version, "-")
+	if version == "" {
+		return nil, false
+	}
+	parts := strings.Split(version, ".")
+	result := make([]int, 0, len(parts))
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		result = append(result, n)
+	}
+
+	return result, true
+}
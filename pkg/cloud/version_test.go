@@ -0,0 +1,42 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import "testing"
+
+func TestVersionAtLeast(t *testing.T) {
+	cases := []struct {
+		version, minimum string
+		expected         bool
+	}{
+		{"4.19.0.0", "4.19", true},
+		{"4.19.0.0", "4.18.1", true},
+		{"4.18.1.0", "4.19", false},
+		{"4.9.0", "4.18", false},
+		{"4.20.0.0-SNAPSHOT", "4.20", true},
+		{"", "4.18", false},
+		{"unknown", "4.18", false},
+	}
+	for _, c := range cases {
+		if got := VersionAtLeast(c.version, c.minimum); got != c.expected {
+			t.Errorf("VersionAtLeast(%q, %q): expected %v, got %v", c.version, c.minimum, c.expected, got)
+		}
+	}
+}
@@ -47,11 +47,13 @@ func (c *client) GetVMByID(ctx context.Context, vmID string) (*VM, error) {
 		return nil, ErrTooManyResults
 	}
 	vm := l.VirtualMachines[0]
-	logger.V(2).Info("Returning VM", "vmID", vm.Id, "zoneID", vm.Zoneid)
+	logger.V(2).Info("Returning VM", "vmID", vm.Id, "zoneID", vm.Zoneid, "hostID", vm.Hostid)
 
 	return &VM{
 		ID:     vm.Id,
 		ZoneID: vm.Zoneid,
+		State:  vm.State,
+		HostID: vm.Hostid,
 	}, nil
 }
 
@@ -77,5 +79,29 @@ func (c *client) getVMByName(ctx context.Context, name string) (*VM, error) {
 	return &VM{
 		ID:     vm.Id,
 		ZoneID: vm.Zoneid,
+		State:  vm.State,
+		HostID: vm.Hostid,
 	}, nil
 }
+
+// GetHostClusterID returns the ID of the cluster of a host.
+func (c *client) GetHostClusterID(ctx context.Context, hostID string) (string, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Host.NewListHostsParams()
+	p.SetId(hostID)
+	logger.V(2).Info("CloudStack API call", "command", "ListHosts", "params", map[string]string{
+		"id": hostID,
+	})
+	l, err := c.Host.ListHosts(p)
+	if err != nil {
+		return "", err
+	}
+	if l.Count == 0 {
+		return "", ErrNotFound
+	}
+	if l.Count > 1 {
+		return "", ErrTooManyResults
+	}
+
+	return l.Hosts[0].Clusterid, nil
+}
@@ -0,0 +1,65 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetVMHostID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("command") != "listVirtualMachines" {
+			t.Errorf("Unexpected request %v", r.URL.Query())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"listvirtualmachinesresponse": map[string]any{
+				"count": 1,
+				"virtualmachine": []map[string]string{{
+					"id":     "vm-1",
+					"name":   "node-1",
+					"zoneid": "zone-1",
+					"state":  "Running",
+					"hostid": "host-1",
+				}},
+			},
+		})
+	}))
+	defer server.Close()
+
+	c, _ := New(&Config{APIURL: server.URL}).(*client)
+	ctx := context.Background()
+	for name, get := range map[string]func() (*VM, error){
+		"by ID":   func() (*VM, error) { return c.GetVMByID(ctx, "vm-1") },
+		"by name": func() (*VM, error) { return c.getVMByName(ctx, "node-1") },
+	} {
+		vm, err := get()
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if vm.HostID != "host-1" {
+			t.Errorf("%s: expected host host-1, got %q", name, vm.HostID)
+		}
+	}
+}
@@ -21,16 +21,31 @@ package cloud
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apache/cloudstack-go/v2/cloudstack"
+	"github.com/hashicorp/go-uuid"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/util"
 )
 
+const (
+	// allProjectsID lists the resources of all the projects of the caller.
+	allProjectsID = "-1"
+
+	// dataDiskType is the type of the volumes which are not the root disk of a VM.
+	dataDiskType = "DATADISK"
+
+	// listVolumesPageSize is the page size used to list all the volumes.
+	listVolumesPageSize = 500
+)
+
 func (c *client) listVolumes(p *cloudstack.ListVolumesParams) (*Volume, error) {
 	l, err := c.Volume.ListVolumes(p)
 	if err != nil {
@@ -42,24 +57,53 @@ func (c *client) listVolumes(p *cloudstack.ListVolumesParams) (*Volume, error) {
 	if l.Count > 1 {
 		return nil, ErrTooManyResults
 	}
-	vol := l.Volumes[0]
-	v := Volume{
+
+	return toVolume(l.Volumes[0]), nil
+}
+
+// listVolumesInAnyProject lists volumes, looking into all the projects if
+// no volume is found, even if the client is bound to a project: volumes
+// created in the project of a storage class are only listed with its ID.
+func (c *client) listVolumesInAnyProject(ctx context.Context, p *cloudstack.ListVolumesParams) (*Volume, error) {
+	vol, err := c.listVolumes(p)
+	if !errors.Is(err, ErrNotFound) {
+		return vol, err
+	}
+	p.SetProjectid(allProjectsID)
+	klog.FromContext(ctx).V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+		"projectid": allProjectsID,
+	})
+
+	return c.listVolumes(p)
+}
+
+func toVolume(vol *cloudstack.Volume) *Volume {
+	tags := make(map[string]string, len(vol.Tags))
+	for _, tag := range vol.Tags {
+		tags[tag.Key] = tag.Value
+	}
+
+	return &Volume{
 		ID:               vol.Id,
 		Name:             vol.Name,
-		Size:             vol.Size,
+		Size:             firstNonZero(vol.Size, vol.Virtualsize, vol.Physicalsize),
 		DiskOfferingID:   vol.Diskofferingid,
 		DomainID:         vol.Domainid,
 		ProjectID:        vol.Projectid,
 		ZoneID:           vol.Zoneid,
 		VirtualMachineID: vol.Virtualmachineid,
 		DeviceID:         strconv.FormatInt(vol.Deviceid, 10),
+		State:            vol.State,
+		Tags:             tags,
 	}
-
-	return &v, nil
 }
 
 func (c *client) GetVolumeByID(ctx context.Context, volumeID string) (*Volume, error) {
 	logger := klog.FromContext(ctx)
+	// CloudStack volume IDs are UUIDs.
+	if _, err := uuid.ParseUUID(volumeID); err != nil {
+		return nil, fmt.Errorf("%w: volume ID %q", ErrInvalidID, volumeID)
+	}
 	p := c.Volume.NewListVolumesParams()
 	p.SetId(volumeID)
 	if c.projectID != "" {
@@ -70,38 +114,300 @@ func (c *client) GetVolumeByID(ctx context.Context, volumeID string) (*Volume, e
 		"projectid": c.projectID,
 	})
 
-	return c.listVolumes(p)
+	return c.listVolumesInAnyProject(ctx, p)
 }
 
 func (c *client) GetVolumeByName(ctx context.Context, name string) (*Volume, error) {
 	logger := klog.FromContext(ctx)
 	p := c.Volume.NewListVolumesParams()
 	p.SetName(name)
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
 	logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
-		"name": name,
+		"name":      name,
+		"projectid": c.projectID,
 	})
 
-	return c.listVolumes(p)
+	return c.listVolumesInAnyProject(ctx, p)
 }
 
-func (c *client) CreateVolume(ctx context.Context, diskOfferingID, zoneID, name string, sizeInGB int64) (string, error) {
+// ListVolumesByName returns all the volumes with exactly the given name.
+func (c *client) ListVolumesByName(ctx context.Context, name string) ([]*Volume, error) {
 	logger := klog.FromContext(ctx)
-	p := c.Volume.NewCreateVolumeParams()
-	p.SetDiskofferingid(diskOfferingID)
-	p.SetZoneid(zoneID)
+	p := c.Volume.NewListVolumesParams()
 	p.SetName(name)
-	p.SetSize(sizeInGB)
 	if c.projectID != "" {
 		p.SetProjectid(c.projectID)
 	}
+	logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+		"name":      name,
+		"projectid": c.projectID,
+	})
+	l, err := c.Volume.ListVolumes(p)
+	if err != nil {
+		return nil, err
+	}
+	if l.Count == 0 {
+		// Volumes created in the project of a storage class are only
+		// listed with its ID.
+		p.SetProjectid(allProjectsID)
+		logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+			"name":      name,
+			"projectid": allProjectsID,
+		})
+		if l, err = c.Volume.ListVolumes(p); err != nil {
+			return nil, err
+		}
+	}
+	vols := make([]*Volume, 0, len(l.Volumes))
+	for _, vol := range l.Volumes {
+		if vol.Name == name {
+			vols = append(vols, toVolume(vol))
+		}
+	}
+
+	return vols, nil
+}
+
+// GetVolumeByTag returns the volume with the given tag.
+func (c *client) GetVolumeByTag(ctx context.Context, key, value string) (*Volume, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Volume.NewListVolumesParams()
+	p.SetTags(map[string]string{key: value})
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+		"tags":      key + "=" + value,
+		"projectid": c.projectID,
+	})
+
+	return c.listVolumesInAnyProject(ctx, p)
+}
+
+func (c *client) ListVolumesForVM(ctx context.Context, vmID string) ([]*Volume, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Volume.NewListVolumesParams()
+	p.SetVirtualmachineid(vmID)
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+		"virtualmachineid": vmID,
+		"projectid":        c.projectID,
+	})
+	l, err := c.Volume.ListVolumes(p)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*Volume, 0, len(l.Volumes))
+	for _, vol := range l.Volumes {
+		vols = append(vols, toVolume(vol))
+	}
+
+	return vols, nil
+}
+
+// ListVolumes lists a page of the data disks, or the one with the given ID.
+// Pages are numbered from 1. All the volumes are listed if pageSize is 0.
+func (c *client) ListVolumes(ctx context.Context, volumeID string, pageSize, page int) ([]*Volume, error) {
+	if pageSize > 0 {
+		return c.listVolumesPage(ctx, volumeID, pageSize, page)
+	}
+
+	vols := make([]*Volume, 0)
+	for page := 1; ; page++ {
+		l, err := c.listVolumesPage(ctx, volumeID, listVolumesPageSize, page)
+		if err != nil {
+			return nil, err
+		}
+		vols = append(vols, l...)
+		if len(l) < listVolumesPageSize {
+			return vols, nil
+		}
+	}
+}
+
+func (c *client) listVolumesPage(ctx context.Context, volumeID string, pageSize, page int) ([]*Volume, error) {
+	logger := klog.FromContext(ctx)
+	p := c.Volume.NewListVolumesParams()
+	p.SetType(dataDiskType)
+	p.SetPagesize(pageSize)
+	p.SetPage(page)
+	if volumeID != "" {
+		p.SetId(volumeID)
+	}
+	if c.projectID != "" {
+		p.SetProjectid(c.projectID)
+	}
+	logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+		"id":        volumeID,
+		"type":      dataDiskType,
+		"pagesize":  strconv.Itoa(pageSize),
+		"page":      strconv.Itoa(page),
+		"projectid": c.projectID,
+	})
+	l, err := c.Volume.ListVolumes(p)
+	if err != nil {
+		return nil, err
+	}
+	vols := make([]*Volume, 0, len(l.Volumes))
+	for _, vol := range l.Volumes {
+		vols = append(vols, toVolume(vol))
+	}
+
+	return vols, nil
+}
+
+// FindUnattachedVolume returns a Ready data disk tagged with the namespaced
+// name of a PersistentVolumeClaim, of the disk offering, zone, project (the
+// project of the client if empty) and size in GB, attached to no VM and not
+// tagged with a CSI volume name, i.e. not owned by a CSI volume. It returns
+// ErrNotFound if there is none.
+func (c *client) FindUnattachedVolume(ctx context.Context, pvc, diskOfferingID, zoneID, projectID string, sizeInGB int64) (*Volume, error) {
+	logger := klog.FromContext(ctx)
+	if projectID == "" {
+		projectID = c.projectID
+	}
+	for page := 1; ; page++ {
+		p := c.Volume.NewListVolumesParams()
+		p.SetTags(map[string]string{PVCTagKey: pvc})
+		p.SetType(dataDiskType)
+		p.SetDiskofferingid(diskOfferingID)
+		p.SetZoneid(zoneID)
+		p.SetPagesize(listVolumesPageSize)
+		p.SetPage(page)
+		if projectID != "" {
+			p.SetProjectid(projectID)
+		}
+		logger.V(2).Info("CloudStack API call", "command", "ListVolumes", "params", map[string]string{
+			"tags":           PVCTagKey + "=" + pvc,
+			"type":           dataDiskType,
+			"diskofferingid": diskOfferingID,
+			"zoneid":         zoneID,
+			"pagesize":       strconv.Itoa(listVolumesPageSize),
+			"page":           strconv.Itoa(page),
+			"projectid":      projectID,
+		})
+		l, err := c.Volume.ListVolumes(p)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range l.Volumes {
+			vol := toVolume(v)
+			if isAdoptable(vol, pvc, sizeInGB) {
+				return vol, nil
+			}
+		}
+		if len(l.Volumes) < listVolumesPageSize {
+			return nil, ErrNotFound
+		}
+	}
+}
+
+// isAdoptable returns true if a volume of the given size in GB may be
+// adopted by a new CSI volume of a PersistentVolumeClaim.
+func isAdoptable(vol *Volume, pvc string, sizeInGB int64) bool {
+	return vol.Tags[PVCTagKey] == pvc &&
+		vol.State == "Ready" &&
+		vol.VirtualMachineID == "" &&
+		vol.Size == util.GigaBytesToBytes(sizeInGB) &&
+		vol.Tags[CSINameTagKey] == ""
+}
+
+// UsedDeviceIDs returns the device IDs of the volumes attached to a VM.
+func UsedDeviceIDs(ctx context.Context, c Interface, vmID string) ([]string, error) {
+	vols, err := c.ListVolumesForVM(ctx, vmID)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(vols))
+	for _, vol := range vols {
+		if vol.DeviceID != "" {
+			ids = append(ids, vol.DeviceID)
+		}
+	}
+
+	return ids, nil
+}
+
+// reservedDeviceID is the device ID reserved by CloudStack for the CD-ROM drive.
+const reservedDeviceID = 3
+
+// LowestFreeDeviceID returns the lowest device ID of a data disk
+// not used by a volume attached to a VM.
+func LowestFreeDeviceID(ctx context.Context, c Interface, vmID string) (string, error) {
+	usedDeviceIDs, err := UsedDeviceIDs(ctx, c, vmID)
+	if err != nil {
+		return "", err
+	}
+	used := make(map[string]bool, len(usedDeviceIDs))
+	for _, id := range usedDeviceIDs {
+		used[id] = true
+	}
+	// Device ID 0 is the root disk.
+	id := 1
+	for used[strconv.Itoa(id)] || id == reservedDeviceID {
+		id++
+	}
+
+	return strconv.Itoa(id), nil
+}
+
+// CreateVolume creates a volume, in the local storage pool of the host of
+// the options if any. It returns ErrNotFound if the host has no such pool.
+func (c *client) CreateVolume(ctx context.Context, opts *VolumeOptions) (string, error) {
+	logger := klog.FromContext(ctx)
+	var storageID string
+	if opts.HostID != "" {
+		var err error
+		storageID, err = c.hostLocalStoragePool(ctx, opts.ZoneID, opts.HostID, opts.DiskOfferingID)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	projectID := opts.ProjectID
+	if projectID == "" {
+		projectID = c.projectID
+	}
+	p := c.Volume.NewCreateVolumeParams()
+	p.SetDiskofferingid(opts.DiskOfferingID)
+	p.SetZoneid(opts.ZoneID)
+	p.SetName(opts.Name)
+	if opts.SizeInGB > 0 {
+		p.SetSize(opts.SizeInGB)
+	}
+	if projectID != "" {
+		p.SetProjectid(projectID)
+	}
+	if opts.MinIops > 0 {
+		p.SetMiniops(opts.MinIops)
+	}
+	if opts.MaxIops > 0 {
+		p.SetMaxiops(opts.MaxIops)
+	}
+	if storageID != "" {
+		p.SetStorageid(storageID)
+	}
 	logger.V(2).Info("CloudStack API call", "command", "CreateVolume", "params", map[string]string{
-		"diskofferingid": diskOfferingID,
-		"zoneid":         zoneID,
-		"name":           name,
-		"size":           strconv.FormatInt(sizeInGB, 10),
-		"projectid":      c.projectID,
+		"diskofferingid": opts.DiskOfferingID,
+		"zoneid":         opts.ZoneID,
+		"name":           opts.Name,
+		"size":           strconv.FormatInt(opts.SizeInGB, 10),
+		"projectid":      projectID,
+		"miniops":        strconv.FormatInt(opts.MinIops, 10),
+		"maxiops":        strconv.FormatInt(opts.MaxIops, 10),
+		"storageid":      storageID,
+	})
+	var vol *cloudstack.CreateVolumeResponse
+	err := c.retrier.doCreate(ctx, "CreateVolume", func() error {
+		var err error
+		vol, err = c.Volume.CreateVolume(p)
+
+		return err
 	})
-	vol, err := c.Volume.CreateVolume(p)
 	if err != nil {
 		return "", err
 	}
@@ -109,6 +415,19 @@ func (c *client) CreateVolume(ctx context.Context, diskOfferingID, zoneID, name
 	return vol.Id, nil
 }
 
+// CreateTags sets tags on a CloudStack resource, e.g. a volume.
+func (c *client) CreateTags(ctx context.Context, resourceType, resourceID string, tags map[string]string) error {
+	logger := klog.FromContext(ctx)
+	p := c.Resourcetags.NewCreateTagsParams([]string{resourceID}, resourceType, tags)
+	logger.V(2).Info("CloudStack API call", "command", "CreateTags", "params", map[string]string{
+		"resourceids":  resourceID,
+		"resourcetype": resourceType,
+	})
+	_, err := c.Resourcetags.CreateTags(p)
+
+	return err
+}
+
 func (c *client) DeleteVolume(ctx context.Context, id string) error {
 	logger := klog.FromContext(ctx)
 	p := c.Volume.NewDeleteVolumeParams(id)
@@ -125,18 +444,84 @@ func (c *client) DeleteVolume(ctx context.Context, id string) error {
 }
 
 func (c *client) AttachVolume(ctx context.Context, volumeID, vmID string) (string, error) {
+	return c.AttachVolumeAtDevice(ctx, volumeID, vmID, "")
+}
+
+// AttachVolumeAtDevice attaches a volume to a VM with the given device ID,
+// or lets CloudStack choose it if deviceID is empty.
+func (c *client) AttachVolumeAtDevice(ctx context.Context, volumeID, vmID, deviceID string) (string, error) {
 	logger := klog.FromContext(ctx)
 	p := c.Volume.NewAttachVolumeParams(volumeID, vmID)
+	if deviceID != "" {
+		id, err := strconv.ParseInt(deviceID, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("invalid device ID %q: %w", deviceID, err)
+		}
+		p.SetDeviceid(id)
+	}
 	logger.V(2).Info("CloudStack API call", "command", "AttachVolume", "params", map[string]string{
 		"id":               volumeID,
 		"virtualmachineid": vmID,
+		"deviceid":         deviceID,
+	})
+	// The asynchronous client waits for the completion of the attach job,
+	// and fails if the job fails.
+	attempts := 0
+	err := c.retrier.do(ctx, "AttachVolume", func() error {
+		// A failed call may still have attached the volume: it is not
+		// attached again, which would fail.
+		if attempts++; attempts > 1 {
+			if vol, err := c.GetVolumeByID(ctx, volumeID); err == nil && vol.VirtualMachineID == vmID {
+				return nil
+			}
+		}
+		_, err := c.Volume.AttachVolume(p)
+
+		return err
 	})
-	r, err := c.Volume.AttachVolume(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to attach volume %s to VM %s: %w", volumeID, vmID, err)
+	}
+
+	// The device ID in the job result may be 0 or stale: get it from
+	// the volume once it shows as attached to the VM.
+	return waitForAttachment(ctx, func(ctx context.Context) (*Volume, error) {
+		return c.GetVolumeByID(ctx, volumeID)
+	}, vmID, attachVerifyInterval, attachVerifyTimeout)
+}
+
+const (
+	// attachVerifyInterval is the interval between checks of the VM a volume
+	// is attached to, after the attach job completed.
+	attachVerifyInterval = time.Second
+	// attachVerifyTimeout is how long a volume may take to show as attached.
+	attachVerifyTimeout = 30 * time.Second
+)
+
+// waitForAttachment waits for a volume to show as attached to a VM, and
+// returns its device ID.
+func waitForAttachment(ctx context.Context, getVolume func(context.Context) (*Volume, error),
+	vmID string, interval, timeout time.Duration,
+) (string, error) {
+	var vol *Volume
+	err := wait.PollUntilContextTimeout(ctx, interval, timeout, true, func(ctx context.Context) (bool, error) {
+		var err error
+		vol, err = getVolume(ctx)
+		if err != nil {
+			return false, err
+		}
+
+		// Device ID 0 is the root disk: a data disk reporting it is not attached yet.
+		return vol.VirtualMachineID == vmID && vol.DeviceID != "" && vol.DeviceID != "0", nil
+	})
+	if wait.Interrupted(err) && vol != nil {
+		return "", fmt.Errorf("volume %s attached to VM %q with device ID %q, expected VM %s", vol.ID, vol.VirtualMachineID, vol.DeviceID, vmID)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	return strconv.FormatInt(r.Deviceid, 10), nil
+	return vol.DeviceID, nil
 }
 
 func (c *client) DetachVolume(ctx context.Context, volumeID string) error {
@@ -146,11 +531,47 @@ func (c *client) DetachVolume(ctx context.Context, volumeID string) error {
 	logger.V(2).Info("CloudStack API call", "command", "DetachVolume", "params", map[string]string{
 		"id": volumeID,
 	})
-	_, err := c.Volume.DetachVolume(p)
+	err := c.retrier.do(ctx, "DetachVolume", func() error {
+		_, err := c.Volume.DetachVolume(p)
+
+		return err
+	})
+	if err != nil && isNotAttachedError(err) {
+		// The volume was detached concurrently, e.g. by a previous call
+		// that timed out: detaching is idempotent.
+		logger.Info("Volume already detached", "volumeID", volumeID, "error", err.Error())
+
+		return nil
+	}
+	if err != nil && isInvalidParameterError(err) {
+		// CloudStack also refuses to detach existing volumes with this error,
+		// e.g. from a VM with VM snapshots: the volume is only gone if it
+		// cannot be found anymore.
+		if _, getErr := c.GetVolumeByID(ctx, volumeID); errors.Is(getErr, ErrNotFound) {
+			return ErrNotFound
+		}
+	}
 
 	return err
 }
 
+// isInvalidParameterError returns true if the CloudStack error is an
+// InvalidParameterValueException, e.g. for a volume ID which does not exist,
+// or a volume which cannot be detached.
+func isInvalidParameterError(err error) bool {
+	_, csCode, ok := apiErrorCodes(err)
+
+	return ok && csCode == invalidParameterValueErrorCode
+}
+
+// isNotAttachedError returns true if the CloudStack error reports that
+// the volume is not attached to any virtual machine.
+func isNotAttachedError(err error) bool {
+	msg := strings.ToLower(err.Error())
+
+	return strings.Contains(msg, "not attached")
+}
+
 // ExpandVolume expands the volume to new size.
 func (c *client) ExpandVolume(ctx context.Context, volumeID string, newSizeInGB int64) error {
 	logger := klog.FromContext(ctx)
@@ -174,7 +595,18 @@ func (c *client) ExpandVolume(ctx context.Context, volumeID string, newSizeInGB
 		"requested_size": strconv.FormatInt(newSizeInGB, 10),
 	})
 	// Execute the API call to resize the volume.
-	_, err = c.Volume.ResizeVolume(p)
+	attempts := 0
+	err = c.retrier.do(ctx, "ResizeVolume", func() error {
+		// A failed call may still have resized the volume.
+		if attempts++; attempts > 1 {
+			if vol, err := c.GetVolumeByID(ctx, volumeID); err == nil && util.RoundUpBytesToGB(vol.Size) >= newSizeInGB {
+				return nil
+			}
+		}
+		_, err := c.Volume.ResizeVolume(p)
+
+		return err
+	})
 	if err != nil {
 		// Handle the error accordingly
 		return fmt.Errorf("failed to expand volume '%s': %w", volumeID, err)
@@ -183,7 +615,7 @@ func (c *client) ExpandVolume(ctx context.Context, volumeID string, newSizeInGB
 	return nil
 }
 
-func (c *client) CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, projectID, snapshotID string, sizeInGB int64) (*Volume, error) {
+func (c *client) CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, diskOfferingID, projectID, snapshotID string, sizeInGB int64) (*Volume, error) {
 	logger := klog.FromContext(ctx)
 
 	p := c.Volume.NewCreateVolumeParams()
@@ -192,18 +624,30 @@ func (c *client) CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, pro
 		p.SetProjectid(projectID)
 	}
 	p.SetName(name)
-	p.SetSize(sizeInGB)
+	if sizeInGB > 0 {
+		p.SetSize(sizeInGB)
+	}
 	p.SetSnapshotid(snapshotID)
+	if diskOfferingID != "" {
+		p.SetDiskofferingid(diskOfferingID)
+	}
 
 	logger.V(2).Info("CloudStack API call", "command", "CreateVolume", "params", map[string]string{
-		"name":       name,
-		"size":       strconv.FormatInt(sizeInGB, 10),
-		"snapshotid": snapshotID,
-		"projectid":  projectID,
-		"zoneid":     zoneID,
+		"name":           name,
+		"size":           strconv.FormatInt(sizeInGB, 10),
+		"snapshotid":     snapshotID,
+		"diskofferingid": diskOfferingID,
+		"projectid":      projectID,
+		"zoneid":         zoneID,
 	})
 	// Execute the API call to create volume from snapshot
-	vol, err := c.Volume.CreateVolume(p)
+	var vol *cloudstack.CreateVolumeResponse
+	err := c.retrier.doCreate(ctx, "CreateVolume", func() error {
+		var err error
+		vol, err = c.Volume.CreateVolume(p)
+
+		return err
+	})
 	if err != nil {
 		// Handle the error accordingly
 		return nil, fmt.Errorf("failed to create volume from snapshot '%s': %w", snapshotID, err)
@@ -212,14 +656,39 @@ func (c *client) CreateVolumeFromSnapshot(ctx context.Context, zoneID, name, pro
 	v := Volume{
 		ID:               vol.Id,
 		Name:             vol.Name,
-		Size:             vol.Size,
+		Size:             firstNonZero(vol.Size, vol.Virtualsize, vol.Physicalsize),
 		DiskOfferingID:   vol.Diskofferingid,
 		DomainID:         vol.Domainid,
 		ProjectID:        vol.Projectid,
 		ZoneID:           vol.Zoneid,
 		VirtualMachineID: vol.Virtualmachineid,
 		DeviceID:         strconv.FormatInt(vol.Deviceid, 10),
+		State:            vol.State,
 	}
 
 	return &v, nil
 }
+
+// CloneVolume creates a copy of a volume with the given options, in the
+// zone of the source volume. CloudStack cannot create a volume from another
+// one, so the copy goes through a temporary snapshot. The host and IOPS of
+// the options are not used.
+func (c *client) CloneVolume(ctx context.Context, sourceVolumeID string, opts *VolumeOptions) (*Volume, error) {
+	logger := klog.FromContext(ctx)
+	snapshot, err := c.CreateSnapshot(ctx, sourceVolumeID, opts.Name+"-clone")
+	if err != nil {
+		return nil, fmt.Errorf("cannot snapshot source volume '%s': %w", sourceVolumeID, err)
+	}
+	defer func() {
+		if err := c.DeleteSnapshot(ctx, snapshot.ID); err != nil {
+			logger.Error(err, "Cannot delete temporary snapshot of cloned volume", "snapshotID", snapshot.ID, "sourceVolumeID", sourceVolumeID)
+		}
+	}()
+
+	projectID := opts.ProjectID
+	if projectID == "" {
+		projectID = c.projectID
+	}
+
+	return c.CreateVolumeFromSnapshot(ctx, opts.ZoneID, opts.Name, opts.DiskOfferingID, projectID, snapshot.ID, opts.SizeInGB)
+}
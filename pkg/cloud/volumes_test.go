@@ -0,0 +1,367 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWaitForAttachment(t *testing.T) {
+	listErr := errors.New("list failed")
+
+	cases := []struct {
+		name        string
+		volumes     []Volume
+		err         error
+		expected    string
+		expectedErr bool
+	}{
+		{"attached", []Volume{{VirtualMachineID: "vm-1", DeviceID: "2"}}, nil, "2", false},
+		{"attached after a while", []Volume{{}, {VirtualMachineID: "vm-1", DeviceID: "0"}, {VirtualMachineID: "vm-1", DeviceID: "4"}}, nil, "4", false},
+		{"attached to another VM", []Volume{{VirtualMachineID: "vm-2", DeviceID: "1"}}, nil, "", true},
+		{"error", nil, listErr, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			calls := 0
+			getVolume := func(context.Context) (*Volume, error) {
+				if c.err != nil {
+					return nil, c.err
+				}
+				vol := c.volumes[min(calls, len(c.volumes)-1)]
+				vol.ID = "vol-1"
+				calls++
+
+				return &vol, nil
+			}
+
+			deviceID, err := waitForAttachment(context.Background(), getVolume, "vm-1", time.Millisecond, 50*time.Millisecond)
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error: %v, got %v", c.expectedErr, err)
+			}
+			if c.err != nil && !errors.Is(err, c.err) {
+				t.Errorf("Expected error %v, got %v", c.err, err)
+			}
+			if deviceID != c.expected {
+				t.Errorf("Expected device ID %q, got %q", c.expected, deviceID)
+			}
+		})
+	}
+}
+
+func TestDetachVolumeErrors(t *testing.T) {
+	const volumeID = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	const existingVolume = `{"listvolumesresponse":{"count":1,"volume":[{"id":"` + volumeID + `","virtualmachineid":"vm-1"}]}}`
+	const noVolume = `{"listvolumesresponse":{}}`
+
+	cases := []struct {
+		name        string
+		status      int
+		response    string
+		volumes     string
+		expectedErr error
+		expectError bool
+	}{
+		{
+			"already detached",
+			431, `{"detachvolumeresponse":{"errorcode":431,"cserrorcode":4350,"errortext":"Volume is not attached to any VM"}}`,
+			existingVolume, nil, false,
+		},
+		{
+			"volume not found",
+			431, `{"detachvolumeresponse":{"errorcode":431,"cserrorcode":4350,"errortext":"Unable to execute API command detachvolume due to invalid value. Invalid parameter id value=vol-1 due to incorrect long value format, or entity does not exist or due to incorrect parameter annotation for the field in api cmd class."}}`,
+			noVolume, ErrNotFound, true,
+		},
+		{
+			"detach refused",
+			431, `{"detachvolumeresponse":{"errorcode":431,"cserrorcode":4350,"errortext":"Unable to detach volume, please specify a VM that does not have VM snapshots"}}`,
+			existingVolume, nil, true,
+		},
+		{
+			"other error",
+			530, `{"detachvolumeresponse":{"errorcode":530,"cserrorcode":4250,"errortext":"Internal error"}}`,
+			existingVolume, nil, true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				if r.URL.Query().Get("command") == "listVolumes" {
+					_, _ = w.Write([]byte(c.volumes))
+
+					return
+				}
+				w.WriteHeader(c.status)
+				_, _ = w.Write([]byte(c.response))
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, MaxRetries: -1})
+			err := connector.DetachVolume(context.Background(), volumeID)
+			if (err != nil) != c.expectError {
+				t.Fatalf("Expected error: %v, got %v", c.expectError, err)
+			}
+			if c.expectedErr != nil && !errors.Is(err, c.expectedErr) {
+				t.Errorf("Expected %v, got %v", c.expectedErr, err)
+			}
+			if c.expectedErr == nil && errors.Is(err, ErrNotFound) {
+				t.Errorf("Expected the volume not to be reported as not found, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAttachVolumeRetry(t *testing.T) {
+	const volumeID = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	cases := []struct {
+		name                string
+		attachedOnFailure   bool
+		expectedAttachCalls int
+		expectError         bool
+	}{
+		{"attached by the failed call", true, 1, false},
+		{"not attached by the failed call", false, 2, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			attachCalls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Query().Get("command") {
+				case "attachVolume":
+					attachCalls++
+					w.WriteHeader(http.StatusServiceUnavailable)
+					_, _ = w.Write([]byte(`{"attachvolumeresponse":{"errorcode":503,"cserrorcode":9999,"errortext":"Service Unavailable"}}`))
+				case "listVolumes":
+					volume := map[string]any{"id": volumeID}
+					if c.attachedOnFailure && attachCalls > 0 {
+						volume["virtualmachineid"] = "vm-1"
+						volume["deviceid"] = 1
+					}
+					_ = json.NewEncoder(w).Encode(map[string]any{"listvolumesresponse": map[string]any{
+						"count":  1,
+						"volume": []map[string]any{volume},
+					}})
+				default:
+					t.Errorf("Unexpected request %v", r.URL.Query())
+				}
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL, MaxRetries: 1, RetryBaseDelay: time.Millisecond})
+			deviceID, err := connector.AttachVolume(context.Background(), volumeID, "vm-1")
+			if (err != nil) != c.expectError {
+				t.Fatalf("Expected error: %v, got %v", c.expectError, err)
+			}
+			if err == nil && deviceID != "1" {
+				t.Errorf("Expected device ID 1, got %q", deviceID)
+			}
+			if attachCalls != c.expectedAttachCalls {
+				t.Errorf("Expected %d attach calls, got %d", c.expectedAttachCalls, attachCalls)
+			}
+		})
+	}
+}
+
+func TestFindUnattachedVolume(t *testing.T) {
+	var projectIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("command") != "listVolumes" || q.Get("tags[0].key") != PVCTagKey || q.Get("tags[0].value") != "default/data" {
+			t.Errorf("Unexpected request %v", q)
+		}
+		projectIDs = append(projectIDs, q.Get("projectid"))
+		pvcTag := map[string]string{"key": PVCTagKey, "value": "default/data"}
+		volumes := []map[string]any{
+			{"id": "owned", "state": "Ready", "size": 5 << 30, "tags": []map[string]string{pvcTag, {"key": CSINameTagKey, "value": "pvc-1"}}},
+			{"id": "attached", "state": "Ready", "size": 5 << 30, "virtualmachineid": "vm-1", "tags": []map[string]string{pvcTag}},
+			{"id": "adoptable", "state": "Ready", "size": 5 << 30, "tags": []map[string]string{pvcTag}},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"listvolumesresponse": map[string]any{"count": len(volumes), "volume": volumes}})
+	}))
+	defer server.Close()
+
+	connector := New(&Config{APIURL: server.URL, ProjectID: "global-project"})
+	for _, projectID := range []string{"", "storage-class-project"} {
+		vol, err := connector.FindUnattachedVolume(context.Background(), "default/data", "offering-1", "zone-1", projectID, 5)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if vol.ID != "adoptable" {
+			t.Errorf("Expected volume adoptable, got %s", vol.ID)
+		}
+	}
+	if expected := []string{"global-project", "storage-class-project"}; !slices.Equal(projectIDs, expected) {
+		t.Errorf("Expected volumes listed in projects %v, got %v", expected, projectIDs)
+	}
+}
+
+func TestGetVolumeByIDInvalidID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		t.Errorf("Unexpected request %v", r.URL.Query())
+	}))
+	defer server.Close()
+
+	connector := New(&Config{APIURL: server.URL})
+	for _, volumeID := range []string{"", "volume-1", "ace9f28b-3081-40c1-8353"} {
+		if _, err := connector.GetVolumeByID(context.Background(), volumeID); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("Expected ErrInvalidID for volume ID %q, got %v", volumeID, err)
+		}
+	}
+}
+
+func TestCreateVolumeOnHost(t *testing.T) {
+	cases := []struct {
+		name              string
+		hostID            string
+		hostAddress       string
+		expectedStorageID string
+		expectedErr       error
+	}{
+		{"local storage pool", "host-1", "10.0.0.5", "pool-local", nil},
+		{"no local storage pool", "host-1", "10.0.0.6", "", ErrNotFound},
+		{"unknown host", "unknown", "", "", ErrNotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var storageID string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				var resp map[string]any
+				switch q.Get("command") {
+				case "listHosts":
+					hosts := []map[string]string{}
+					if q.Get("id") == "host-1" {
+						hosts = append(hosts, map[string]string{"id": "host-1", "clusterid": "cluster-1", "ipaddress": c.hostAddress})
+					}
+					resp = map[string]any{"listhostsresponse": map[string]any{"count": len(hosts), "host": hosts}}
+				case "listDiskOfferings":
+					resp = map[string]any{"listdiskofferingsresponse": map[string]any{
+						"count":        1,
+						"diskoffering": []map[string]string{{"id": "offering-1", "storagetype": "local"}},
+					}}
+				case "listStoragePools":
+					resp = map[string]any{"liststoragepoolsresponse": map[string]any{"count": 3, "storagepool": []map[string]string{
+						{"id": "pool-shared", "state": "Up", "scope": "ZONE"},
+						{"id": "pool-other-host", "state": "Up", "scope": "HOST", "clusterid": "cluster-1", "ipaddress": "10.0.0.7"},
+						{"id": "pool-local", "state": "Up", "scope": "HOST", "clusterid": "cluster-1", "ipaddress": "10.0.0.5"},
+					}}}
+				case "createVolume":
+					storageID = q.Get("storageid")
+					resp = map[string]any{"createvolumeresponse": map[string]any{"jobid": "job-1", "id": "volume-1"}}
+				case "queryAsyncJobResult":
+					resp = map[string]any{"queryasyncjobresultresponse": map[string]any{
+						"jobid":     q.Get("jobid"),
+						"jobstatus": 1,
+						"jobresult": map[string]any{"volume": map[string]string{"id": "volume-1"}},
+					}}
+				default:
+					t.Errorf("Unexpected request %v", q)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				_ = json.NewEncoder(w).Encode(resp)
+			}))
+			defer server.Close()
+
+			connector := New(&Config{APIURL: server.URL})
+			_, err := connector.CreateVolume(context.Background(), &VolumeOptions{
+				Name:           "pvc-1",
+				DiskOfferingID: "offering-1",
+				ZoneID:         "zone-1",
+				SizeInGB:       1,
+				HostID:         c.hostID,
+			})
+			if c.expectedErr != nil {
+				if !errors.Is(err, c.expectedErr) {
+					t.Fatalf("Expected %v, got %v", c.expectedErr, err)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if storageID != c.expectedStorageID {
+				t.Errorf("Expected volume created in storage pool %q, got %q", c.expectedStorageID, storageID)
+			}
+		})
+	}
+}
+
+func TestGetVolumeInStorageClassProject(t *testing.T) {
+	const (
+		volumeID  = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+		projectID = "storage-class-project"
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("command") != "listVolumes" {
+			t.Errorf("Unexpected request %v", q)
+		}
+		// The volume is only listed with its project, or all the projects.
+		volumes := []map[string]any{}
+		if q.Get("projectid") == projectID || q.Get("projectid") == allProjectsID {
+			volumes = append(volumes, map[string]any{
+				"id":        volumeID,
+				"name":      "pvc-1",
+				"projectid": projectID,
+				"tags":      []map[string]string{{"key": CSINameTagKey, "value": "pvc-1"}},
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"listvolumesresponse": map[string]any{"count": len(volumes), "volume": volumes}})
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	for _, globalProjectID := range []string{"", "global-project"} {
+		connector := New(&Config{APIURL: server.URL, ProjectID: globalProjectID})
+		lookups := map[string]func() (*Volume, error){
+			"by ID":   func() (*Volume, error) { return connector.GetVolumeByID(ctx, volumeID) },
+			"by name": func() (*Volume, error) { return connector.GetVolumeByName(ctx, "pvc-1") },
+			"by tag":  func() (*Volume, error) { return connector.GetVolumeByTag(ctx, CSINameTagKey, "pvc-1") },
+		}
+		for name, lookup := range lookups {
+			vol, err := lookup()
+			if err != nil {
+				t.Fatalf("Global project %q, lookup %s: unexpected error: %v", globalProjectID, name, err)
+			}
+			if vol.ID != volumeID || vol.ProjectID != projectID {
+				t.Errorf("Global project %q, lookup %s: expected volume %s in project %s, got %+v", globalProjectID, name, volumeID, projectID, vol)
+			}
+		}
+		vols, err := connector.ListVolumesByName(ctx, "pvc-1")
+		if err != nil {
+			t.Fatalf("Global project %q: unexpected error: %v", globalProjectID, err)
+		}
+		if len(vols) != 1 || vols[0].ID != volumeID {
+			t.Errorf("Global project %q: expected volume %s listed by name, got %v", globalProjectID, volumeID, vols)
+		}
+	}
+}
@@ -21,11 +21,117 @@ package cloud
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
 
 	"k8s.io/klog/v2"
 )
 
+// capacityTypeStorageAllocated is the CloudStack capacity type
+// of the allocated primary storage.
+const capacityTypeStorageAllocated = 3
+
+// zoneCache caches the IDs of the available zones, which rarely change,
+// to avoid listing them on every volume creation.
+type zoneCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	// mu is held while listing the zones, so that concurrent
+	// callers wait for a single ListZones call.
+	mu      sync.Mutex
+	zoneIDs []string
+	expiry  time.Time
+
+	// idsByName maps zone names to IDs, which never change.
+	namesMu   sync.Mutex
+	idsByName map[string]string
+}
+
+func newZoneCache(ttl time.Duration) *zoneCache {
+	if ttl == 0 {
+		ttl = DefaultZoneCacheTTL
+	}
+
+	return &zoneCache{ttl: ttl, now: time.Now, idsByName: make(map[string]string)}
+}
+
+// get returns the cached zone IDs, or lists them with list if the cache
+// is disabled, empty or expired. Errors and empty lists are not cached.
+func (z *zoneCache) get(list func() ([]string, error)) ([]string, error) {
+	if z.ttl < 0 {
+		return list()
+	}
+
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	if z.zoneIDs != nil && z.now().Before(z.expiry) {
+		return slices.Clone(z.zoneIDs), nil
+	}
+
+	zoneIDs, err := list()
+	if err != nil || len(zoneIDs) == 0 {
+		z.zoneIDs = nil
+
+		return zoneIDs, err
+	}
+	z.zoneIDs = zoneIDs
+	z.expiry = z.now().Add(z.ttl)
+
+	return slices.Clone(zoneIDs), nil
+}
+
 func (c *client) ListZonesID(ctx context.Context) ([]string, error) {
+	return c.zones.get(func() ([]string, error) {
+		return c.listZonesID(ctx)
+	})
+}
+
+// GetZoneIDByName returns the ID of the zone with the given name.
+// It returns ErrTooManyResults if several zones, e.g. dedicated to
+// different domains, have this name.
+func (c *client) GetZoneIDByName(ctx context.Context, name string) (string, error) {
+	c.zones.namesMu.Lock()
+	defer c.zones.namesMu.Unlock()
+	if zoneID, ok := c.zones.idsByName[name]; ok {
+		return zoneID, nil
+	}
+
+	logger := klog.FromContext(ctx)
+	p := c.Zone.NewListZonesParams()
+	p.SetName(name)
+	p.SetAvailable(true)
+	logger.V(2).Info("CloudStack API call", "command", "ListZones", "params", map[string]string{
+		"name":      name,
+		"available": "true",
+	})
+	r, err := c.Zone.ListZones(p)
+	if err != nil {
+		return "", err
+	}
+	// The name filter of listZones is a keyword search.
+	var zoneIDs []string
+	for _, zone := range r.Zones {
+		if zone.Name == name {
+			zoneIDs = append(zoneIDs, zone.Id)
+		}
+	}
+	switch len(zoneIDs) {
+	case 0:
+		return "", ErrNotFound
+	case 1:
+		c.zones.idsByName[name] = zoneIDs[0]
+
+		return zoneIDs[0], nil
+	default:
+		return "", ErrTooManyResults
+	}
+}
+
+func (c *client) listZonesID(ctx context.Context) ([]string, error) {
 	logger := klog.FromContext(ctx)
 	result := make([]string, 0)
 	p := c.Zone.NewListZonesParams()
@@ -43,3 +149,32 @@ func (c *client) ListZonesID(ctx context.Context) ([]string, error) {
 
 	return result, nil
 }
+
+// GetZoneCapacity returns the primary storage capacity, in bytes,
+// still available for allocation in the zone.
+func (c *client) GetZoneCapacity(ctx context.Context, zoneID string) (int64, error) {
+	logger := klog.FromContext(ctx)
+	p := c.SystemCapacity.NewListCapacityParams()
+	p.SetZoneid(zoneID)
+	p.SetType(capacityTypeStorageAllocated)
+	logger.V(2).Info("CloudStack API call", "command", "ListCapacity", "params", map[string]string{
+		"zoneid": zoneID,
+		"type":   fmt.Sprint(capacityTypeStorageAllocated),
+	})
+	r, err := c.SystemCapacity.ListCapacity(p)
+	if err != nil {
+		return 0, err
+	}
+	if r.Count == 0 {
+		return 0, ErrNotFound
+	}
+
+	var available int64
+	for _, capacity := range r.Capacity {
+		if capacity.Zoneid == zoneID && capacity.Capacitytotal > capacity.Capacityused {
+			available += capacity.Capacitytotal - capacity.Capacityused
+		}
+	}
+
+	return available, nil
+}
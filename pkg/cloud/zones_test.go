@@ -0,0 +1,100 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package cloud
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestZoneCache(t *testing.T) {
+	now := time.Now()
+	cache := newZoneCache(time.Minute)
+	cache.now = func() time.Time { return now }
+
+	calls := 0
+	zoneIDs := []string{"zone-1", "zone-2"}
+	var listErr error
+	list := func() ([]string, error) {
+		calls++
+
+		return zoneIDs, listErr
+	}
+
+	get := func(expectedCalls int, expected []string) {
+		t.Helper()
+		got, err := cache.get(list)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !slices.Equal(got, expected) {
+			t.Errorf("Expected zones %v, got %v", expected, got)
+		}
+		if calls != expectedCalls {
+			t.Errorf("Expected %d ListZones calls, got %d", expectedCalls, calls)
+		}
+	}
+
+	get(1, []string{"zone-1", "zone-2"})
+	// Cached.
+	zoneIDs = []string{"zone-3"}
+	get(1, []string{"zone-1", "zone-2"})
+
+	// Expired.
+	now = now.Add(time.Minute)
+	get(2, []string{"zone-3"})
+
+	// An error invalidates the cache.
+	now = now.Add(time.Minute)
+	listErr = errors.New("unavailable")
+	if _, err := cache.get(list); err == nil {
+		t.Fatal("Expected an error")
+	}
+	listErr = nil
+	zoneIDs = []string{"zone-4"}
+	get(4, []string{"zone-4"})
+
+	// Empty lists are not cached.
+	now = now.Add(time.Minute)
+	zoneIDs = []string{}
+	get(5, []string{})
+	zoneIDs = []string{"zone-5"}
+	get(6, []string{"zone-5"})
+}
+
+func TestZoneCacheDisabled(t *testing.T) {
+	cache := newZoneCache(-1)
+	calls := 0
+	list := func() ([]string, error) {
+		calls++
+
+		return []string{"zone-1"}, nil
+	}
+	for range 3 {
+		if _, err := cache.get(list); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("Expected 3 ListZones calls, got %d", calls)
+	}
+}
@@ -0,0 +1,94 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"slices"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// maxCachedConnectors bounds the number of cached per-request connectors,
+// so that the connectors of rotated credentials are eventually dropped.
+const maxCachedConnectors = 32
+
+// connectorCache holds the CloudStack connectors built from per-request
+// credentials passed in CSI secrets, keyed by the hash of their configuration.
+// The least recently used connector is evicted beyond maxCachedConnectors.
+type connectorCache struct {
+	newConnector func(*cloud.Config) cloud.Interface
+
+	mu         sync.Mutex
+	connectors map[string]cloud.Interface
+	// keys are the keys of connectors, from the least to the most recently used.
+	keys []string
+}
+
+func newConnectorCache(newConnector func(*cloud.Config) cloud.Interface) *connectorCache {
+	return &connectorCache{
+		newConnector: newConnector,
+		connectors:   make(map[string]cloud.Interface),
+	}
+}
+
+// get returns the connector for the given configuration, creating it if needed.
+func (c *connectorCache) get(config *cloud.Config) cloud.Interface {
+	key := config.Hash()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	connector, ok := c.connectors[key]
+	if ok {
+		c.keys = slices.DeleteFunc(c.keys, func(k string) bool { return k == key })
+	} else {
+		connector = c.newConnector(config)
+		c.connectors[key] = connector
+		if len(c.keys) >= maxCachedConnectors {
+			delete(c.connectors, c.keys[0])
+			c.keys = c.keys[1:]
+		}
+	}
+	c.keys = append(c.keys, key)
+
+	return connector
+}
+
+// connectorFor returns the CloudStack connector to use for a request:
+// one using the credentials passed in the request secrets if any, with
+// the other settings of the driver-wide configuration, the driver-wide
+// connector otherwise.
+func (cs *controllerServer) connectorFor(secrets map[string]string) (cloud.Interface, error) {
+	config, err := cloud.ConfigFromSecrets(secrets, cs.cloudConfig)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid CloudStack credentials in secrets: %v", err)
+	}
+	if config == nil {
+		return cs.connector, nil
+	}
+	if config.UserAgent == "" {
+		config.UserAgent = UserAgent()
+	}
+
+	return cs.connectors.get(config), nil
+}
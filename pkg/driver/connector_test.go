@@ -0,0 +1,229 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+// newTestControllerServer returns a controller server whose per-request
+// connectors are fakes, recording the configurations they were built from.
+func newTestControllerServer(defaultConnector cloud.Interface) (*controllerServer, *[]*cloud.Config) {
+	cs, _ := NewControllerServer(defaultConnector, &Options{}).(*controllerServer)
+	configs := &[]*cloud.Config{}
+	cs.connectors = newConnectorCache(func(config *cloud.Config) cloud.Interface {
+		*configs = append(*configs, config)
+
+		return fake.New()
+	})
+
+	return cs, configs
+}
+
+func tenantSecrets(apiKey string) map[string]string {
+	return map[string]string{
+		cloud.SecretAPIURL:    "https://cloudstack.example.com/client/api",
+		cloud.SecretAPIKey:    apiKey,
+		cloud.SecretSecretKey: "secret-" + apiKey,
+	}
+}
+
+func TestConnectorForWithoutSecrets(t *testing.T) {
+	defaultConnector := fake.New()
+	cs, configs := newTestControllerServer(defaultConnector)
+
+	connector, err := cs.connectorFor(nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if connector != defaultConnector {
+		t.Error("Expected the default connector")
+	}
+	if len(*configs) != 0 {
+		t.Errorf("Expected no connector to be created, got %d", len(*configs))
+	}
+}
+
+func TestConnectorForSecretsCached(t *testing.T) {
+	defaultConnector := fake.New()
+	cs, configs := newTestControllerServer(defaultConnector)
+
+	tenantA, err := cs.connectorFor(tenantSecrets("tenant-a"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tenantA == defaultConnector {
+		t.Fatal("Expected a per-request connector, got the default one")
+	}
+	again, _ := cs.connectorFor(tenantSecrets("tenant-a"))
+	if again != tenantA {
+		t.Error("Expected the cached connector for the same credentials")
+	}
+	tenantB, _ := cs.connectorFor(tenantSecrets("tenant-b"))
+	if tenantB == tenantA {
+		t.Error("Expected a different connector for different credentials")
+	}
+
+	if len(*configs) != 2 {
+		t.Fatalf("Expected 2 connectors to be created, got %d", len(*configs))
+	}
+	if c := (*configs)[0]; c.APIKey != "tenant-a" || c.SecretKey != "secret-tenant-a" || !c.VerifySSL {
+		t.Errorf("Unexpected configuration %+v", c)
+	}
+}
+
+func TestConnectorForSecretsKeepsSettings(t *testing.T) {
+	cs, configs := newTestControllerServer(fake.New())
+	cs.cloudConfig = &cloud.Config{
+		APIURL:     "https://cloudstack.example.com/client/api",
+		APIKey:     "driver",
+		SecretKey:  "secret-driver",
+		VerifySSL:  true,
+		ProjectID:  "driver-project",
+		ClusterID:  "cluster-1",
+		MaxRetries: 5,
+		ListAll:    true,
+	}
+
+	if _, err := cs.connectorFor(tenantSecrets("tenant-a")); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(*configs) != 1 {
+		t.Fatalf("Expected 1 connector to be created, got %d", len(*configs))
+	}
+	c := (*configs)[0]
+	if c.APIKey != "tenant-a" || c.SecretKey != "secret-tenant-a" || c.ProjectID != "" {
+		t.Errorf("Expected the credentials of the secrets, got %+v", c)
+	}
+	if c.ClusterID != "cluster-1" || c.MaxRetries != 5 || !c.ListAll {
+		t.Errorf("Expected the other settings of the driver configuration, got %+v", c)
+	}
+	if cs.cloudConfig.APIKey != "driver" {
+		t.Errorf("Expected the driver configuration to be unchanged, got %+v", cs.cloudConfig)
+	}
+}
+
+func TestConnectorCacheEviction(t *testing.T) {
+	cs, configs := newTestControllerServer(fake.New())
+
+	first, _ := cs.connectorFor(tenantSecrets("tenant-0"))
+	for i := 1; i < maxCachedConnectors; i++ {
+		_, _ = cs.connectorFor(tenantSecrets(fmt.Sprintf("tenant-%d", i)))
+	}
+	// Using the first connector makes tenant-1 the least recently used.
+	if again, _ := cs.connectorFor(tenantSecrets("tenant-0")); again != first {
+		t.Error("Expected the cached connector of tenant-0")
+	}
+	_, _ = cs.connectorFor(tenantSecrets("rotated"))
+	if len(cs.connectors.connectors) != maxCachedConnectors {
+		t.Errorf("Expected %d cached connectors, got %d", maxCachedConnectors, len(cs.connectors.connectors))
+	}
+	if again, _ := cs.connectorFor(tenantSecrets("tenant-0")); again != first {
+		t.Error("Expected the recently used connector of tenant-0 to be kept")
+	}
+	created := len(*configs)
+	_, _ = cs.connectorFor(tenantSecrets("tenant-1"))
+	if len(*configs) != created+1 {
+		t.Error("Expected the least recently used connector of tenant-1 to be evicted")
+	}
+}
+
+func TestConnectorForInvalidSecrets(t *testing.T) {
+	cs, _ := newTestControllerServer(fake.New())
+
+	cases := map[string]map[string]string{
+		"missing secret key": {
+			cloud.SecretAPIURL: "https://cloudstack.example.com/client/api",
+			cloud.SecretAPIKey: "tenant-a",
+		},
+		"invalid ssl-no-verify": {
+			cloud.SecretAPIURL:      "https://cloudstack.example.com/client/api",
+			cloud.SecretAPIKey:      "tenant-a",
+			cloud.SecretSecretKey:   "secret-tenant-a",
+			cloud.SecretSSLNoVerify: "maybe",
+		},
+	}
+	for name, secrets := range cases {
+		t.Run(name, func(t *testing.T) {
+			_, err := cs.connectorFor(secrets)
+			if status.Code(err) != codes.InvalidArgument {
+				t.Fatalf("Expected InvalidArgument error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeUsesSecretsConnector(t *testing.T) {
+	ctx := context.Background()
+	defaultConnector := fake.New()
+	cs, _ := newTestControllerServer(defaultConnector)
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+
+	_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: volumeID,
+		Secrets:  tenantSecrets("tenant-a"),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if _, err := defaultConnector.GetVolumeByID(ctx, volumeID); err != nil {
+		t.Errorf("Expected volume to be kept by the default connector, got %v", err)
+	}
+	tenantA, _ := cs.connectorFor(tenantSecrets("tenant-a"))
+	if _, err := tenantA.GetVolumeByID(ctx, volumeID); err == nil {
+		t.Error("Expected volume to be deleted with the tenant connector")
+	}
+}
+
+func TestSecretsNotLogged(t *testing.T) {
+	logger := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.BufferLogs(true), ktesting.Verbosity(6)))
+	ctx := klog.NewContext(context.Background(), logger)
+	cs, _ := newTestControllerServer(fake.New())
+
+	_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		Secrets:  tenantSecrets("tenant-a"),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	underlier, _ := logger.GetSink().(ktesting.Underlier)
+	logs := underlier.GetBuffer().String()
+	if !strings.Contains(logs, "DeleteVolume: called") {
+		t.Fatalf("Expected the request to be logged, got:\n%s", logs)
+	}
+	if strings.Contains(logs, "secret-tenant-a") {
+		t.Errorf("Expected secrets to be stripped from logs, got:\n%s", logs)
+	}
+}
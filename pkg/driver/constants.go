@@ -19,6 +19,12 @@
 
 package driver
 
+import (
+	"time"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
 // DriverName is the name of the CSI plugin.
 const DriverName = "csi.cloudstack.apache.org"
 
@@ -38,8 +44,34 @@ const (
 // constants for default command line flag values.
 const (
 	// DefaultCSIEndpoint is the default CSI endpoint for the driver.
-	DefaultCSIEndpoint             = "unix://tmp/csi.sock"
-	DefaultMaxVolAttachLimit int64 = 256
+	DefaultCSIEndpoint                   = "unix://tmp/csi.sock"
+	DefaultMaxVolAttachLimit       int64 = 256
+	DefaultStageMountRetries             = 3
+	DefaultExpandDeviceRetries           = 5
+	DefaultDeviceCacheTTL                = time.Minute
+	DefaultCustomVolumeSize        int64 = 1
+	DefaultInvalidSnapshotToken          = InvalidTokenAbort
+	DefaultNodeDeletionGracePeriod       = time.Minute
+	DefaultVolumeSnapshotsOnDelete       = VolumeSnapshotsRefuse
+	DefaultCapacityMode                  = string(cloud.CapacityAllocated)
+)
+
+// Behaviors of ListSnapshots when given an invalid starting token.
+const (
+	// InvalidTokenAbort returns an Aborted error.
+	InvalidTokenAbort = "abort"
+	// InvalidTokenRestart lists snapshots from the beginning.
+	InvalidTokenRestart = "restart"
+	// InvalidTokenEmpty returns an empty list.
+	InvalidTokenEmpty = "empty"
+)
+
+// Behaviors of DeleteVolume when the volume has snapshots.
+const (
+	// VolumeSnapshotsRefuse returns a FailedPrecondition error.
+	VolumeSnapshotsRefuse = "refuse"
+	// VolumeSnapshotsDelete deletes the snapshots before the volume.
+	VolumeSnapshotsDelete = "delete"
 )
 
 // Filesystem types.
@@ -56,13 +88,74 @@ const (
 
 // Topology keys.
 const (
-	ZoneKey = "topology." + DriverName + "/zone"
-	HostKey = "topology." + DriverName + "/host"
+	ZoneKey    = "topology." + DriverName + "/zone"
+	ClusterKey = "topology." + DriverName + "/cluster"
+	HostKey    = "topology." + DriverName + "/host"
+)
+
+// Plugin info manifest keys.
+const (
+	topologyKeysManifestKey = "topologyKeys"
+	// cloudStackVersionManifestKey holds the version of the CloudStack management server.
+	cloudStackVersionManifestKey = "cloudStackVersion"
 )
 
 // Volume parameters keys.
 const (
 	DiskOfferingKey = DriverName + "/disk-offering-id"
+	ProjectIDKey    = DriverName + "/project-id"
+
+	// ZoneParamKey is the ID or name of the zone of the volumes,
+	// when not set by topology requirements.
+	ZoneParamKey = "zone"
+
+	// EncryptedKey requires an encrypted disk offering when set to "true".
+	EncryptedKey = "encrypted"
+
+	// MinIopsKey and MaxIopsKey are the IOPS of the volumes of custom IOPS
+	// disk offerings.
+	MinIopsKey = "minIops"
+	MaxIopsKey = "maxIops"
+
+	// TagKeyPrefix prefixes the parameters holding CloudStack tags of the
+	// volumes, e.g. "tag-team: storage" sets the tag team=storage.
+	TagKeyPrefix = "tag-"
+	// RequireTagsKey makes failing to set these tags fatal when set to "true".
+	RequireTagsKey = "requireTags"
+
+	// MkfsOptionsKey holds comma-separated mkfs.ext* extended options
+	// (-E) used when formatting the volumes, e.g. "nodiscard,lazy_itable_init=1".
+	MkfsOptionsKey = "mkfsOptions"
+
+	// AdoptExistingKey makes CreateVolume adopt an unattached volume tagged
+	// with the PersistentVolumeClaim of the request, of its disk offering,
+	// zone, project and size, not owned by a CSI volume, instead of creating
+	// one, when set to "true".
+	AdoptExistingKey = "adoptExisting"
+
+	// RequireSizeKey makes CreateVolume fail, when set to "true", if no size
+	// is requested for a volume with a custom disk offering.
+	RequireSizeKey = "requireSize"
+
+	// FsckBeforeMountKey makes the node check, and repair if safe, the
+	// filesystem of the volumes before mounting them when set to "true".
+	FsckBeforeMountKey = "fsckBeforeMount"
+
+	// PVNameKey, PVCNameKey and PVCNamespaceKey are set by the
+	// external-provisioner with --extra-create-metadata.
+	PVNameKey       = "csi.storage.k8s.io/pv/name"
+	PVCNameKey      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespaceKey = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// Snapshot parameters keys.
+const (
+	// SnapshotTagsKey holds comma-separated key=value CloudStack tags
+	// set on the snapshots of a VolumeSnapshotClass.
+	SnapshotTagsKey = "snapshot-tags"
 )
 
-const deviceIDContextKey = "deviceID"
+// Publish context keys.
+const (
+	deviceIDContextKey = "deviceID"
+)
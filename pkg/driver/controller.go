@@ -21,11 +21,13 @@ package driver
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"math/rand"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -33,12 +35,17 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
 
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/util"
 )
 
+// listZonesRetryDelay is the initial delay between two zone listings,
+// when CloudStack transiently reports no zone (e.g. while restarting).
+const listZonesRetryDelay = time.Second
+
 // onlyVolumeCapAccessMode is the only volume capability access
 // mode possible for CloudStack: SINGLE_NODE_WRITER, since a
 // CloudStack volume can only be attached to a single node at
@@ -58,21 +65,128 @@ type controllerServer struct {
 
 	// A map storing all volumes/snapshots with ongoing operations.
 	operationLocks *util.OperationLock
+
+	// invalidSnapshotToken is the behavior of ListSnapshots on an invalid starting token.
+	invalidSnapshotToken string
+
+	// listSnapshotsFallback enables listing all snapshots when a scoped listing fails.
+	listSnapshotsFallback bool
+
+	// managedSnapshotsOnly enables ignoring the snapshots not created by the driver.
+	managedSnapshotsOnly bool
+
+	// deleteVolumeSnapshots enables deleting the snapshots of a volume in DeleteVolume,
+	// instead of refusing to delete it.
+	deleteVolumeSnapshots bool
+	// snapshotReferences lists the snapshots that must not be deleted with
+	// their volume (nil if the snapshots are not deleted).
+	snapshotReferences snapshotReferenceLister
+
+	// maxDeviceSlots is the number of device slots available on a node (0 if unknown).
+	maxDeviceSlots int
+
+	// compactDeviceIDs enables attaching volumes at the lowest free device ID.
+	compactDeviceIDs bool
+
+	// checkZoneCapacity enables the zone capacity pre-check in CreateVolume.
+	checkZoneCapacity bool
+
+	// maxCustomVolumeSize is the maximum size in GB of a volume with a custom disk offering (0 if unknown).
+	maxCustomVolumeSize int64
+
+	// defaultCustomVolumeSize is the size in GB of a volume with a custom disk offering when no size is requested.
+	defaultCustomVolumeSize int64
+
+	// failoverDetach enables detaching volumes from stopped or absent VMs in ControllerPublishVolume.
+	failoverDetach bool
+
+	// sizeIncrements are the size increments in GB of disk offerings, by disk offering ID.
+	sizeIncrements map[string]int64
+
+	// zoneDiskOfferings are the disk offerings allowed in a zone, by zone ID.
+	// Zones absent from the map allow any disk offering.
+	zoneDiskOfferings map[string]map[string]bool
+
+	// volumeNameTemplate is the template of the names of new volumes (empty for the CSI name).
+	volumeNameTemplate string
+
+	// snapshotSlots limits the number of concurrent snapshot creations (nil if unlimited).
+	snapshotSlots chan struct{}
+
+	// maxSnapshotsPerVolume is the maximum number of snapshots of a volume (0 if unlimited).
+	maxSnapshotsPerVolume int
+
+	// snapshotTimeout bounds the wait for the creation of a snapshot (0 if unbounded).
+	snapshotTimeout time.Duration
+
+	// capacityMode is how GetCapacity computes the available capacity of storage pools.
+	capacityMode cloud.CapacityMode
+
+	// adoptMu serializes the adoptions of existing volumes, so that a volume
+	// is not adopted by two CSI volumes.
+	adoptMu sync.Mutex
+
+	// connectors caches the CloudStack connectors built from credentials passed in CSI secrets.
+	connectors *connectorCache
+	// cloudConfig is the driver-wide CloudStack configuration, whose
+	// credentials are replaced by those passed in CSI secrets.
+	cloudConfig *cloud.Config
+
+	// listZonesBackoff bounds the retries of ListZonesID when no zone is returned.
+	listZonesBackoff wait.Backoff
+
+	// storageScopeTopology enables restricting the topology of volumes to the clusters of their storage.
+	storageScopeTopology bool
 }
 
 // NewControllerServer creates a new Controller gRPC server.
-func NewControllerServer(connector cloud.Interface) csi.ControllerServer {
-	return &controllerServer{
-		connector:      connector,
-		volumeLocks:    util.NewVolumeLocks(),
-		operationLocks: util.NewOperationLock(),
+func NewControllerServer(connector cloud.Interface, options *Options) csi.ControllerServer {
+	cs := &controllerServer{
+		connector:               connector,
+		volumeLocks:             util.NewVolumeLocks(),
+		operationLocks:          util.NewOperationLock(),
+		invalidSnapshotToken:    options.InvalidSnapshotToken,
+		listSnapshotsFallback:   options.ListSnapshotsFallback,
+		managedSnapshotsOnly:    options.ManagedSnapshotsOnly,
+		deleteVolumeSnapshots:   options.VolumeSnapshotsOnDelete == VolumeSnapshotsDelete,
+		maxDeviceSlots:          options.MaxDeviceSlots,
+		compactDeviceIDs:        options.CompactDeviceIDs,
+		checkZoneCapacity:       options.CheckZoneCapacity,
+		maxCustomVolumeSize:     options.MaxCustomVolumeSize,
+		defaultCustomVolumeSize: options.DefaultCustomVolumeSize,
+		failoverDetach:          options.FailoverDetach,
+		zoneDiskOfferings:       make(map[string]map[string]bool),
+		volumeNameTemplate:      options.VolumeNameTemplate,
+		maxSnapshotsPerVolume:   options.MaxSnapshotsPerVolume,
+		snapshotTimeout:         options.SnapshotTimeout,
+		capacityMode:            cloud.CapacityMode(options.CapacityMode),
+		sizeIncrements:          options.SizeIncrements,
+		connectors:              newConnectorCache(cloud.New),
+		cloudConfig:             options.CloudStack,
+		listZonesBackoff: wait.Backoff{
+			Duration: listZonesRetryDelay,
+			Factor:   2,
+			Steps:    3,
+		},
+		storageScopeTopology: options.StorageScopeTopology,
+	}
+	if options.MaxConcurrentSnapshots > 0 {
+		cs.snapshotSlots = make(chan struct{}, options.MaxConcurrentSnapshots)
+	}
+	for zoneID, diskOfferingIDs := range options.ZoneDiskOfferings {
+		cs.zoneDiskOfferings[zoneID] = make(map[string]bool)
+		for _, diskOfferingID := range strings.Split(diskOfferingIDs, ":") {
+			cs.zoneDiskOfferings[zoneID][diskOfferingID] = true
+		}
 	}
+
+	return cs
 }
 
 //nolint:gocognit
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("CreateVolume: called", "args", *req)
+	logger.V(6).Info("CreateVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check arguments.
 
@@ -85,9 +199,6 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if len(volCaps) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities missing in request")
 	}
-	if !isValidVolumeCapabilities(volCaps) {
-		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not supported. Only SINGLE_NODE_WRITER supported.")
-	}
 
 	if req.GetParameters() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume parameters missing in request")
@@ -96,6 +207,22 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if diskOfferingID == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "Missing parameter %v", DiskOfferingKey)
 	}
+	minIops, maxIops, err := parseIops(req.GetParameters())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if _, err := parseMkfsOptions(req.GetParameters()[MkfsOptionsKey]); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid %s parameter: %v", MkfsOptionsKey, err)
+	}
+
+	if reason := volumeCapabilitiesError(volCaps); reason != "" {
+		return nil, status.Errorf(codes.InvalidArgument, "Volume capabilities not supported: %s", reason)
+	}
+
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
 
 	if acquired := cs.volumeLocks.TryAcquire(name); !acquired {
 		logger.Error(errors.New(util.ErrVolumeOperationAlreadyExistsVolumeName), "failed to acquire volume lock", "volumeName", name)
@@ -104,40 +231,64 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 	defer cs.volumeLocks.Release(name)
 
+	// Log the time spent in each provisioning phase.
+	timer := newPhaseTimer()
+	defer func() {
+		logger.V(4).Info("CreateVolume: provisioning latency", append([]any{"name", name}, timer.keysAndValues()...)...)
+	}()
+
+	volumeName, err := cs.volumeName(ctx, connector, req)
+	if err != nil {
+		return nil, err
+	}
+
 	// Check if a volume with that name already exists.
-	vol, err := cs.connector.GetVolumeByName(ctx, name)
+	vol, err := findVolume(ctx, connector, name, volumeName)
+	timer.done("lookup")
 	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, err
+		}
 		if !errors.Is(err, cloud.ErrNotFound) {
 			// Error with CloudStack
 			return nil, status.Errorf(codes.Internal, "CloudStack error: %v", err)
 		}
 	} else {
 		// The volume exists. Check if it suits the request.
-		if ok, message := checkVolumeSuitable(vol, diskOfferingID, req.GetCapacityRange(), req.GetAccessibilityRequirements()); !ok {
+		zoneIDs, err := resolveTopologyZones(ctx, connector, &csi.TopologyRequirement{Requisite: req.GetAccessibilityRequirements().GetRequisite()})
+		if err != nil {
+			return nil, err
+		}
+		if ok, message := checkVolumeSuitable(vol, diskOfferingID, req.GetCapacityRange(), zoneIDs); !ok {
 			return nil, status.Errorf(codes.AlreadyExists, "Volume %v already exists but does not satisfy request: %s", name, message)
 		}
 		// Existing volume is ok.
+		topologies, err := cs.volumeTopology(ctx, connector, vol.ZoneID, vol.DiskOfferingID)
+		if err != nil {
+			return nil, err
+		}
 		resp := &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
 				VolumeId:      vol.ID,
 				CapacityBytes: vol.Size,
 				VolumeContext: req.GetParameters(),
 				// ContentSource: req.GetVolumeContentSource(), TODO: snapshot support.
-				AccessibleTopology: []*csi.Topology{
-					Topology{ZoneID: vol.ZoneID}.ToCSI(),
-				},
+				AccessibleTopology: topologies,
 			},
 		}
 
 		return resp, nil
 	}
 
-	// Check if this is a volume from snapshot
-	var snapshotID string
+	// Check if this is a volume from snapshot, or a clone
+	var snapshotID, sourceVolumeID string
 	if src := req.GetVolumeContentSource(); src != nil {
 		if snap := src.GetSnapshot(); snap != nil {
 			snapshotID = snap.GetSnapshotId()
 		}
+		if srcVol := src.GetVolume(); srcVol != nil {
+			sourceVolumeID = srcVol.GetVolumeId()
+		}
 	}
 
 	// We have to create the volume.
@@ -148,13 +299,39 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
+	offering, err := connector.GetDiskOffering(ctx, diskOfferingID)
+	timer.done("offeringLookup")
+	if errors.Is(err, cloud.ErrNotFound) {
+		return nil, status.Errorf(codes.InvalidArgument, "Disk offering %s not found", diskOfferingID)
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get disk offering %s: %v", diskOfferingID, err)
+	}
+	if req.GetParameters()[EncryptedKey] == "true" {
+		// An unknown version is not fatal: the disk offering check remains.
+		if version, err := connector.GetCloudStackVersion(ctx); err != nil {
+			logger.Error(err, "Cannot get CloudStack version")
+		} else if !cloud.VersionAtLeast(version, cloud.MinEncryptionVersion) {
+			return nil, status.Errorf(codes.InvalidArgument, "Volume encryption requires CloudStack %s or later, got %s", cloud.MinEncryptionVersion, version)
+		}
+		if !offering.Encrypt {
+			return nil, status.Errorf(codes.InvalidArgument, "Disk offering %s does not support encryption", diskOfferingID)
+		}
+	}
+	if (minIops > 0 || maxIops > 0) && !offering.IsCustomizedIops {
+		logger.Info("Ignoring IOPS of a disk offering without custom IOPS", "offering", diskOfferingID, "minIops", minIops, "maxIops", maxIops)
+		minIops, maxIops = 0, 0
+	}
+
 	// If creating from snapshot, get the snapshot size
 	var snapshotSizeGiB int64
 	if snapshotID != "" {
 		logger.Info("Creating volume from snapshot", "snapshotID", snapshotID)
-		// Call the cloud connector's CreateVolumeFromSnapshot if implemented
-		printVolumeAsJSON(req)
-		snapshot, err := cs.connector.GetSnapshotByID(ctx, snapshotID)
+		snapshot, err := connector.GetSnapshotByID(ctx, snapshotID)
+		timer.done("snapshotLookup")
+		if err == nil && cs.managedSnapshotsOnly && !snapshot.IsManaged() {
+			logger.Info("Ignoring snapshot not created by the driver", "snapshotID", snapshotID)
+			err = cloud.ErrNotFound
+		}
 		if errors.Is(err, cloud.ErrNotFound) {
 			return nil, status.Errorf(codes.NotFound, "Snapshot %v not found", snapshotID)
 		} else if err != nil {
@@ -168,92 +345,499 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			logger.Info("Snapshot size is greater than the request PVC, creating volume from snapshot of size", "snapshot size:", snapshotSizeGiB)
 			sizeInGB = snapshotSizeGiB
 		}
+		if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && util.GigaBytesToBytes(sizeInGB) > limit {
+			return nil, status.Errorf(codes.OutOfRange, "Snapshot %s of %d GB exceeds the limit specified of %d bytes", snapshotID, sizeInGB, limit)
+		}
+
+		// The restored volume uses the disk offering of the storage class,
+		// which may differ from the one of the source volume.
+		if err := cs.checkCustomSize(offering, sizeInGB); err != nil {
+			return nil, err
+		}
+		if !offering.IsCustomized && offering.DiskSize < sizeInGB {
+			return nil, status.Errorf(codes.InvalidArgument, "Disk offering %s has a fixed size of %d GB, too small for a volume of %d GB from snapshot %s",
+				diskOfferingID, offering.DiskSize, sizeInGB, snapshotID)
+		}
+
+		if !offering.IsCustomized {
+			// The size of a fixed offering is set by CloudStack.
+			sizeInGB = 0
+		}
+
+		if err := cs.checkZoneDiskOffering(snapshot.ZoneID, diskOfferingID); err != nil {
+			return nil, err
+		}
+		topologies, err := cs.volumeTopology(ctx, connector, snapshot.ZoneID, diskOfferingID)
+		if err != nil {
+			return nil, err
+		}
 
-		volFromSnapshot, err := cs.connector.CreateVolumeFromSnapshot(ctx, snapshot.ZoneID, name, snapshot.ProjectID, snapshotID, sizeInGB)
+		volFromSnapshot, err := connector.CreateVolumeFromSnapshot(ctx, snapshot.ZoneID, volumeName, diskOfferingID, snapshot.ProjectID, snapshotID, sizeInGB)
+		timer.done("create")
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Cannot create volume from snapshot %s: %v", snapshotID, err.Error())
+			return nil, creationError(err, "Cannot create volume from snapshot %s", snapshotID)
+		}
+		if err := tagNewVolume(ctx, connector, volFromSnapshot.ID, name, req.GetParameters()); err != nil {
+			return nil, err
 		}
 
 		resp := &csi.CreateVolumeResponse{
 			Volume: &csi.Volume{
-				VolumeId:      volFromSnapshot.ID,
-				CapacityBytes: volFromSnapshot.Size,
-				VolumeContext: req.GetParameters(),
-				ContentSource: req.GetVolumeContentSource(),
-				AccessibleTopology: []*csi.Topology{
-					Topology{ZoneID: volFromSnapshot.ZoneID}.ToCSI(),
-				},
+				VolumeId:           volFromSnapshot.ID,
+				CapacityBytes:      volFromSnapshot.Size,
+				VolumeContext:      req.GetParameters(),
+				ContentSource:      req.GetVolumeContentSource(),
+				AccessibleTopology: topologies,
 			},
 		}
 
 		return resp, nil
 	}
 
+	if sourceVolumeID != "" {
+		return cs.cloneVolume(ctx, connector, req, volumeName, sourceVolumeID, offering, sizeInGB, timer)
+	}
+
+	if offering.IsCustomized && req.GetCapacityRange().GetRequiredBytes() == 0 {
+		if sizeInGB, err = cs.defaultCustomSize(req, offering); err != nil {
+			return nil, err
+		}
+	}
+	if err := cs.checkCustomSize(offering, sizeInGB); err != nil {
+		return nil, err
+	}
+	// The size of a fixed offering is set by CloudStack, and must not be passed.
+	createSizeInGB := sizeInGB
+	if !offering.IsCustomized {
+		if err := checkFixedSize(offering, req.GetCapacityRange()); err != nil {
+			return nil, err
+		}
+		sizeInGB = offering.DiskSize
+		createSizeInGB = 0
+	}
+
 	// Determine zone using topology constraints.
-	var zoneID string
+	var zoneID, hostID string
 	topologyRequirement := req.GetAccessibilityRequirements()
-	if topologyRequirement == nil || topologyRequirement.GetRequisite() == nil { //nolint:nestif
+	if zone := req.GetParameters()[ZoneParamKey]; zone != "" && len(topologyRequirement.GetRequisite()) == 0 {
+		topologyRequirement = &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{Topology{ZoneID: zone}.ToCSI()},
+		}
+	}
+	switch {
+	case cs.checkZoneCapacity:
+		zoneID, err = cs.selectZoneWithCapacity(ctx, connector, topologyRequirement, sizeInGB)
+		if err != nil {
+			return nil, err
+		}
+		// The requisite topologies only select a host within a single zone.
+		if t, err := requisiteTopology(topologyRequirement); err == nil && t.HostID != "" {
+			if requisiteZoneID, err := resolveZoneID(ctx, connector, t.ZoneID); err == nil && requisiteZoneID == zoneID {
+				hostID = t.HostID
+			}
+		}
+	case topologyRequirement == nil || topologyRequirement.GetRequisite() == nil:
 		// No topology requirement. Use random zone.
-		zones, err := cs.connector.ListZonesID(ctx)
+		zones, err := cs.listZones(ctx, connector)
+		if err != nil {
+			return nil, err
+		}
+		zoneID = zones[rand.Intn(len(zones))] //nolint:gosec
+	default:
+		t, err := requisiteTopology(topologyRequirement)
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
-		n := len(zones)
-		if n == 0 {
-			return nil, status.Error(codes.Internal, "No zone available")
+		zoneID, err = resolveZoneID(ctx, connector, t.ZoneID)
+		if err != nil {
+			return nil, zoneError(t.ZoneID, err)
 		}
-		zoneID = zones[rand.Intn(n)] //nolint:gosec
-	} else {
-		reqTopology := topologyRequirement.GetRequisite()
-		if len(reqTopology) > 1 {
-			return nil, status.Error(codes.InvalidArgument, "Too many topology requirements")
+		hostID = t.HostID
+	}
+
+	if err := cs.checkZoneDiskOffering(zoneID, diskOfferingID); err != nil {
+		return nil, err
+	}
+	// Only volumes on the local storage of a host are pinned to it. The
+	// host of the nodes is in their topology, and in the requirements of
+	// all the volumes: a volume on shared storage satisfies them if the
+	// host can access its storage pools.
+	if !offering.LocalStorage && hostID != "" {
+		if err := checkHostSharedStorage(ctx, connector, zoneID, hostID, diskOfferingID); err != nil {
+			return nil, err
+		}
+		hostID = ""
+	}
+	var topologies []*csi.Topology
+	if hostID != "" {
+		if minIops > 0 || maxIops > 0 {
+			logger.Info("Ignoring IOPS of a volume on the local storage of a host", "offering", diskOfferingID, "minIops", minIops, "maxIops", maxIops)
 		}
-		t, err := NewTopology(reqTopology[0])
+		topologies = []*csi.Topology{Topology{ZoneID: zoneID, HostID: hostID}.ToCSI()}
+	} else {
+		topologies, err = cs.volumeTopology(ctx, connector, zoneID, diskOfferingID)
 		if err != nil {
-			return nil, status.Error(codes.InvalidArgument, "Cannot parse topology requirements")
+			return nil, err
+		}
+	}
+	timer.done("zone")
+
+	if req.GetParameters()[AdoptExistingKey] == "true" {
+		resp, err := cs.adoptVolume(ctx, connector, req, zoneID, sizeInGB, topologies)
+		if resp != nil || err != nil {
+			return resp, err
 		}
-		zoneID = t.ZoneID
 	}
 
+	projectID := req.GetParameters()[ProjectIDKey]
 	logger.Info("Creating new volume",
 		"name", name,
+		"volumeName", volumeName,
 		"size", sizeInGB,
 		"offering", diskOfferingID,
 		"zone", zoneID,
+		"host", hostID,
+		"project", projectID,
 	)
 
-	volID, err := cs.connector.CreateVolume(ctx, diskOfferingID, zoneID, name, sizeInGB)
+	opts := &cloud.VolumeOptions{
+		Name:           volumeName,
+		DiskOfferingID: diskOfferingID,
+		ZoneID:         zoneID,
+		ProjectID:      projectID,
+		SizeInGB:       createSizeInGB,
+		HostID:         hostID,
+	}
+	if hostID == "" {
+		opts.MinIops, opts.MaxIops = minIops, maxIops
+	}
+	volID, err := connector.CreateVolume(ctx, opts)
+	if hostID != "" && errors.Is(err, cloud.ErrNotFound) {
+		return nil, status.Errorf(codes.InvalidArgument, "Host %s in zone %s has no local storage for disk offering %s", hostID, zoneID, diskOfferingID)
+	}
+	// The CloudStack client waits for the completion of the asynchronous
+	// job, so this includes the post-create wait.
+	timer.done("create")
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Cannot create volume %s: %v", name, err.Error())
+		return nil, creationError(err, "Cannot create volume %s", name)
+	}
+	if err := tagNewVolume(ctx, connector, volID, name, req.GetParameters()); err != nil {
+		return nil, err
+	}
+
+	// Report the actual size of the volume, as when it already exists,
+	// in case CloudStack did not create it with the requested size.
+	capacityBytes := util.GigaBytesToBytes(sizeInGB)
+	if vol, err := connector.GetVolumeByID(ctx, volID); err != nil {
+		logger.Error(err, "Cannot get the size of the new volume, reporting the requested size", "volumeID", volID)
+	} else if vol.Size > 0 {
+		capacityBytes = vol.Size
 	}
 
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      volID,
-			CapacityBytes: util.GigaBytesToBytes(sizeInGB),
-			VolumeContext: req.GetParameters(),
-			ContentSource: req.GetVolumeContentSource(),
-			AccessibleTopology: []*csi.Topology{
-				Topology{ZoneID: zoneID}.ToCSI(),
-			},
+			VolumeId:           volID,
+			CapacityBytes:      capacityBytes,
+			VolumeContext:      req.GetParameters(),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topologies,
 		},
 	}
 
 	return resp, nil
 }
 
-func printVolumeAsJSON(vol *csi.CreateVolumeRequest) {
-	b, err := json.MarshalIndent(vol, "", "  ")
+// adoptVolume tags an unattached volume matching the request as the CSI
+// volume, and returns it, or nil if there is none. Only a volume tagged with
+// the PersistentVolumeClaim of the request, in its project, is adopted.
+func (cs *controllerServer) adoptVolume(ctx context.Context, connector cloud.Interface, req *csi.CreateVolumeRequest, zoneID string, sizeInGB int64, topologies []*csi.Topology) (*csi.CreateVolumeResponse, error) {
+	params := req.GetParameters()
+	pvcName, pvcNamespace := params[PVCNameKey], params[PVCNamespaceKey]
+	if pvcName == "" || pvcNamespace == "" {
+		klog.FromContext(ctx).Info("Not adopting a volume without the PersistentVolumeClaim of the request, requires --extra-create-metadata on the external-provisioner", "name", req.GetName())
+
+		return nil, nil //nolint:nilnil
+	}
+
+	cs.adoptMu.Lock()
+	defer cs.adoptMu.Unlock()
+
+	diskOfferingID := params[DiskOfferingKey]
+	vol, err := connector.FindUnattachedVolume(ctx, pvcNamespace+"/"+pvcName, diskOfferingID, zoneID, params[ProjectIDKey], sizeInGB)
+	if errors.Is(err, cloud.ErrNotFound) {
+		return nil, nil //nolint:nilnil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot look for a volume to adopt: %v", err)
+	}
+	klog.FromContext(ctx).Info("Adopting existing volume", "name", req.GetName(), "volumeID", vol.ID, "volumeName", vol.Name)
+
+	// The CSI name tag lets retries find the volume, and keeps it from
+	// being adopted again: failing to set it is fatal.
+	if err := connector.CreateTags(ctx, cloud.ResourceTypeVolume, vol.ID, volumeTags(req.GetName(), req.GetParameters())); err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot tag adopted volume %s: %v", vol.ID, err)
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           vol.ID,
+			CapacityBytes:      vol.Size,
+			VolumeContext:      req.GetParameters(),
+			AccessibleTopology: topologies,
+		},
+	}, nil
+}
+
+// creationError returns the status of a CloudStack call allocating
+// resources: ResourceExhausted, naming the scope of the limit, if an account
+// or domain resource limit is exceeded, so that they can be told apart,
+// Internal otherwise.
+func creationError(err error, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if scope, ok := cloud.ResourceLimitScope(err); ok {
+		return status.Errorf(codes.ResourceExhausted, "%s: %s resource limit exceeded: %v", msg, scope, err)
+	}
+
+	return status.Errorf(codes.Internal, "%s: %v", msg, err)
+}
+
+// volumeTopology returns the accessible topology of a volume of the disk
+// offering in the zone: the zone, restricted to the clusters accessing the
+// storage of the offering if it is not zone-wide.
+func (cs *controllerServer) volumeTopology(ctx context.Context, connector cloud.Interface, zoneID, diskOfferingID string) ([]*csi.Topology, error) {
+	if !cs.storageScopeTopology {
+		return []*csi.Topology{Topology{ZoneID: zoneID}.ToCSI()}, nil
+	}
+	clusterIDs, err := connector.GetStorageClusterIDs(ctx, zoneID, diskOfferingID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get the storage scope of disk offering %s in zone %s: %v", diskOfferingID, zoneID, err)
+	}
+	if len(clusterIDs) == 0 {
+		return []*csi.Topology{Topology{ZoneID: zoneID}.ToCSI()}, nil
+	}
+
+	topologies := make([]*csi.Topology, 0, len(clusterIDs))
+	for _, clusterID := range clusterIDs {
+		topologies = append(topologies, Topology{ZoneID: zoneID, ClusterID: clusterID}.ToCSI())
+	}
+
+	return topologies, nil
+}
+
+// parseIops returns the minimum and maximum IOPS set in the parameters
+// of a storage class, 0 if not set.
+func parseIops(params map[string]string) (int64, int64, error) {
+	var iops [2]int64
+	for i, key := range []string{MinIopsKey, MaxIopsKey} {
+		v, ok := params[key]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, fmt.Errorf("invalid parameter %s: %q, must be a non-negative integer", key, v)
+		}
+		iops[i] = n
+	}
+	if iops[0] > 0 && iops[1] > 0 && iops[0] > iops[1] {
+		return 0, 0, fmt.Errorf("parameter %s must not be greater than %s", MinIopsKey, MaxIopsKey)
+	}
+
+	return iops[0], iops[1], nil
+}
+
+// selectZoneWithCapacity returns the first zone allowed by the topology
+// requirement, preferred zones first, with enough primary storage available
+// for a volume of sizeInGB. Without requirement, all zones are allowed,
+// in random order.
+func (cs *controllerServer) selectZoneWithCapacity(ctx context.Context, connector cloud.Interface,
+	topologyRequirement *csi.TopologyRequirement, sizeInGB int64,
+) (string, error) {
+	logger := klog.FromContext(ctx)
+
+	zones, err := topologyZones(topologyRequirement)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, "Cannot parse topology requirements")
+	}
+	if len(zones) == 0 {
+		zones, err = cs.listZones(ctx, connector)
+		if err != nil {
+			return "", err
+		}
+		rand.Shuffle(len(zones), func(i, j int) { zones[i], zones[j] = zones[j], zones[i] }) //nolint:gosec
+	}
+
+	for _, zone := range zones {
+		zoneID, err := resolveZoneID(ctx, connector, zone)
+		if err != nil {
+			return "", zoneError(zone, err)
+		}
+		available, err := connector.GetZoneCapacity(ctx, zoneID)
+		if err != nil {
+			return "", status.Errorf(codes.Internal, "Cannot get capacity of zone %s: %v", zoneID, err)
+		}
+		if available >= util.GigaBytesToBytes(sizeInGB) {
+			return zoneID, nil
+		}
+		logger.Info("Not enough capacity in zone",
+			"zone", zoneID,
+			"availableBytes", available,
+			"size", sizeInGB,
+		)
+	}
+
+	return "", status.Errorf(codes.ResourceExhausted, "Not enough capacity for a volume of %d GB in zones %v", sizeInGB, zones)
+}
+
+// checkHostSharedStorage returns an InvalidArgument error if a volume of the
+// shared storage of a disk offering cannot be pinned to a host, because the
+// host cannot access the cluster-wide storage pools of the offering.
+func checkHostSharedStorage(ctx context.Context, connector cloud.Interface, zoneID, hostID, diskOfferingID string) error {
+	clusterIDs, err := connector.GetStorageClusterIDs(ctx, zoneID, diskOfferingID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get the storage scope of disk offering %s in zone %s: %v", diskOfferingID, zoneID, err)
+	}
+	if len(clusterIDs) == 0 {
+		// Zone-wide storage is accessible from all the hosts of the zone.
+		return nil
+	}
+	clusterID, err := connector.GetHostClusterID(ctx, hostID)
+	if errors.Is(err, cloud.ErrNotFound) {
+		return status.Errorf(codes.InvalidArgument, "Host %s not found", hostID)
+	} else if err != nil {
+		return status.Errorf(codes.Internal, "Cannot get the cluster of host %s: %v", hostID, err)
+	}
+	if !slices.Contains(clusterIDs, clusterID) {
+		return status.Errorf(codes.InvalidArgument, "Disk offering %s is on shared storage, which host %s cannot access", diskOfferingID, hostID)
+	}
+
+	return nil
+}
+
+// zoneError converts an error resolving the ID of a zone to a gRPC error.
+func zoneError(zone string, err error) error {
+	if errors.Is(err, cloud.ErrTooManyResults) {
+		return status.Errorf(codes.InvalidArgument, "Several zones are named %s, use the zone ID instead", zone)
+	}
+
+	return status.Errorf(codes.Internal, "Cannot get zone %s: %v", zone, err)
+}
+
+// topologyZones returns the zones allowed by a topology requirement:
+// the preferred zones first, then the other requisite zones.
+func topologyZones(topologyRequirement *csi.TopologyRequirement) ([]string, error) {
+	zones := make([]string, 0)
+	for _, topologies := range [][]*csi.Topology{topologyRequirement.GetPreferred(), topologyRequirement.GetRequisite()} {
+		for _, topology := range topologies {
+			t, err := NewTopology(topology)
+			if err != nil {
+				return nil, err
+			}
+			if !slices.Contains(zones, t.ZoneID) {
+				zones = append(zones, t.ZoneID)
+			}
+		}
+	}
+
+	return zones, nil
+}
+
+// resolveTopologyZones returns the IDs of the zones allowed by a topology
+// requirement, whose zones may be given by ID or by name.
+func resolveTopologyZones(ctx context.Context, connector cloud.Interface, topologyRequirement *csi.TopologyRequirement) ([]string, error) {
+	zones, err := topologyZones(topologyRequirement)
 	if err != nil {
-		klog.Errorf("Failed to marshal CreateVolumeRequest to JSON: %v", err)
+		return nil, status.Error(codes.InvalidArgument, "Cannot parse topology requirements")
+	}
+	zoneIDs := make([]string, 0, len(zones))
+	for _, zone := range zones {
+		zoneID, err := resolveZoneID(ctx, connector, zone)
+		if err != nil {
+			return nil, zoneError(zone, err)
+		}
+		zoneIDs = append(zoneIDs, zoneID)
+	}
+
+	return zoneIDs, nil
+}
+
+// phaseTimer measures the duration of the successive phases of an operation.
+type phaseTimer struct {
+	start, last time.Time
+	durations   []any
+}
+
+func newPhaseTimer() *phaseTimer {
+	now := time.Now()
+
+	return &phaseTimer{start: now, last: now}
+}
+
+// done records the end of a phase, started at the end of the previous one.
+func (t *phaseTimer) done(phase string) {
+	now := time.Now()
+	t.durations = append(t.durations, phase+"Duration", now.Sub(t.last))
+	t.last = now
+}
+
+// keysAndValues returns the phase durations and the total duration, as log fields.
+func (t *phaseTimer) keysAndValues() []any {
+	return append(slices.Clone(t.durations), "totalDuration", time.Since(t.start))
+}
 
-		return
+// findVolume returns the volume created for the given CSI name. It is looked
+// up by tag first, as CloudStack may have truncated the volume name, then by
+// its CloudStack name for volumes created before the tag was set.
+func findVolume(ctx context.Context, connector cloud.Interface, name, volumeName string) (*cloud.Volume, error) {
+	vol, err := connector.GetVolumeByTag(ctx, cloud.CSINameTagKey, name)
+	if !errors.Is(err, cloud.ErrNotFound) {
+		return vol, err
 	}
-	klog.V(5).Infof("CreateVolumeRequest as JSON:\n%s", string(b))
+
+	return findVolumeByName(ctx, connector, volumeName)
 }
 
+// findVolumeByName returns the volume with the given name. When several
+// volumes share the name (e.g. created by other tools), only the one
+// managed by the driver is considered.
+func findVolumeByName(ctx context.Context, connector cloud.Interface, name string) (*cloud.Volume, error) {
+	vol, err := connector.GetVolumeByName(ctx, name)
+	if !errors.Is(err, cloud.ErrTooManyResults) {
+		return vol, err
+	}
+
+	vols, err := connector.ListVolumesByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	managed := make([]*cloud.Volume, 0, 1)
+	ids := make([]string, 0, len(vols))
+	for _, v := range vols {
+		ids = append(ids, v.ID)
+		if v.Name == name && v.IsManaged() {
+			managed = append(managed, v)
+		}
+	}
+	klog.FromContext(ctx).Info("Several volumes with the same name",
+		"name", name,
+		"volumeIDs", ids,
+		"managed", len(managed),
+	)
+
+	switch len(managed) {
+	case 0:
+		return nil, cloud.ErrNotFound
+	case 1:
+		return managed[0], nil
+	default:
+		return nil, status.Errorf(codes.AlreadyExists,
+			"Several volumes named %s are managed by the driver (%v): delete or rename the extra ones in CloudStack", name, ids)
+	}
+}
+
+// checkVolumeSuitable checks that an existing volume suits a request, whose
+// requisite zones are given by ID.
 func checkVolumeSuitable(vol *cloud.Volume,
-	diskOfferingID string, capRange *csi.CapacityRange, topologyRequirement *csi.TopologyRequirement,
+	diskOfferingID string, capRange *csi.CapacityRange, requisiteZoneIDs []string,
 ) (bool, string) {
 	if vol.DiskOfferingID != diskOfferingID {
 		return false, fmt.Sprintf("Disk offering %s; requested disk offering %s", vol.DiskOfferingID, diskOfferingID)
@@ -263,26 +847,282 @@ func checkVolumeSuitable(vol *cloud.Volume,
 		if capRange.GetLimitBytes() > 0 && vol.Size > capRange.GetLimitBytes() {
 			return false, fmt.Sprintf("Disk size %v bytes > requested limit size %v bytes", vol.Size, capRange.GetLimitBytes())
 		}
-		if capRange.GetRequiredBytes() > 0 && vol.Size < capRange.GetRequiredBytes() {
-			return false, fmt.Sprintf("Disk size %v bytes < requested required size %v bytes", vol.Size, capRange.GetRequiredBytes())
+		// Volumes are created with a size in GB: compare sizes in GB, since
+		// the size reported by CloudStack may differ by rounding.
+		if required := capRange.GetRequiredBytes(); required > 0 && util.RoundUpBytesToGB(vol.Size) < util.RoundUpBytesToGB(required) {
+			return false, fmt.Sprintf("Disk size %v bytes < requested required size %v bytes", vol.Size, required)
+		}
+	}
+
+	if len(requisiteZoneIDs) > 0 && !slices.Contains(requisiteZoneIDs, vol.ZoneID) {
+		return false, fmt.Sprintf("Volume in zone %s, requested zones are %v", vol.ZoneID, requisiteZoneIDs)
+	}
+
+	return true, ""
+}
+
+// cloneVolume creates a volume as a copy of the source volume, with the disk
+// offering and project of the storage class, in the zone of the source
+// volume since CloudStack volumes cannot be copied across zones.
+func (cs *controllerServer) cloneVolume(ctx context.Context, connector cloud.Interface, req *csi.CreateVolumeRequest,
+	volumeName, sourceVolumeID string, offering *cloud.DiskOffering, sizeInGB int64, timer *phaseTimer,
+) (*csi.CreateVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	logger.Info("Cloning volume", "sourceVolumeID", sourceVolumeID)
+
+	source, err := connector.GetVolumeByID(ctx, sourceVolumeID)
+	if isVolumeNotFound(err) {
+		return nil, status.Errorf(codes.NotFound, "Source volume %v not found", sourceVolumeID)
+	} else if err != nil {
+		// Error with CloudStack
+		return nil, status.Errorf(codes.Internal, "Error %v", err)
+	}
+
+	zones, err := resolveTopologyZones(ctx, connector, req.GetAccessibilityRequirements())
+	if err != nil {
+		return nil, err
+	}
+	if len(zones) > 0 && !slices.Contains(zones, source.ZoneID) {
+		return nil, status.Errorf(codes.InvalidArgument, "Source volume %s is in zone %s, not in requested zones %v",
+			sourceVolumeID, source.ZoneID, zones)
+	}
+	if err := cs.checkZoneDiskOffering(source.ZoneID, offering.ID); err != nil {
+		return nil, err
+	}
+	topologies, err := cs.volumeTopology(ctx, connector, source.ZoneID, offering.ID)
+	if err != nil {
+		return nil, err
+	}
+	timer.done("zone")
+
+	if sourceSizeGiB := util.RoundUpBytesToGB(source.Size); sourceSizeGiB > sizeInGB {
+		logger.Info("Source volume is larger than the request, cloning with the size of the source", "size", sourceSizeGiB)
+		sizeInGB = sourceSizeGiB
+	}
+	if err := cs.checkCustomSize(offering, sizeInGB); err != nil {
+		return nil, err
+	}
+	if !offering.IsCustomized {
+		if offering.DiskSize < sizeInGB {
+			return nil, status.Errorf(codes.InvalidArgument, "Disk offering %s has a fixed size of %d GB, too small for a clone of %d GB of volume %s",
+				offering.ID, offering.DiskSize, sizeInGB, sourceVolumeID)
+		}
+		// The size of a fixed offering is set by CloudStack.
+		sizeInGB = 0
+	}
+
+	vol, err := connector.CloneVolume(ctx, sourceVolumeID, &cloud.VolumeOptions{
+		Name:           volumeName,
+		DiskOfferingID: offering.ID,
+		ZoneID:         source.ZoneID,
+		ProjectID:      req.GetParameters()[ProjectIDKey],
+		SizeInGB:       sizeInGB,
+	})
+	timer.done("create")
+	if err != nil {
+		return nil, creationError(err, "Cannot clone volume %s", sourceVolumeID)
+	}
+	if err := tagNewVolume(ctx, connector, vol.ID, req.GetName(), req.GetParameters()); err != nil {
+		return nil, err
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:           vol.ID,
+			CapacityBytes:      vol.Size,
+			VolumeContext:      req.GetParameters(),
+			ContentSource:      req.GetVolumeContentSource(),
+			AccessibleTopology: topologies,
+		},
+	}, nil
+}
+
+// parseSnapshotTags parses the comma-separated key=value tags of the
+// snapshot-tags parameter.
+func parseSnapshotTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil //nolint:nilnil
+	}
+	tags := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("expected key=value, got %q", pair)
 		}
+		tags[key] = strings.TrimSpace(value)
 	}
 
-	if topologyRequirement != nil && topologyRequirement.GetRequisite() != nil {
-		reqTopology := topologyRequirement.GetRequisite()
-		if len(reqTopology) > 1 {
-			return false, "Too many topology requirements"
+	return tags, nil
+}
+
+// volumeTags returns the CloudStack tags of the volume with the given CSI
+// name: its CSI name, for idempotency, the names of its PersistentVolume
+// and PersistentVolumeClaim, if passed by the external-provisioner, so that
+// the volume can be found without the Kubernetes API, and the parameters of
+// the storage class prefixed with tag-.
+func volumeTags(name string, params map[string]string) map[string]string {
+	tags := map[string]string{cloud.CSINameTagKey: name}
+	if pvName := params[PVNameKey]; pvName != "" {
+		tags[cloud.PVNameTagKey] = pvName
+	}
+	if pvcName, pvcNamespace := params[PVCNameKey], params[PVCNamespaceKey]; pvcName != "" && pvcNamespace != "" {
+		tags[cloud.PVCTagKey] = pvcNamespace + "/" + pvcName
+	}
+	for key, value := range params {
+		if tagKey, ok := strings.CutPrefix(key, TagKeyPrefix); ok && tagKey != "" {
+			tags[tagKey] = value
 		}
-		t, err := NewTopology(reqTopology[0])
+	}
+
+	return tags
+}
+
+// tagNewVolume sets the tags of volumeTags on a volume created by the driver,
+// with the tag marking it as managed by the driver. Failing to tag it is only
+// fatal with the requireTags parameter: the volume is then deleted, so that a
+// retry creates it again with its tags. Otherwise retries find the untagged
+// volume by name.
+func tagNewVolume(ctx context.Context, connector cloud.Interface, volumeID, name string, params map[string]string) error {
+	logger := klog.FromContext(ctx)
+	tags := volumeTags(name, params)
+	tags[cloud.ManagedByTagKey] = cloud.ManagedByTagValue
+	err := connector.CreateTags(ctx, cloud.ResourceTypeVolume, volumeID, tags)
+	if err == nil {
+		return nil
+	}
+	if params[RequireTagsKey] != "true" {
+		logger.Error(err, "Cannot tag volume", "volumeID", volumeID, "tags", tags)
+
+		return nil
+	}
+
+	if deleteErr := connector.DeleteVolume(ctx, volumeID); deleteErr != nil {
+		logger.Error(deleteErr, "Cannot delete volume which could not be tagged", "volumeID", volumeID)
+	}
+
+	return status.Errorf(codes.Internal, "Cannot tag volume %s: %v", volumeID, err)
+}
+
+// isVolumeNotFound returns true if the error of a volume lookup means that
+// the volume does not exist, including when its ID is not a CloudStack ID.
+func isVolumeNotFound(err error) bool {
+	return errors.Is(err, cloud.ErrNotFound) || errors.Is(err, cloud.ErrInvalidID)
+}
+
+// isVMDown returns true if the VM is absent, or in a state where it
+// cannot write to its volumes.
+func isVMDown(ctx context.Context, connector cloud.Interface, vmID string) (bool, error) {
+	vm, err := connector.GetVMByID(ctx, vmID)
+	if errors.Is(err, cloud.ErrNotFound) {
+		return true, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch vm.State {
+	case "Stopped", "Destroyed", "Expunging":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// listZones returns the IDs of the zones, retrying for a short while if
+// there is none: CloudStack may transiently report no zone while restarting.
+func (cs *controllerServer) listZones(ctx context.Context, connector cloud.Interface) ([]string, error) {
+	var zones []string
+	err := wait.ExponentialBackoffWithContext(ctx, cs.listZonesBackoff, func(ctx context.Context) (bool, error) {
+		var err error
+		zones, err = connector.ListZonesID(ctx)
 		if err != nil {
-			return false, "Cannot parse topology requirements"
+			return false, err
 		}
-		if t.ZoneID != vol.ZoneID {
-			return false, fmt.Sprintf("Volume in zone %s, requested zone is %s", vol.ZoneID, t.ZoneID)
+		if len(zones) == 0 {
+			klog.FromContext(ctx).Info("No zone available, retrying")
+
+			return false, nil
 		}
+
+		return true, nil
+	})
+	if wait.Interrupted(err) {
+		return nil, status.Error(codes.Unavailable, "No zone available")
+	} else if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	return true, ""
+	return zones, nil
+}
+
+// checkCustomSize checks that CloudStack accepts a volume of sizeInGB
+// with the given disk offering: the size of a custom offering is a whole
+// number of GB, between 1 and the custom.diskoffering.size.max setting.
+func (cs *controllerServer) checkCustomSize(offering *cloud.DiskOffering, sizeInGB int64) error {
+	if !offering.IsCustomized {
+		return nil
+	}
+	if sizeInGB < 1 {
+		return status.Errorf(codes.OutOfRange, "Invalid size %d GB for custom disk offering %s", sizeInGB, offering.ID)
+	}
+	if cs.maxCustomVolumeSize > 0 && sizeInGB > cs.maxCustomVolumeSize {
+		return status.Errorf(codes.OutOfRange, "Size %d GB exceeds the maximum of %d GB for custom disk offering %s",
+			sizeInGB, cs.maxCustomVolumeSize, offering.ID)
+	}
+
+	return nil
+}
+
+// defaultCustomSize returns the size in GB of a volume with a custom disk
+// offering when no size is requested: the default size, unless it exceeds
+// the requested limit, or an InvalidArgument error if the storage class
+// requires an explicit size.
+func (cs *controllerServer) defaultCustomSize(req *csi.CreateVolumeRequest, offering *cloud.DiskOffering) (int64, error) {
+	if req.GetParameters()[RequireSizeKey] == "true" {
+		return 0, status.Errorf(codes.InvalidArgument, "A size is required for volumes with custom disk offering %s", offering.ID)
+	}
+	sizeInGB := max(cs.defaultCustomVolumeSize, 1)
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit > 0 && util.GigaBytesToBytes(sizeInGB) > limit {
+		sizeInGB = 1
+	}
+
+	return sizeInGB, nil
+}
+
+// checkZoneDiskOffering checks that the disk offering is allowed in the zone.
+func (cs *controllerServer) checkZoneDiskOffering(zoneID, diskOfferingID string) error {
+	allowed, ok := cs.zoneDiskOfferings[zoneID]
+	if !ok || allowed[diskOfferingID] {
+		return nil
+	}
+
+	return status.Errorf(codes.InvalidArgument, "Disk offering %s is not allowed in zone %s", diskOfferingID, zoneID)
+}
+
+// offeringMaxSize returns the maximum size in GB of the volumes of a disk
+// offering, or 0 if unknown.
+func (cs *controllerServer) offeringMaxSize(offering *cloud.DiskOffering) int64 {
+	if !offering.IsCustomized || offering.DiskSizeStrict {
+		return offering.DiskSize
+	}
+
+	return cs.maxCustomVolumeSize
+}
+
+// checkFixedSize checks that the size of a fixed disk offering
+// is within the requested capacity range.
+func checkFixedSize(offering *cloud.DiskOffering, capRange *csi.CapacityRange) error {
+	size := util.GigaBytesToBytes(offering.DiskSize)
+	if required := capRange.GetRequiredBytes(); required > size {
+		return status.Errorf(codes.InvalidArgument, "Disk offering %s has a fixed size of %d GB, smaller than the required %d bytes",
+			offering.ID, offering.DiskSize, required)
+	}
+	if limit := capRange.GetLimitBytes(); limit > 0 && limit < size {
+		return status.Errorf(codes.InvalidArgument, "Disk offering %s has a fixed size of %d GB, larger than the limit of %d bytes",
+			offering.ID, offering.DiskSize, limit)
+	}
+
+	return nil
 }
 
 func determineSize(req *csi.CreateVolumeRequest) (int64, error) {
@@ -313,7 +1153,7 @@ func determineSize(req *csi.CreateVolumeRequest) (int64, error) {
 
 func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(4).Info("DeleteVolume: called", "args", *req)
+	logger.V(4).Info("DeleteVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -321,6 +1161,11 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 
 	volumeID := req.GetVolumeId()
 
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
 	if acquired := cs.volumeLocks.TryAcquire(volumeID); !acquired {
 		logger.Error(errors.New(util.ErrVolumeOperationAlreadyExistsVolumeID), "failed to acquire volume lock", "volumeID", volumeID)
 
@@ -336,16 +1181,73 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	}
 	defer cs.operationLocks.ReleaseDeleteLock(volumeID)
 
+	if _, err := connector.GetVolumeByID(ctx, volumeID); isVolumeNotFound(err) {
+		return &csi.DeleteVolumeResponse{}, nil
+	} else if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get volume %s: %v", volumeID, err)
+	}
+	if err := cs.deleteVolumeSnapshotsOf(ctx, connector, volumeID); err != nil {
+		return nil, err
+	}
+
 	logger.Info("Deleting volume",
 		"volumeID", volumeID,
 	)
 
-	err := cs.connector.DeleteVolume(ctx, volumeID)
+	err = connector.DeleteVolume(ctx, volumeID)
 	if err != nil && !errors.Is(err, cloud.ErrNotFound) {
 		return nil, status.Errorf(codes.Internal, "Cannot delete volume %s: %s", volumeID, err.Error())
 	}
 
-	return &csi.DeleteVolumeResponse{}, nil
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// deleteVolumeSnapshotsOf deletes the snapshots of a volume before deleting it,
+// or fails with FailedPrecondition if it has snapshots and their deletion is
+// not enabled, to avoid losing them by surprise. Only the snapshots created
+// by the driver are considered, and those still referenced by
+// VolumeSnapshotContents are never deleted: the volume is deleted once their
+// VolumeSnapshots are.
+func (cs *controllerServer) deleteVolumeSnapshotsOf(ctx context.Context, connector cloud.Interface, volumeID string) error {
+	snapshots, err := connector.ListSnapshots(ctx, volumeID, "")
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot list snapshots of volume %s: %v", volumeID, err)
+	}
+	snapshotIDs := make([]string, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		if snapshot.IsManaged() {
+			snapshotIDs = append(snapshotIDs, snapshot.ID)
+		}
+	}
+	if len(snapshotIDs) == 0 {
+		return nil
+	}
+	if !cs.deleteVolumeSnapshots || cs.snapshotReferences == nil {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s has snapshots: %s", volumeID, strings.Join(snapshotIDs, ", "))
+	}
+
+	references, err := cs.snapshotReferences.ListSnapshotReferences(ctx)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot check the snapshots of volume %s: %v", volumeID, err)
+	}
+	var referenced []string
+	for _, snapshotID := range snapshotIDs {
+		if references[snapshotID] {
+			referenced = append(referenced, snapshotID)
+		}
+	}
+	if len(referenced) > 0 {
+		return status.Errorf(codes.FailedPrecondition, "Volume %s has snapshots referenced by VolumeSnapshotContents: %s", volumeID, strings.Join(referenced, ", "))
+	}
+
+	for _, snapshotID := range snapshotIDs {
+		klog.FromContext(ctx).Info("Deleting snapshot of volume", "volumeID", volumeID, "snapshotID", snapshotID)
+		if err := connector.DeleteSnapshot(ctx, snapshotID); err != nil && !errors.Is(err, cloud.ErrNotFound) {
+			return status.Errorf(codes.Internal, "Cannot delete snapshot %s of volume %s: %v", snapshotID, volumeID, err)
+		}
+	}
+
+	return nil
 }
 
 func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
@@ -360,9 +1262,14 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
 	}
 
-	volume, err := cs.connector.GetVolumeByID(ctx, volumeID)
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	volume, err := connector.GetVolumeByID(ctx, volumeID)
 	if err != nil {
-		if err.Error() == "invalid volume ID: empty string" {
+		if errors.Is(err, cloud.ErrInvalidID) {
 			return nil, status.Error(codes.InvalidArgument, "Invalid volume ID")
 		}
 		if errors.Is(err, cloud.ErrNotFound) {
@@ -372,14 +1279,72 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		return nil, status.Errorf(codes.Internal, "Error %v", err)
 	}
 
+	// The external-snapshotter calls CreateSnapshot again until the snapshot
+	// is ready: return the snapshot created by a previous call.
+	existing, err := connector.GetSnapshotByName(ctx, req.GetName())
+	switch {
+	case err == nil && existing.VolumeID != volume.ID:
+		return nil, status.Errorf(codes.AlreadyExists, "Snapshot name conflict: already exists for a different source volume")
+	case err == nil:
+		klog.FromContext(ctx).V(4).Info("Snapshot already exists", "snapshotID", existing.ID, "volumeID", volume.ID)
+
+		return newCreateSnapshotResponse(existing, volume.ID)
+	case !errors.Is(err, cloud.ErrNotFound):
+		return nil, status.Errorf(codes.Internal, "Cannot look up snapshot %s: %v", req.GetName(), err)
+	}
+
+	// CloudStack only snapshots Ready volumes: an Allocated volume was
+	// never attached, and has no data on a primary storage yet.
+	if volume.State != "" && volume.State != "Ready" {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s cannot be snapshotted in state %s", volume.ID, volume.State)
+	}
+
+	release, err := cs.acquireSnapshotSlot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	tags, err := parseSnapshotTags(req.GetParameters()[SnapshotTagsKey])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid %s parameter: %v", SnapshotTagsKey, err)
+	}
+
+	if err := cs.checkSnapshotLimit(ctx, connector, volume.ID, req.GetName()); err != nil {
+		return nil, err
+	}
+
 	klog.V(4).Infof("CreateSnapshot of volume: %s", volume.ID)
-	snapshot, err := cs.connector.CreateSnapshot(ctx, volume.ID, req.GetName())
-	if errors.Is(err, cloud.ErrAlreadyExists) {
+	createCtx := ctx
+	if cs.snapshotTimeout > 0 {
+		var cancel context.CancelFunc
+		createCtx, cancel = context.WithTimeout(ctx, cs.snapshotTimeout)
+		defer cancel()
+	}
+	snapshot, err := connector.CreateSnapshot(createCtx, volume.ID, req.GetName())
+	switch {
+	case errors.Is(err, cloud.ErrAlreadyExists):
 		return nil, status.Errorf(codes.AlreadyExists, "Snapshot name conflict: already exists for a different source volume")
-	} else if err != nil {
-		return nil, status.Errorf(codes.Internal, "Failed to create snapshot for volume %s: %v", volume.ID, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return nil, status.Errorf(codes.DeadlineExceeded, "Snapshot of volume %s not created in time: %v", volume.ID, err)
+	case errors.Is(err, context.Canceled):
+		return nil, status.Errorf(codes.Canceled, "Snapshot of volume %s canceled: %v", volume.ID, err)
+	case err != nil:
+		return nil, creationError(err, "Failed to create snapshot for volume %s", volume.ID)
+	}
+
+	if len(tags) > 0 {
+		if err := connector.TagSnapshot(ctx, snapshot.ID, tags); err != nil {
+			klog.FromContext(ctx).Error(err, "Cannot tag snapshot", "snapshotID", snapshot.ID, "tags", tags)
+		}
 	}
 
+	return newCreateSnapshotResponse(snapshot, volume.ID)
+}
+
+// newCreateSnapshotResponse returns the response to CreateSnapshot for the
+// given snapshot of a volume.
+func newCreateSnapshotResponse(snapshot *cloud.Snapshot, volumeID string) (*csi.CreateSnapshotResponse, error) {
 	t, err := time.Parse("2006-01-02T15:04:05-0700", snapshot.CreatedAt)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to parse snapshot creation time: %v", err)
@@ -390,30 +1355,83 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	resp := &csi.CreateSnapshotResponse{
 		Snapshot: &csi.Snapshot{
 			SnapshotId:     snapshot.ID,
-			SourceVolumeId: volume.ID,
+			SourceVolumeId: volumeID,
+			SizeBytes:      snapshot.Size,
 			CreationTime:   ts,
-			ReadyToUse:     true,
+			ReadyToUse:     snapshot.IsReady(),
 		},
 	}
 
 	return resp, nil
 }
 
+// checkSnapshotLimit returns a ResourceExhausted error if the volume already
+// has the maximum number of snapshots, unless one of them is the requested
+// snapshot, i.e. CreateSnapshot is retried.
+func (cs *controllerServer) checkSnapshotLimit(ctx context.Context, connector cloud.Interface, volumeID, name string) error {
+	if cs.maxSnapshotsPerVolume == 0 {
+		return nil
+	}
+
+	snapshots, err := cs.listSnapshots(ctx, connector, volumeID, "")
+	if err != nil {
+		return status.Errorf(codes.Internal, "Cannot list the snapshots of volume %s: %v", volumeID, err)
+	}
+	for _, snapshot := range snapshots {
+		if snapshot.Name == name {
+			return nil
+		}
+	}
+	if len(snapshots) >= cs.maxSnapshotsPerVolume {
+		return status.Errorf(codes.ResourceExhausted, "Volume %s already has %d snapshots, the maximum is %d",
+			volumeID, len(snapshots), cs.maxSnapshotsPerVolume)
+	}
+
+	return nil
+}
+
+// acquireSnapshotSlot waits until a snapshot creation may start, if their
+// number is limited, and returns the function to call once it is done.
+func (cs *controllerServer) acquireSnapshotSlot(ctx context.Context) (func(), error) {
+	if cs.snapshotSlots == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case cs.snapshotSlots <- struct{}{}:
+		return func() { <-cs.snapshotSlots }, nil
+	case <-ctx.Done():
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
 func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
 	entries := []*csi.ListSnapshotsResponse_Entry{}
 
-	snapshots, err := cs.connector.ListSnapshots(ctx, req.GetSourceVolumeId(), req.GetSnapshotId())
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := cs.listSnapshots(ctx, connector, req.GetSourceVolumeId(), req.GetSnapshotId())
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Failed to list snapshots: %v", err)
 	}
+	if cs.managedSnapshotsOnly {
+		snapshots = managedSnapshots(snapshots)
+	}
 
 	// Pagination logic
-	start := 0
-	if req.GetStartingToken() != "" {
-		var err error
-		start, err = strconv.Atoi(req.GetStartingToken())
-		if err != nil || start < 0 || start > len(snapshots) {
-			return nil, status.Error(codes.Aborted, "Invalid startingToken")
+	start, err := parseStartingToken(req.GetStartingToken(), len(snapshots))
+	if err != nil {
+		switch cs.invalidSnapshotToken {
+		case InvalidTokenRestart:
+			klog.FromContext(ctx).Info("Invalid starting token, listing snapshots from the beginning", "startingToken", req.GetStartingToken(), "error", err)
+			start = 0
+		case InvalidTokenEmpty:
+			return &csi.ListSnapshotsResponse{Entries: entries}, nil
+		default:
+			return nil, status.Errorf(codes.Aborted, "Invalid startingToken: %v", err)
 		}
 	}
 	maxEntries := int(req.GetMaxEntries())
@@ -434,8 +1452,9 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 			Snapshot: &csi.Snapshot{
 				SnapshotId:     snap.ID,
 				SourceVolumeId: snap.VolumeID,
+				SizeBytes:      snap.Size,
 				CreationTime:   ts,
-				ReadyToUse:     true,
+				ReadyToUse:     snap.IsReady(),
 			},
 		}
 		entries = append(entries, entry)
@@ -444,6 +1463,65 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	return &csi.ListSnapshotsResponse{Entries: entries, NextToken: nextToken}, nil
 }
 
+// listSnapshots lists the snapshots of a volume, or a given snapshot, or all
+// snapshots. If enabled, a failed listing of a volume or a snapshot (e.g. of a
+// volume which was deleted) falls back to listing all snapshots, filtered here.
+func (cs *controllerServer) listSnapshots(ctx context.Context, connector cloud.Interface, volumeID, snapshotID string) ([]*cloud.Snapshot, error) {
+	snapshots, err := connector.ListSnapshots(ctx, volumeID, snapshotID)
+	if err == nil || !cs.listSnapshotsFallback || (volumeID == "" && snapshotID == "") {
+		return snapshots, err
+	}
+
+	klog.FromContext(ctx).Error(err, "Cannot list snapshots, listing all snapshots instead",
+		"volumeID", volumeID,
+		"snapshotID", snapshotID,
+	)
+	all, fallbackErr := connector.ListSnapshots(ctx, "", "")
+	if fallbackErr != nil {
+		return nil, err
+	}
+	snapshots = make([]*cloud.Snapshot, 0)
+	for _, snap := range all {
+		if (volumeID == "" || snap.VolumeID == volumeID) && (snapshotID == "" || snap.ID == snapshotID) {
+			snapshots = append(snapshots, snap)
+		}
+	}
+
+	return snapshots, nil
+}
+
+// managedSnapshots returns the snapshots created by the driver.
+func managedSnapshots(snapshots []*cloud.Snapshot) []*cloud.Snapshot {
+	managed := make([]*cloud.Snapshot, 0, len(snapshots))
+	for _, snap := range snapshots {
+		if snap.IsManaged() {
+			managed = append(managed, snap)
+		}
+	}
+
+	return managed
+}
+
+// parseStartingToken parses a pagination token, which is the index
+// of the first entry to return among total entries.
+func parseStartingToken(token string, total int) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	start, err := strconv.Atoi(token)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid integer", token)
+	}
+	if start < 0 {
+		return 0, fmt.Errorf("%d is negative", start)
+	}
+	if start > total {
+		return 0, fmt.Errorf("%d is out of range, only %d entries available", start, total)
+	}
+
+	return start, nil
+}
+
 func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
 	snapshotID := req.GetSnapshotId()
 
@@ -453,7 +1531,12 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 
 	klog.V(4).Infof("DeleteSnapshot for snapshotID: %s", snapshotID)
 
-	err := cs.connector.DeleteSnapshot(ctx, snapshotID)
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	err = connector.DeleteSnapshot(ctx, snapshotID)
 	if errors.Is(err, cloud.ErrNotFound) {
 		// Per CSI spec, return OK if snapshot does not exist
 		return &csi.DeleteSnapshotResponse{}, nil
@@ -466,7 +1549,7 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("ControllerPublishVolume: called", "args", *req)
+	logger.V(6).Info("ControllerPublishVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check arguments.
 
@@ -480,10 +1563,6 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 	}
 	nodeID := req.GetNodeId()
 
-	if req.GetReadonly() {
-		return nil, status.Error(codes.InvalidArgument, "Readonly not possible")
-	}
-
 	if req.GetVolumeCapability() == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
@@ -491,36 +1570,61 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 		return nil, status.Error(codes.InvalidArgument, "Access mode not accepted")
 	}
 
+	if req.GetReadonly() {
+		return nil, status.Error(codes.InvalidArgument, "Readonly not possible")
+	}
+
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
 	logger.Info("Initiating attaching volume",
 		"volumeID", volumeID,
 		"nodeID", nodeID,
 	)
 
 	// Check volume.
-	vol, err := cs.connector.GetVolumeByID(ctx, volumeID)
-	if errors.Is(err, cloud.ErrNotFound) {
+	vol, err := connector.GetVolumeByID(ctx, volumeID)
+	if isVolumeNotFound(err) {
 		return nil, status.Errorf(codes.NotFound, "Volume %v not found", volumeID)
 	} else if err != nil {
 		// Error with CloudStack
 		return nil, status.Errorf(codes.Internal, "Error %v", err)
 	}
 
-	if vol.VirtualMachineID != "" && vol.VirtualMachineID != nodeID {
+	// CloudStack attaches a volume to a single VM at a time, even if the
+	// nodes may share it: a volume attached elsewhere must be detached first.
+	attachedElsewhere := vol.VirtualMachineID != "" && vol.VirtualMachineID != nodeID
+	if attachedElsewhere {
 		logger.Error(nil, "Volume already attached to another node",
 			"volumeID", volumeID,
 			"nodeID", nodeID,
 			"attachedNodeID", vol.VirtualMachineID,
 		)
-
-		return nil, status.Error(codes.AlreadyExists, "Volume already assigned to another node")
+		if !cs.failoverDetach {
+			return nil, status.Error(codes.AlreadyExists, "Volume already assigned to another node")
+		}
+		// Only take the volume over from a node which cannot write to it
+		// anymore, to avoid a split brain.
+		if down, err := isVMDown(ctx, connector, vol.VirtualMachineID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot get VM %s: %v", vol.VirtualMachineID, err)
+		} else if !down {
+			return nil, status.Errorf(codes.AlreadyExists, "Volume already assigned to another node %s, which is running", vol.VirtualMachineID)
+		}
 	}
 
-	if _, err := cs.connector.GetVMByID(ctx, nodeID); errors.Is(err, cloud.ErrNotFound) {
+	vm, err := connector.GetVMByID(ctx, nodeID)
+	if errors.Is(err, cloud.ErrNotFound) {
 		return nil, status.Errorf(codes.NotFound, "VM %v not found", nodeID)
 	} else if err != nil {
 		// Error with CloudStack
 		return nil, status.Errorf(codes.Internal, "Error %v", err)
 	}
+	if vol.ZoneID != "" && vm.ZoneID != "" && vol.ZoneID != vm.ZoneID {
+		return nil, status.Errorf(codes.FailedPrecondition, "Volume %s in zone %s cannot be attached to node %s in zone %s",
+			volumeID, vol.ZoneID, nodeID, vm.ZoneID)
+	}
 
 	if vol.VirtualMachineID == nodeID {
 		// volume already attached.
@@ -529,19 +1633,47 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 			"nodeID", nodeID,
 			"deviceID", vol.DeviceID,
 		)
-		publishContext := map[string]string{
-			deviceIDContextKey: vol.DeviceID,
+		return &csi.ControllerPublishVolumeResponse{PublishContext: newPublishContext(vol.DeviceID)}, nil
+	}
+
+	if attachedElsewhere {
+		logger.Info("Detaching volume from stopped node for failover",
+			"volumeID", volumeID,
+			"nodeID", nodeID,
+			"attachedNodeID", vol.VirtualMachineID,
+		)
+		if err := connector.DetachVolume(ctx, volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot detach volume %s from VM %s: %v", volumeID, vol.VirtualMachineID, err)
+		}
+	}
+
+	if cs.maxDeviceSlots > 0 {
+		usedDeviceIDs, err := cloud.UsedDeviceIDs(ctx, connector, nodeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot list volumes of VM %s: %v", nodeID, err)
 		}
+		if len(usedDeviceIDs) >= cs.maxDeviceSlots {
+			return nil, status.Errorf(codes.ResourceExhausted,
+				"Cannot attach volume %s: all %d device slots of VM %s are in use (device IDs %v)",
+				volumeID, cs.maxDeviceSlots, nodeID, usedDeviceIDs)
+		}
+	}
 
-		return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
+	var requestedDeviceID string
+	if cs.compactDeviceIDs {
+		requestedDeviceID, err = cloud.LowestFreeDeviceID(ctx, connector, nodeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot list volumes of VM %s: %v", nodeID, err)
+		}
 	}
 
 	logger.Info("Attaching volume to node",
 		"volumeID", volumeID,
 		"nodeID", nodeID,
+		"deviceID", requestedDeviceID,
 	)
 
-	deviceID, err := cs.connector.AttachVolume(ctx, volumeID, nodeID)
+	deviceID, err := connector.AttachVolumeAtDevice(ctx, volumeID, nodeID, requestedDeviceID)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Cannot attach volume %s: %s", volumeID, err.Error())
 	}
@@ -551,16 +1683,19 @@ func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *cs
 		"nodeID", nodeID,
 	)
 
-	publishContext := map[string]string{
+	return &csi.ControllerPublishVolumeResponse{PublishContext: newPublishContext(deviceID)}, nil
+}
+
+// newPublishContext returns the publish context passed to the node.
+func newPublishContext(deviceID string) map[string]string {
+	return map[string]string{
 		deviceIDContextKey: deviceID,
 	}
-
-	return &csi.ControllerPublishVolumeResponse{PublishContext: publishContext}, nil
 }
 
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("ControllerUnpublishVolume: called", "args", *req)
+	logger.V(6).Info("ControllerUnpublishVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check arguments.
 
@@ -570,8 +1705,13 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	volumeID := req.GetVolumeId()
 	nodeID := req.GetNodeId()
 
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
 	// Check volume.
-	if vol, err := cs.connector.GetVolumeByID(ctx, volumeID); errors.Is(err, cloud.ErrNotFound) {
+	if vol, err := connector.GetVolumeByID(ctx, volumeID); isVolumeNotFound(err) {
 		// Volume does not exist in CloudStack. We can safely assume this volume is no longer attached
 		// The spec requires us to return OK here.
 		return &csi.ControllerUnpublishVolumeResponse{}, nil
@@ -584,7 +1724,7 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 	}
 
 	// Check VM existence.
-	if _, err := cs.connector.GetVMByID(ctx, nodeID); errors.Is(err, cloud.ErrNotFound) {
+	if _, err := connector.GetVMByID(ctx, nodeID); errors.Is(err, cloud.ErrNotFound) {
 		// volumes cannot be attached to deleted VMs.
 		logger.Error(nil, "VM not found, marking ControllerUnpublishVolume successful",
 			"volumeID", volumeID,
@@ -602,8 +1742,13 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 		"nodeID", nodeID,
 	)
 
-	err := cs.connector.DetachVolume(ctx, volumeID)
-	if err != nil {
+	err = connector.DetachVolume(ctx, volumeID)
+	if errors.Is(err, cloud.ErrNotFound) {
+		// The volume was deleted meanwhile: it is not attached anymore.
+		logger.Info("Volume not found, considering it detached", "volumeID", volumeID)
+
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, "Cannot detach volume %s: %s", volumeID, err.Error())
 	}
 
@@ -617,7 +1762,7 @@ func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("ValidateVolumeCapabilities: called", "args", *req)
+	logger.V(6).Info("ValidateVolumeCapabilities: called", "args", protosanitizer.StripSecrets(req))
 
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
@@ -629,15 +1774,21 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "Volume capabilities not provided")
 	}
 
-	if _, err := cs.connector.GetVolumeByID(ctx, volumeID); errors.Is(err, cloud.ErrNotFound) {
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = connector.GetVolumeByID(ctx, volumeID)
+	if isVolumeNotFound(err) {
 		return nil, status.Errorf(codes.NotFound, "Volume %v not found", volumeID)
 	} else if err != nil {
 		// Error with CloudStack
 		return nil, status.Errorf(codes.Internal, "Error %v", err)
 	}
 
-	if !isValidVolumeCapabilities(volCaps) {
-		return &csi.ValidateVolumeCapabilitiesResponse{Message: "Requested VolumeCapabilities are invalid"}, nil
+	if reason := volumeCapabilitiesError(volCaps); reason != "" {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: "Requested VolumeCapabilities are invalid: " + reason}, nil
 	}
 
 	return &csi.ValidateVolumeCapabilitiesResponse{
@@ -649,19 +1800,46 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 	}, nil
 }
 
+// isValidVolumeCapabilities checks volume capabilities, see volumeCapabilitiesError.
 func isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
+	return volumeCapabilitiesError(volCaps) == ""
+}
+
+// volumeCapabilitiesError returns why volume capabilities are not supported,
+// or "" if they are: the access modes must be SINGLE_NODE_WRITER, the
+// filesystem types supported ones, and a volume cannot be both a block
+// device and a mounted filesystem.
+func volumeCapabilitiesError(volCaps []*csi.VolumeCapability) string {
+	var block, mount bool
 	for _, c := range volCaps {
-		if c.GetAccessMode() != nil && c.GetAccessMode().GetMode() != onlyVolumeCapAccessMode.GetMode() {
-			return false
+		if c.GetAccessMode() != nil {
+			mode := c.GetAccessMode().GetMode()
+			if mode != onlyVolumeCapAccessMode.GetMode() {
+				return fmt.Sprintf("access mode %s is not supported", mode)
+			}
+		}
+		switch t := c.GetAccessType().(type) {
+		case *csi.VolumeCapability_Block:
+			block = true
+		case *csi.VolumeCapability_Mount:
+			mount = true
+			if fsType := t.Mount.GetFsType(); fsType != "" {
+				if _, ok := ValidFSTypes[strings.ToLower(fsType)]; !ok {
+					return fmt.Sprintf("filesystem type %s is not supported", fsType)
+				}
+			}
 		}
 	}
+	if block && mount {
+		return "block and mount access types cannot be requested together"
+	}
 
-	return true
+	return ""
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("ControllerExpandVolume: called", "args", protosanitizer.StripSecrets(*req))
+	logger.V(6).Info("ControllerExpandVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
@@ -673,6 +1851,11 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		return nil, status.Error(codes.InvalidArgument, "Capacity range not provided")
 	}
 
+	connector, err := cs.connectorFor(req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+
 	// lock out parallel requests against the same volume ID
 	if acquired := cs.volumeLocks.TryAcquire(volumeID); !acquired {
 		logger.Error(errors.New(util.ErrVolumeOperationAlreadyExistsVolumeID), "failed to acquire volume lock", "volumeID", volumeID)
@@ -689,15 +1872,45 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 		return nil, status.Error(codes.OutOfRange, "Volume size exceeds the limit specified")
 	}
 
-	_, err := cs.connector.GetVolumeByID(ctx, volumeID)
+	vol, err := connector.GetVolumeByID(ctx, volumeID)
 	if err != nil {
-		if errors.Is(err, cloud.ErrNotFound) {
+		if isVolumeNotFound(err) {
 			return nil, status.Errorf(codes.NotFound, "Volume %v not found", volumeID)
 		}
 
 		return nil, status.Error(codes.Internal, fmt.Sprintf("GetVolume failed with error %v", err))
 	}
 
+	if increment := cs.sizeIncrements[vol.DiskOfferingID]; increment > 1 {
+		rounded := roundUpToIncrement(volSizeGB, increment)
+		if maxVolSize > 0 && maxVolSize < util.GigaBytesToBytes(rounded) {
+			return nil, status.Errorf(codes.OutOfRange, "Volume size of %d GB, rounded up to the increment of %d GB of disk offering %s, exceeds the limit specified",
+				rounded, increment, vol.DiskOfferingID)
+		}
+		if rounded != volSizeGB {
+			logger.Info("Rounding up volume size to the increment of the disk offering",
+				"volumeID", volumeID,
+				"requestedSize", volSizeGB,
+				"size", rounded,
+				"increment", increment,
+			)
+			volSizeGB = rounded
+		}
+	}
+
+	offering, err := connector.GetDiskOffering(ctx, vol.DiskOfferingID)
+	switch {
+	case errors.Is(err, cloud.ErrNotFound):
+		logger.Info("Disk offering of volume not found, not checking its maximum size", "volumeID", volumeID, "diskOfferingID", vol.DiskOfferingID)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "Cannot get disk offering %s: %v", vol.DiskOfferingID, err)
+	default:
+		if maxSize := cs.offeringMaxSize(offering); maxSize > 0 && volSizeGB > maxSize {
+			return nil, status.Errorf(codes.OutOfRange, "Volume size %d GB exceeds the maximum of %d GB of disk offering %s",
+				volSizeGB, maxSize, offering.ID)
+		}
+	}
+
 	// lock out volumeID for clone and delete operation
 	if err := cs.operationLocks.GetExpandLock(volumeID); err != nil {
 		logger.Error(err, "failed acquiring expand lock", "volumeID", volumeID)
@@ -706,9 +1919,9 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}
 	defer cs.operationLocks.ReleaseExpandLock(volumeID)
 
-	err = cs.connector.ExpandVolume(ctx, volumeID, volSizeGB)
+	err = connector.ExpandVolume(ctx, volumeID, volSizeGB)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Could not resize volume %q to size %v: %v", volumeID, volSizeGB, err)
+		return nil, creationError(err, "Could not resize volume %q to size %v", volumeID, volSizeGB)
 	}
 
 	logger.Info("Volume successfully expanded",
@@ -729,9 +1942,187 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 	}, nil
 }
 
+// roundUpToIncrement rounds a size up to a multiple of the increment.
+func roundUpToIncrement(size, increment int64) int64 {
+	return (size + increment - 1) / increment * increment
+}
+
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	logger := klog.FromContext(ctx)
+	logger.V(6).Info("ControllerGetVolume: called", "args", protosanitizer.StripSecrets(req))
+
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	vol, err := cs.connector.GetVolumeByID(ctx, volumeID)
+	if isVolumeNotFound(err) {
+		return nil, status.Errorf(codes.NotFound, "Volume %v not found", volumeID)
+	} else if err != nil {
+		// Error with CloudStack
+		return nil, status.Errorf(codes.Internal, "Error %v", err)
+	}
+
+	condition, err := volumeCondition(ctx, cs.connector, vol)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Cannot get VM %s: %v", vol.VirtualMachineID, err)
+	}
+
+	var publishedNodeIDs []string
+	if vol.VirtualMachineID != "" {
+		publishedNodeIDs = []string{vol.VirtualMachineID}
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      vol.ID,
+			CapacityBytes: vol.Size,
+			AccessibleTopology: []*csi.Topology{
+				Topology{ZoneID: vol.ZoneID}.ToCSI(),
+			},
+		},
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: publishedNodeIDs,
+			VolumeCondition:  condition,
+		},
+	}, nil
+}
+
+// volumeCondition returns the condition of a volume: abnormal if CloudStack
+// is destroying it, or if the VM it is attached to is gone.
+func volumeCondition(ctx context.Context, connector cloud.Interface, vol *cloud.Volume) (*csi.VolumeCondition, error) {
+	switch vol.State {
+	case "Destroy", "Expunging", "Expunged":
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Volume is in state %s", vol.State),
+		}, nil
+	}
+
+	if vol.VirtualMachineID != "" {
+		vm, err := connector.GetVMByID(ctx, vol.VirtualMachineID)
+		if errors.Is(err, cloud.ErrNotFound) {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("Volume is attached to VM %s, which does not exist", vol.VirtualMachineID),
+			}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if vm.State == "Destroyed" || vm.State == "Expunging" {
+			return &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  fmt.Sprintf("Volume is attached to VM %s, which is in state %s", vol.VirtualMachineID, vm.State),
+			}, nil
+		}
+	}
+
+	return &csi.VolumeCondition{
+		Message: fmt.Sprintf("Volume is in state %s", vol.State),
+	}, nil
+}
+
+// ListVolumes lists the volumes using the pagination of CloudStack: the
+// starting token is the number of the page to return, of MaxEntries volumes.
+func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	logger := klog.FromContext(ctx)
+	logger.V(6).Info("ListVolumes: called", "args", protosanitizer.StripSecrets(req))
+
+	page := 1
+	if token := req.GetStartingToken(); token != "" {
+		var err error
+		page, err = strconv.Atoi(token)
+		if err != nil || page < 1 {
+			return nil, status.Errorf(codes.Aborted, "Invalid startingToken: %q is not a valid page number", token)
+		}
+	}
+	maxEntries := int(req.GetMaxEntries())
+	if maxEntries < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid maxEntries: %d is negative", maxEntries)
+	}
+
+	entries := []*csi.ListVolumesResponse_Entry{}
+	if maxEntries == 0 && page > 1 {
+		// All the volumes were listed on the first page.
+		return &csi.ListVolumesResponse{Entries: entries}, nil
+	}
+
+	vols, err := cs.connector.ListVolumes(ctx, "", maxEntries, page)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to list volumes: %v", err)
+	}
+	nextToken := ""
+	if maxEntries > 0 && len(vols) == maxEntries {
+		nextToken = strconv.Itoa(page + 1)
+	}
+
+	for _, vol := range vols {
+		var publishedNodeIDs []string
+		if vol.VirtualMachineID != "" {
+			publishedNodeIDs = []string{vol.VirtualMachineID}
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &csi.Volume{
+				VolumeId:      vol.ID,
+				CapacityBytes: vol.Size,
+				AccessibleTopology: []*csi.Topology{
+					Topology{ZoneID: vol.ZoneID}.ToCSI(),
+				},
+			},
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: publishedNodeIDs,
+			},
+		})
+	}
+
+	return &csi.ListVolumesResponse{Entries: entries, NextToken: nextToken}, nil
+}
+
+func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	logger := klog.FromContext(ctx)
+	logger.V(6).Info("GetCapacity: called", "args", protosanitizer.StripSecrets(req))
+
+	diskOfferingID := req.GetParameters()[DiskOfferingKey]
+
+	// Without topology, report the capacity of all zones.
+	var zones []string
+	if req.GetAccessibleTopology() != nil {
+		t, err := NewTopology(req.GetAccessibleTopology())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "Cannot parse accessible topology")
+		}
+		zoneID, err := resolveZoneID(ctx, cs.connector, t.ZoneID)
+		if err != nil {
+			return nil, zoneError(t.ZoneID, err)
+		}
+		zones = []string{zoneID}
+	} else {
+		var err error
+		zones, err = cs.connector.ListZonesID(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot list zones: %v", err)
+		}
+	}
+
+	var available int64
+	for _, zoneID := range zones {
+		capacity, err := cs.connector.GetAvailableCapacity(ctx, zoneID, diskOfferingID, cs.capacityMode)
+		switch {
+		case errors.Is(err, cloud.ErrNotFound) && diskOfferingID != "":
+			return nil, status.Errorf(codes.InvalidArgument, "Disk offering %s not found", diskOfferingID)
+		case err != nil:
+			return nil, status.Errorf(codes.Internal, "Cannot get capacity of zone %s: %v", zoneID, err)
+		}
+		available += capacity
+	}
+
+	return &csi.GetCapacityResponse{AvailableCapacity: available}, nil
+}
+
 func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("ControllerGetCapabilities: called", "args", protosanitizer.StripSecrets(*req))
+	logger.V(6).Info("ControllerGetCapabilities: called", "args", protosanitizer.StripSecrets(req))
 
 	resp := &csi.ControllerGetCapabilitiesResponse{
 		Capabilities: []*csi.ControllerServiceCapability{
@@ -770,6 +2161,48 @@ func (cs *controllerServer) ControllerGetCapabilities(ctx context.Context, req *
 					},
 				},
 			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+					},
+				},
+			},
+			{
+				Type: &csi.ControllerServiceCapability_Rpc{
+					Rpc: &csi.ControllerServiceCapability_RPC{
+						Type: csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}
 
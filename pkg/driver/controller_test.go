@@ -20,9 +20,26 @@
 package driver
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/util"
 )
 
 func TestDetermineSize(t *testing.T) {
@@ -59,3 +76,2430 @@ func TestDetermineSize(t *testing.T) {
 		})
 	}
 }
+
+// zoneListingConnector counts the listings of zones.
+type zoneListingConnector struct {
+	cloud.Interface
+	listings int
+}
+
+func (c *zoneListingConnector) ListZonesID(ctx context.Context) ([]string, error) {
+	c.listings++
+
+	return c.Interface.ListZonesID(ctx)
+}
+
+func TestCreateVolumeUnknownDiskOffering(t *testing.T) {
+	connector := &zoneListingConnector{Interface: fake.New()}
+	cs := NewControllerServer(connector, &Options{})
+	req := createVolumeRequest("pvc-1", 1, nil, nil)
+	req.Parameters[DiskOfferingKey] = "unknown"
+
+	_, err := cs.CreateVolume(context.Background(), req)
+	if status.Code(err) != codes.InvalidArgument || !strings.Contains(err.Error(), "Disk offering unknown not found") {
+		t.Fatalf("Expected InvalidArgument for the unknown disk offering, got %v", err)
+	}
+	if connector.listings != 0 {
+		t.Errorf("Expected the disk offering to be checked before selecting a zone, got %d zone listings", connector.listings)
+	}
+}
+
+func TestCreateVolumeDefaultCustomSize(t *testing.T) {
+	const fixedOffering = "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e"
+	cases := []struct {
+		name          string
+		offering      string
+		capacityRange *csi.CapacityRange
+		requireSize   bool
+		expectedCode  codes.Code
+		expectedSize  int64
+	}{
+		{"default size", "", nil, false, codes.OK, 20},
+		{"default size beyond limit", "", &csi.CapacityRange{LimitBytes: util.GigaBytesToBytes(10)}, false, codes.OK, 1},
+		{"requested size", "", &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(5)}, false, codes.OK, 5},
+		{"size required", "", nil, true, codes.InvalidArgument, 0},
+		{"size required and requested", "", &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(5)}, true, codes.OK, 5},
+		{"size required with fixed offering", fixedOffering, nil, true, codes.OK, 10},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(fake.New(), &Options{DefaultCustomVolumeSize: 20})
+			req := createVolumeRequest("pvc-1", 0, nil, nil)
+			req.CapacityRange = c.capacityRange
+			if c.offering != "" {
+				req.Parameters[DiskOfferingKey] = c.offering
+			}
+			if c.requireSize {
+				req.Parameters[RequireSizeKey] = "true"
+			}
+
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if size := resp.GetVolume().GetCapacityBytes(); size != util.GigaBytesToBytes(c.expectedSize) {
+				t.Errorf("Expected %d GB, got %d bytes", c.expectedSize, size)
+			}
+		})
+	}
+}
+
+func TestCheckVolumeSuitableSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		size          int64
+		capacityRange *csi.CapacityRange
+		expected      bool
+	}{
+		{"3GB requested, 3GB volume", 3221225472, &csi.CapacityRange{RequiredBytes: 3 * 1024 * 1024 * 1024}, true},
+		{"3GB requested in decimal units, 3GB volume", 3221225472, &csi.CapacityRange{RequiredBytes: 3_000_000_000}, true},
+		{"3GB requested, volume reported slightly smaller", 3221225000, &csi.CapacityRange{RequiredBytes: 3221225472}, true},
+		{"3GB requested, 2GB volume", 2147483648, &csi.CapacityRange{RequiredBytes: 3221225472}, false},
+		{"3GB volume, 2GB limit", 3221225472, &csi.CapacityRange{LimitBytes: 2147483648}, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vol := &cloud.Volume{Size: c.size, DiskOfferingID: "offering"}
+			if ok, message := checkVolumeSuitable(vol, "offering", c.capacityRange, nil); ok != c.expected {
+				t.Errorf("Expected %v, got %v (%s)", c.expected, ok, message)
+			}
+		})
+	}
+}
+
+func TestParseStartingToken(t *testing.T) {
+	cases := []struct {
+		name          string
+		token         string
+		expectedStart int
+		expectError   bool
+	}{
+		{"empty", "", 0, false},
+		{"first", "0", 0, false},
+		{"middle", "2", 2, false},
+		{"end", "3", 3, false},
+		{"non-numeric", "abc", 0, true},
+		{"negative", "-1", 0, true},
+		{"out of range", "4", 0, true},
+		{"too large", "99999999999999999999", 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, err := parseStartingToken(c.token, 3)
+			if c.expectError {
+				if err == nil {
+					t.Errorf("Expected error, got start %d", start)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if start != c.expectedStart {
+				t.Errorf("Expected start %d, got %d", c.expectedStart, start)
+			}
+		})
+	}
+}
+
+func TestListSnapshotsInvalidToken(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	for _, name := range []string{"snap-1", "snap-2", "snap-3"} {
+		if _, err := connector.CreateSnapshot(ctx, "vol-1", name); err != nil {
+			t.Fatalf("Cannot create snapshot: %v", err)
+		}
+	}
+
+	for _, token := range []string{"abc", "-1", "4", "99999999999999999999"} {
+		req := &csi.ListSnapshotsRequest{StartingToken: token}
+
+		t.Run(InvalidTokenAbort+"/"+token, func(t *testing.T) {
+			cs := NewControllerServer(connector, &Options{InvalidSnapshotToken: InvalidTokenAbort})
+			_, err := cs.ListSnapshots(ctx, req)
+			if status.Code(err) != codes.Aborted {
+				t.Errorf("Expected Aborted error, got %v", err)
+			}
+		})
+
+		t.Run(InvalidTokenRestart+"/"+token, func(t *testing.T) {
+			cs := NewControllerServer(connector, &Options{InvalidSnapshotToken: InvalidTokenRestart})
+			resp, err := cs.ListSnapshots(ctx, req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(resp.GetEntries()) != 3 {
+				t.Errorf("Expected all 3 snapshots, got %d", len(resp.GetEntries()))
+			}
+		})
+
+		t.Run(InvalidTokenEmpty+"/"+token, func(t *testing.T) {
+			cs := NewControllerServer(connector, &Options{InvalidSnapshotToken: InvalidTokenEmpty})
+			resp, err := cs.ListSnapshots(ctx, req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(resp.GetEntries()) != 0 || resp.GetNextToken() != "" {
+				t.Errorf("Expected empty result, got %v", resp)
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeDeviceSlotsExhausted(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	nodeID := "0d7107a3-94d2-44e7-89b8-8930881309a5"
+
+	// Occupy the two slots of the node.
+	for _, name := range []string{"vol-2", "vol-3"} {
+		volID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{Name: name, SizeInGB: 1})
+		if err != nil {
+			t.Fatalf("Cannot create volume: %v", err)
+		}
+		if _, err := connector.AttachVolume(ctx, volID, nodeID); err != nil {
+			t.Fatalf("Cannot attach volume: %v", err)
+		}
+	}
+
+	cs := NewControllerServer(connector, &Options{MaxDeviceSlots: 2})
+	_, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &onlyVolumeCapAccessMode,
+		},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted error, got %v", err)
+	}
+	vol, _ := connector.GetVolumeByID(ctx, "ace9f28b-3081-40c1-8353-4cc3e3014072")
+	if vol.VirtualMachineID != "" {
+		t.Errorf("Expected volume not to be attached, got attached to %s", vol.VirtualMachineID)
+	}
+
+	// With a free slot, the volume gets attached.
+	cs = NewControllerServer(connector, &Options{MaxDeviceSlots: 3})
+	resp, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		NodeId:   nodeID,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &onlyVolumeCapAccessMode,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.GetPublishContext()[deviceIDContextKey] != "3" {
+		t.Errorf("Expected device ID 3, got %v", resp.GetPublishContext())
+	}
+}
+
+func TestControllerPublishVolumeCompactDeviceIDs(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	nodeID := "0d7107a3-94d2-44e7-89b8-8930881309a5"
+
+	// Use device IDs 1, 2 and 4, then free 1.
+	volIDs := make(map[string]string)
+	for _, deviceID := range []string{"1", "2", "4"} {
+		volID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{Name: "vol-dev-" + deviceID, SizeInGB: 1})
+		if err != nil {
+			t.Fatalf("Cannot create volume: %v", err)
+		}
+		if _, err := connector.AttachVolumeAtDevice(ctx, volID, nodeID, deviceID); err != nil {
+			t.Fatalf("Cannot attach volume: %v", err)
+		}
+		volIDs[deviceID] = volID
+	}
+	if err := connector.DetachVolume(ctx, volIDs["1"]); err != nil {
+		t.Fatalf("Cannot detach volume: %v", err)
+	}
+
+	cs := NewControllerServer(connector, &Options{CompactDeviceIDs: true})
+	publish := func(volumeID string) string {
+		t.Helper()
+		resp, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId: volumeID,
+			NodeId:   nodeID,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessMode: &onlyVolumeCapAccessMode,
+			},
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		return resp.GetPublishContext()[deviceIDContextKey]
+	}
+
+	if deviceID := publish("ace9f28b-3081-40c1-8353-4cc3e3014072"); deviceID != "1" {
+		t.Errorf("Expected lowest free device ID 1, got %s", deviceID)
+	}
+	// 3 is reserved for the CD-ROM drive.
+	if deviceID := publish(volIDs["1"]); deviceID != "5" {
+		t.Errorf("Expected lowest free device ID 5, got %s", deviceID)
+	}
+}
+
+// capacityConnector is a fake connector with zones of given capacities.
+type capacityConnector struct {
+	cloud.Interface
+	capacities map[string]int64
+}
+
+func (c *capacityConnector) ListZonesID(_ context.Context) ([]string, error) {
+	zones := make([]string, 0, len(c.capacities))
+	for zoneID := range c.capacities {
+		zones = append(zones, zoneID)
+	}
+
+	return zones, nil
+}
+
+func (c *capacityConnector) GetZoneCapacity(_ context.Context, zoneID string) (int64, error) {
+	capacity, ok := c.capacities[zoneID]
+	if !ok {
+		return 0, cloud.ErrNotFound
+	}
+
+	return capacity, nil
+}
+
+func (c *capacityConnector) GetAvailableCapacity(ctx context.Context, zoneID, _ string, _ cloud.CapacityMode) (int64, error) {
+	return c.GetZoneCapacity(ctx, zoneID)
+}
+
+func createVolumeRequest(name string, sizeInGB int64, requisite, preferred []string) *csi.CreateVolumeRequest {
+	toTopologies := func(zones []string) []*csi.Topology {
+		if len(zones) == 0 {
+			return nil
+		}
+		topologies := make([]*csi.Topology, 0, len(zones))
+		for _, zoneID := range zones {
+			topologies = append(topologies, Topology{ZoneID: zoneID}.ToCSI())
+		}
+
+		return topologies
+	}
+
+	return &csi.CreateVolumeRequest{
+		Name:               name,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(sizeInGB)},
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessMode: &onlyVolumeCapAccessMode}},
+		Parameters:         map[string]string{DiskOfferingKey: "9743fd77-0f5d-4ef9-b2f8-f194235c769c"},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: toTopologies(requisite),
+			Preferred: toTopologies(preferred),
+		},
+	}
+}
+
+func TestCreateVolumeZoneCapacityFallThrough(t *testing.T) {
+	connector := &capacityConnector{
+		Interface: fake.New(),
+		capacities: map[string]int64{
+			"zone-a": util.GigaBytesToBytes(5),
+			"zone-b": util.GigaBytesToBytes(100),
+		},
+	}
+	cs := NewControllerServer(connector, &Options{CheckZoneCapacity: true})
+
+	resp, err := cs.CreateVolume(context.Background(),
+		createVolumeRequest("pvc-1", 10, []string{"zone-a", "zone-b"}, []string{"zone-a"}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	segments := resp.GetVolume().GetAccessibleTopology()[0].GetSegments()
+	if segments[ZoneKey] != "zone-b" {
+		t.Errorf("Expected volume in zone-b, got %v", segments)
+	}
+}
+
+func TestCreateVolumeSingleZoneExhausted(t *testing.T) {
+	connector := &capacityConnector{
+		Interface: fake.New(),
+		capacities: map[string]int64{
+			"zone-a": util.GigaBytesToBytes(5),
+			"zone-b": util.GigaBytesToBytes(100),
+		},
+	}
+	cs := NewControllerServer(connector, &Options{CheckZoneCapacity: true})
+
+	_, err := cs.CreateVolume(context.Background(),
+		createVolumeRequest("pvc-1", 10, []string{"zone-a"}, nil))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted error, got %v", err)
+	}
+	if _, err := connector.GetVolumeByName(context.Background(), "pvc-1"); err == nil {
+		t.Error("Expected no volume to be created")
+	}
+}
+
+func TestCreateVolumeFromSnapshotDiskOffering(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	snapshot, err := connector.CreateSnapshot(ctx, "ace9f28b-3081-40c1-8353-4cc3e3014072", "snap-1")
+	if err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+	cs := NewControllerServer(connector, &Options{})
+
+	cases := []struct {
+		name           string
+		diskOfferingID string
+		sizeInGB       int64
+		expectedCode   codes.Code
+	}{
+		{"customized offering", "9743fd77-0f5d-4ef9-b2f8-f194235c769c", 20, codes.OK},
+		{"fixed offering", "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e", 10, codes.OK},
+		{"fixed offering too small", "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e", 20, codes.InvalidArgument},
+		{"unknown offering", "unknown", 20, codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := createVolumeRequest("restore-"+c.name, c.sizeInGB, nil, nil)
+			req.Parameters[DiskOfferingKey] = c.diskOfferingID
+			req.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.ID},
+				},
+			}
+
+			resp, err := cs.CreateVolume(ctx, req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			vol, err := connector.GetVolumeByID(ctx, resp.GetVolume().GetVolumeId())
+			if err != nil {
+				t.Fatalf("Cannot get restored volume: %v", err)
+			}
+			if vol.DiskOfferingID != c.diskOfferingID {
+				t.Errorf("Expected restored volume to use disk offering %s, got %s", c.diskOfferingID, vol.DiskOfferingID)
+			}
+		})
+	}
+}
+
+// duplicateNameConnector is a fake connector where several volumes share a name.
+type duplicateNameConnector struct {
+	cloud.Interface
+	duplicates []*cloud.Volume
+}
+
+func (c *duplicateNameConnector) GetVolumeByName(_ context.Context, _ string) (*cloud.Volume, error) {
+	return nil, cloud.ErrTooManyResults
+}
+
+func (c *duplicateNameConnector) ListVolumesByName(_ context.Context, _ string) ([]*cloud.Volume, error) {
+	return c.duplicates, nil
+}
+
+func TestCreateVolumeDuplicateNames(t *testing.T) {
+	diskOfferingID := "9743fd77-0f5d-4ef9-b2f8-f194235c769c"
+	managed := map[string]string{cloud.ManagedByTagKey: cloud.ManagedByTagValue}
+	external := &cloud.Volume{ID: "external", Name: "pvc-1", DiskOfferingID: diskOfferingID, Size: util.GigaBytesToBytes(10)}
+	ours := &cloud.Volume{ID: "ours", Name: "pvc-1", DiskOfferingID: diskOfferingID, Size: util.GigaBytesToBytes(10), Tags: managed}
+	oursToo := &cloud.Volume{ID: "ours-too", Name: "pvc-1", DiskOfferingID: diskOfferingID, Size: util.GigaBytesToBytes(10), Tags: managed}
+
+	cases := []struct {
+		name         string
+		duplicates   []*cloud.Volume
+		expectedCode codes.Code
+		expectedID   string
+	}{
+		{"one managed", []*cloud.Volume{external, ours}, codes.OK, "ours"},
+		{"several managed", []*cloud.Volume{external, ours, oursToo}, codes.AlreadyExists, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connector := &duplicateNameConnector{Interface: fake.New(), duplicates: c.duplicates}
+			cs := NewControllerServer(connector, &Options{})
+
+			resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 10, nil, nil))
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if c.expectedID != "" && resp.GetVolume().GetVolumeId() != c.expectedID {
+				t.Errorf("Expected volume %s, got %s", c.expectedID, resp.GetVolume().GetVolumeId())
+			}
+		})
+	}
+}
+
+func TestCreateVolumeLogsPhaseDurations(t *testing.T) {
+	logger := ktesting.NewLogger(t, ktesting.NewConfig(ktesting.BufferLogs(true), ktesting.Verbosity(4)))
+	ctx := klog.NewContext(context.Background(), logger)
+	cs := NewControllerServer(fake.New(), &Options{})
+
+	if _, err := cs.CreateVolume(ctx, createVolumeRequest("pvc-1", 10, nil, nil)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	underlier, _ := logger.GetSink().(ktesting.Underlier)
+	logs := underlier.GetBuffer().String()
+	for _, field := range []string{"provisioning latency", `name="pvc-1"`, "lookupDuration=", "zoneDuration=", "createDuration=", "totalDuration="} {
+		if !strings.Contains(logs, field) {
+			t.Errorf("Expected %s in logs, got:\n%s", field, logs)
+		}
+	}
+}
+
+func TestMultiNodeAccessModesUnsupported(t *testing.T) {
+	ctx := context.Background()
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+
+	// CloudStack attaches a volume to a single VM at a time.
+	for _, mode := range []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	} {
+		t.Run(mode.String(), func(t *testing.T) {
+			volCap := &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+			}
+			cs := NewControllerServer(fake.New(), &Options{})
+
+			req := createVolumeRequest("pvc-1", 10, nil, nil)
+			req.VolumeCapabilities = []*csi.VolumeCapability{volCap}
+			if _, err := cs.CreateVolume(ctx, req); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("CreateVolume: expected InvalidArgument, got %v", err)
+			}
+			validated, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           volumeID,
+				VolumeCapabilities: []*csi.VolumeCapability{volCap},
+			})
+			if err != nil {
+				t.Fatalf("ValidateVolumeCapabilities: unexpected error %v", err)
+			}
+			if validated.GetConfirmed() != nil {
+				t.Errorf("ValidateVolumeCapabilities: expected unconfirmed capabilities")
+			}
+			_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         volumeID,
+				NodeId:           "0d7107a3-94d2-44e7-89b8-8930881309a5",
+				VolumeCapability: volCap,
+				Readonly:         mode == csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			})
+			if status.Code(err) != codes.InvalidArgument {
+				t.Errorf("ControllerPublishVolume: expected InvalidArgument, got %v", err)
+			}
+		})
+	}
+}
+
+// staleAttachmentConnector is a fake connector reporting volumes as still
+// attached to a VM they have already been detached from.
+type staleAttachmentConnector struct {
+	cloud.Interface
+	vmID string
+}
+
+func (c *staleAttachmentConnector) GetVolumeByID(ctx context.Context, volumeID string) (*cloud.Volume, error) {
+	vol, err := c.Interface.GetVolumeByID(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	vol.VirtualMachineID = c.vmID
+
+	return vol, nil
+}
+
+func TestControllerUnpublishVolumeAlreadyDetached(t *testing.T) {
+	nodeID := "0d7107a3-94d2-44e7-89b8-8930881309a5"
+	connector := &staleAttachmentConnector{Interface: fake.New(), vmID: nodeID}
+	cs := NewControllerServer(connector, &Options{})
+
+	_, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		NodeId:   nodeID,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+// deletedOnDetachConnector deletes volumes right before detaching them,
+// as if they were deleted concurrently.
+type deletedOnDetachConnector struct {
+	cloud.Interface
+}
+
+func (c *deletedOnDetachConnector) DetachVolume(ctx context.Context, volumeID string) error {
+	if err := c.Interface.DeleteVolume(ctx, volumeID); err != nil {
+		return err
+	}
+
+	return c.Interface.DetachVolume(ctx, volumeID)
+}
+
+func TestControllerUnpublishVolumeDeletedVolume(t *testing.T) {
+	ctx := context.Background()
+	nodeID := "0d7107a3-94d2-44e7-89b8-8930881309a5"
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	connector := fake.New()
+	if _, err := connector.AttachVolume(ctx, volumeID, nodeID); err != nil {
+		t.Fatalf("Cannot attach volume: %v", err)
+	}
+	cs := NewControllerServer(&deletedOnDetachConnector{connector}, &Options{})
+
+	_, err := cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: volumeID,
+		NodeId:   nodeID,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
+
+func TestCreateVolumeCustomOfferingSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		capacityRange *csi.CapacityRange
+		maxSize       int64
+		expectedSize  int64
+		expectedCode  codes.Code
+	}{
+		{"one byte", &csi.CapacityRange{RequiredBytes: 1}, 0, 1, codes.OK},
+		{"fractional GB", &csi.CapacityRange{RequiredBytes: 1_500_000_000}, 0, 2, codes.OK},
+		{"no maximum", &csi.CapacityRange{RequiredBytes: 2048 * 1024 * 1024 * 1024}, 0, 2048, codes.OK},
+		{"maximum", &csi.CapacityRange{RequiredBytes: 1024 * 1024 * 1024 * 1024}, 1024, 1024, codes.OK},
+		{"rounded up above maximum", &csi.CapacityRange{RequiredBytes: 1024*1024*1024*1024 + 1}, 1024, 0, codes.OutOfRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(fake.New(), &Options{MaxCustomVolumeSize: c.maxSize})
+
+			req := createVolumeRequest("pvc-1", 0, nil, nil)
+			req.CapacityRange = c.capacityRange
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if size := resp.GetVolume().GetCapacityBytes(); size != util.GigaBytesToBytes(c.expectedSize) {
+				t.Errorf("Expected size %d GB, got %d bytes", c.expectedSize, size)
+			}
+		})
+	}
+}
+
+// lateZonesConnector is a fake connector reporting no zone on the first listings.
+type lateZonesConnector struct {
+	cloud.Interface
+	emptyListings int
+}
+
+func (c *lateZonesConnector) ListZonesID(ctx context.Context) ([]string, error) {
+	if c.emptyListings > 0 {
+		c.emptyListings--
+
+		return []string{}, nil
+	}
+
+	return c.Interface.ListZonesID(ctx)
+}
+
+func TestCreateVolumeNoZoneAvailable(t *testing.T) {
+	cases := []struct {
+		name          string
+		emptyListings int
+		expectedCode  codes.Code
+	}{
+		{"zones populated after a retry", 1, codes.OK},
+		{"no zone", 10, codes.Unavailable},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs, _ := NewControllerServer(&lateZonesConnector{fake.New(), c.emptyListings}, &Options{}).(*controllerServer)
+			cs.listZonesBackoff = wait.Backoff{Duration: time.Millisecond, Factor: 1, Steps: 3}
+
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1, nil, nil))
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+		})
+	}
+}
+
+// vmStatesConnector is a fake connector with VMs in given states.
+type vmStatesConnector struct {
+	cloud.Interface
+	states map[string]string
+}
+
+func (c *vmStatesConnector) GetVMByID(_ context.Context, vmID string) (*cloud.VM, error) {
+	state, ok := c.states[vmID]
+	if !ok {
+		return nil, cloud.ErrNotFound
+	}
+
+	return &cloud.VM{ID: vmID, State: state}, nil
+}
+
+func TestControllerPublishVolumeFailoverDetach(t *testing.T) {
+	ctx := context.Background()
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	nodeID := "0d7107a3-94d2-44e7-89b8-8930881309a5"
+
+	cases := []struct {
+		name           string
+		failoverDetach bool
+		oldNodeState   string
+		expectedCode   codes.Code
+		expectedVMID   string
+	}{
+		{"failover disabled", false, "Stopped", codes.AlreadyExists, "old-node"},
+		{"old node stopped", true, "Stopped", codes.OK, nodeID},
+		{"old node absent", true, "", codes.OK, nodeID},
+		{"old node running", true, "Running", codes.AlreadyExists, "old-node"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			states := map[string]string{nodeID: "Running"}
+			if c.oldNodeState != "" {
+				states["old-node"] = c.oldNodeState
+			}
+			connector := &vmStatesConnector{fake.New(), states}
+			if _, err := connector.AttachVolume(ctx, volumeID, "old-node"); err != nil {
+				t.Fatalf("Cannot attach volume: %v", err)
+			}
+
+			cs := NewControllerServer(connector, &Options{FailoverDetach: c.failoverDetach})
+			_, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId: volumeID,
+				NodeId:   nodeID,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessMode: &onlyVolumeCapAccessMode,
+				},
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			vol, _ := connector.GetVolumeByID(ctx, volumeID)
+			if vol.VirtualMachineID != c.expectedVMID {
+				t.Errorf("Expected volume attached to %s, got %s", c.expectedVMID, vol.VirtualMachineID)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeClone(t *testing.T) {
+	cases := []struct {
+		name           string
+		sourceVolumeID string
+		zones          []string
+		params         map[string]string
+		expectedCode   codes.Code
+	}{
+		{"same zone", "", []string{"a1887604-237c-4212-a9cd-94620b7880fa"}, nil, codes.OK},
+		{"same zone by name", "", []string{"zone-1"}, nil, codes.OK},
+		{"no topology", "", nil, nil, codes.OK},
+		{"other zone", "", []string{"zone-b"}, nil, codes.InvalidArgument},
+		{"unknown source", "unknown", nil, nil, codes.NotFound},
+		{"fixed offering", "", nil, map[string]string{DiskOfferingKey: "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e"}, codes.OK},
+		{"project", "", nil, map[string]string{ProjectIDKey: "project-1"}, codes.OK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			connector := fake.New()
+			cs := NewControllerServer(connector, &Options{})
+
+			if c.sourceVolumeID == "" {
+				// The source volume is larger than the requested clone.
+				sourceVolumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+					Name:           "pvc-source",
+					DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+					ZoneID:         "a1887604-237c-4212-a9cd-94620b7880fa",
+					SizeInGB:       10,
+				})
+				if err != nil {
+					t.Fatalf("Cannot create source volume: %v", err)
+				}
+				c.sourceVolumeID = sourceVolumeID
+			}
+
+			req := createVolumeRequest("pvc-clone", 1, c.zones, nil)
+			maps.Copy(req.Parameters, c.params)
+			req.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Volume{
+					Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: c.sourceVolumeID},
+				},
+			}
+			resp, err := cs.CreateVolume(ctx, req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.GetVolume().GetContentSource().GetVolume().GetVolumeId(); got != c.sourceVolumeID {
+				t.Errorf("Expected content source volume %s, got %s", c.sourceVolumeID, got)
+			}
+			// The clone is at least as large as its 10 GB source.
+			if size := resp.GetVolume().GetCapacityBytes(); size != util.GigaBytesToBytes(10) {
+				t.Errorf("Expected size 10 GB, got %d bytes", size)
+			}
+			// The clone has the disk offering and project of the storage class.
+			vol, err := connector.GetVolumeByID(ctx, resp.GetVolume().GetVolumeId())
+			if err != nil {
+				t.Fatalf("Cannot get clone: %v", err)
+			}
+			if vol.DiskOfferingID != req.GetParameters()[DiskOfferingKey] || vol.ProjectID != req.GetParameters()[ProjectIDKey] {
+				t.Errorf("Expected clone with offering %s in project %q, got offering %s in project %q",
+					req.GetParameters()[DiskOfferingKey], req.GetParameters()[ProjectIDKey], vol.DiskOfferingID, vol.ProjectID)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeFixedDiskOffering(t *testing.T) {
+	cases := []struct {
+		name          string
+		capacityRange *csi.CapacityRange
+		expectedCode  codes.Code
+	}{
+		{"smaller than offering", &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(5)}, codes.OK},
+		{"size of offering", &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(10)}, codes.OK},
+		{"larger than offering", &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(11)}, codes.InvalidArgument},
+		{"limit below offering", &csi.CapacityRange{LimitBytes: util.GigaBytesToBytes(5)}, codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(fake.New(), &Options{})
+
+			req := createVolumeRequest("pvc-1", 0, nil, nil)
+			req.Parameters[DiskOfferingKey] = "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e"
+			req.CapacityRange = c.capacityRange
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if err == nil && resp.GetVolume().GetCapacityBytes() != util.GigaBytesToBytes(10) {
+				t.Errorf("Expected the 10 GB of the offering, got %d bytes", resp.GetVolume().GetCapacityBytes())
+			}
+		})
+	}
+}
+
+func TestCreateVolumeTagsPVName(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	cs := NewControllerServer(connector, &Options{})
+
+	req := createVolumeRequest("pvc-1", 1, nil, nil)
+	req.Parameters[PVNameKey] = "pvc-1"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	vol, err := connector.GetVolumeByTag(ctx, cloud.PVNameTagKey, "pvc-1")
+	if err != nil {
+		t.Fatalf("Cannot find volume by PersistentVolume name: %v", err)
+	}
+	if vol.ID != resp.GetVolume().GetVolumeId() {
+		t.Errorf("Expected volume %s, got %s", resp.GetVolume().GetVolumeId(), vol.ID)
+	}
+}
+
+func TestCreateVolumeInProject(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	cs := NewControllerServer(connector, &Options{})
+
+	req := createVolumeRequest("pvc-1", 1, nil, nil)
+	req.Parameters[ProjectIDKey] = "project-1"
+	resp, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	vol, err := connector.GetVolumeByID(ctx, resp.GetVolume().GetVolumeId())
+	if err != nil {
+		t.Fatalf("Cannot get volume: %v", err)
+	}
+	if vol.ProjectID != "project-1" {
+		t.Errorf("Expected volume in project project-1, got %q", vol.ProjectID)
+	}
+
+	// Creating the volume again finds the existing one.
+	again, err := cs.CreateVolume(ctx, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if again.GetVolume().GetVolumeId() != vol.ID {
+		t.Errorf("Expected existing volume %s, got %s", vol.ID, again.GetVolume().GetVolumeId())
+	}
+}
+
+func TestControllerExpandVolumeOfferingMaxSize(t *testing.T) {
+	cases := []struct {
+		name           string
+		diskOfferingID string
+		sizeInGB       int64
+		expectedCode   codes.Code
+	}{
+		{"custom offering within maximum", "9743fd77-0f5d-4ef9-b2f8-f194235c769c", 100, codes.OK},
+		{"custom offering beyond maximum", "9743fd77-0f5d-4ef9-b2f8-f194235c769c", 101, codes.OutOfRange},
+		{"fixed offering within size", "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e", 10, codes.OK},
+		{"fixed offering beyond size", "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e", 11, codes.OutOfRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			connector := fake.New()
+			volumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{Name: "vol-2", DiskOfferingID: c.diskOfferingID})
+			if err != nil {
+				t.Fatalf("Cannot create volume: %v", err)
+			}
+			cs := NewControllerServer(connector, &Options{MaxCustomVolumeSize: 100})
+
+			_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: util.GigaBytesToBytes(c.sizeInGB)},
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolumeSizeIncrements(t *testing.T) {
+	const diskOfferingID = "9743fd77-0f5d-4ef9-b2f8-f194235c769c"
+
+	cases := []struct {
+		name         string
+		increments   map[string]int64
+		sizeInGB     int64
+		limitInGB    int64
+		expectedSize int64
+		expectedCode codes.Code
+	}{
+		{"no increment", nil, 11, 0, 11, codes.OK},
+		{"rounded up", map[string]int64{diskOfferingID: 10}, 11, 0, 20, codes.OK},
+		{"already a multiple", map[string]int64{diskOfferingID: 10}, 30, 0, 30, codes.OK},
+		{"other offering", map[string]int64{"other": 10}, 11, 0, 11, codes.OK},
+		{"rounded beyond limit", map[string]int64{diskOfferingID: 10}, 11, 15, 0, codes.OutOfRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			connector := fake.New()
+			volumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{Name: "vol-2", DiskOfferingID: diskOfferingID, SizeInGB: 1})
+			if err != nil {
+				t.Fatalf("Cannot create volume: %v", err)
+			}
+			cs := NewControllerServer(connector, &Options{SizeIncrements: c.increments})
+
+			resp, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+				VolumeId: volumeID,
+				CapacityRange: &csi.CapacityRange{
+					RequiredBytes: util.GigaBytesToBytes(c.sizeInGB),
+					LimitBytes:    util.GigaBytesToBytes(c.limitInGB),
+				},
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if resp.GetCapacityBytes() != util.GigaBytesToBytes(c.expectedSize) {
+				t.Errorf("Expected capacity of %d GB, got %d bytes", c.expectedSize, resp.GetCapacityBytes())
+			}
+			if c.expectedCode != codes.OK {
+				return
+			}
+			vol, _ := connector.GetVolumeByID(ctx, volumeID)
+			if vol.Size != util.GigaBytesToBytes(c.expectedSize) {
+				t.Errorf("Expected volume of %d GB, got %d bytes", c.expectedSize, vol.Size)
+			}
+		})
+	}
+}
+
+// volumeStateConnector is a fake connector with volumes in a given state.
+type volumeStateConnector struct {
+	cloud.Interface
+	state string
+}
+
+func (c *volumeStateConnector) GetVolumeByID(ctx context.Context, volumeID string) (*cloud.Volume, error) {
+	vol, err := c.Interface.GetVolumeByID(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	vol.State = c.state
+
+	return vol, nil
+}
+
+func TestControllerGetVolumeCondition(t *testing.T) {
+	ctx := context.Background()
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+
+	cases := []struct {
+		name             string
+		volumeState      string
+		attachedVM       string
+		vmStates         map[string]string
+		expectedAbnormal bool
+	}{
+		{"ready", "Ready", "", nil, false},
+		{"destroyed", "Destroy", "", nil, true},
+		{"expunging", "Expunging", "", nil, true},
+		{"attached to running VM", "Ready", "vm-1", map[string]string{"vm-1": "Running"}, false},
+		{"attached to stopped VM", "Ready", "vm-1", map[string]string{"vm-1": "Stopped"}, false},
+		{"attached to destroyed VM", "Ready", "vm-1", map[string]string{"vm-1": "Destroyed"}, true},
+		{"attached to missing VM", "Ready", "vm-1", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connector := fake.New()
+			if c.attachedVM != "" {
+				if _, err := connector.AttachVolume(ctx, volumeID, c.attachedVM); err != nil {
+					t.Fatalf("Cannot attach volume: %v", err)
+				}
+			}
+			cs := NewControllerServer(&volumeStateConnector{
+				Interface: &vmStatesConnector{Interface: connector, states: c.vmStates},
+				state:     c.volumeState,
+			}, &Options{})
+
+			resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			condition := resp.GetStatus().GetVolumeCondition()
+			if condition.GetAbnormal() != c.expectedAbnormal {
+				t.Errorf("Expected abnormal %v, got condition %v", c.expectedAbnormal, condition)
+			}
+			if c.attachedVM != "" && !slices.Equal(resp.GetStatus().GetPublishedNodeIds(), []string{c.attachedVM}) {
+				t.Errorf("Expected published node %s, got %v", c.attachedVM, resp.GetStatus().GetPublishedNodeIds())
+			}
+		})
+	}
+
+	cs := NewControllerServer(fake.New(), &Options{})
+	if _, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "missing"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Expected NotFound error, got %v", err)
+	}
+}
+
+// truncatingConnector is a fake connector truncating the names of new volumes.
+type truncatingConnector struct {
+	cloud.Interface
+	maxNameLength int
+}
+
+func (c *truncatingConnector) CreateVolume(ctx context.Context, opts *cloud.VolumeOptions) (string, error) {
+	truncated := *opts
+	truncated.Name = opts.Name[:min(len(opts.Name), c.maxNameLength)]
+
+	return c.Interface.CreateVolume(ctx, &truncated)
+}
+
+func TestCreateVolumeTruncatedName(t *testing.T) {
+	ctx := context.Background()
+	connector := &truncatingConnector{Interface: fake.New(), maxNameLength: 16}
+	cs := NewControllerServer(connector, &Options{})
+
+	name := "pvc-" + strings.Repeat("0123456789", 8)
+	first, err := cs.CreateVolume(ctx, createVolumeRequest(name, 1, nil, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The volume cannot be found by name anymore, but by tag.
+	if _, err := connector.GetVolumeByName(ctx, name); !errors.Is(err, cloud.ErrNotFound) {
+		t.Fatalf("Expected volume not to be found by name, got %v", err)
+	}
+	vol, err := connector.GetVolumeByTag(ctx, cloud.CSINameTagKey, name)
+	if err != nil {
+		t.Fatalf("Expected volume to be found by tag, got %v", err)
+	}
+	if vol.ID != first.GetVolume().GetVolumeId() {
+		t.Errorf("Expected volume %s, got %s", first.GetVolume().GetVolumeId(), vol.ID)
+	}
+
+	// Retrying the request returns the same volume.
+	second, err := cs.CreateVolume(ctx, createVolumeRequest(name, 1, nil, nil))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if second.GetVolume().GetVolumeId() != first.GetVolume().GetVolumeId() {
+		t.Errorf("Expected the same volume %s, got %s", first.GetVolume().GetVolumeId(), second.GetVolume().GetVolumeId())
+	}
+}
+
+// slowSnapshotConnector is a fake connector recording the maximum number
+// of concurrent snapshot creations, which last a while.
+type slowSnapshotConnector struct {
+	cloud.Interface
+	duration time.Duration
+
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (c *slowSnapshotConnector) CreateSnapshot(ctx context.Context, volumeID, name string) (*cloud.Snapshot, error) {
+	c.mu.Lock()
+	c.inFlight++
+	c.maxInFlight = max(c.maxInFlight, c.inFlight)
+	c.mu.Unlock()
+
+	time.Sleep(c.duration)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+
+	return c.Interface.CreateSnapshot(ctx, volumeID, name)
+}
+
+func TestCreateSnapshotConcurrencyLimit(t *testing.T) {
+	ctx := context.Background()
+	connector := &slowSnapshotConnector{Interface: fake.New(), duration: 20 * time.Millisecond}
+	cs := NewControllerServer(connector, &Options{MaxConcurrentSnapshots: 2})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+				Name:           fmt.Sprintf("snap-%d", i),
+				SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+			})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
+	}
+	if connector.maxInFlight != 2 {
+		t.Errorf("Expected at most 2 concurrent snapshot creations, got %d", connector.maxInFlight)
+	}
+
+	// A request waiting for a slot gives up with its context.
+	connector.duration = time.Second
+	go func() {
+		_, _ = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "slow-1", SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072"})
+	}()
+	go func() {
+		_, _ = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "slow-2", SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072"})
+	}()
+	time.Sleep(50 * time.Millisecond)
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err := cs.CreateSnapshot(timeoutCtx, &csi.CreateSnapshotRequest{
+		Name:           "waiting",
+		SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded error, got %v", err)
+	}
+}
+
+// ambiguousZoneConnector is a fake connector with several zones of each name.
+type ambiguousZoneConnector struct {
+	cloud.Interface
+}
+
+func (c *ambiguousZoneConnector) GetZoneIDByName(_ context.Context, _ string) (string, error) {
+	return "", cloud.ErrTooManyResults
+}
+
+func TestCreateVolumeZoneName(t *testing.T) {
+	ctx := context.Background()
+	zoneID := "a1887604-237c-4212-a9cd-94620b7880fa"
+
+	cases := []struct {
+		name         string
+		connector    cloud.Interface
+		requisite    []string
+		params       map[string]string
+		expectedZone string
+		expectedCode codes.Code
+	}{
+		{"topology zone ID", fake.New(), []string{zoneID}, nil, zoneID, codes.OK},
+		{"topology zone name", fake.New(), []string{"zone-1"}, nil, zoneID, codes.OK},
+		{"parameter zone name", fake.New(), nil, map[string]string{ZoneParamKey: "zone-1"}, zoneID, codes.OK},
+		{"ambiguous zone name", &ambiguousZoneConnector{fake.New()}, []string{"zone-1"}, nil, "", codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(c.connector, &Options{})
+			req := createVolumeRequest("pvc-zone", 1, c.requisite, nil)
+			maps.Copy(req.Parameters, c.params)
+
+			resp, err := cs.CreateVolume(ctx, req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if zone := resp.GetVolume().GetAccessibleTopology()[0].GetSegments()[ZoneKey]; zone != c.expectedZone {
+				t.Errorf("Expected zone %s, got %s", c.expectedZone, zone)
+			}
+			vol, _ := c.connector.GetVolumeByID(ctx, resp.GetVolume().GetVolumeId())
+			if vol.ZoneID != c.expectedZone {
+				t.Errorf("Expected volume created in zone %s, got %s", c.expectedZone, vol.ZoneID)
+			}
+
+			// The existing volume suits a retried request.
+			retried, err := cs.CreateVolume(ctx, req)
+			if err != nil {
+				t.Fatalf("Retry: unexpected error %v", err)
+			}
+			if retried.GetVolume().GetVolumeId() != vol.ID {
+				t.Errorf("Retry: expected volume %s, got %s", vol.ID, retried.GetVolume().GetVolumeId())
+			}
+		})
+	}
+}
+
+// scopedSnapshotsErrorConnector is a fake connector failing to list
+// the snapshots of a volume, or a given snapshot.
+type scopedSnapshotsErrorConnector struct {
+	cloud.Interface
+}
+
+func (c *scopedSnapshotsErrorConnector) ListSnapshots(ctx context.Context, volumeID, snapshotID string) ([]*cloud.Snapshot, error) {
+	if volumeID != "" || snapshotID != "" {
+		return nil, errors.New("unable to find volume")
+	}
+
+	return c.Interface.ListSnapshots(ctx, volumeID, snapshotID)
+}
+
+func TestListSnapshotsFallback(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	otherVolumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{Name: "vol-2", SizeInGB: 1})
+	if err != nil {
+		t.Fatalf("Cannot create volume: %v", err)
+	}
+	snap, err := connector.CreateSnapshot(ctx, volumeID, "snap-1")
+	if err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+	if _, err := connector.CreateSnapshot(ctx, otherVolumeID, "snap-2"); err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+
+	req := &csi.ListSnapshotsRequest{SourceVolumeId: volumeID}
+	cs := NewControllerServer(&scopedSnapshotsErrorConnector{connector}, &Options{})
+	if _, err := cs.ListSnapshots(ctx, req); status.Code(err) != codes.Internal {
+		t.Fatalf("Expected Internal error without fallback, got %v", err)
+	}
+
+	cs = NewControllerServer(&scopedSnapshotsErrorConnector{connector}, &Options{ListSnapshotsFallback: true})
+	for _, req := range []*csi.ListSnapshotsRequest{
+		{SourceVolumeId: volumeID},
+		{SnapshotId: snap.ID},
+	} {
+		resp, err := cs.ListSnapshots(ctx, req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(resp.GetEntries()) != 1 || resp.GetEntries()[0].GetSnapshot().GetSnapshotId() != snap.ID {
+			t.Errorf("Expected only snapshot %s, got %v", snap.ID, resp.GetEntries())
+		}
+	}
+}
+
+func TestManagedSnapshotsOnly(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	volumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	managed, err := connector.CreateSnapshot(ctx, volumeID, "snap-1")
+	if err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+	external, err := connector.CreateSnapshot(ctx, volumeID, "snap-2")
+	if err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+	// Taken outside of the driver, e.g. in the CloudStack UI.
+	external.Tags = map[string]string{"team": "storage"}
+
+	cases := []struct {
+		name         string
+		managedOnly  bool
+		req          *csi.ListSnapshotsRequest
+		expectedIDs  []string
+		restoredCode codes.Code
+	}{
+		{"all snapshots", false, &csi.ListSnapshotsRequest{}, []string{managed.ID, external.ID}, codes.OK},
+		{"all snapshots of volume", false, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID}, []string{managed.ID, external.ID}, codes.OK},
+		{"external snapshot by ID", false, &csi.ListSnapshotsRequest{SnapshotId: external.ID}, []string{external.ID}, codes.OK},
+		{"managed snapshots", true, &csi.ListSnapshotsRequest{}, []string{managed.ID}, codes.NotFound},
+		{"managed snapshots of volume", true, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID}, []string{managed.ID}, codes.NotFound},
+		{"managed snapshot by ID", true, &csi.ListSnapshotsRequest{SnapshotId: managed.ID}, []string{managed.ID}, codes.NotFound},
+		{"external snapshot by ID hidden", true, &csi.ListSnapshotsRequest{SnapshotId: external.ID}, []string{}, codes.NotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(connector, &Options{ManagedSnapshotsOnly: c.managedOnly})
+			resp, err := cs.ListSnapshots(ctx, c.req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			ids := make([]string, 0, len(resp.GetEntries()))
+			for _, entry := range resp.GetEntries() {
+				ids = append(ids, entry.GetSnapshot().GetSnapshotId())
+			}
+			slices.Sort(ids)
+			expectedIDs := slices.Sorted(slices.Values(c.expectedIDs))
+			if !slices.Equal(ids, expectedIDs) {
+				t.Errorf("Expected snapshots %v, got %v", expectedIDs, ids)
+			}
+
+			req := createVolumeRequest("restore-"+c.name, 1, nil, nil)
+			req.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: external.ID},
+				},
+			}
+			if _, err := cs.CreateVolume(ctx, req); status.Code(err) != c.restoredCode {
+				t.Errorf("Expected %v restoring external snapshot, got %v", c.restoredCode, err)
+			}
+		})
+	}
+}
+
+// snapshotSizeConnector is a fake connector with snapshots of a given size.
+type snapshotSizeConnector struct {
+	cloud.Interface
+	size int64
+}
+
+func (c *snapshotSizeConnector) GetSnapshotByID(ctx context.Context, snapshotID string) (*cloud.Snapshot, error) {
+	snapshot, err := c.Interface.GetSnapshotByID(ctx, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Size = c.size
+
+	return snapshot, nil
+}
+
+func TestCreateVolumeFromSnapshotLimitBytes(t *testing.T) {
+	ctx := context.Background()
+	connector := &snapshotSizeConnector{Interface: fake.New(), size: util.GigaBytesToBytes(20)}
+	snapshot, err := connector.CreateSnapshot(ctx, "ace9f28b-3081-40c1-8353-4cc3e3014072", "snap-1")
+	if err != nil {
+		t.Fatalf("Cannot create snapshot: %v", err)
+	}
+	cs := NewControllerServer(connector, &Options{})
+
+	cases := []struct {
+		name         string
+		limitInGB    int64
+		expectedCode codes.Code
+	}{
+		{"no limit", 0, codes.OK},
+		{"limit above snapshot size", 30, codes.OK},
+		{"limit below snapshot size", 15, codes.OutOfRange},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			req := createVolumeRequest("restore-"+c.name, 10, nil, nil)
+			req.CapacityRange.LimitBytes = util.GigaBytesToBytes(c.limitInGB)
+			req.VolumeContentSource = &csi.VolumeContentSource{
+				Type: &csi.VolumeContentSource_Snapshot{
+					Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshot.ID},
+				},
+			}
+
+			if _, err := cs.CreateVolume(ctx, req); status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if _, err := connector.GetVolumeByName(ctx, req.GetName()); (err == nil) != (c.expectedCode == codes.OK) {
+				t.Errorf("Expected volume to be created: %v, got error %v", c.expectedCode == codes.OK, err)
+			}
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	ctx := context.Background()
+	capacities := &capacityConnector{
+		Interface:  fake.New(),
+		capacities: map[string]int64{"zone-a": util.GigaBytesToBytes(10), "zone-b": util.GigaBytesToBytes(5)},
+	}
+
+	cases := []struct {
+		name         string
+		connector    cloud.Interface
+		zone         string
+		offeringID   string
+		expected     int64
+		expectedCode codes.Code
+	}{
+		{"all zones", capacities, "", "", util.GigaBytesToBytes(15), codes.OK},
+		{"zone", capacities, "zone-a", "", util.GigaBytesToBytes(10), codes.OK},
+		{"zone and offering", fake.New(), "a1887604-237c-4212-a9cd-94620b7880fa", "9743fd77-0f5d-4ef9-b2f8-f194235c769c", util.GigaBytesToBytes(1024), codes.OK},
+		{"zone name", fake.New(), "zone-1", "", util.GigaBytesToBytes(1024), codes.OK},
+		{"unknown offering", fake.New(), "", "unknown", 0, codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(c.connector, &Options{})
+			req := &csi.GetCapacityRequest{}
+			if c.zone != "" {
+				req.AccessibleTopology = Topology{ZoneID: c.zone}.ToCSI()
+			}
+			if c.offeringID != "" {
+				req.Parameters = map[string]string{DiskOfferingKey: c.offeringID}
+			}
+
+			resp, err := cs.GetCapacity(ctx, req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if resp.GetAvailableCapacity() != c.expected {
+				t.Errorf("Expected capacity %d, got %d", c.expected, resp.GetAvailableCapacity())
+			}
+		})
+	}
+}
+
+func TestListVolumes(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	for _, name := range []string{"pvc-1", "pvc-2"} {
+		if _, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+			Name:           name,
+			DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+			ZoneID:         "a1887604-237c-4212-a9cd-94620b7880fa",
+			SizeInGB:       1,
+		}); err != nil {
+			t.Fatalf("Failed to create volume: %v", err)
+		}
+	}
+	if _, err := connector.AttachVolume(ctx, "ace9f28b-3081-40c1-8353-4cc3e3014072", "0d7107a3-94d2-44e7-89b8-8930881309a5"); err != nil {
+		t.Fatalf("Failed to attach volume: %v", err)
+	}
+	cs := NewControllerServer(connector, &Options{})
+
+	resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(resp.GetEntries()) != 3 || resp.GetNextToken() != "" {
+		t.Fatalf("Expected 3 volumes and no next token, got %d and %q", len(resp.GetEntries()), resp.GetNextToken())
+	}
+	for _, entry := range resp.GetEntries() {
+		if entry.GetVolume().GetVolumeId() != "ace9f28b-3081-40c1-8353-4cc3e3014072" {
+			continue
+		}
+		if !slices.Equal(entry.GetStatus().GetPublishedNodeIds(), []string{"0d7107a3-94d2-44e7-89b8-8930881309a5"}) {
+			t.Errorf("Expected the volume to be published on the node, got %v", entry.GetStatus().GetPublishedNodeIds())
+		}
+	}
+
+	var ids []string
+	token := ""
+	for range 3 {
+		resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 2, StartingToken: token})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for _, entry := range resp.GetEntries() {
+			ids = append(ids, entry.GetVolume().GetVolumeId())
+		}
+		token = resp.GetNextToken()
+		if token == "" {
+			break
+		}
+	}
+	if len(ids) != 3 || len(slices.Compact(slices.Sorted(slices.Values(ids)))) != 3 {
+		t.Errorf("Expected 3 distinct volumes across pages, got %v", ids)
+	}
+
+	if _, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid"}); status.Code(err) != codes.Aborted {
+		t.Errorf("Expected Aborted for an invalid token, got %v", err)
+	}
+}
+
+type encryptedOfferingConnector struct {
+	cloud.Interface
+}
+
+func (c *encryptedOfferingConnector) GetDiskOffering(ctx context.Context, diskOfferingID string) (*cloud.DiskOffering, error) {
+	offering, err := c.Interface.GetDiskOffering(ctx, diskOfferingID)
+	if err != nil {
+		return nil, err
+	}
+	offering.Encrypt = true
+
+	return offering, nil
+}
+
+// versionConnector is a fake connector reporting the given CloudStack version.
+type versionConnector struct {
+	cloud.Interface
+	version string
+}
+
+func (c *versionConnector) GetCloudStackVersion(_ context.Context) (string, error) {
+	return c.version, nil
+}
+
+func TestCreateVolumeEncrypted(t *testing.T) {
+	cases := []struct {
+		name         string
+		connector    cloud.Interface
+		encrypted    string
+		expectedCode codes.Code
+	}{
+		{"encrypted offering", &encryptedOfferingConnector{fake.New()}, "true", codes.OK},
+		{"unencrypted offering", fake.New(), "true", codes.InvalidArgument},
+		{"encryption not requested", fake.New(), "", codes.OK},
+		{"CloudStack 4.18", &versionConnector{&encryptedOfferingConnector{fake.New()}, "4.18.0.0"}, "true", codes.OK},
+		{"CloudStack before 4.18", &versionConnector{&encryptedOfferingConnector{fake.New()}, "4.17.2.0"}, "true", codes.InvalidArgument},
+		{"CloudStack before 4.18 without encryption", &versionConnector{fake.New(), "4.17.2.0"}, "", codes.OK},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(c.connector, &Options{})
+
+			req := createVolumeRequest("pvc-1", 1, nil, nil)
+			if c.encrypted != "" {
+				req.Parameters[EncryptedKey] = c.encrypted
+			}
+			if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+		})
+	}
+}
+
+// unmanagedSnapshotsConnector is a fake connector listing the snapshots
+// as taken outside of the driver.
+type unmanagedSnapshotsConnector struct {
+	cloud.Interface
+}
+
+func (c *unmanagedSnapshotsConnector) ListSnapshots(ctx context.Context, volumeID, snapshotID string) ([]*cloud.Snapshot, error) {
+	snapshots, err := c.Interface.ListSnapshots(ctx, volumeID, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	unmanaged := make([]*cloud.Snapshot, 0, len(snapshots))
+	for _, snapshot := range snapshots {
+		s := *snapshot
+		s.Tags = nil
+		unmanaged = append(unmanaged, &s)
+	}
+
+	return unmanaged, nil
+}
+
+// staticSnapshotReferences is a snapshotReferenceLister of given snapshots.
+type staticSnapshotReferences map[string]bool
+
+func (r staticSnapshotReferences) ListSnapshotReferences(context.Context) (map[string]bool, error) {
+	return r, nil
+}
+
+func TestDeleteVolumeWithSnapshots(t *testing.T) {
+	const volumeID = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	cases := []struct {
+		name                  string
+		snapshotsOnDelete     string
+		unmanaged             bool
+		referenced            bool
+		expectedCode          codes.Code
+		expectedVolumeFound   bool
+		expectedSnapshotFound bool
+	}{
+		{"refuse", VolumeSnapshotsRefuse, false, false, codes.FailedPrecondition, true, true},
+		{"refuse unmanaged", VolumeSnapshotsRefuse, true, false, codes.OK, false, true},
+		{"delete", VolumeSnapshotsDelete, false, false, codes.OK, false, false},
+		{"delete referenced", VolumeSnapshotsDelete, false, true, codes.FailedPrecondition, true, true},
+		{"delete unmanaged", VolumeSnapshotsDelete, true, false, codes.OK, false, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			var connector cloud.Interface = fake.New()
+			snapshot, err := connector.CreateSnapshot(ctx, volumeID, "snap-1")
+			if err != nil {
+				t.Fatalf("Cannot create snapshot: %v", err)
+			}
+			if c.unmanaged {
+				connector = &unmanagedSnapshotsConnector{connector}
+			}
+			cs, _ := NewControllerServer(connector, &Options{VolumeSnapshotsOnDelete: c.snapshotsOnDelete}).(*controllerServer)
+			if c.snapshotsOnDelete == VolumeSnapshotsDelete {
+				cs.snapshotReferences = staticSnapshotReferences{snapshot.ID: c.referenced}
+			}
+
+			_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if err != nil && !strings.Contains(err.Error(), snapshot.ID) {
+				t.Errorf("Expected the error to list snapshot %s, got %v", snapshot.ID, err)
+			}
+			if _, err := connector.GetVolumeByID(ctx, volumeID); (err == nil) != c.expectedVolumeFound {
+				t.Errorf("Expected volume found: %v, got %v", c.expectedVolumeFound, err)
+			}
+			snapshots, _ := connector.ListSnapshots(ctx, volumeID, "")
+			if c.expectedSnapshotFound != (len(snapshots) == 1) {
+				t.Errorf("Expected snapshot found: %v, got %v", c.expectedSnapshotFound, snapshots)
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolumeZoneMismatch(t *testing.T) {
+	ctx := context.Background()
+	connector := fake.New()
+	volID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+		Name:           "vol-other-zone",
+		DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+		ZoneID:         "b6d4d8e0-5d3b-4bbd-a0a4-1b3e8e1c0b0f",
+		SizeInGB:       1,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create volume: %v", err)
+	}
+
+	cs := NewControllerServer(connector, &Options{})
+	_, err = cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId: volID,
+		NodeId:   "0d7107a3-94d2-44e7-89b8-8930881309a5",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessMode: &onlyVolumeCapAccessMode,
+		},
+	})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Expected FailedPrecondition, got %v", err)
+	}
+	if vol, _ := connector.GetVolumeByID(ctx, volID); vol.VirtualMachineID != "" {
+		t.Errorf("Expected volume not to be attached, got attached to %s", vol.VirtualMachineID)
+	}
+}
+
+func TestCreateSnapshotVolumeState(t *testing.T) {
+	cases := []struct {
+		state        string
+		expectedCode codes.Code
+	}{
+		{"Ready", codes.OK},
+		{"Allocated", codes.FailedPrecondition},
+		{"Migrating", codes.FailedPrecondition},
+	}
+	for _, c := range cases {
+		t.Run(c.state, func(t *testing.T) {
+			cs := NewControllerServer(&volumeStateConnector{Interface: fake.New(), state: c.state}, &Options{})
+
+			_, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+				Name:           "snap-1",
+				SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+		})
+	}
+}
+
+// iopsConnector is a fake connector with custom IOPS disk offerings,
+// recording the IOPS of the created volumes.
+type iopsConnector struct {
+	cloud.Interface
+	customizedIops   bool
+	minIops, maxIops int64
+}
+
+func (c *iopsConnector) GetDiskOffering(ctx context.Context, diskOfferingID string) (*cloud.DiskOffering, error) {
+	offering, err := c.Interface.GetDiskOffering(ctx, diskOfferingID)
+	if err != nil {
+		return nil, err
+	}
+	offering.IsCustomizedIops = c.customizedIops
+
+	return offering, nil
+}
+
+func (c *iopsConnector) CreateVolume(ctx context.Context, opts *cloud.VolumeOptions) (string, error) {
+	c.minIops, c.maxIops = opts.MinIops, opts.MaxIops
+
+	return c.Interface.CreateVolume(ctx, opts)
+}
+
+func TestCreateVolumeIops(t *testing.T) {
+	cases := []struct {
+		name            string
+		customizedIops  bool
+		params          map[string]string
+		expectedCode    codes.Code
+		expectedMinIops int64
+		expectedMaxIops int64
+	}{
+		{"custom IOPS offering", true, map[string]string{MinIopsKey: "500", MaxIopsKey: "1000"}, codes.OK, 500, 1000},
+		{"maximum only", true, map[string]string{MaxIopsKey: "1000"}, codes.OK, 0, 1000},
+		{"offering without custom IOPS", false, map[string]string{MinIopsKey: "500", MaxIopsKey: "1000"}, codes.OK, 0, 0},
+		{"not numeric", true, map[string]string{MinIopsKey: "fast"}, codes.InvalidArgument, 0, 0},
+		{"negative", true, map[string]string{MaxIopsKey: "-1"}, codes.InvalidArgument, 0, 0},
+		{"minimum above maximum", true, map[string]string{MinIopsKey: "1000", MaxIopsKey: "500"}, codes.InvalidArgument, 0, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connector := &iopsConnector{Interface: fake.New(), customizedIops: c.customizedIops}
+			cs := NewControllerServer(connector, &Options{})
+
+			req := createVolumeRequest("pvc-1", 1, nil, nil)
+			maps.Copy(req.Parameters, c.params)
+			if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if connector.minIops != c.expectedMinIops || connector.maxIops != c.expectedMaxIops {
+				t.Errorf("Expected IOPS %d-%d, got %d-%d", c.expectedMinIops, c.expectedMaxIops, connector.minIops, connector.maxIops)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilitiesMessages(t *testing.T) {
+	mountCap := func(fsType string, mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	blockCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &onlyVolumeCapAccessMode,
+	}
+	cases := []struct {
+		name            string
+		volCaps         []*csi.VolumeCapability
+		expectedMessage string
+	}{
+		{
+			"valid",
+			[]*csi.VolumeCapability{mountCap(FSTypeXfs, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			"",
+		},
+		{
+			"unsupported access mode",
+			[]*csi.VolumeCapability{mountCap(FSTypeExt4, csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			"Requested VolumeCapabilities are invalid: access mode MULTI_NODE_MULTI_WRITER is not supported",
+		},
+		{
+			"unsupported filesystem type",
+			[]*csi.VolumeCapability{mountCap("btrfs", csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			"Requested VolumeCapabilities are invalid: filesystem type btrfs is not supported",
+		},
+		{
+			"block and mount",
+			[]*csi.VolumeCapability{blockCap, mountCap(FSTypeExt4, csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			"Requested VolumeCapabilities are invalid: block and mount access types cannot be requested together",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(fake.New(), &Options{})
+
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				VolumeCapabilities: c.volCaps,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if resp.GetMessage() != c.expectedMessage {
+				t.Errorf("Expected message %q, got %q", c.expectedMessage, resp.GetMessage())
+			}
+			if (resp.GetConfirmed() != nil) != (c.expectedMessage == "") {
+				t.Errorf("Unexpected confirmation %v", resp.GetConfirmed())
+			}
+		})
+	}
+}
+
+// roundingConnector is a fake connector creating volumes with a size
+// rounded up to a multiple of 5 GB.
+type roundingConnector struct {
+	cloud.Interface
+}
+
+func (c *roundingConnector) CreateVolume(ctx context.Context, opts *cloud.VolumeOptions) (string, error) {
+	rounded := *opts
+	rounded.SizeInGB = (opts.SizeInGB + 4) / 5 * 5
+
+	return c.Interface.CreateVolume(ctx, &rounded)
+}
+
+func TestCreateVolumeReportedCapacity(t *testing.T) {
+	cases := []struct {
+		name          string
+		connector     cloud.Interface
+		requiredBytes int64
+		expectedBytes int64
+	}{
+		{"whole GB", fake.New(), util.GigaBytesToBytes(2), util.GigaBytesToBytes(2)},
+		{"rounded up to GB", fake.New(), util.GigaBytesToBytes(2) + 1, util.GigaBytesToBytes(3)},
+		{"rounded by CloudStack", &roundingConnector{fake.New()}, util.GigaBytesToBytes(2), util.GigaBytesToBytes(5)},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(c.connector, &Options{})
+
+			req := createVolumeRequest("pvc-1", 0, nil, nil)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: c.requiredBytes}
+			created, err := cs.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if created.GetVolume().GetCapacityBytes() != c.expectedBytes {
+				t.Errorf("Expected %d bytes for %d requested, got %d", c.expectedBytes, c.requiredBytes, created.GetVolume().GetCapacityBytes())
+			}
+
+			// The capacity reported for the existing volume is the same.
+			existing, err := cs.CreateVolume(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if existing.GetVolume().GetCapacityBytes() != created.GetVolume().GetCapacityBytes() {
+				t.Errorf("Expected %d bytes for the existing volume, got %d", created.GetVolume().GetCapacityBytes(), existing.GetVolume().GetCapacityBytes())
+			}
+		})
+	}
+}
+
+// snapshotStateConnector is a fake connector with snapshots in a given state.
+type snapshotStateConnector struct {
+	cloud.Interface
+	state string
+}
+
+func (c *snapshotStateConnector) CreateSnapshot(ctx context.Context, volumeID, name string) (*cloud.Snapshot, error) {
+	snapshot, err := c.Interface.CreateSnapshot(ctx, volumeID, name)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.State = c.state
+
+	return snapshot, nil
+}
+
+func (c *snapshotStateConnector) ListSnapshots(ctx context.Context, volumeID, snapshotID string) ([]*cloud.Snapshot, error) {
+	snapshots, err := c.Interface.ListSnapshots(ctx, volumeID, snapshotID)
+	for _, snapshot := range snapshots {
+		snapshot.State = c.state
+	}
+
+	return snapshots, err
+}
+
+func (c *snapshotStateConnector) GetSnapshotByName(ctx context.Context, name string) (*cloud.Snapshot, error) {
+	snapshot, err := c.Interface.GetSnapshotByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.State = c.state
+
+	return snapshot, nil
+}
+
+func TestSnapshotReadyToUse(t *testing.T) {
+	cases := []struct {
+		state    string
+		expected bool
+	}{
+		{"BackedUp", true},
+		{"BackingUp", false},
+		{"Creating", false},
+		{"", true},
+	}
+	for _, c := range cases {
+		t.Run(c.state, func(t *testing.T) {
+			ctx := context.Background()
+			cs := NewControllerServer(&snapshotStateConnector{Interface: fake.New(), state: c.state}, &Options{})
+
+			created, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+				Name:           "snap-1",
+				SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if created.GetSnapshot().GetReadyToUse() != c.expected {
+				t.Errorf("Expected CreateSnapshot ReadyToUse %v, got %v", c.expected, created.GetSnapshot().GetReadyToUse())
+			}
+
+			listed, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: created.GetSnapshot().GetSnapshotId()})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if len(listed.GetEntries()) != 1 {
+				t.Fatalf("Expected 1 snapshot, got %d", len(listed.GetEntries()))
+			}
+			if listed.GetEntries()[0].GetSnapshot().GetReadyToUse() != c.expected {
+				t.Errorf("Expected ListSnapshots ReadyToUse %v, got %v", c.expected, listed.GetEntries()[0].GetSnapshot().GetReadyToUse())
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotRetry(t *testing.T) {
+	const volumeID = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	ctx := context.Background()
+	connector := &snapshotStateConnector{Interface: fake.New(), state: "BackingUp"}
+	cs := NewControllerServer(connector, &Options{})
+
+	req := &csi.CreateSnapshotRequest{Name: "snap-1", SourceVolumeId: volumeID}
+	first, err := cs.CreateSnapshot(ctx, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if first.GetSnapshot().GetReadyToUse() {
+		t.Fatalf("Expected snapshot not ready to use")
+	}
+
+	// The external-snapshotter retries until the snapshot is ready.
+	connector.state = cloud.SnapshotStateBackedUp
+	second, err := cs.CreateSnapshot(ctx, req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if second.GetSnapshot().GetSnapshotId() != first.GetSnapshot().GetSnapshotId() {
+		t.Errorf("Expected the same snapshot %s, got %s", first.GetSnapshot().GetSnapshotId(), second.GetSnapshot().GetSnapshotId())
+	}
+	if !second.GetSnapshot().GetReadyToUse() {
+		t.Errorf("Expected snapshot ready to use")
+	}
+	snapshots, err := connector.ListSnapshots(ctx, volumeID, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(snapshots) != 1 {
+		t.Errorf("Expected a single snapshot, got %d", len(snapshots))
+	}
+
+	// The name of a snapshot of another volume is refused.
+	otherVolumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+		Name:           "vol-2",
+		DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+		ZoneID:         "a1887604-237c-4212-a9cd-94620b7880fa",
+		SizeInGB:       1,
+	})
+	if err != nil {
+		t.Fatalf("Cannot create volume: %v", err)
+	}
+	req.SourceVolumeId = otherVolumeID
+	if _, err := cs.CreateSnapshot(ctx, req); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("Expected AlreadyExists, got %v", err)
+	}
+}
+
+func TestSnapshotSizeBytes(t *testing.T) {
+	ctx := context.Background()
+	cs := NewControllerServer(fake.New(), &Options{})
+
+	created, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+		Name:           "snap-1",
+		SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if created.GetSnapshot().GetSizeBytes() != 10 {
+		t.Errorf("Expected CreateSnapshot SizeBytes 10, got %d", created.GetSnapshot().GetSizeBytes())
+	}
+
+	listed, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: created.GetSnapshot().GetSnapshotId()})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(listed.GetEntries()) != 1 {
+		t.Fatalf("Expected 1 snapshot, got %d", len(listed.GetEntries()))
+	}
+	if listed.GetEntries()[0].GetSnapshot().GetSizeBytes() != 10 {
+		t.Errorf("Expected ListSnapshots SizeBytes 10, got %d", listed.GetEntries()[0].GetSnapshot().GetSizeBytes())
+	}
+}
+
+func TestCreateVolumeZoneDiskOfferings(t *testing.T) {
+	const (
+		zoneID          = "a1887604-237c-4212-a9cd-94620b7880fa"
+		customOffering  = "9743fd77-0f5d-4ef9-b2f8-f194235c769c"
+		fixedOffering   = "f8bd6a5e-bf46-4b4f-8ac6-2f3bb9de0c8e"
+		otherZoneID     = "b2887604-237c-4212-a9cd-94620b7880fa"
+		unknownOffering = "00000000-0000-0000-0000-000000000000"
+	)
+	cases := []struct {
+		name              string
+		zoneDiskOfferings map[string]string
+		expectedCode      codes.Code
+	}{
+		{"no allowlist", nil, codes.OK},
+		{"allowed", map[string]string{zoneID: fixedOffering + ":" + customOffering}, codes.OK},
+		{"zone not listed", map[string]string{otherZoneID: unknownOffering}, codes.OK},
+		{"disallowed", map[string]string{zoneID: fixedOffering}, codes.InvalidArgument},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(fake.New(), &Options{ZoneDiskOfferings: c.zoneDiskOfferings})
+
+			req := createVolumeRequest("pvc-1", 1, nil, nil)
+			req.Parameters[DiskOfferingKey] = customOffering
+			_, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if c.expectedCode == codes.InvalidArgument && !strings.Contains(err.Error(), zoneID) {
+				t.Errorf("Expected error naming zone %s, got %v", zoneID, err)
+			}
+		})
+	}
+}
+
+// clusterStorageConnector is a fake connector whose disk offerings have
+// cluster-wide storage in the given clusters.
+type clusterStorageConnector struct {
+	cloud.Interface
+	clusterIDs []string
+}
+
+func (c *clusterStorageConnector) GetStorageClusterIDs(_ context.Context, _, _ string) ([]string, error) {
+	return c.clusterIDs, nil
+}
+
+func TestCreateVolumeStorageScopeTopology(t *testing.T) {
+	const zoneID = "a1887604-237c-4212-a9cd-94620b7880fa"
+	cases := []struct {
+		name                 string
+		storageScopeTopology bool
+		clusterIDs           []string
+		expected             []Topology
+	}{
+		{"disabled", false, []string{"cluster-1"}, []Topology{{ZoneID: zoneID}}},
+		{"zone-wide", true, nil, []Topology{{ZoneID: zoneID}}},
+		{"cluster-wide", true, []string{"cluster-1", "cluster-2"}, []Topology{
+			{ZoneID: zoneID, ClusterID: "cluster-1"},
+			{ZoneID: zoneID, ClusterID: "cluster-2"},
+		}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			connector := &clusterStorageConnector{Interface: fake.New(), clusterIDs: c.clusterIDs}
+			cs := NewControllerServer(connector, &Options{StorageScopeTopology: c.storageScopeTopology})
+
+			resp, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1, nil, nil))
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			topologies := resp.GetVolume().GetAccessibleTopology()
+			if len(topologies) != len(c.expected) {
+				t.Fatalf("Expected %d topologies, got %v", len(c.expected), topologies)
+			}
+			for i, expected := range c.expected {
+				got, err := NewTopology(topologies[i])
+				if err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if got != expected {
+					t.Errorf("Expected topology %+v, got %+v", expected, got)
+				}
+			}
+		})
+	}
+}
+
+// limitConnector fails to create volumes with a CloudStack error.
+type limitConnector struct {
+	cloud.Interface
+	err error
+}
+
+func (c *limitConnector) CreateVolume(_ context.Context, _ *cloud.VolumeOptions) (string, error) {
+	return "", c.err
+}
+
+func TestCreateVolumeResourceLimit(t *testing.T) {
+	cases := []struct {
+		name         string
+		err          error
+		expectedCode codes.Code
+		expectedText string
+	}{
+		{"account limit", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'volume' for account name=admin in domain id=1 has been exceeded."), codes.ResourceExhausted, "account resource limit exceeded"},
+		{"domain limit", errors.New("CloudStack API error 534 (CSExceptionErrorCode: 4370): Maximum number of resources of type 'volume' for domain id=2 has been exceeded."), codes.ResourceExhausted, "domain resource limit exceeded"},
+		{"other error", errors.New("CloudStack API error 431 (CSExceptionErrorCode: 9999): Unable to execute API command"), codes.Internal, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(&limitConnector{Interface: fake.New(), err: c.err}, &Options{})
+
+			_, err := cs.CreateVolume(context.Background(), createVolumeRequest("pvc-1", 1, nil, nil))
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if !strings.Contains(err.Error(), c.expectedText) {
+				t.Errorf("Expected %q in error, got %v", c.expectedText, err)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeHostTopology(t *testing.T) {
+	const (
+		zoneID         = "a1887604-237c-4212-a9cd-94620b7880fa"
+		hostID         = "5b2f7a3e-6c2d-4f7e-9a0b-3c4d5e6f7a8b"
+		clusterID      = "8e1d3c5b-2a4f-4b6d-8c0e-1f2a3b4c5d6e"
+		localOffering  = "3c5a1e2b-7d4f-4a9e-8b6c-0d1e2f3a4b5c"
+		sharedOffering = "9743fd77-0f5d-4ef9-b2f8-f194235c769c"
+	)
+	cases := []struct {
+		name         string
+		connector    cloud.Interface
+		zoneCapacity bool
+		offering     string
+		requisite    []string
+		preferred    string
+		expectedCode codes.Code
+		expected     Topology
+	}{
+		{"local storage", fake.New(), false, localOffering, []string{hostID}, "", codes.OK, Topology{ZoneID: zoneID, HostID: hostID}},
+		{"local storage with zone capacity", fake.New(), true, localOffering, []string{hostID}, "", codes.OK, Topology{ZoneID: zoneID, HostID: hostID}},
+		{"host of preferred topology", fake.New(), false, localOffering, []string{"other-host", hostID}, hostID, codes.OK, Topology{ZoneID: zoneID, HostID: hostID}},
+		{"several hosts", fake.New(), false, localOffering, []string{"other-host", hostID}, "", codes.OK, Topology{ZoneID: zoneID}},
+		{"zone-wide shared storage", fake.New(), false, sharedOffering, []string{hostID}, "", codes.OK, Topology{ZoneID: zoneID}},
+		{
+			"shared storage of the cluster of the host", &clusterStorageConnector{fake.New(), []string{clusterID}}, false,
+			sharedOffering, []string{hostID}, "", codes.OK, Topology{ZoneID: zoneID},
+		},
+		{
+			"shared storage of another cluster", &clusterStorageConnector{fake.New(), []string{"other-cluster"}}, false,
+			sharedOffering, []string{hostID}, "", codes.InvalidArgument, Topology{},
+		},
+		{"unknown host", fake.New(), false, localOffering, []string{"unknown-host"}, "", codes.InvalidArgument, Topology{}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cs := NewControllerServer(c.connector, &Options{CheckZoneCapacity: c.zoneCapacity})
+			req := createVolumeRequest("pvc-1", 1, nil, nil)
+			req.Parameters[DiskOfferingKey] = c.offering
+			for _, host := range c.requisite {
+				req.AccessibilityRequirements.Requisite = append(req.AccessibilityRequirements.Requisite, Topology{ZoneID: zoneID, HostID: host}.ToCSI())
+			}
+			if c.preferred != "" {
+				req.AccessibilityRequirements.Preferred = []*csi.Topology{Topology{ZoneID: zoneID, HostID: c.preferred}.ToCSI()}
+			}
+
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			topologies := resp.GetVolume().GetAccessibleTopology()
+			if len(topologies) != 1 {
+				t.Fatalf("Expected 1 topology, got %v", topologies)
+			}
+			if got, _ := NewTopology(topologies[0]); got != c.expected {
+				t.Errorf("Expected topology %+v, got %+v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotTags(t *testing.T) {
+	cases := []struct {
+		name         string
+		tags         string
+		expectedCode codes.Code
+		expectedTags map[string]string
+	}{
+		{"no tags", "", codes.OK, nil},
+		{"tags", "cost-center=42, team=storage", codes.OK, map[string]string{"cost-center": "42", "team": "storage"}},
+		{"invalid tags", "cost-center", codes.InvalidArgument, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			connector := fake.New()
+			cs := NewControllerServer(connector, &Options{})
+
+			resp, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+				Name:           "snap-1",
+				SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				Parameters:     map[string]string{SnapshotTagsKey: c.tags},
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				return
+			}
+			tags, err := connector.GetSnapshotTags(ctx, resp.GetSnapshot().GetSnapshotId())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !maps.Equal(tags, c.expectedTags) {
+				t.Errorf("Expected tags %v, got %v", c.expectedTags, tags)
+			}
+		})
+	}
+}
+
+// untaggableConnector is a fake connector failing to set tags.
+type untaggableConnector struct {
+	cloud.Interface
+}
+
+func (c *untaggableConnector) CreateTags(_ context.Context, _, _ string, _ map[string]string) error {
+	return errors.New("tagging failed")
+}
+
+func TestCreateVolumeTags(t *testing.T) {
+	cases := []struct {
+		name         string
+		connector    cloud.Interface
+		requireTags  string
+		expectedCode codes.Code
+		expectedTags map[string]string
+	}{
+		{"tagged", fake.New(), "", codes.OK, map[string]string{
+			"team":                "storage",
+			cloud.PVCTagKey:       "default/data",
+			cloud.CSINameTagKey:   "pvc-1",
+			cloud.ManagedByTagKey: cloud.ManagedByTagValue,
+		}},
+		{"tagging failure", &untaggableConnector{fake.New()}, "", codes.OK, nil},
+		{"required tagging failure", &untaggableConnector{fake.New()}, "true", codes.Internal, nil},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			cs := NewControllerServer(c.connector, &Options{})
+
+			req := createVolumeRequest("pvc-1", 1, nil, nil)
+			req.Parameters[TagKeyPrefix+"team"] = "storage"
+			req.Parameters[PVCNameKey] = "data"
+			req.Parameters[PVCNamespaceKey] = "default"
+			req.Parameters[RequireTagsKey] = c.requireTags
+			resp, err := cs.CreateVolume(ctx, req)
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if err != nil {
+				// The volume which could not be tagged is deleted.
+				if _, err := c.connector.GetVolumeByName(ctx, "pvc-1"); !errors.Is(err, cloud.ErrNotFound) {
+					t.Errorf("Expected volume to be deleted, got %v", err)
+				}
+
+				return
+			}
+			vol, err := c.connector.GetVolumeByID(ctx, resp.GetVolume().GetVolumeId())
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			for key, value := range c.expectedTags {
+				if vol.Tags[key] != value {
+					t.Errorf("Expected tag %s=%s, got %v", key, value, vol.Tags)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotInvalidVolumeID(t *testing.T) {
+	cs := NewControllerServer(fake.New(), &Options{})
+
+	_, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-1",
+		SourceVolumeId: "volume-1",
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument, got %v", err)
+	}
+}
+
+func TestInvalidVolumeID(t *testing.T) {
+	const (
+		volumeID = "volume-1"
+		nodeID   = "0d7107a3-94d2-44e7-89b8-8930881309a5"
+	)
+	ctx := context.Background()
+	cs := NewControllerServer(fake.New(), &Options{})
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+
+	cases := []struct {
+		name         string
+		call         func() error
+		expectedCode codes.Code
+	}{
+		{"DeleteVolume", func() error {
+			_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+
+			return err
+		}, codes.OK},
+		{"ControllerUnpublishVolume", func() error {
+			_, err := cs.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID})
+
+			return err
+		}, codes.OK},
+		{"ControllerPublishVolume", func() error {
+			_, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{VolumeId: volumeID, NodeId: nodeID, VolumeCapability: volCap})
+
+			return err
+		}, codes.NotFound},
+		{"ValidateVolumeCapabilities", func() error {
+			_, err := cs.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{VolumeId: volumeID, VolumeCapabilities: []*csi.VolumeCapability{volCap}})
+
+			return err
+		}, codes.NotFound},
+		{"ControllerExpandVolume", func() error {
+			_, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{VolumeId: volumeID, CapacityRange: &csi.CapacityRange{RequiredBytes: 1}})
+
+			return err
+		}, codes.NotFound},
+		{"ControllerGetVolume", func() error {
+			_, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+
+			return err
+		}, codes.NotFound},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if err := c.call(); status.Code(err) != c.expectedCode {
+				t.Errorf("Expected %v, got %v", c.expectedCode, err)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshotMaxSnapshotsPerVolume(t *testing.T) {
+	ctx := context.Background()
+	cs := NewControllerServer(fake.New(), &Options{MaxSnapshotsPerVolume: 2})
+
+	createSnapshot := func(name string) error {
+		_, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{
+			Name:           name,
+			SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		})
+
+		return err
+	}
+	for _, name := range []string{"snap-1", "snap-2"} {
+		if err := createSnapshot(name); err != nil {
+			t.Fatalf("Unexpected error creating %s: %v", name, err)
+		}
+	}
+	// A retry of an existing snapshot is not a new snapshot.
+	if err := createSnapshot("snap-2"); err != nil {
+		t.Errorf("Unexpected error retrying snap-2: %v", err)
+	}
+	if err := createSnapshot("snap-3"); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected ResourceExhausted beyond the limit, got %v", err)
+	}
+}
+
+// stuckSnapshotConnector creates snapshots until the context is done.
+type stuckSnapshotConnector struct {
+	cloud.Interface
+}
+
+func (c *stuckSnapshotConnector) CreateSnapshot(ctx context.Context, _, _ string) (*cloud.Snapshot, error) {
+	<-ctx.Done()
+
+	return nil, ctx.Err()
+}
+
+func TestCreateSnapshotTimeout(t *testing.T) {
+	cs := NewControllerServer(&stuckSnapshotConnector{Interface: fake.New()}, &Options{SnapshotTimeout: 10 * time.Millisecond})
+
+	_, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		Name:           "snap-1",
+		SourceVolumeId: "ace9f28b-3081-40c1-8353-4cc3e3014072",
+	})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("Expected DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestCreateVolumeAdoptExisting(t *testing.T) {
+	const zoneID = "a1887604-237c-4212-a9cd-94620b7880fa"
+	ctx := context.Background()
+	connector := fake.New()
+	cs := NewControllerServer(connector, &Options{})
+
+	retainedID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+		Name:           "retained",
+		DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+		ZoneID:         zoneID,
+		SizeInGB:       5,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := connector.CreateTags(ctx, cloud.ResourceTypeVolume, retainedID, map[string]string{cloud.PVCTagKey: "default/data"}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	createVolume := func(name, pvcName string, sizeInGB int64, adopt bool) string {
+		t.Helper()
+		req := createVolumeRequest(name, sizeInGB, []string{zoneID}, nil)
+		if pvcName != "" {
+			req.Parameters[PVCNamespaceKey] = "default"
+			req.Parameters[PVCNameKey] = pvcName
+		}
+		if adopt {
+			req.Parameters[AdoptExistingKey] = "true"
+		}
+		resp, err := cs.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("Unexpected error creating %s: %v", name, err)
+		}
+
+		return resp.GetVolume().GetVolumeId()
+	}
+
+	if id := createVolume("pvc-1", "data", 5, false); id == retainedID {
+		t.Errorf("Expected a new volume without %s", AdoptExistingKey)
+	}
+	if id := createVolume("pvc-2", "other", 5, true); id == retainedID {
+		t.Errorf("Expected a new volume when no volume is tagged with the PersistentVolumeClaim")
+	}
+	if id := createVolume("pvc-3", "", 5, true); id == retainedID {
+		t.Errorf("Expected a new volume without the PersistentVolumeClaim of the request")
+	}
+	if id := createVolume("pvc-4", "data", 8, true); id == retainedID {
+		t.Errorf("Expected a new volume when no volume has the requested size")
+	}
+	if id := createVolume("pvc-5", "data", 5, true); id != retainedID {
+		t.Errorf("Expected volume %s to be adopted, got %s", retainedID, id)
+	}
+	// A retry returns the adopted volume, which is not adopted again.
+	if id := createVolume("pvc-5", "data", 5, true); id != retainedID {
+		t.Errorf("Expected the retry to return volume %s, got %s", retainedID, id)
+	}
+	if id := createVolume("pvc-6", "data", 5, true); id == retainedID {
+		t.Errorf("Expected volume %s not to be adopted twice", retainedID)
+	}
+}
@@ -0,0 +1,129 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// deviceCache remembers the device paths of volumes for a short time, so
+// that looking up the device of a recently resolved volume does not scan
+// the device buses again. A nil cache is disabled.
+type deviceCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]deviceCacheEntry
+}
+
+type deviceCacheEntry struct {
+	devicePath string
+	expires    time.Time
+}
+
+// newDeviceCache creates a cache keeping device paths for ttl, or returns
+// nil if ttl is not positive.
+func newDeviceCache(ttl time.Duration) *deviceCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &deviceCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]deviceCacheEntry),
+	}
+}
+
+// get returns the cached device path of a volume, if not expired.
+func (c *deviceCache) get(volumeID string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[volumeID]
+	if !ok {
+		return "", false
+	}
+	if !c.now().Before(entry.expires) {
+		delete(c.entries, volumeID)
+
+		return "", false
+	}
+
+	return entry.devicePath, true
+}
+
+func (c *deviceCache) put(volumeID, devicePath string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[volumeID] = deviceCacheEntry{devicePath: devicePath, expires: c.now().Add(c.ttl)}
+}
+
+func (c *deviceCache) remove(volumeID string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, volumeID)
+}
+
+// getDevicePath returns the device path of a volume, from the cache if it
+// is still the block device of the volume, or else looked up by the mounter.
+func (ns *nodeServer) getDevicePath(ctx context.Context, volumeID string) (string, error) {
+	if devicePath, ok := ns.deviceCache.get(volumeID); ok {
+		if ns.isVolumeDevice(ctx, devicePath, volumeID) {
+			klog.FromContext(ctx).V(4).Info("Using cached device path", "volumeID", volumeID, "devicePath", devicePath)
+
+			return devicePath, nil
+		}
+		ns.deviceCache.remove(volumeID)
+	}
+
+	devicePath, err := ns.mounter.GetDevicePath(ctx, volumeID)
+	if err == nil && devicePath != "" {
+		ns.deviceCache.put(volumeID, devicePath)
+	}
+
+	return devicePath, err
+}
+
+// isVolumeDevice returns true if devicePath is still a block device, and
+// has the serial of the volume where it can be checked (KVM).
+func (ns *nodeServer) isVolumeDevice(ctx context.Context, devicePath, volumeID string) bool {
+	if isBlock, err := ns.mounter.IsBlockDevice(devicePath); err != nil || !isBlock {
+		return false
+	}
+
+	return ns.mounter.CheckVolumeDevice(ctx, devicePath, volumeID) == nil
+}
@@ -46,6 +46,13 @@ type cloudstackDriver struct {
 	controller csi.ControllerServer
 	node       csi.NodeServer
 	options    *Options
+
+	// nodeWatcher detaches the volumes of deleted nodes (nil if disabled).
+	nodeWatcher *nodeWatcher
+
+	// cloudStackVersion is the version of the CloudStack management server,
+	// empty if it could not be fetched at startup.
+	cloudStackVersion string
 }
 
 // New instantiates a new CloudStack CSI driver.
@@ -61,18 +68,57 @@ func New(ctx context.Context, csConnector cloud.Interface, options *Options, mou
 		options: options,
 	}
 
+	// The version is only used for diagnostics and to enable features
+	// depending on it: failing to get it is not fatal.
+	if version, err := csConnector.GetCloudStackVersion(ctx); err != nil {
+		logger.Error(err, "Cannot get CloudStack version")
+	} else {
+		logger.Info("Connected to CloudStack", "cloudStackVersion", version)
+		driver.cloudStackVersion = version
+	}
+
 	switch options.Mode {
 	case ControllerMode:
-		driver.controller = NewControllerServer(csConnector)
+		driver.controller = NewControllerServer(csConnector, options)
 	case NodeMode:
 		driver.node = NewNodeServer(csConnector, mounter, options)
 	case AllMode:
-		driver.controller = NewControllerServer(csConnector)
+		driver.controller = NewControllerServer(csConnector, options)
 		driver.node = NewNodeServer(csConnector, mounter, options)
 	default:
 		return nil, fmt.Errorf("unknown mode: %s", options.Mode)
 	}
 
+	if ns, ok := driver.node.(*nodeServer); ok {
+		if err := ns.checkNodeZone(ctx, options.StrictNodeZone); err != nil {
+			return nil, err
+		}
+		if options.WarmUpDevices {
+			logger.Info("Warming up device buses")
+			ns.mounter.WarmUp(ctx)
+		}
+	}
+
+	if cs, ok := driver.controller.(*controllerServer); ok && cs.deleteVolumeSnapshots {
+		lister, err := newSnapshotContentLister(options.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create Kubernetes client: %w", err)
+		}
+		cs.snapshotReferences = lister
+	}
+
+	if driver.controller != nil && options.DetachOnNodeDeletion {
+		client, err := newKubeClient(options.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create Kubernetes client: %w", err)
+		}
+		driver.nodeWatcher = &nodeWatcher{
+			client:      client,
+			connector:   csConnector,
+			gracePeriod: options.NodeDeletionGracePeriod,
+		}
+	}
+
 	return driver, nil
 }
 
@@ -114,6 +160,14 @@ func (cs *cloudstackDriver) Run(ctx context.Context) error {
 		return fmt.Errorf("unknown mode: %s", cs.options.Mode)
 	}
 
+	if cs.nodeWatcher != nil {
+		go func() {
+			if err := cs.nodeWatcher.Run(ctx); err != nil {
+				logger.Error(err, "Node watcher failed")
+			}
+		}()
+	}
+
 	logger.Info("Listening for connections", "address", listener.Addr())
 
 	return grpcServer.Serve(listener)
@@ -21,6 +21,7 @@ package driver
 
 import (
 	"context"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"k8s.io/klog/v2"
@@ -32,6 +33,13 @@ func (cs *cloudstackDriver) GetPluginInfo(ctx context.Context, req *csi.GetPlugi
 	resp := &csi.GetPluginInfoResponse{
 		Name:          DriverName,
 		VendorVersion: driverVersion,
+		Manifest: map[string]string{
+			// Topology keys that may appear in the accessible topology of volumes and nodes.
+			topologyKeysManifestKey: strings.Join(TopologyKeys, ","),
+		},
+	}
+	if cs.cloudStackVersion != "" {
+		resp.Manifest[cloudStackVersionManifestKey] = cs.cloudStackVersion
 	}
 
 	return resp, nil
@@ -0,0 +1,80 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+func TestGetPluginInfoTopologyKeys(t *testing.T) {
+	cs := &cloudstackDriver{}
+	resp, err := cs.GetPluginInfo(context.Background(), &csi.GetPluginInfoRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := ZoneKey + "," + ClusterKey + "," + HostKey
+	if got := resp.GetManifest()[topologyKeysManifestKey]; got != expected {
+		t.Errorf("Expected topology keys %q, got %q", expected, got)
+	}
+}
+
+// noVersionConnector is a fake connector failing to return the CloudStack version.
+type noVersionConnector struct {
+	cloud.Interface
+}
+
+func (c *noVersionConnector) GetCloudStackVersion(_ context.Context) (string, error) {
+	return "", errors.New("unavailable")
+}
+
+func TestGetPluginInfoCloudStackVersion(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name      string
+		connector cloud.Interface
+		expected  string
+	}{
+		{"version", fake.New(), "4.19.0.0"},
+		{"unavailable version", &noVersionConnector{fake.New()}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d, err := New(ctx, c.connector, &Options{Mode: ControllerMode}, nil)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			resp, err := d.(*cloudstackDriver).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if got := resp.GetManifest()[cloudStackVersionManifestKey]; got != c.expected {
+				t.Errorf("Expected CloudStack version %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
@@ -25,12 +25,18 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/klog/v2"
+	kmount "k8s.io/mount-utils"
 
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/mount"
@@ -40,6 +46,17 @@ import (
 const (
 	// default file system type to be used when it is not provided.
 	defaultFsType = FSTypeExt4
+
+	// initial delay between two format and mount attempts on transient errors.
+	stageMountRetryDelay = 500 * time.Millisecond
+
+	// initial delay between two rescans of a device not reflecting
+	// the size of an expanded volume yet.
+	expandDeviceRetryDelay = time.Second
+
+	// fraction of the device size a resized filesystem may lack
+	// (filesystem metadata) before the resize is considered failed.
+	resizeSizeTolerance = 0.1
 )
 
 var ValidFSTypes = map[string]struct{}{
@@ -49,33 +66,83 @@ var ValidFSTypes = map[string]struct{}{
 	FSTypeXfs:  {},
 }
 
+// allowedMkfsOptions are the mkfs.ext* extended options accepted in the
+// mkfsOptions parameter, which is passed on the mkfs command line.
+var allowedMkfsOptions = map[string]struct{}{
+	"discard":             {},
+	"nodiscard":           {},
+	"lazy_itable_init=0":  {},
+	"lazy_itable_init=1":  {},
+	"lazy_journal_init=0": {},
+	"lazy_journal_init=1": {},
+}
+
 type nodeServer struct {
 	csi.UnimplementedNodeServer
 	connector         cloud.Interface
 	mounter           mount.Interface
 	maxVolumesPerNode int64
 	nodeName          string
+	nodeZone          string
+	cleanupStagingDir bool
 	volumeLocks       *util.VolumeLocks
+
+	// verifyUnstageDevice enables checking the device of a volume before unstaging it.
+	verifyUnstageDevice bool
+
+	// stageMountBackoff bounds the retries of FormatAndMount on transient errors.
+	stageMountBackoff wait.Backoff
+
+	// deviceCache holds the recently resolved device paths of volumes, nil if disabled.
+	deviceCache *deviceCache
+
+	// expandDeviceBackoff bounds the rescans of a device until it reflects
+	// the size of an expanded volume.
+	expandDeviceBackoff wait.Backoff
+
+	// fsTypeMinSizes are the filesystem types of new volumes staged
+	// without fstype, by minimum size in GB.
+	fsTypeMinSizes map[string]int64
+
+	// storageScopeTopology enables advertising the cluster of the node in its topology.
+	storageScopeTopology bool
 }
 
 // NewNodeServer creates a new Node gRPC server.
 func NewNodeServer(connector cloud.Interface, mounter mount.Interface, options *Options) csi.NodeServer {
 	if mounter == nil {
-		mounter = mount.New()
+		mounter = mount.New(options.RootDevice, options.DeviceReadinessCommand,
+			mount.WithDevicePathBackoff(options.DevicePathTimeout, options.DevicePathRetries))
 	}
 
 	return &nodeServer{
-		connector:         connector,
-		mounter:           mounter,
-		maxVolumesPerNode: options.VolumeAttachLimit,
-		nodeName:          options.NodeName,
-		volumeLocks:       util.NewVolumeLocks(),
+		connector:           connector,
+		mounter:             mounter,
+		maxVolumesPerNode:   options.VolumeAttachLimit,
+		nodeName:            options.NodeName,
+		nodeZone:            options.NodeZone,
+		cleanupStagingDir:   options.CleanupStagingDir,
+		volumeLocks:         util.NewVolumeLocks(),
+		verifyUnstageDevice: options.VerifyUnstageDevice,
+		deviceCache:         newDeviceCache(options.DeviceCacheTTL),
+		stageMountBackoff: wait.Backoff{
+			Duration: stageMountRetryDelay,
+			Factor:   2,
+			Steps:    options.StageMountRetries + 1,
+		},
+		expandDeviceBackoff: wait.Backoff{
+			Duration: expandDeviceRetryDelay,
+			Factor:   2,
+			Steps:    options.ExpandDeviceRetries + 1,
+		},
+		fsTypeMinSizes:       options.FSTypeMinSizes,
+		storageScopeTopology: options.StorageScopeTopology,
 	}
 }
 
 func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeStageVolume: called", "args", *req)
+	logger.V(6).Info("NodeStageVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check parameters
 
@@ -108,6 +175,7 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	}
 
 	fsType := mnt.GetFsType()
+	selectFsType := fsType == "" && len(ns.fsTypeMinSizes) > 0
 	if fsType == "" {
 		fsType = defaultFsType
 	}
@@ -132,15 +200,26 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	defer ns.volumeLocks.Release(volumeID)
 
 	// Now, find the device path
-	source, err := ns.mounter.GetDevicePath(ctx, volumeID)
+	source, err := ns.getDevicePath(ctx, volumeID)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Cannot find device path for volume %s: %s", volumeID, err.Error())
+		return nil, status.Errorf(mountErrorCode(err), "Cannot find device path for volume %s: %s", volumeID, err.Error())
 	}
 
 	logger.V(4).Info("NodeStageVolume: device found",
 		"source", source,
 	)
 
+	if selectFsType {
+		if fsType, err = ns.fsTypeBySize(source); err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot select the filesystem type of volume %s: %v", volumeID, err)
+		}
+	}
+
+	formatOptions, err := mkfsFormatOptions(fsType, req.GetVolumeContext()[MkfsOptionsKey])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "Invalid %s parameter: %v", MkfsOptionsKey, err)
+	}
+
 	exists, err := ns.mounter.PathExists(target)
 	if err != nil {
 		msg := fmt.Sprintf("failed to check if target %q exists: %v", target, err)
@@ -171,16 +250,23 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 	logger.V(4).Info("NodeStageVolume: checking if volume is already staged", "device", device, "source", source, "target", target)
 	if device == source {
 		logger.V(4).Info("NodeStageVolume: volume already staged", "volumeID", volumeID)
+		writeStagingMetadata(ctx, target, stagingMetadata{VolumeID: volumeID, DevicePath: source})
 
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
+	if req.GetVolumeContext()[FsckBeforeMountKey] == "true" {
+		if err := ns.repairFilesystem(ctx, source); err != nil {
+			return nil, status.Errorf(mountErrorCode(err), "Cannot check the filesystem of volume %s (%q): %v", volumeID, source, err)
+		}
+	}
+
 	logger.V(4).Info("NodeStageVolume: staging volume", "source", source, "volumeID", volumeID, "target", target, "fstype", fsType, "options", mountOptions)
-	err = ns.mounter.FormatAndMount(source, target, fsType, mountOptions)
+	err = ns.formatAndMount(ctx, source, target, fsType, mountOptions, formatOptions)
 	if err != nil {
 		msg := fmt.Sprintf("could not format %q and mount it at %q: %v", source, target, err)
 
-		return nil, status.Error(codes.Internal, msg)
+		return nil, status.Error(mountErrorCode(err), msg)
 	}
 
 	needResize, err := ns.mounter.NeedResize(source, target)
@@ -195,10 +281,235 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 	}
 	logger.V(4).Info("NodeStageVolume: successfully staged volume", "source", source, "volumeID", volumeID, "target", target, "fstype", fsType)
+	writeStagingMetadata(ctx, target, stagingMetadata{VolumeID: volumeID, DevicePath: source})
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// repairFilesystem checks, and repairs if safe, the filesystem of a device
+// before mounting it. Unformatted devices are skipped.
+func (ns *nodeServer) repairFilesystem(ctx context.Context, devicePath string) error {
+	fsType, err := ns.mounter.GetFSType(devicePath)
+	if err != nil || fsType == "" {
+		return err
+	}
+	klog.FromContext(ctx).V(4).Info("NodeStageVolume: checking filesystem", "devicePath", devicePath, "fsType", fsType)
+
+	return ns.mounter.RepairFilesystem(ctx, devicePath, fsType)
+}
+
+// fsTypeBySize returns the filesystem type of a device: its current one if
+// it is already formatted, so that expanding a volume does not change it,
+// else the one selected by the size of the device.
+func (ns *nodeServer) fsTypeBySize(devicePath string) (string, error) {
+	existing, err := ns.mounter.GetFSType(devicePath)
+	if err != nil {
+		return "", err
+	}
+	if existing != "" {
+		return existing, nil
+	}
+	sizeBytes, err := ns.mounter.GetBlockSizeBytes(devicePath)
+	if err != nil {
+		return "", err
+	}
+
+	return fsTypeForSize(ns.fsTypeMinSizes, sizeBytes), nil
+}
+
+// fsTypeForSize returns the filesystem type with the largest minimum size
+// in GB not above sizeBytes, or defaultFsType if there is none.
+func fsTypeForSize(minSizes map[string]int64, sizeBytes int64) string {
+	fsType := defaultFsType
+	selectedMinSize := int64(-1)
+	for t, minSize := range minSizes {
+		if util.GigaBytesToBytes(minSize) > sizeBytes {
+			continue
+		}
+		// Break ties by name, for a stable choice.
+		if minSize > selectedMinSize || (minSize == selectedMinSize && t < fsType) {
+			fsType, selectedMinSize = t, minSize
+		}
+	}
+
+	return fsType
+}
+
+// parseMkfsOptions splits the value of the mkfsOptions parameter,
+// checking each option against allowedMkfsOptions.
+func parseMkfsOptions(value string) ([]string, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var options []string
+	for _, o := range strings.Split(value, ",") {
+		o = strings.TrimSpace(o)
+		if _, ok := allowedMkfsOptions[o]; !ok {
+			return nil, fmt.Errorf("mkfs option %q is not allowed", o)
+		}
+		options = append(options, o)
+	}
+
+	return options, nil
+}
+
+// mkfsFormatOptions returns the mkfs arguments matching the value of the
+// mkfsOptions parameter, which only applies to ext filesystems.
+func mkfsFormatOptions(fsType, value string) ([]string, error) {
+	options, err := parseMkfsOptions(value)
+	if err != nil || len(options) == 0 {
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToLower(fsType), "ext") {
+		return nil, fmt.Errorf("mkfs options are not supported for filesystem type %s", fsType)
+	}
+
+	return []string{"-E", strings.Join(options, ",")}, nil
+}
+
+// formatAndMount formats and mounts the device, retrying with backoff
+// as long as the failure is transient (the device is busy, which often
+// happens right after it has been attached). Other errors are returned
+// immediately.
+func (ns *nodeServer) formatAndMount(ctx context.Context, source, target, fsType string, options, formatOptions []string) error {
+	logger := klog.FromContext(ctx)
+
+	var mountErr error
+	err := wait.ExponentialBackoffWithContext(ctx, ns.stageMountBackoff, func(context.Context) (bool, error) {
+		if len(formatOptions) > 0 {
+			mountErr = ns.mounter.FormatAndMountSensitiveWithFormatOptions(source, target, fsType, options, nil, formatOptions)
+		} else {
+			mountErr = ns.mounter.FormatAndMount(source, target, fsType, options)
+		}
+		if mountErr == nil {
+			return true, nil
+		}
+		if !isTransientMountError(mountErr) {
+			return false, mountErr
+		}
+		logger.V(2).Info("NodeStageVolume: device busy, retrying format and mount", "source", source, "target", target, "error", mountErr)
+
+		return false, nil
+	})
+	if wait.Interrupted(err) && mountErr != nil {
+		return mountErr
+	}
+
+	return err
+}
+
+// waitForDeviceSize waits until the size of the device is at least
+// requiredBytes, rescanning it in between, as the new size of an expanded
+// volume may not have propagated to the node yet. Resizing the filesystem
+// before that would grow it to the old size.
+func (ns *nodeServer) waitForDeviceSize(ctx context.Context, devicePath string, requiredBytes int64) error {
+	if requiredBytes <= 0 {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+
+	var size int64
+	err := wait.ExponentialBackoffWithContext(ctx, ns.expandDeviceBackoff, func(ctx context.Context) (bool, error) {
+		var err error
+		size, err = ns.mounter.GetBlockSizeBytes(devicePath)
+		if err != nil {
+			return false, err
+		}
+		if size >= requiredBytes {
+			return true, nil
+		}
+		logger.V(2).Info("NodeExpandVolume: device size smaller than requested, rescanning", "devicePath", devicePath, "size", size, "requiredBytes", requiredBytes)
+		if err := ns.mounter.RescanDevice(ctx, devicePath); err != nil {
+			logger.Error(err, "Failed to rescan device", "devicePath", devicePath)
+		}
+
+		return false, nil
+	})
+	if wait.Interrupted(err) {
+		return fmt.Errorf("size is %d bytes after %d rescans, smaller than the requested %d bytes", size, ns.expandDeviceBackoff.Steps-1, requiredBytes)
+	}
+
+	return err
+}
+
+// corruptedMountStatsResponse reports a volume whose filesystem cannot be
+// read anymore, e.g. after the device was lost, as abnormal.
+func corruptedMountStatsResponse(volumePath string, err error) *csi.NodeGetVolumeStatsResponse {
+	return &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("Mount point %s is corrupted: %v", volumePath, err),
+		},
+	}
+}
+
+// isTransientMountError returns true if the error returned by
+// FormatAndMount is worth retrying.
+func isTransientMountError(err error) bool {
+	if errors.Is(err, unix.EBUSY) {
+		return true
+	}
+
+	// mount and mkfs errors are reported through their output.
+	return strings.Contains(strings.ToLower(err.Error()), "device or resource busy")
+}
+
+// mountErrorCode returns the gRPC code matching an error returned while
+// looking for, formatting or mounting a device, so that the sidecars retry
+// transient failures and give up on those needing an operator.
+func mountErrorCode(err error) codes.Code {
+	var mountErr kmount.MountError
+	if errors.As(err, &mountErr) {
+		switch mountErr.Type {
+		case kmount.FilesystemMismatch, kmount.HasFilesystemErrors, kmount.UnformattedReadOnly:
+			return codes.FailedPrecondition
+		default:
+		}
+	}
+
+	switch {
+	case errors.Is(err, unix.ENOSPC):
+		return codes.ResourceExhausted
+	case errors.Is(err, unix.EBUSY):
+		return codes.Unavailable
+	case errors.Is(err, unix.ENOENT), errors.Is(err, unix.ENODEV), errors.Is(err, unix.ENXIO):
+		return codes.NotFound
+	case errors.Is(err, unix.EACCES), errors.Is(err, unix.EPERM):
+		return codes.PermissionDenied
+	}
+
+	// mount and mkfs errors are mostly reported through their output.
+	msg := strings.ToLower(err.Error())
+	for _, e := range mountErrorMessages {
+		if strings.Contains(msg, e.substr) {
+			return e.code
+		}
+	}
+
+	return codes.Internal
+}
+
+// mountErrorMessages maps messages found in the output of mount, mkfs and
+// the device lookup to gRPC codes. The first match wins.
+var mountErrorMessages = []struct {
+	substr string
+	code   codes.Code
+}{
+	{"no space left on device", codes.ResourceExhausted},
+	{"device or resource busy", codes.Unavailable},
+	{"failed to find device", codes.NotFound},
+	{"device path was empty", codes.NotFound},
+	{"does not exist", codes.NotFound},
+	{"no such device", codes.NotFound},
+	{"no such file or directory", codes.NotFound},
+	{"wrong fs type", codes.FailedPrecondition},
+	{"unknown filesystem type", codes.FailedPrecondition},
+	{"bad superblock", codes.FailedPrecondition},
+	{"read-only file system", codes.FailedPrecondition},
+	{"permission denied", codes.PermissionDenied},
+	{"operation not permitted", codes.PermissionDenied},
+}
+
 // hasMountOption returns a boolean indicating whether the given
 // slice already contains a mount option. This is used to prevent
 // passing duplicate option to the mount command.
@@ -214,7 +525,7 @@ func hasMountOption(options []string, opt string) bool {
 
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeUnstageVolume: called", "args", *req)
+	logger.V(6).Info("NodeUnstageVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check parameters
 	volumeID := req.GetVolumeId()
@@ -234,6 +545,9 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 	defer ns.volumeLocks.Release(volumeID)
 
+	// The device may be detached once the volume is unstaged.
+	ns.deviceCache.remove(volumeID)
+
 	// Check if target directory is a mount point. GetDeviceNameFromMount
 	// given a mnt point, finds the device from /proc/mounts
 	// returns the device name, reference count, and error code
@@ -249,6 +563,8 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	// reply 0 OK.
 	if refCount == 0 {
 		logger.V(4).Info("NodeUnstageVolume: target not mounted", "target", target)
+		removeStagingMetadata(ctx, target)
+		ns.removeStagingDir(ctx, target)
 
 		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
@@ -257,6 +573,12 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		logger.V(4).Info("NodeUnstageVolume: found references to device mounted at target path", "refCount", refCount, "device", dev, "target", target)
 	}
 
+	if ns.verifyUnstageDevice {
+		if err := ns.checkStagedDevice(ctx, volumeID, target, dev); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "Refusing to unstage volume %s from %q: %v", volumeID, target, err)
+		}
+	}
+
 	logger.V(4).Info("NodeUnstageVolume: unmounting", "target", target)
 
 	err = ns.mounter.Unstage(target)
@@ -268,10 +590,70 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		"target", target,
 		"volumeID", volumeID,
 	)
+	removeStagingMetadata(ctx, target)
+	ns.removeStagingDir(ctx, target)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// checkStagedDevice returns an error if the device mounted at the staging
+// directory target is not the one of the volume: either not the one recorded
+// when staging it, or not the one with the serial of the volume.
+func (ns *nodeServer) checkStagedDevice(ctx context.Context, volumeID, target, device string) error {
+	metadata, err := readStagingMetadata(target)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		// Staged by a previous version of the driver.
+	case err != nil:
+		return fmt.Errorf("cannot read the staging metadata: %w", err)
+	case metadata.VolumeID != volumeID:
+		return fmt.Errorf("%w: %s is staged at %q, not %s", mount.ErrDeviceMismatch, metadata.VolumeID, target, volumeID)
+	case mount.ResolveDevicePath(metadata.DevicePath) != mount.ResolveDevicePath(device):
+		return fmt.Errorf("%w: %s was staged on %s, but %s is mounted", mount.ErrDeviceMismatch, volumeID, metadata.DevicePath, device)
+	}
+
+	return ns.mounter.CheckVolumeDevice(ctx, device, volumeID)
+}
+
+// removeStagingDir removes the staging directory of an unstaged volume, if
+// enabled. A directory which is still mounted or not empty is kept. Failures
+// are only logged, since the volume is unstaged anyway.
+func (ns *nodeServer) removeStagingDir(ctx context.Context, target string) {
+	if !ns.cleanupStagingDir {
+		return
+	}
+	logger := klog.FromContext(ctx)
+
+	notMnt, err := ns.mounter.IsLikelyNotMountPoint(target)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil || !notMnt {
+		logger.Info("Keeping staging directory, it may still be mounted", "target", target, "error", err)
+
+		return
+	}
+
+	entries, err := os.ReadDir(target)
+	if err != nil {
+		logger.Error(err, "Cannot read staging directory", "target", target)
+
+		return
+	}
+	if len(entries) > 0 {
+		logger.Info("Keeping staging directory, it is not empty", "target", target)
+
+		return
+	}
+
+	if err := os.Remove(target); err != nil {
+		logger.Error(err, "Cannot remove staging directory", "target", target)
+
+		return
+	}
+	logger.V(4).Info("NodeUnstageVolume: staging directory removed", "target", target)
+}
+
 func (ns *nodeServer) isMounted(ctx context.Context, target string) (bool, error) {
 	logger := klog.FromContext(ctx)
 
@@ -301,7 +683,7 @@ func (ns *nodeServer) isMounted(ctx context.Context, target string) (bool, error
 
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) { //nolint:gocyclo,gocognit
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodePublishVolume: called", "args", *req)
+	logger.V(6).Info("NodePublishVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	// Check arguments
 	volumeID := req.GetVolumeId()
@@ -328,7 +710,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not supported")
 	}
 
-	mountOptions := []string{"bind"}
+	var mountOptions []string
 	if req.GetReadonly() {
 		mountOptions = append(mountOptions, "ro")
 	}
@@ -362,6 +744,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		if mnt == nil {
 			return nil, status.Error(codes.InvalidArgument, "NodePublishVolume: mount volume capability not found")
 		}
+		mountOptions = append([]string{"bind"}, mountOptions...)
 		if mnt := volCap.GetMount(); mnt != nil {
 			for _, f := range mnt.GetMountFlags() {
 				if !hasMountOption(mountOptions, f) {
@@ -389,12 +772,12 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		)
 
 		if err := ns.mounter.Mount(source, target, fsType, mountOptions); err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to mount %q at %q: %v", source, target, err)
+			return nil, status.Errorf(mountErrorCode(err), "failed to mount %q at %q: %v", source, target, err)
 		}
 	case *csi.VolumeCapability_Block:
-		source, err := ns.mounter.GetDevicePath(ctx, volumeID)
+		source, err := ns.getDevicePath(ctx, volumeID)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, "Cannot find device path for volume %s: %v", volumeID, err)
+			return nil, status.Errorf(mountErrorCode(err), "Cannot find device path for volume %s: %v", volumeID, err)
 		}
 
 		globalMountPath := filepath.Dir(target)
@@ -441,12 +824,12 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			"volumeID", volumeID,
 		)
 
-		if err := ns.mounter.Mount(source, target, "", mountOptions); err != nil {
+		if err := ns.mounter.BindMount(source, target, mountOptions); err != nil {
 			if removeErr := os.Remove(target); removeErr != nil {
 				return nil, status.Errorf(codes.Internal, "Could not remove mount target %q: %v", target, removeErr)
 			}
 
-			return nil, status.Errorf(codes.Internal, "failed to mount %q at %q: %v", source, target, err)
+			return nil, status.Errorf(mountErrorCode(err), "failed to mount %q at %q: %v", source, target, err)
 		}
 	}
 
@@ -455,7 +838,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 
 func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeUnpublishVolume: called", "args", *req)
+	logger.V(6).Info("NodeUnpublishVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	volumeID := req.GetVolumeId()
 	if volumeID == "" {
@@ -469,12 +852,26 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	// Considering that kubelet ensures the stage and publish operations
 	// are serialized, we don't need any extra locking in NodeUnpublishVolume.
 
+	// The target path may have been removed out-of-band, e.g. by the kubelet.
+	// A corrupted mount, e.g. of a device which disappeared, is still unmounted.
+	exists, err := ns.mounter.PathExists(target)
+	switch {
+	case err != nil && ns.mounter.IsCorruptedMnt(err):
+		logger.Info("NodeUnpublishVolume: target is a corrupted mount, unmounting it", "target", target, "volumeID", volumeID)
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "Cannot check target path %q: %v", target, err)
+	case !exists:
+		logger.V(4).Info("NodeUnpublishVolume: target path does not exist, nothing to unmount", "target", target, "volumeID", volumeID)
+
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
 	logger.V(4).Info("NodeUnpublishVolume: unmounting volume",
 		"target", target,
 		"volumeID", volumeID,
 	)
 
-	err := ns.mounter.Unpublish(target)
+	err = ns.mounter.Unpublish(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to unmount target %q: %v", target, err)
 	}
@@ -482,9 +879,44 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
+// checkNodeZone checks at startup that the configured zone of the node,
+// which overrides the zone of its instance in the node topology, is the zone
+// of the instance in CloudStack: volumes created in the zone of the topology
+// cannot be attached to an instance of another zone. A mismatch, or a failed
+// check, is logged, or returned if strict.
+func (ns *nodeServer) checkNodeZone(ctx context.Context, strict bool) error {
+	if ns.nodeZone == "" {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+	fail := func(err error) error {
+		if strict {
+			return err
+		}
+		logger.Error(err, "Node zone check failed, volumes may fail to attach to the node")
+
+		return nil
+	}
+
+	vm, err := ns.connector.GetNodeInfo(ctx, ns.nodeName)
+	if err != nil {
+		return fail(fmt.Errorf("cannot get the instance of node %s: %w", ns.nodeName, err))
+	}
+	nodeZoneID, err := resolveZoneID(ctx, ns.connector, ns.nodeZone)
+	if err != nil {
+		return fail(fmt.Errorf("cannot get zone %s: %w", ns.nodeZone, err))
+	}
+	if nodeZoneID != vm.ZoneID {
+		return fail(fmt.Errorf("node zone %s differs from the zone %s of instance %s in CloudStack", ns.nodeZone, vm.ZoneID, vm.ID))
+	}
+	logger.V(2).Info("Node zone matches the zone of the instance", "nodeZone", ns.nodeZone, "zoneID", vm.ZoneID)
+
+	return nil
+}
+
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeGetInfo: called", "args", *req)
+	logger.V(6).Info("NodeGetInfo: called", "args", protosanitizer.StripSecrets(req))
 
 	if ns.nodeName == "" {
 		return nil, status.Error(codes.Internal, "Missing node name")
@@ -497,11 +929,44 @@ func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 	if vm.ID == "" {
 		return nil, status.Error(codes.Internal, "Node with no ID")
 	}
-	if vm.ZoneID == "" {
+
+	zoneID := vm.ZoneID
+	if ns.nodeZone != "" {
+		nodeZoneID, err := resolveZoneID(ctx, ns.connector, ns.nodeZone)
+		switch {
+		case errors.Is(err, cloud.ErrTooManyResults):
+			return nil, status.Errorf(codes.FailedPrecondition, "Several zones are named %s, use the zone ID instead", ns.nodeZone)
+		case err != nil:
+			return nil, status.Errorf(codes.Internal, "Cannot get zone %s: %v", ns.nodeZone, err)
+		}
+		zones, err := ns.connector.ListZonesID(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot list zones: %v", err)
+		}
+		if !slices.Contains(zones, nodeZoneID) {
+			return nil, status.Errorf(codes.FailedPrecondition, "Node zone %s does not exist", ns.nodeZone)
+		}
+		if zoneID != nodeZoneID {
+			logger.Info("Node zone overrides the zone of the instance", "nodeZone", ns.nodeZone, "instanceZone", zoneID)
+		}
+		zoneID = nodeZoneID
+	}
+	if zoneID == "" {
 		return nil, status.Error(codes.Internal, "Node zone ID not found")
 	}
 
-	topology := Topology{ZoneID: vm.ZoneID}
+	// The host is only known while the VM is running, and may change
+	// when it is migrated.
+	topology := Topology{ZoneID: zoneID, HostID: vm.HostID}
+	if ns.storageScopeTopology {
+		if vm.HostID == "" {
+			return nil, status.Error(codes.Internal, "Node host ID not found")
+		}
+		topology.ClusterID, err = ns.connector.GetHostClusterID(ctx, vm.HostID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Cannot get cluster of host %s: %v", vm.HostID, err)
+		}
+	}
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:             vm.ID,
@@ -512,7 +977,7 @@ func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoReque
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeExpandVolume: called", "args", *req)
+	logger.V(6).Info("NodeExpandVolume: called", "args", protosanitizer.StripSecrets(req))
 
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
@@ -570,14 +1035,14 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 
 	_, err := ns.connector.GetVolumeByID(ctx, volumeID)
 	if err != nil {
-		if errors.Is(err, cloud.ErrNotFound) {
+		if isVolumeNotFound(err) {
 			return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume with ID %s not found", volumeID))
 		}
 
 		return nil, status.Error(codes.Internal, fmt.Sprintf("NodeExpandVolume failed with error %v", err))
 	}
 
-	devicePath, err := ns.mounter.GetDevicePath(ctx, volumeID)
+	devicePath, err := ns.getDevicePath(ctx, volumeID)
 	if devicePath == "" {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Unable to find Device path for volume %s: %v", volumeID, err))
 	}
@@ -588,8 +1053,21 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		"volumePath", volumePath,
 	)
 
-	if _, err := ns.mounter.Resize(devicePath, volumePath); err != nil {
-		return nil, status.Errorf(codes.Internal, "Could not resize volume %q (%q): %v", volumeID, devicePath, err)
+	if err := ns.waitForDeviceSize(ctx, devicePath, req.GetCapacityRange().GetRequiredBytes()); err != nil {
+		return nil, status.Errorf(codes.Internal, "Device %s of volume %s: %v", devicePath, volumeID, err)
+	}
+
+	needResize, err := ns.mounter.NeedResize(devicePath, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine if volume %q (%q) needs to be resized: %v", volumeID, devicePath, err)
+	}
+
+	if needResize {
+		if _, err := ns.mounter.Resize(devicePath, volumePath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not resize volume %q (%q): %v", volumeID, devicePath, err)
+		}
+	} else {
+		logger.V(4).Info("NodeExpandVolume: filesystem already matches the device size", "volumeID", volumeID, "devicePath", devicePath)
 	}
 
 	bcap, err := ns.mounter.GetBlockSizeBytes(devicePath)
@@ -597,12 +1075,22 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 		return nil, status.Errorf(codes.Internal, "failed to get block capacity on path %s: %v", req.GetVolumePath(), err)
 	}
 
+	// Guard against a resize reported successful that did not grow the filesystem.
+	stats, err := ns.mounter.GetStatistics(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get filesystem statistics of %s after resize: %v", volumePath, err)
+	}
+	if float64(stats.TotalBytes) < float64(bcap)*(1-resizeSizeTolerance) {
+		return nil, status.Errorf(codes.Internal, "filesystem of volume %q was not resized: filesystem size is %d bytes, device size is %d bytes",
+			volumeID, stats.TotalBytes, bcap)
+	}
+
 	return &csi.NodeExpandVolumeResponse{CapacityBytes: bcap}, nil
 }
 
 func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
 	logger := klog.FromContext(ctx)
-	logger.V(6).Info("NodeGetVolumeStats: called", "args", *req)
+	logger.V(6).Info("NodeGetVolumeStats: called", "args", protosanitizer.StripSecrets(req))
 
 	if req.GetVolumeId() == "" {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
@@ -620,7 +1108,9 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	}
 
 	exists, err := ns.mounter.PathExists(volumePath)
-	if err != nil {
+	if err != nil && ns.mounter.IsCorruptedMnt(err) {
+		return corruptedMountStatsResponse(volumePath, err), nil
+	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, "unknown error when stat on %s: %v", volumePath, err)
 	}
 	if !exists {
@@ -633,9 +1123,9 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	}
 
 	if isBlock {
-		bcap, blockErr := ns.mounter.GetBlockSizeBytes(req.GetVolumePath())
+		bcap, blockErr := ns.mounter.GetBlockSizeBytes(volumePath)
 		if blockErr != nil {
-			return nil, status.Errorf(codes.Internal, "failed to get block capacity on path %s: %v", req.GetVolumePath(), blockErr)
+			return nil, status.Errorf(codes.Internal, "failed to get block capacity on path %s: %v", volumePath, blockErr)
 		}
 
 		return &csi.NodeGetVolumeStatsResponse{
@@ -645,11 +1135,14 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 					Total: bcap,
 				},
 			},
+			VolumeCondition: &csi.VolumeCondition{},
 		}, nil
 	}
 
 	stats, err := ns.mounter.GetStatistics(volumePath)
-	if err != nil {
+	if err != nil && ns.mounter.IsCorruptedMnt(err) {
+		return corruptedMountStatsResponse(volumePath, err), nil
+	} else if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to retrieve capacity statistics for volume path %q: %s", volumePath, err)
 	}
 
@@ -668,6 +1161,7 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: &csi.VolumeCondition{},
 	}, nil
 }
 
@@ -695,6 +1189,13 @@ func (ns *nodeServer) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapab
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
 		},
 	}
 
@@ -0,0 +1,1171 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/util/wait"
+	kmount "k8s.io/mount-utils"
+	kexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/mount"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/util"
+)
+
+// execMounter is a fake mounter whose FormatAndMount goes through
+// mount-utils with a scripted exec, so that blkid and mkfs results
+// can be controlled by the test.
+type execMounter struct {
+	mount.Interface
+	safe *kmount.SafeFormatAndMount
+}
+
+func newExecMounter(fakeExec *testingexec.FakeExec) *execMounter {
+	return &execMounter{
+		Interface: mount.NewFake(),
+		safe: &kmount.SafeFormatAndMount{
+			Interface: kmount.NewFakeMounter([]kmount.MountPoint{}),
+			Exec:      fakeExec,
+		},
+	}
+}
+
+func (m *execMounter) FormatAndMount(source string, target string, fstype string, options []string) error {
+	return m.safe.FormatAndMount(source, target, fstype, options)
+}
+
+func fakeCommand(output string, err error) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) kexec.Cmd {
+		return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(output), nil, err },
+			},
+		}, cmd, args...)
+	}
+}
+
+func newTestNodeServer(mounter mount.Interface) *nodeServer {
+	return &nodeServer{
+		connector:         fake.New(),
+		mounter:           mounter,
+		maxVolumesPerNode: DefaultMaxVolAttachLimit,
+		nodeName:          "node",
+		volumeLocks:       util.NewVolumeLocks(),
+		stageMountBackoff: wait.Backoff{
+			Duration: time.Millisecond,
+			Factor:   1,
+			Steps:    DefaultStageMountRetries + 1,
+		},
+		expandDeviceBackoff: wait.Backoff{
+			Duration: time.Millisecond,
+			Factor:   1,
+			Steps:    DefaultExpandDeviceRetries + 1,
+		},
+	}
+}
+
+func stageVolumeRequest(stagingPath string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{
+				Mount: &csi.VolumeCapability_MountVolume{FsType: FSTypeExt4},
+			},
+			AccessMode: &csi.VolumeCapability_AccessMode{
+				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			},
+		},
+	}
+}
+
+func TestNodeStageVolumeRetriesBusyDevice(t *testing.T) {
+	unformatted := testingexec.FakeExitError{Status: 2}
+	fakeExec := &testingexec.FakeExec{
+		CommandScript: []testingexec.FakeCommandAction{
+			fakeCommand("", unformatted),
+			fakeCommand("/dev/sdb is apparently in use by the system; will not make a filesystem here!\nDevice or resource busy", errors.New("exit status 1")),
+			fakeCommand("", unformatted),
+			fakeCommand("", nil),
+		},
+	}
+	ns := newTestNodeServer(newExecMounter(fakeExec))
+
+	_, err := ns.NodeStageVolume(context.Background(), stageVolumeRequest(filepath.Join(t.TempDir(), "staging")))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fakeExec.CommandCalls != 4 {
+		t.Errorf("Expected 4 commands (blkid and mkfs, twice), got %d", fakeExec.CommandCalls)
+	}
+}
+
+// optionsMounter is a fake mounter recording the mount and format options
+// of FormatAndMount.
+type optionsMounter struct {
+	mount.Interface
+	options       []string
+	formatOptions []string
+}
+
+func (m *optionsMounter) FormatAndMount(source string, target string, fstype string, options []string) error {
+	m.options = options
+
+	return m.Mount(source, target, fstype, options)
+}
+
+func TestNodeStageVolumeMountFlags(t *testing.T) {
+	mounter := &optionsMounter{Interface: mount.NewFake()}
+	ns := newTestNodeServer(mounter)
+
+	req := stageVolumeRequest(filepath.Join(t.TempDir(), "staging"))
+	req.GetVolumeCapability().GetMount().MountFlags = []string{"noatime", "discard", "noatime"}
+	if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := []string{"noatime", "discard"}; !slices.Equal(mounter.options, expected) {
+		t.Errorf("Expected mount options %v, got %v", expected, mounter.options)
+	}
+}
+
+func (m *optionsMounter) FormatAndMountSensitiveWithFormatOptions(source string, target string, fstype string, options []string, _ []string, formatOptions []string) error {
+	m.formatOptions = formatOptions
+
+	return m.FormatAndMount(source, target, fstype, options)
+}
+
+func TestNodeStageVolumeMkfsOptions(t *testing.T) {
+	cases := []struct {
+		name          string
+		fsType        string
+		mkfsOptions   string
+		expected      []string
+		expectInvalid bool
+	}{
+		{"none", "", "", nil, false},
+		{"ext4", "ext4", "nodiscard, lazy_itable_init=1", []string{"-E", "nodiscard,lazy_itable_init=1"}, false},
+		{"not allowed", "ext4", "nodiscard,root_owner=0:0", nil, true},
+		{"injection", "ext4", "nodiscard;reboot", nil, true},
+		{"xfs", "xfs", "nodiscard", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &optionsMounter{Interface: mount.NewFake()}
+			ns := newTestNodeServer(mounter)
+
+			req := stageVolumeRequest(filepath.Join(t.TempDir(), "staging"))
+			req.GetVolumeCapability().GetMount().FsType = c.fsType
+			req.VolumeContext = map[string]string{MkfsOptionsKey: c.mkfsOptions}
+			_, err := ns.NodeStageVolume(context.Background(), req)
+			if c.expectInvalid {
+				if status.Code(err) != codes.InvalidArgument {
+					t.Fatalf("Expected InvalidArgument, got %v", err)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(mounter.formatOptions, c.expected) {
+				t.Errorf("Expected format options %v, got %v", c.expected, mounter.formatOptions)
+			}
+		})
+	}
+}
+
+// bindMounter is a fake mounter recording the options of Mount.
+type bindMounter struct {
+	mount.Interface
+	options []string
+}
+
+func (m *bindMounter) Mount(source string, target string, fstype string, options []string) error {
+	m.options = options
+
+	return m.Interface.Mount(source, target, fstype, options)
+}
+
+func TestNodePublishVolumeMountFlags(t *testing.T) {
+	cases := []struct {
+		name       string
+		readonly   bool
+		mountFlags []string
+		expected   []string
+	}{
+		{"read-write", false, []string{"noatime", "discard", "noatime"}, []string{"bind", "noatime", "discard"}},
+		{"read-only", true, []string{"noatime", "ro"}, []string{"bind", "ro", "noatime"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &bindMounter{Interface: mount.NewFake()}
+			ns := newTestNodeServer(mounter)
+
+			dir := t.TempDir()
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				StagingTargetPath: filepath.Join(dir, "staging"),
+				TargetPath:        filepath.Join(dir, "target"),
+				Readonly:          c.readonly,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{
+						Mount: &csi.VolumeCapability_MountVolume{MountFlags: c.mountFlags},
+					},
+					AccessMode: &onlyVolumeCapAccessMode,
+				},
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if !slices.Equal(mounter.options, c.expected) {
+				t.Errorf("Expected mount options %v, got %v", c.expected, mounter.options)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeDoesNotRetryPermanentError(t *testing.T) {
+	fakeExec := &testingexec.FakeExec{
+		CommandScript: []testingexec.FakeCommandAction{
+			fakeCommand("", testingexec.FakeExitError{Status: 2}),
+			fakeCommand("mkfs.ext4: invalid blocks '/dev/sdb' on device", errors.New("exit status 1")),
+		},
+	}
+	ns := newTestNodeServer(newExecMounter(fakeExec))
+
+	_, err := ns.NodeStageVolume(context.Background(), stageVolumeRequest(filepath.Join(t.TempDir(), "staging")))
+	if status.Code(err) != codes.Internal {
+		t.Fatalf("Expected Internal error, got %v", err)
+	}
+	if fakeExec.CommandCalls != 2 {
+		t.Errorf("Expected a single format attempt (2 commands), got %d", fakeExec.CommandCalls)
+	}
+}
+
+func TestIsTransientMountError(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected bool
+	}{
+		{"EBUSY", fmt.Errorf("mount: %w", unix.EBUSY), true},
+		{"busy output", kmount.NewMountError(kmount.FormatFailed, "output:(Device or resource busy)"), true},
+		{"wrong fs type", kmount.NewMountError(kmount.FilesystemMismatch, "wrong fs type, bad option"), false},
+		{"other", errors.New("no such device"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := isTransientMountError(c.err); got != c.expected {
+				t.Errorf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestMountErrorCode(t *testing.T) {
+	cases := []struct {
+		name     string
+		err      error
+		expected codes.Code
+	}{
+		{"device not found", errors.New(`failed to find device for the volumeID: "vol-1" within the alloted time`), codes.NotFound},
+		{"ENODEV", fmt.Errorf("open /dev/vdb: %w", unix.ENODEV), codes.NotFound},
+		{"special device", errors.New("mount: /mnt: special device /dev/vdb does not exist."), codes.NotFound},
+		{"filesystem mismatch", kmount.NewMountError(kmount.FilesystemMismatch, "filesystem is ext4, requested xfs"), codes.FailedPrecondition},
+		{"wrong fs type", errors.New("mount: /mnt: wrong fs type, bad option, bad superblock on /dev/vdb"), codes.FailedPrecondition},
+		{"unformatted read-only", kmount.NewMountError(kmount.UnformattedReadOnly, "cannot mount unformatted disk as read-only"), codes.FailedPrecondition},
+		{"no space", kmount.NewMountError(kmount.FormatFailed, "output: mkfs.xfs: No space left on device"), codes.ResourceExhausted},
+		{"ENOSPC", fmt.Errorf("write: %w", unix.ENOSPC), codes.ResourceExhausted},
+		{"busy", kmount.NewMountError(kmount.FormatFailed, "output:(Device or resource busy)"), codes.Unavailable},
+		{"permission denied", errors.New("mount: /mnt: permission denied."), codes.PermissionDenied},
+		{"other", errors.New("mkfs.ext4: invalid blocks '/dev/sdb' on device"), codes.Internal},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := mountErrorCode(c.err); got != c.expected {
+				t.Errorf("Expected %v, got %v", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestNodeGetInfoTopology(t *testing.T) {
+	ns := newTestNodeServer(mount.NewFake())
+
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	segments := resp.GetAccessibleTopology().GetSegments()
+	if segments[ZoneKey] == "" {
+		t.Errorf("Expected node to advertise %s, got %v", ZoneKey, segments)
+	}
+	if host := segments[HostKey]; host != "5b2f7a3e-6c2d-4f7e-9a0b-3c4d5e6f7a8b" {
+		t.Errorf("Expected node to advertise its host, got %q", host)
+	}
+	if resp.GetMaxVolumesPerNode() != DefaultMaxVolAttachLimit {
+		t.Errorf("Expected %d volumes per node, got %d", DefaultMaxVolAttachLimit, resp.GetMaxVolumesPerNode())
+	}
+	for key := range segments {
+		if !slices.Contains(TopologyKeys, key) {
+			t.Errorf("Node advertises unknown topology key %s", key)
+		}
+	}
+}
+
+func TestNodeGetInfoStorageScopeTopology(t *testing.T) {
+	ns := newTestNodeServer(mount.NewFake())
+	ns.storageScopeTopology = true
+
+	resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cluster := resp.GetAccessibleTopology().GetSegments()[ClusterKey]; cluster != "8e1d3c5b-2a4f-4b6d-8c0e-1f2a3b4c5d6e" {
+		t.Errorf("Expected node to advertise its cluster, got %q", cluster)
+	}
+}
+
+func TestCheckNodeZone(t *testing.T) {
+	cases := []struct {
+		name      string
+		nodeZone  string
+		strict    bool
+		expectErr bool
+	}{
+		{"no node zone", "", true, false},
+		{"same zone", "a1887604-237c-4212-a9cd-94620b7880fa", true, false},
+		{"same zone by name", "zone-1", true, false},
+		{"other zone", "zone-b", false, false},
+		{"other zone, strict", "zone-b", true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ns := newTestNodeServer(mount.NewFake())
+			ns.nodeZone = c.nodeZone
+
+			err := ns.checkNodeZone(context.Background(), c.strict)
+			if (err != nil) != c.expectErr {
+				t.Errorf("Expected error %v, got %v", c.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestNodeGetInfoNodeZone(t *testing.T) {
+	cases := []struct {
+		name         string
+		nodeZone     string
+		expectedZone string
+		expectedCode codes.Code
+	}{
+		{"no override", "", "a1887604-237c-4212-a9cd-94620b7880fa", codes.OK},
+		{"override", "zone-b", "zone-b", codes.OK},
+		{"override by name", "zone-1", "a1887604-237c-4212-a9cd-94620b7880fa", codes.OK},
+		{"unknown zone", "zone-c", "", codes.FailedPrecondition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ns := newTestNodeServer(mount.NewFake())
+			ns.connector = &capacityConnector{
+				Interface:  ns.connector,
+				capacities: map[string]int64{"a1887604-237c-4212-a9cd-94620b7880fa": 0, "zone-b": 0},
+			}
+			ns.nodeZone = c.nodeZone
+
+			resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if zone := resp.GetAccessibleTopology().GetSegments()[ZoneKey]; zone != c.expectedZone {
+				t.Errorf("Expected zone %q, got %q", c.expectedZone, zone)
+			}
+		})
+	}
+}
+
+func TestTopologyToCSI(t *testing.T) {
+	segments := Topology{ZoneID: "zone-1"}.ToCSI().GetSegments()
+	if _, ok := segments[HostKey]; ok {
+		t.Errorf("Expected no %s when host is unknown, got %v", HostKey, segments)
+	}
+
+	segments = Topology{ZoneID: "zone-1", HostID: "host-1"}.ToCSI().GetSegments()
+	if segments[ZoneKey] != "zone-1" || segments[HostKey] != "host-1" {
+		t.Errorf("Expected zone and host segments, got %v", segments)
+	}
+
+	segments = Topology{ZoneID: "zone-1", ClusterID: "cluster-1"}.ToCSI().GetSegments()
+	if segments[ZoneKey] != "zone-1" || segments[ClusterKey] != "cluster-1" {
+		t.Errorf("Expected zone and cluster segments, got %v", segments)
+	}
+}
+
+// staleResizeMounter is a fake mounter whose resize succeeds
+// without growing the filesystem.
+type staleResizeMounter struct {
+	mount.Interface
+	deviceSize, filesystemSize int64
+}
+
+func (m *staleResizeMounter) GetBlockSizeBytes(_ string) (int64, error) {
+	return m.deviceSize, nil
+}
+
+func (m *staleResizeMounter) GetStatistics(volumePath string) (mount.VolumeStatistics, error) {
+	stats, err := m.Interface.GetStatistics(volumePath)
+	stats.TotalBytes = m.filesystemSize
+
+	return stats, err
+}
+
+func TestNodeExpandVolumeVerifiesFilesystemSize(t *testing.T) {
+	cases := []struct {
+		name           string
+		filesystemSize int64
+		expectError    bool
+	}{
+		{"resized", 19 * 1024 * 1024 * 1024, false},
+		{"not resized", 10 * 1024 * 1024 * 1024, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ns := newTestNodeServer(&staleResizeMounter{
+				Interface:      mount.NewFake(),
+				deviceSize:     20 * 1024 * 1024 * 1024,
+				filesystemSize: c.filesystemSize,
+			})
+
+			_, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				VolumePath: t.TempDir(),
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &onlyVolumeCapAccessMode,
+				},
+			})
+			if c.expectError {
+				if status.Code(err) != codes.Internal {
+					t.Errorf("Expected Internal error, got %v", err)
+				}
+			} else if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+// resizeMounter is a fake mounter recording whether a resize was run.
+type resizeMounter struct {
+	mount.Interface
+	needResize bool
+	resized    bool
+}
+
+func (m *resizeMounter) NeedResize(_, _ string) (bool, error) {
+	return m.needResize, nil
+}
+
+func (m *resizeMounter) Resize(_, _ string) (bool, error) {
+	m.resized = true
+
+	return true, nil
+}
+
+func TestNodeExpandVolumeNeedResize(t *testing.T) {
+	for _, needResize := range []bool{true, false} {
+		m := &resizeMounter{Interface: mount.NewFake(), needResize: needResize}
+		ns := newTestNodeServer(m)
+
+		res, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+			VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+			StagingTargetPath: t.TempDir(),
+		})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if m.resized != needResize {
+			t.Errorf("NeedResize %v: expected resize %v, got %v", needResize, needResize, m.resized)
+		}
+		if res.GetCapacityBytes() == 0 {
+			t.Errorf("Expected the capacity of the device to be returned")
+		}
+	}
+}
+
+// rescanMounter is a device whose size reflects an expansion only after
+// it has been rescanned a number of times.
+type rescanMounter struct {
+	mount.Interface
+	rescansNeeded int
+	rescans       int
+	resizedSize   int64
+}
+
+func (m *rescanMounter) GetBlockSizeBytes(_ string) (int64, error) {
+	if m.rescans < m.rescansNeeded {
+		return 1 * 1024 * 1024 * 1024, nil
+	}
+
+	return 2 * 1024 * 1024 * 1024, nil
+}
+
+func (m *rescanMounter) RescanDevice(_ context.Context, _ string) error {
+	m.rescans++
+
+	return nil
+}
+
+func (m *rescanMounter) NeedResize(_ string, _ string) (bool, error) {
+	return true, nil
+}
+
+func (m *rescanMounter) Resize(devicePath string, _ string) (bool, error) {
+	m.resizedSize, _ = m.GetBlockSizeBytes(devicePath)
+
+	return true, nil
+}
+
+func TestNodeExpandVolumeWaitForDeviceSize(t *testing.T) {
+	cases := []struct {
+		name          string
+		rescansNeeded int
+		expectErr     bool
+	}{
+		{"size already propagated", 0, false},
+		{"size propagated after rescans", 2, false},
+		{"size never propagated", DefaultExpandDeviceRetries + 1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &rescanMounter{Interface: mount.NewFake(), rescansNeeded: c.rescansNeeded}
+			ns := newTestNodeServer(m)
+
+			_, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				StagingTargetPath: t.TempDir(),
+				CapacityRange:     &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024 * 1024},
+			})
+			if c.expectErr {
+				if status.Code(err) != codes.Internal {
+					t.Fatalf("Expected Internal error, got %v", err)
+				}
+				if m.resizedSize != 0 {
+					t.Errorf("Expected no resize, got a resize to %d bytes", m.resizedSize)
+				}
+
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if m.rescans != c.rescansNeeded {
+				t.Errorf("Expected %d rescans, got %d", c.rescansNeeded, m.rescans)
+			}
+			if m.resizedSize != 2*1024*1024*1024 {
+				t.Errorf("Expected a resize to the new size, got %d bytes", m.resizedSize)
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolumeCleanupStagingDir(t *testing.T) {
+	cases := []struct {
+		name      string
+		cleanup   bool
+		withFile  bool
+		expectDir bool
+	}{
+		{"cleanup disabled", false, false, true},
+		{"empty directory", true, false, false},
+		{"non-empty directory", true, true, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ns := newTestNodeServer(mount.NewFake())
+			ns.cleanupStagingDir = c.cleanup
+
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+			if err := os.Mkdir(stagingPath, 0o750); err != nil {
+				t.Fatalf("Cannot create staging directory: %v", err)
+			}
+			if c.withFile {
+				if err := os.WriteFile(filepath.Join(stagingPath, "file"), nil, 0o600); err != nil {
+					t.Fatalf("Cannot create file: %v", err)
+				}
+			}
+
+			_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				StagingTargetPath: stagingPath,
+			})
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if _, err := os.Stat(stagingPath); (err == nil) != c.expectDir {
+				t.Errorf("Expected staging directory to exist: %v, got %v", c.expectDir, err)
+			}
+		})
+	}
+}
+
+func TestRemoveStagingDirKeepsMountPoint(t *testing.T) {
+	mounter := mount.NewFake()
+	ns := newTestNodeServer(mounter)
+	ns.cleanupStagingDir = true
+
+	stagingPath := t.TempDir()
+	if err := mounter.Mount("/dev/sdb", stagingPath, FSTypeExt4, nil); err != nil {
+		t.Fatalf("Cannot mount: %v", err)
+	}
+
+	ns.removeStagingDir(context.Background(), stagingPath)
+	if _, err := os.Stat(stagingPath); err != nil {
+		t.Errorf("Expected mounted staging directory to be kept, got %v", err)
+	}
+}
+
+// corruptedMounter is a fake mounter whose mount points are corrupted.
+type corruptedMounter struct {
+	mount.Interface
+}
+
+func (m *corruptedMounter) GetStatistics(_ string) (mount.VolumeStatistics, error) {
+	return mount.VolumeStatistics{}, unix.EIO
+}
+
+func (m *corruptedMounter) IsCorruptedMnt(err error) bool {
+	return errors.Is(err, unix.EIO)
+}
+
+// corruptedPathMounter is a fake mounter failing to stat corrupted mount points,
+// as mount.PathExists does.
+type corruptedPathMounter struct {
+	corruptedMounter
+}
+
+func (m *corruptedPathMounter) PathExists(_ string) (bool, error) {
+	return true, unix.EIO
+}
+
+func TestNodeGetVolumeStatsUsage(t *testing.T) {
+	resp, err := newTestNodeServer(mount.NewFake()).NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		VolumePath: t.TempDir(),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	usage := make(map[csi.VolumeUsage_Unit]*csi.VolumeUsage)
+	for _, u := range resp.GetUsage() {
+		usage[u.GetUnit()] = u
+	}
+	if bytes := usage[csi.VolumeUsage_BYTES]; bytes.GetTotal() != 10*1024*1024*1024 || bytes.GetUsed() != 7*1024*1024*1024 || bytes.GetAvailable() != 3*1024*1024*1024 {
+		t.Errorf("Unexpected bytes usage: %v", bytes)
+	}
+	if inodes := usage[csi.VolumeUsage_INODES]; inodes.GetTotal() != 10000 || inodes.GetUsed() != 7000 || inodes.GetAvailable() != 3000 {
+		t.Errorf("Unexpected inodes usage: %v", inodes)
+	}
+}
+
+func TestNodeGetVolumeStatsCondition(t *testing.T) {
+	volumePath := t.TempDir()
+	req := &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		VolumePath: volumePath,
+	}
+
+	resp, err := newTestNodeServer(mount.NewFake()).NodeGetVolumeStats(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.GetVolumeCondition().GetAbnormal() {
+		t.Errorf("Expected healthy volume, got %v", resp.GetVolumeCondition())
+	}
+
+	for _, mounter := range []mount.Interface{&corruptedMounter{mount.NewFake()}, &corruptedPathMounter{corruptedMounter{mount.NewFake()}}} {
+		resp, err = newTestNodeServer(mounter).NodeGetVolumeStats(context.Background(), req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !resp.GetVolumeCondition().GetAbnormal() {
+			t.Errorf("Expected abnormal volume, got %v", resp.GetVolumeCondition())
+		}
+	}
+}
+
+// warmUpMounter counts the warm-ups of the device buses.
+type warmUpMounter struct {
+	mount.Interface
+	warmUps int
+}
+
+func (m *warmUpMounter) WarmUp(_ context.Context) {
+	m.warmUps++
+}
+
+func TestNodeWarmUpDevices(t *testing.T) {
+	cases := []struct {
+		name            string
+		mode            Mode
+		warmUpDevices   bool
+		expectedWarmUps int
+	}{
+		{"node", NodeMode, true, 1},
+		{"all", AllMode, true, 1},
+		{"controller", ControllerMode, true, 0},
+		{"disabled", NodeMode, false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &warmUpMounter{Interface: mount.NewFake()}
+			options := &Options{Mode: c.mode, WarmUpDevices: c.warmUpDevices}
+			if _, err := New(context.Background(), fake.New(), options, mounter); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mounter.warmUps != c.expectedWarmUps {
+				t.Errorf("Expected %d warm-ups, got %d", c.expectedWarmUps, mounter.warmUps)
+			}
+		})
+	}
+}
+
+func TestFSTypeForSize(t *testing.T) {
+	minSizes := map[string]int64{FSTypeXfs: 100, FSTypeExt3: 10}
+	cases := []struct {
+		name      string
+		sizeBytes int64
+		expected  string
+	}{
+		{"below all thresholds", util.GigaBytesToBytes(1), FSTypeExt4},
+		{"just below first threshold", util.GigaBytesToBytes(10) - 1, FSTypeExt4},
+		{"at first threshold", util.GigaBytesToBytes(10), FSTypeExt3},
+		{"just below second threshold", util.GigaBytesToBytes(100) - 1, FSTypeExt3},
+		{"at second threshold", util.GigaBytesToBytes(100), FSTypeXfs},
+		{"above all thresholds", util.GigaBytesToBytes(1000), FSTypeXfs},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if fsType := fsTypeForSize(minSizes, c.sizeBytes); fsType != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, fsType)
+			}
+		})
+	}
+}
+
+// sizedMounter is a fake mounter with devices of a given size and
+// filesystem type, recording the filesystem type of FormatAndMount.
+type sizedMounter struct {
+	mount.Interface
+	sizeBytes int64
+	existing  string
+	fsType    string
+}
+
+func (m *sizedMounter) GetBlockSizeBytes(_ string) (int64, error) {
+	return m.sizeBytes, nil
+}
+
+func (m *sizedMounter) GetFSType(_ string) (string, error) {
+	return m.existing, nil
+}
+
+func (m *sizedMounter) FormatAndMount(source string, target string, fstype string, options []string) error {
+	m.fsType = fstype
+
+	return m.Mount(source, target, fstype, options)
+}
+
+func TestNodeStageVolumeFSTypeBySize(t *testing.T) {
+	cases := []struct {
+		name      string
+		fsType    string
+		existing  string
+		sizeBytes int64
+		expected  string
+	}{
+		{"small volume", "", "", util.GigaBytesToBytes(10), FSTypeExt4},
+		{"large volume", "", "", util.GigaBytesToBytes(200), FSTypeXfs},
+		{"large volume already formatted", "", FSTypeExt4, util.GigaBytesToBytes(200), FSTypeExt4},
+		{"explicit fstype", FSTypeExt3, "", util.GigaBytesToBytes(200), FSTypeExt3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &sizedMounter{Interface: mount.NewFake(), sizeBytes: c.sizeBytes, existing: c.existing}
+			ns := newTestNodeServer(mounter)
+			ns.fsTypeMinSizes = map[string]int64{FSTypeXfs: 100}
+
+			req := stageVolumeRequest(filepath.Join(t.TempDir(), "staging"))
+			req.GetVolumeCapability().GetMount().FsType = c.fsType
+			if _, err := ns.NodeStageVolume(context.Background(), req); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if mounter.fsType != c.expected {
+				t.Errorf("Expected %s, got %s", c.expected, mounter.fsType)
+			}
+		})
+	}
+}
+
+// pathMounter is a fake mounter whose target paths are in a given state,
+// recording whether Unpublish was called.
+type pathMounter struct {
+	mount.Interface
+	pathErr     error
+	corrupted   bool
+	unpublished bool
+}
+
+func (m *pathMounter) PathExists(_ string) (bool, error) {
+	return m.pathErr != nil, m.pathErr
+}
+
+func (m *pathMounter) IsCorruptedMnt(_ error) bool {
+	return m.corrupted
+}
+
+func (m *pathMounter) Unpublish(_ string) error {
+	m.unpublished = true
+
+	return nil
+}
+
+func TestNodeUnpublishVolumeTargetState(t *testing.T) {
+	cases := []struct {
+		name                string
+		pathErr             error
+		corrupted           bool
+		expectedCode        codes.Code
+		expectedUnpublished bool
+	}{
+		{"already gone", nil, false, codes.OK, false},
+		{"corrupted mount", unix.ENOTCONN, true, codes.OK, true},
+		{"path error", unix.EACCES, false, codes.Internal, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &pathMounter{Interface: mount.NewFake(), pathErr: c.pathErr, corrupted: c.corrupted}
+			ns := newTestNodeServer(mounter)
+
+			_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+				TargetPath: filepath.Join(t.TempDir(), "target"),
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected code %v, got %v", c.expectedCode, err)
+			}
+			if mounter.unpublished != c.expectedUnpublished {
+				t.Errorf("Expected unpublished %v, got %v", c.expectedUnpublished, mounter.unpublished)
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolumeAlreadyGone(t *testing.T) {
+	ns := newTestNodeServer(mount.NewFake())
+
+	_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		TargetPath: filepath.Join(t.TempDir(), "removed"),
+	})
+	if err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestNodeStageVolumeRecordsDevicePath(t *testing.T) {
+	ctx := context.Background()
+	ns := newTestNodeServer(mount.NewFake())
+	target := filepath.Join(t.TempDir(), "staging")
+
+	req := stageVolumeRequest(target)
+	if _, err := ns.NodeStageVolume(ctx, req); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	metadata, err := readStagingMetadata(target)
+	if err != nil {
+		t.Fatalf("Cannot read staging metadata: %v", err)
+	}
+	if metadata.VolumeID != req.GetVolumeId() || metadata.DevicePath != "/dev/sdb" {
+		t.Errorf("Expected volume %s on /dev/sdb, got %+v", req.GetVolumeId(), metadata)
+	}
+
+	if _, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          req.GetVolumeId(),
+		StagingTargetPath: target,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, err := readStagingMetadata(target); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected staging metadata to be removed, got %v", err)
+	}
+}
+
+func TestNodePublishVolumeBlockBindMount(t *testing.T) {
+	ctx := context.Background()
+	mounter := mount.NewFake()
+	ns := newTestNodeServer(mounter)
+
+	target := filepath.Join(t.TempDir(), "publish", "volume")
+	_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:          "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+		TargetPath:        target,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &onlyVolumeCapAccessMode,
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	mountPoints, err := mounter.List()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(mountPoints) != 1 || mountPoints[0].Device != "/dev/sdb" || mountPoints[0].Path != target || !slices.Contains(mountPoints[0].Opts, "bind") {
+		t.Fatalf("Expected /dev/sdb bind-mounted at %s, got %+v", target, mountPoints)
+	}
+
+	if _, err := ns.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{
+		VolumeId:   "ace9f28b-3081-40c1-8353-4cc3e3014072",
+		TargetPath: target,
+	}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if mountPoints, _ := mounter.List(); len(mountPoints) != 0 {
+		t.Errorf("Expected the bind mount to be removed, got %+v", mountPoints)
+	}
+	if _, err := os.Stat(target); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected target file to be removed, got %v", err)
+	}
+}
+
+// serialMounter is a fake mounter finding the devices of volumes
+// by their serial, as on KVM.
+type serialMounter struct {
+	mount.Interface
+	devices map[string]string
+}
+
+func (m *serialMounter) GetDevicePath(_ context.Context, volumeID string) (string, error) {
+	return m.devices[volumeID], nil
+}
+
+func (m *serialMounter) CheckVolumeDevice(_ context.Context, devicePath string, volumeID string) error {
+	if m.devices[volumeID] != devicePath {
+		return fmt.Errorf("%w: %s is the device of volume %s", mount.ErrDeviceMismatch, m.devices[volumeID], volumeID)
+	}
+
+	return nil
+}
+
+func TestNodeUnstageVolumeVerifyDevice(t *testing.T) {
+	const volumeA, volumeB = "ace9f28b-3081-40c1-8353-4cc3e3014072", "5d6f2e1a-7b3c-4d8e-9f0a-1b2c3d4e5f6a"
+	cases := []struct {
+		name            string
+		unstagedVolume  string
+		unstagedTarget  string
+		serialDeviceOfA string
+		expectedCode    codes.Code
+	}{
+		{"matching device", volumeA, "a", "/dev/sdb", codes.OK},
+		{"other staged volume", volumeA, "b", "/dev/sdb", codes.FailedPrecondition},
+		{"misattributed device", volumeA, "a", "/dev/sdc", codes.FailedPrecondition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+			mounter := &serialMounter{
+				Interface: mount.NewFake(),
+				devices:   map[string]string{volumeA: "/dev/sdb", volumeB: "/dev/sdc"},
+			}
+			ns := newTestNodeServer(mounter)
+			ns.verifyUnstageDevice = true
+
+			dir := t.TempDir()
+			for volumeID, target := range map[string]string{volumeA: "a", volumeB: "b"} {
+				req := stageVolumeRequest(filepath.Join(dir, target, "globalmount"))
+				req.VolumeId = volumeID
+				if err := os.MkdirAll(filepath.Dir(req.GetStagingTargetPath()), 0o750); err != nil {
+					t.Fatalf("Unexpected error: %v", err)
+				}
+				if _, err := ns.NodeStageVolume(ctx, req); err != nil {
+					t.Fatalf("Unexpected error staging %s: %v", volumeID, err)
+				}
+			}
+			// The device attributed to volume A at staging turns out to be another one.
+			mounter.devices[volumeA] = c.serialDeviceOfA
+
+			target := filepath.Join(dir, c.unstagedTarget, "globalmount")
+			_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+				VolumeId:          c.unstagedVolume,
+				StagingTargetPath: target,
+			})
+			if status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if c.expectedCode == codes.OK {
+				return
+			}
+			if _, refCount, _ := mounter.GetDeviceName(target); refCount == 0 {
+				t.Errorf("Expected the mismatched device to stay mounted at %s", target)
+			}
+		})
+	}
+}
+
+// repairMounter is a fake mounter recording the filesystem checks.
+type repairMounter struct {
+	mount.Interface
+	existing  string
+	repairErr error
+	checked   string
+}
+
+func (m *repairMounter) GetFSType(_ string) (string, error) {
+	return m.existing, nil
+}
+
+func (m *repairMounter) RepairFilesystem(_ context.Context, _ string, fsType string) error {
+	m.checked = fsType
+
+	return m.repairErr
+}
+
+func TestNodeStageVolumeFsckBeforeMount(t *testing.T) {
+	cases := []struct {
+		name            string
+		fsckBeforeMount string
+		existing        string
+		repairErr       error
+		expectedChecked string
+		expectedCode    codes.Code
+	}{
+		{"disabled", "", "ext4", nil, "", codes.OK},
+		{"ext4", "true", "ext4", nil, "ext4", codes.OK},
+		{"unformatted", "true", "", nil, "", codes.OK},
+		{"corrupted", "true", "xfs", kmount.NewMountError(kmount.HasFilesystemErrors, "corrupted"), "xfs", codes.FailedPrecondition},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			mounter := &repairMounter{Interface: mount.NewFake(), existing: c.existing, repairErr: c.repairErr}
+			ns := newTestNodeServer(mounter)
+
+			req := stageVolumeRequest(filepath.Join(t.TempDir(), "staging"))
+			req.VolumeContext = map[string]string{FsckBeforeMountKey: c.fsckBeforeMount}
+			if _, err := ns.NodeStageVolume(context.Background(), req); status.Code(err) != c.expectedCode {
+				t.Fatalf("Expected %v, got %v", c.expectedCode, err)
+			}
+			if mounter.checked != c.expectedChecked {
+				t.Errorf("Expected filesystem check %q, got %q", c.expectedChecked, mounter.checked)
+			}
+		})
+	}
+}
+
+// lookupMounter counts the lookups of device paths, and tells whether the
+// devices are still block devices.
+type lookupMounter struct {
+	serialMounter
+	lookups  int
+	detached map[string]bool
+}
+
+func (m *lookupMounter) GetDevicePath(ctx context.Context, volumeID string) (string, error) {
+	m.lookups++
+
+	return m.serialMounter.GetDevicePath(ctx, volumeID)
+}
+
+func (m *lookupMounter) IsBlockDevice(devicePath string) (bool, error) {
+	return !m.detached[devicePath], nil
+}
+
+func TestNodeDeviceCache(t *testing.T) {
+	const volumeID = "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	ctx := context.Background()
+	m := &lookupMounter{
+		serialMounter: serialMounter{Interface: mount.NewFake(), devices: map[string]string{volumeID: "/dev/vdb"}},
+		detached:      make(map[string]bool),
+	}
+	ns := newTestNodeServer(m)
+	ns.deviceCache = newDeviceCache(time.Minute)
+	now := time.Now()
+	ns.deviceCache.now = func() time.Time { return now }
+
+	get := func(expectedPath string, expectedLookups int) {
+		t.Helper()
+		devicePath, err := ns.getDevicePath(ctx, volumeID)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if devicePath != expectedPath {
+			t.Errorf("Expected device %s, got %s", expectedPath, devicePath)
+		}
+		if m.lookups != expectedLookups {
+			t.Errorf("Expected %d lookups, got %d", expectedLookups, m.lookups)
+		}
+	}
+
+	get("/dev/vdb", 1)
+	// Cached.
+	get("/dev/vdb", 1)
+
+	// The cached device has another serial.
+	m.devices[volumeID] = "/dev/vdc"
+	get("/dev/vdc", 2)
+	get("/dev/vdc", 2)
+
+	// The cached device is gone.
+	m.detached["/dev/vdc"] = true
+	get("/dev/vdc", 3)
+	m.detached["/dev/vdc"] = false
+
+	// Expired.
+	get("/dev/vdc", 3)
+	now = now.Add(time.Minute)
+	get("/dev/vdc", 4)
+
+	// Forgotten when the volume is unstaged.
+	_, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeID,
+		StagingTargetPath: filepath.Join(t.TempDir(), "staging"),
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	get("/dev/vdc", 5)
+}
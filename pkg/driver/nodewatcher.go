@@ -0,0 +1,189 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/klog/v2"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// nodeIDAnnotationKey is the annotation set by the kubelet on a Node with
+// the CSI node IDs of its drivers, i.e. the ID of the CloudStack VM.
+const nodeIDAnnotationKey = "csi.volume.kubernetes.io/nodeid"
+
+// nodeWatcher detaches the volumes of deleted Kubernetes nodes, instead of
+// waiting for the external-attacher to time out.
+type nodeWatcher struct {
+	client    kubernetes.Interface
+	connector cloud.Interface
+
+	// gracePeriod is the delay after a node deletion before detaching its
+	// volumes, during which the node may register again.
+	gracePeriod time.Duration
+}
+
+// newKubeConfig returns the Kubernetes client configuration of a kubeconfig
+// file, or the in-cluster configuration if kubeconfig is empty.
+func newKubeConfig(kubeconfig string) (*rest.Config, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	config.UserAgent = DriverName
+
+	return config, nil
+}
+
+// newKubeClient creates a Kubernetes client, see newKubeConfig.
+func newKubeClient(kubeconfig string) (kubernetes.Interface, error) {
+	config, err := newKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(config)
+}
+
+// Run watches the node deletions until the context is done.
+func (w *nodeWatcher) Run(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	factory := informers.NewSharedInformerFactory(w.client, 0)
+	informer := factory.Core().V1().Nodes().Informer()
+	_, err := informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		DeleteFunc: func(obj any) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			node, ok := obj.(*corev1.Node)
+			if !ok {
+				return
+			}
+			go func() {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(w.gracePeriod):
+				}
+				if err := w.handleNodeDeletion(ctx, node); err != nil {
+					logger.Error(err, "Cannot detach the volumes of deleted node", "node", node.Name)
+				}
+			}()
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("cannot watch nodes: %w", err)
+	}
+
+	logger.Info("Watching node deletions", "gracePeriod", w.gracePeriod)
+	factory.Start(ctx.Done())
+	<-ctx.Done()
+	factory.Shutdown()
+
+	return nil
+}
+
+// handleNodeDeletion detaches the volumes managed by the driver from the VM
+// of a deleted node, unless the node has registered again or the VM is still
+// running, e.g. when the Node object was deleted while temporarily NotReady.
+func (w *nodeWatcher) handleNodeDeletion(ctx context.Context, node *corev1.Node) error {
+	logger := klog.FromContext(ctx).WithValues("node", node.Name)
+
+	vmID, err := nodeVMID(node)
+	if err != nil {
+		return err
+	}
+	if vmID == "" {
+		logger.V(4).Info("Deleted node has no CSI node ID, ignoring")
+
+		return nil
+	}
+	logger = logger.WithValues("vmID", vmID)
+
+	if _, err := w.client.CoreV1().Nodes().Get(ctx, node.Name, metav1.GetOptions{}); err == nil {
+		logger.Info("Deleted node registered again, not detaching its volumes")
+
+		return nil
+	} else if !apierrors.IsNotFound(err) {
+		return fmt.Errorf("cannot get node: %w", err)
+	}
+
+	down, err := isVMDown(ctx, w.connector, vmID)
+	if err != nil {
+		return fmt.Errorf("cannot get VM %s: %w", vmID, err)
+	}
+	if !down {
+		logger.Info("VM of deleted node is still running, not detaching its volumes")
+
+		return nil
+	}
+
+	vols, err := w.connector.ListVolumesForVM(ctx, vmID)
+	if err != nil {
+		return fmt.Errorf("cannot list volumes of VM %s: %w", vmID, err)
+	}
+	var errs []error
+	for _, vol := range vols {
+		if !vol.IsManaged() {
+			continue
+		}
+		logger.Info("Detaching volume of deleted node", "volumeID", vol.ID)
+		if err := w.connector.DetachVolume(ctx, vol.ID); err != nil {
+			errs = append(errs, fmt.Errorf("cannot detach volume %s: %w", vol.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// nodeVMID returns the CSI node ID of the driver on a node, i.e. the ID of
+// its VM, or an empty string if the driver was not registered on the node.
+func nodeVMID(node *corev1.Node) (string, error) {
+	annotation, ok := node.Annotations[nodeIDAnnotationKey]
+	if !ok {
+		return "", nil
+	}
+	var nodeIDs map[string]string
+	if err := json.Unmarshal([]byte(annotation), &nodeIDs); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %w", nodeIDAnnotationKey, err)
+	}
+
+	return nodeIDs[DriverName], nil
+}
@@ -0,0 +1,104 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+func TestHandleNodeDeletion(t *testing.T) {
+	ctx := context.Background()
+	unmanagedVolumeID := "ace9f28b-3081-40c1-8353-4cc3e3014072"
+	vmID := "deleted-vm"
+
+	cases := []struct {
+		name             string
+		vmState          string
+		registeredAgain  bool
+		annotation       string
+		expectedDetached bool
+	}{
+		{"VM stopped", "Stopped", false, `{"csi.cloudstack.apache.org":"deleted-vm"}`, true},
+		{"VM absent", "", false, `{"csi.cloudstack.apache.org":"deleted-vm"}`, true},
+		{"VM running", "Running", false, `{"csi.cloudstack.apache.org":"deleted-vm"}`, false},
+		{"node registered again", "Stopped", true, `{"csi.cloudstack.apache.org":"deleted-vm"}`, false},
+		{"driver not registered", "Stopped", false, `{"other.csi.driver":"deleted-vm"}`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			states := map[string]string{}
+			if c.vmState != "" {
+				states[vmID] = c.vmState
+			}
+			connector := &vmStatesConnector{fake.New(), states}
+			managedVolumeID, err := connector.CreateVolume(ctx, &cloud.VolumeOptions{
+				Name:           "pvc-1",
+				DiskOfferingID: "9743fd77-0f5d-4ef9-b2f8-f194235c769c",
+				ZoneID:         "a1887604-237c-4212-a9cd-94620b7880fa",
+				SizeInGB:       1,
+			})
+			if err != nil {
+				t.Fatalf("Cannot create volume: %v", err)
+			}
+			managedTags := map[string]string{cloud.ManagedByTagKey: cloud.ManagedByTagValue}
+			if err := connector.CreateTags(ctx, cloud.ResourceTypeVolume, managedVolumeID, managedTags); err != nil {
+				t.Fatalf("Cannot tag volume: %v", err)
+			}
+			for _, volumeID := range []string{managedVolumeID, unmanagedVolumeID} {
+				if _, err := connector.AttachVolume(ctx, volumeID, vmID); err != nil {
+					t.Fatalf("Cannot attach volume: %v", err)
+				}
+			}
+
+			node := &corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "node-1",
+					Annotations: map[string]string{nodeIDAnnotationKey: c.annotation},
+				},
+			}
+			client := k8sfake.NewSimpleClientset()
+			if c.registeredAgain {
+				client = k8sfake.NewSimpleClientset(node)
+			}
+			w := &nodeWatcher{client: client, connector: connector}
+
+			if err := w.handleNodeDeletion(ctx, node); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+
+			managed, _ := connector.GetVolumeByID(ctx, managedVolumeID)
+			if detached := managed.VirtualMachineID == ""; detached != c.expectedDetached {
+				t.Errorf("Expected managed volume detached: %v, got VM %q", c.expectedDetached, managed.VirtualMachineID)
+			}
+			unmanaged, _ := connector.GetVolumeByID(ctx, unmanagedVolumeID)
+			if unmanaged.VirtualMachineID != vmID {
+				t.Errorf("Expected volume not managed by the driver to stay attached, got VM %q", unmanaged.VirtualMachineID)
+			}
+		})
+	}
+}
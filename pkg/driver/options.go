@@ -21,8 +21,15 @@ package driver
 
 import (
 	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	flag "github.com/spf13/pflag"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/mount"
 )
 
 // Options contains options and configuration settings for the driver.
@@ -36,6 +43,104 @@ type Options struct {
 
 	// CloudStackConfig is the path to the CloudStack configuration file
 	CloudStackConfig string
+	// CloudStack is the configuration read from CloudStackConfig. The
+	// connectors built from the credentials passed in CSI secrets share
+	// its other settings.
+	CloudStack *cloud.Config
+
+	// StorageScopeTopology adds the cluster of the nodes to their topology,
+	// and restricts the topology of volumes with cluster-wide storage to
+	// the clusters accessing it. It must be set on controller and nodes.
+	StorageScopeTopology bool
+
+	// #### Controller options #####
+
+	// InvalidSnapshotToken is the behavior of ListSnapshots when the starting token
+	// is invalid or out of range: abort, restart or empty.
+	InvalidSnapshotToken string
+
+	// ListSnapshotsFallback makes ListSnapshots list all snapshots and filter
+	// them when listing the snapshots of a volume, or a snapshot, fails.
+	ListSnapshotsFallback bool
+
+	// ManagedSnapshotsOnly hides the snapshots not created by the driver, e.g.
+	// taken in the CloudStack UI, from ListSnapshots and CreateVolume.
+	ManagedSnapshotsOnly bool
+
+	// VolumeSnapshotsOnDelete is the behavior of DeleteVolume when the volume
+	// has snapshots created by the driver: refuse, keeping the volume until all
+	// its snapshots are deleted, or delete, deleting those not referenced by
+	// VolumeSnapshotContents.
+	VolumeSnapshotsOnDelete string
+
+	// MaxDeviceSlots is the number of device slots available on a node, including
+	// the root disk. When set, ControllerPublishVolume fails early with ResourceExhausted
+	// if all slots of the node are in use. 0 disables the check.
+	MaxDeviceSlots int
+
+	// CompactDeviceIDs makes ControllerPublishVolume attach volumes at the
+	// lowest free device ID of the node, for hypervisors not reusing freed ones.
+	CompactDeviceIDs bool
+
+	// CheckZoneCapacity makes CreateVolume check the available primary storage
+	// of a zone before creating a volume in it, falling through to the next
+	// allowed zone when it is insufficient.
+	CheckZoneCapacity bool
+
+	// MaxCustomVolumeSize is the maximum size in GB of a volume with a custom disk
+	// offering, i.e. the custom.diskoffering.size.max CloudStack setting (0 if unknown).
+	MaxCustomVolumeSize int64
+
+	// DefaultCustomVolumeSize is the size in GB of a volume with a custom
+	// disk offering when no size is requested.
+	DefaultCustomVolumeSize int64
+
+	// FailoverDetach makes ControllerPublishVolume detach a volume attached to
+	// another node whose VM is stopped or absent, instead of failing.
+	FailoverDetach bool
+
+	// SizeIncrements are the size increments in GB of the volumes of disk
+	// offerings only supporting given steps, keyed by disk offering ID.
+	// Expansions are rounded up to the next increment.
+	SizeIncrements map[string]int64
+
+	// ZoneDiskOfferings are the disk offerings allowed in a zone, keyed by zone
+	// ID, as colon-separated disk offering IDs. Zones not listed allow any offering.
+	ZoneDiskOfferings map[string]string
+
+	// MaxConcurrentSnapshots is the maximum number of snapshots being created
+	// at the same time. Further CreateSnapshot calls wait for one to complete.
+	// 0 means no limit.
+	MaxConcurrentSnapshots int
+
+	// CapacityMode is how GetCapacity computes the available capacity of the
+	// storage pools: allocated, physical or overcommit.
+	CapacityMode string
+
+	// MaxSnapshotsPerVolume is the maximum number of snapshots of a volume.
+	// Further CreateSnapshot calls fail with ResourceExhausted. 0 means no limit.
+	MaxSnapshotsPerVolume int
+
+	// SnapshotTimeout bounds the wait for the creation of a snapshot, besides
+	// the deadline of the request. 0 means only the deadline of the request.
+	SnapshotTimeout time.Duration
+
+	// VolumeNameTemplate is the template of the CloudStack names of new volumes,
+	// e.g. "{offering}-{pvName}". The CSI name is used if empty.
+	VolumeNameTemplate string
+
+	// DetachOnNodeDeletion makes the controller watch the Kubernetes nodes,
+	// and detach the volumes of deleted nodes whose VM is stopped or absent.
+	DetachOnNodeDeletion bool
+
+	// NodeDeletionGracePeriod is the delay after a node deletion before
+	// detaching its volumes.
+	NodeDeletionGracePeriod time.Duration
+
+	// Kubeconfig is the path to the kubeconfig file used to watch the nodes
+	// and list the VolumeSnapshotContents.
+	// The in-cluster configuration is used if empty.
+	Kubeconfig string
 
 	// #### Node options #####
 
@@ -46,25 +151,195 @@ type Options struct {
 	// in CSINode objects. It is similar to https://kubernetes.io/docs/concepts/storage/storage-limits/#custom-limits
 	// which allowed administrators to specify custom volume limits by configuring the kube-scheduler.
 	VolumeAttachLimit int64
+
+	// StageMountRetries is the number of times NodeStageVolume retries FormatAndMount
+	// when it fails with a transient error (e.g. the device is still busy right after attach).
+	StageMountRetries int
+
+	// RootDevice is the disk holding the root filesystem of the node (e.g. /dev/sda),
+	// excluded when looking for the device of a volume. Detected from / if empty.
+	RootDevice string
+
+	// DeviceReadinessCommand is run against a candidate device of a volume
+	// before accepting it, for storage backends exposing devices before they
+	// are usable. {device} is replaced by the device path.
+	DeviceReadinessCommand string
+
+	// DevicePathTimeout bounds the time spent looking for the device of
+	// a volume. 0 means it is only bounded by DevicePathRetries.
+	DevicePathTimeout time.Duration
+
+	// DevicePathRetries is the number of rescans of the device buses when
+	// the device of a volume is not found, with increasing delays.
+	DevicePathRetries int
+
+	// DeviceCacheTTL is how long the node remembers the device path of
+	// a volume, 0 to disable the cache.
+	DeviceCacheTTL time.Duration
+
+	// ExpandDeviceRetries is the number of rescans of the device of a volume
+	// in NodeExpandVolume, until its size reflects the requested capacity.
+	ExpandDeviceRetries int
+
+	// WarmUpDevices makes the node plugin scan the device buses once at
+	// startup, so that the device of the first attached volume is found fast.
+	WarmUpDevices bool
+
+	// FSTypeMinSizes are the filesystem types of the volumes staged without
+	// fstype, keyed by the minimum size in GB of the volumes using them.
+	// Smaller volumes are formatted with ext4.
+	FSTypeMinSizes map[string]int64
+
+	// CleanupStagingDir enables the removal of the staging directory
+	// once the volume is unstaged, if it is empty.
+	CleanupStagingDir bool
+
+	// VerifyUnstageDevice makes NodeUnstageVolume refuse to unmount a device
+	// which is not the one of the volume, e.g. after devices found by scanning
+	// were misattributed.
+	VerifyUnstageDevice bool
+
+	// NodeZone is the CloudStack zone ID of the node, typically taken from a node label.
+	// When set, it is advertised in the node topology instead of the zone of the VM.
+	NodeZone string
+
+	// StrictNodeZone makes the node plugin fail to start when NodeZone
+	// differs from the zone of its instance in CloudStack.
+	StrictNodeZone bool
 }
 
 func (o *Options) AddFlags(f *flag.FlagSet) {
 	// Server options
 	f.StringVar(&o.Endpoint, "endpoint", DefaultCSIEndpoint, "Endpoint for the CSI driver server")
 	f.StringVar(&o.CloudStackConfig, "cloudstack-config", "./cloud-config", "Path to CloudStack configuration file")
+	f.BoolVar(&o.StorageScopeTopology, "storage-scope-topology", false, "Advertise the CloudStack cluster of the nodes in their topology, and restrict volumes of disk offerings with cluster-wide or host-wide storage to the clusters of their storage pools. Must be set on the controller and the nodes, and requires a CloudStack admin account.")
+
+	// Controller options
+	if o.Mode == AllMode || o.Mode == ControllerMode {
+		f.StringVar(&o.InvalidSnapshotToken, "list-snapshots-invalid-token", DefaultInvalidSnapshotToken, "Behavior of ListSnapshots on an invalid or out of range starting token: abort (return an Aborted error), restart (list from the beginning) or empty (return no entries).")
+		f.BoolVar(&o.ListSnapshotsFallback, "list-snapshots-fallback", false, "When listing the snapshots of a volume, or a given snapshot, fails in CloudStack, list all snapshots and filter them instead of failing.")
+		f.BoolVar(&o.ManagedSnapshotsOnly, "managed-snapshots-only", false, "Only list, and restore volumes from, the snapshots created by the driver. Snapshots taken outside of the driver, e.g. in the CloudStack UI, are then ignored.")
+		f.StringVar(&o.VolumeSnapshotsOnDelete, "volume-snapshots-on-delete", DefaultVolumeSnapshotsOnDelete, "Behavior of DeleteVolume when the volume has snapshots created by the driver: refuse (return a FailedPrecondition error listing the snapshots, so that the volume of a PersistentVolumeClaim is not deleted until all its VolumeSnapshots are) or delete (delete the snapshots not referenced by VolumeSnapshotContents, then the volume, still refusing while some are referenced; requires permissions to list VolumeSnapshotContents). Snapshots taken outside of the driver are ignored.")
+		f.IntVar(&o.MaxDeviceSlots, "max-device-slots", 0, "Number of device slots available on a node, including the root disk. Attaching a volume to a node with all slots in use fails with ResourceExhausted. 0 disables the check.")
+		f.BoolVar(&o.CompactDeviceIDs, "compact-device-ids", false, "Attach volumes at the lowest free device ID of the node, instead of letting CloudStack choose it, to keep device slots compact on hypervisors not reusing freed device IDs.")
+		f.BoolVar(&o.CheckZoneCapacity, "check-zone-capacity", false, "Check the available primary storage of a zone before creating a volume in it, and fall through to the next requisite or preferred zone if insufficient.")
+		f.Int64Var(&o.DefaultCustomVolumeSize, "default-custom-volume-size", DefaultCustomVolumeSize, "Size in GB of a volume with a custom disk offering when no size is requested, if within the requested limit. Storage classes with the parameter requireSize set to \"true\" require a size instead.")
+		f.Int64Var(&o.MaxCustomVolumeSize, "max-custom-volume-size", 0, "Maximum size in GB of a volume with a custom disk offering, as set by the custom.diskoffering.size.max CloudStack setting. Larger requests fail with OutOfRange. 0 disables the check.")
+		f.BoolVar(&o.FailoverDetach, "failover-detach", false, "Detach a volume attached to another node whose CloudStack VM is stopped or absent, instead of failing to attach it to the requested node.")
+		f.StringToInt64Var(&o.SizeIncrements, "disk-offering-size-increments", nil, "Comma-separated disk offering IDs and size increments in GB (e.g. <offering-id>=10), for disk offerings only supporting sizes in given steps. The size of an expanded volume is rounded up to the next increment.")
+		f.StringToStringVar(&o.ZoneDiskOfferings, "zone-disk-offerings", nil, "Comma-separated zone IDs and colon-separated IDs of the disk offerings allowed in them (e.g. <zone-id>=<offering-id>:<offering-id>). Creating a volume with another disk offering in a listed zone fails with InvalidArgument. Zones not listed allow any disk offering.")
+		f.IntVar(&o.MaxConcurrentSnapshots, "max-concurrent-snapshots", 0, "Maximum number of snapshots created at the same time, to throttle bursts of snapshot creations. Further requests wait for a running creation to complete. 0 means no limit.")
+		f.StringVar(&o.CapacityMode, "capacity-mode", DefaultCapacityMode, "How GetCapacity computes the available capacity of the storage pools: allocated (size not allocated to volumes), physical (physical free space, for thin provisioned pools) or overcommit (size multiplied by the overprovisioning factor of the pool, not allocated to volumes).")
+		f.DurationVar(&o.SnapshotTimeout, "snapshot-timeout", 0, "Maximum time waited for CloudStack to create a snapshot. A snapshot not created in time is deleted, and CreateSnapshot fails with DeadlineExceeded. 0 means the creation is only bounded by the deadline of the request.")
+		f.IntVar(&o.MaxSnapshotsPerVolume, "max-snapshots-per-volume", 0, "Maximum number of snapshots of a volume, to protect the secondary storage from runaway snapshot creations. Creating a snapshot of a volume having as many fails with ResourceExhausted. 0 means no limit.")
+		f.StringVar(&o.VolumeNameTemplate, "volume-name-template", "", "Template of the CloudStack names of new volumes, e.g. \"{offering}-{pvName}\". {name} is replaced by the CSI volume name, {pvName} by the PersistentVolume name (requires --extra-create-metadata on the external-provisioner, defaults to the CSI name) and {offering} by the disk offering name. The CSI volume name is used if empty.")
+		f.BoolVar(&o.DetachOnNodeDeletion, "detach-on-node-deletion", false, "Watch the Kubernetes nodes, and detach the volumes of a deleted node once its CloudStack VM is stopped or absent, instead of waiting for the external-attacher to time out. Requires permissions to list and watch nodes.")
+		f.DurationVar(&o.NodeDeletionGracePeriod, "node-deletion-grace-period", DefaultNodeDeletionGracePeriod, "Delay after the deletion of a node before detaching its volumes, during which the node may register again.")
+		f.StringVar(&o.Kubeconfig, "kubeconfig", "", "Path to the kubeconfig file used with --detach-on-node-deletion and --volume-snapshots-on-delete=delete. The in-cluster configuration is used if empty.")
+	}
 
 	// Node options
 	if o.Mode == AllMode || o.Mode == NodeMode {
 		f.StringVar(&o.NodeName, "node-name", "", "Node name used to look up instance ID in case metadata lookup fails")
 		f.Int64Var(&o.VolumeAttachLimit, "volume-attach-limit", DefaultMaxVolAttachLimit, "Value for the maximum number of volumes attachable per node.")
+		f.IntVar(&o.StageMountRetries, "stage-mount-retries", DefaultStageMountRetries, "Number of retries of format and mount on transient errors (device busy) when staging a volume.")
+		f.StringVar(&o.RootDevice, "root-device", "", "Disk holding the root filesystem of the node (e.g. /dev/sda), ignored when looking for volume devices. Detected from the disk backing / if not set.")
+		f.StringVar(&o.DeviceReadinessCommand, "device-readiness-command", "", "Command run against a candidate device of a volume, which is accepted only if the command succeeds, e.g. \"dd if={device} of=/dev/null bs=512 count=1 iflag=direct\". {device} is replaced by the device path.")
+		f.DurationVar(&o.DevicePathTimeout, "device-path-timeout", 0, "Maximum time spent looking for the device of a volume when staging it. 0 means it is only bounded by --device-path-retries.")
+		f.IntVar(&o.DevicePathRetries, "device-path-retries", mount.DefaultDevicePathRetries, "Number of rescans of the device buses when the device of a volume is not found, with delays starting at 2 seconds and increasing by half at each rescan.")
+		f.DurationVar(&o.DeviceCacheTTL, "device-cache-ttl", DefaultDeviceCacheTTL, "How long the device path of a volume found by the node is reused, after checking that it is still the block device of the volume, instead of scanning the device buses again. It is forgotten when the volume is unstaged. 0 disables the cache.")
+		f.IntVar(&o.ExpandDeviceRetries, "expand-device-retries", DefaultExpandDeviceRetries, "Number of rescans of the device of a volume when expanding it, until the device reflects the requested size, with delays starting at 1 second and doubling at each rescan.")
+		f.BoolVar(&o.WarmUpDevices, "warm-up-devices", false, "Scan the SCSI hosts and wait for udev to settle once at startup, so that the device of the first volume attached to the node is found fast.")
+		f.StringToInt64Var(&o.FSTypeMinSizes, "fstype-min-sizes", nil, "Comma-separated filesystem types and minimum volume sizes in GB (e.g. xfs=100), selecting the filesystem type of new volumes staged without fstype by their size. The type with the largest minimum size not above the size of the volume is used, ext4 if none.")
+		f.BoolVar(&o.CleanupStagingDir, "cleanup-staging-dir", false, "Remove the staging directory of a volume when unstaging it, if it is empty and not mounted.")
+		f.BoolVar(&o.VerifyUnstageDevice, "verify-unstage-device", false, "Before unmounting a volume in NodeUnstageVolume, check that the device mounted at its staging path is the one recorded when staging it and, on KVM, the one with the serial of the volume. A mismatched device is not unmounted, and unstaging fails with FailedPrecondition.")
+		f.StringVar(&o.NodeZone, "node-zone", "", "CloudStack zone ID of the node (e.g. from a node label), overriding the zone of the instance in the node topology.")
+		f.BoolVar(&o.StrictNodeZone, "strict-node-zone", false, "Fail at startup when --node-zone differs from the zone of the node instance in CloudStack, instead of logging an error.")
 	}
 }
 
 func (o *Options) Validate() error {
+	if o.Mode == AllMode || o.Mode == ControllerMode {
+		switch o.InvalidSnapshotToken {
+		case InvalidTokenAbort, InvalidTokenRestart, InvalidTokenEmpty:
+		default:
+			return fmt.Errorf("invalid --list-snapshots-invalid-token specified: %q, allowed values are %s, %s and %s",
+				o.InvalidSnapshotToken, InvalidTokenAbort, InvalidTokenRestart, InvalidTokenEmpty)
+		}
+		switch o.VolumeSnapshotsOnDelete {
+		case VolumeSnapshotsRefuse, VolumeSnapshotsDelete:
+		default:
+			return fmt.Errorf("invalid --volume-snapshots-on-delete specified: %q, allowed values are %s and %s",
+				o.VolumeSnapshotsOnDelete, VolumeSnapshotsRefuse, VolumeSnapshotsDelete)
+		}
+		switch cloud.CapacityMode(o.CapacityMode) {
+		case cloud.CapacityAllocated, cloud.CapacityPhysical, cloud.CapacityOvercommit:
+		default:
+			return fmt.Errorf("invalid --capacity-mode specified: %q, allowed values are %s, %s and %s",
+				o.CapacityMode, cloud.CapacityAllocated, cloud.CapacityPhysical, cloud.CapacityOvercommit)
+		}
+		if o.MaxDeviceSlots < 0 {
+			return errors.New("invalid --max-device-slots specified, must not be negative")
+		}
+		if o.DefaultCustomVolumeSize < 1 {
+			return errors.New("invalid --default-custom-volume-size specified, must be at least 1")
+		}
+		if o.MaxCustomVolumeSize < 0 {
+			return errors.New("invalid --max-custom-volume-size specified, must not be negative")
+		}
+		if o.MaxConcurrentSnapshots < 0 {
+			return errors.New("invalid --max-concurrent-snapshots specified, must not be negative")
+		}
+		if o.SnapshotTimeout < 0 {
+			return errors.New("invalid --snapshot-timeout specified, must not be negative")
+		}
+		if o.MaxSnapshotsPerVolume < 0 {
+			return errors.New("invalid --max-snapshots-per-volume specified, must not be negative")
+		}
+		for diskOfferingID, increment := range o.SizeIncrements {
+			if increment < 1 {
+				return fmt.Errorf("invalid --disk-offering-size-increments specified, increment of disk offering %s must be positive", diskOfferingID)
+			}
+		}
+		for zoneID, diskOfferingIDs := range o.ZoneDiskOfferings {
+			if slices.Contains(strings.Split(diskOfferingIDs, ":"), "") {
+				return fmt.Errorf("invalid --zone-disk-offerings specified, empty disk offering ID for zone %s", zoneID)
+			}
+		}
+		if o.NodeDeletionGracePeriod < 0 {
+			return errors.New("invalid --node-deletion-grace-period specified, must not be negative")
+		}
+		if err := validateVolumeNameTemplate(o.VolumeNameTemplate); err != nil {
+			return fmt.Errorf("invalid --volume-name-template specified: %w", err)
+		}
+	}
 	if o.Mode == AllMode || o.Mode == NodeMode {
 		if o.VolumeAttachLimit < 1 || o.VolumeAttachLimit > 256 {
 			return errors.New("invalid --volume-attach-limit specified, allowed range is 1 to 256")
 		}
+		if o.StageMountRetries < 0 {
+			return errors.New("invalid --stage-mount-retries specified, must not be negative")
+		}
+		if o.DevicePathTimeout < 0 {
+			return errors.New("invalid --device-path-timeout specified, must not be negative")
+		}
+		if o.DevicePathRetries < 0 {
+			return errors.New("invalid --device-path-retries specified, must not be negative")
+		}
+		if o.DeviceCacheTTL < 0 {
+			return errors.New("invalid --device-cache-ttl specified, must not be negative")
+		}
+		if o.ExpandDeviceRetries < 0 {
+			return errors.New("invalid --expand-device-retries specified, must not be negative")
+		}
+		for fsType, minSize := range o.FSTypeMinSizes {
+			if _, ok := ValidFSTypes[fsType]; !ok {
+				return fmt.Errorf("invalid --fstype-min-sizes specified, unsupported filesystem type %q", fsType)
+			}
+			if minSize < 0 {
+				return fmt.Errorf("invalid --fstype-min-sizes specified, minimum size of %s must not be negative", fsType)
+			}
+		}
 	}
 
 	return nil
@@ -0,0 +1,88 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// volumeSnapshotContentResource is the Kubernetes resource of the
+// VolumeSnapshotContents, whose CRD is installed with the snapshot controller.
+var volumeSnapshotContentResource = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshotcontents",
+}
+
+// snapshotReferenceLister lists the CloudStack snapshots referenced by Kubernetes.
+type snapshotReferenceLister interface {
+	// ListSnapshotReferences returns the set of the IDs of the snapshots
+	// referenced by Kubernetes objects.
+	ListSnapshotReferences(ctx context.Context) (map[string]bool, error)
+}
+
+// snapshotContentLister lists the snapshots referenced by the
+// VolumeSnapshotContents of the driver.
+type snapshotContentLister struct {
+	client dynamic.Interface
+}
+
+// newSnapshotContentLister creates a snapshotContentLister, see newKubeConfig.
+func newSnapshotContentLister(kubeconfig string) (*snapshotContentLister, error) {
+	config, err := newKubeConfig(kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dynamic.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshotContentLister{client: client}, nil
+}
+
+func (l *snapshotContentLister) ListSnapshotReferences(ctx context.Context) (map[string]bool, error) {
+	contents, err := l.client.Resource(volumeSnapshotContentResource).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list VolumeSnapshotContents: %w", err)
+	}
+
+	references := make(map[string]bool, len(contents.Items))
+	for _, content := range contents.Items {
+		if driver, _, _ := unstructured.NestedString(content.Object, "spec", "driver"); driver != DriverName {
+			continue
+		}
+		// The snapshot handle is in the source of pre-provisioned
+		// contents, and in the status of dynamically provisioned ones.
+		for _, path := range [][]string{{"spec", "source", "snapshotHandle"}, {"status", "snapshotHandle"}} {
+			if handle, _, _ := unstructured.NestedString(content.Object, path...); handle != "" {
+				references[handle] = true
+			}
+		}
+	}
+
+	return references, nil
+}
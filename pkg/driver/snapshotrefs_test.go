@@ -0,0 +1,80 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"maps"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// volumeSnapshotContent returns a VolumeSnapshotContent of a driver.
+func volumeSnapshotContent(name, driver string, fields map[string]any) *unstructured.Unstructured {
+	spec := map[string]any{"driver": driver}
+	content := map[string]any{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshotContent",
+		"metadata":   map[string]any{"name": name},
+		"spec":       spec,
+	}
+	for key, value := range fields {
+		if key == "source" {
+			spec[key] = value
+		} else {
+			content[key] = value
+		}
+	}
+
+	return &unstructured.Unstructured{Object: content}
+}
+
+func TestListSnapshotReferences(t *testing.T) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{volumeSnapshotContentResource: "VolumeSnapshotContentList"},
+		volumeSnapshotContent("dynamic", DriverName, map[string]any{
+			"source": map[string]any{"volumeHandle": "volume-1"},
+			"status": map[string]any{"snapshotHandle": "snapshot-1"},
+		}),
+		volumeSnapshotContent("pre-provisioned", DriverName, map[string]any{
+			"source": map[string]any{"snapshotHandle": "snapshot-2"},
+		}),
+		volumeSnapshotContent("not-ready", DriverName, map[string]any{
+			"source": map[string]any{"volumeHandle": "volume-1"},
+		}),
+		volumeSnapshotContent("other-driver", "other.csi.driver", map[string]any{
+			"source": map[string]any{"snapshotHandle": "snapshot-3"},
+		}),
+	)
+	lister := &snapshotContentLister{client: client}
+
+	references, err := lister.ListSnapshotReferences(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]bool{"snapshot-1": true, "snapshot-2": true}
+	if !maps.Equal(references, expected) {
+		t.Errorf("Expected references %v, got %v", expected, references)
+	}
+}
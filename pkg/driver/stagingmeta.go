@@ -0,0 +1,87 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+)
+
+// stagingMetadataFile is the name of the file recording how a volume was
+// staged, next to its staging directory (which is hidden by the mount).
+const stagingMetadataFile = "cloudstack-csi.json"
+
+// stagingMetadata records how a volume was staged, so that the device
+// selected by the node can be correlated with the device ID in CloudStack.
+type stagingMetadata struct {
+	VolumeID   string `json:"volumeID"`
+	DevicePath string `json:"devicePath"`
+}
+
+// stagingMetadataPath returns the path of the staging metadata file of
+// the staging directory target.
+func stagingMetadataPath(target string) string {
+	return filepath.Join(filepath.Dir(filepath.Clean(target)), stagingMetadataFile)
+}
+
+// writeStagingMetadata records the device of a staged volume. Failures are
+// only logged, since the file is only meant for troubleshooting.
+func writeStagingMetadata(ctx context.Context, target string, metadata stagingMetadata) {
+	logger := klog.FromContext(ctx)
+
+	data, err := json.Marshal(metadata)
+	if err == nil {
+		err = os.WriteFile(stagingMetadataPath(target), data, 0o600)
+	}
+	if err != nil {
+		logger.Error(err, "Cannot record the device of the staged volume", "target", target, "devicePath", metadata.DevicePath)
+
+		return
+	}
+	logger.V(2).Info("Volume staged", "volumeID", metadata.VolumeID, "devicePath", metadata.DevicePath, "target", target)
+}
+
+// readStagingMetadata returns how the volume at the staging directory
+// target was staged.
+func readStagingMetadata(target string) (*stagingMetadata, error) {
+	data, err := os.ReadFile(stagingMetadataPath(target))
+	if err != nil {
+		return nil, err
+	}
+	metadata := &stagingMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, err
+	}
+
+	return metadata, nil
+}
+
+// removeStagingMetadata removes the staging metadata file of an unstaged
+// volume. Failures are only logged.
+func removeStagingMetadata(ctx context.Context, target string) {
+	if err := os.Remove(stagingMetadataPath(target)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		klog.FromContext(ctx).Error(err, "Cannot remove the staging metadata file", "target", target)
+	}
+}
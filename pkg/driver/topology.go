@@ -20,15 +20,24 @@
 package driver
 
 import (
+	"context"
 	"errors"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/hashicorp/go-uuid"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
 )
 
+// TopologyKeys lists the topology segment keys the driver may use,
+// in order of decreasing scope.
+var TopologyKeys = []string{ZoneKey, ClusterKey, HostKey}
+
 // Topology represents CloudStack storage topology.
 type Topology struct {
-	ZoneID string
-	HostID string
+	ZoneID    string
+	ClusterID string
+	HostID    string
 }
 
 // NewTopology converts a *csi.Topology to Topology.
@@ -42,15 +51,66 @@ func NewTopology(t *csi.Topology) (Topology, error) {
 	if !ok {
 		return Topology{}, errors.New("no zone in topology")
 	}
-	hostID := segments[HostKey]
 
-	return Topology{zoneID, hostID}, nil
+	return Topology{
+		ZoneID:    zoneID,
+		ClusterID: segments[ClusterKey],
+		HostID:    segments[HostKey],
+	}, nil
+}
+
+// requisiteTopology returns the zone of the requisite topologies, which
+// must all be in the same zone, and the host of the volume: the host of the
+// only requisite topology, or else of the first preferred topology, e.g. of
+// the node selected for the first consumer of the volume.
+func requisiteTopology(req *csi.TopologyRequirement) (Topology, error) {
+	var result Topology
+	for i, t := range req.GetRequisite() {
+		topology, err := NewTopology(t)
+		if err != nil {
+			return Topology{}, errors.New("cannot parse topology requirements")
+		}
+		if i > 0 && topology.ZoneID != result.ZoneID {
+			return Topology{}, errors.New("topology requirements span several zones")
+		}
+		result.ZoneID = topology.ZoneID
+		result.HostID = topology.HostID
+	}
+	if len(req.GetRequisite()) > 1 {
+		result.HostID = ""
+		if preferred := req.GetPreferred(); len(preferred) > 0 {
+			if topology, err := NewTopology(preferred[0]); err == nil && topology.ZoneID == result.ZoneID {
+				result.HostID = topology.HostID
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// resolveZoneID returns the ID of a zone given by ID or by name,
+// e.g. in a topology segment or a node label. A zone which is not
+// a UUID and has no zone with this name is assumed to be an ID.
+func resolveZoneID(ctx context.Context, connector cloud.Interface, zone string) (string, error) {
+	if _, err := uuid.ParseUUID(zone); err == nil {
+		return zone, nil
+	}
+
+	zoneID, err := connector.GetZoneIDByName(ctx, zone)
+	if errors.Is(err, cloud.ErrNotFound) {
+		return zone, nil
+	}
+
+	return zoneID, err
 }
 
 // ToCSI converts a Topology to a *csi.Topology.
 func (t Topology) ToCSI() *csi.Topology {
 	segments := make(map[string]string)
 	segments[ZoneKey] = t.ZoneID
+	if t.ClusterID != "" {
+		segments[ClusterKey] = t.ClusterID
+	}
 	if t.HostID != "" {
 		segments[HostKey] = t.HostID
 	}
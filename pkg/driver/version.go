@@ -49,6 +49,16 @@ func GetVersion() VersionInfo {
 	}
 }
 
+// UserAgent returns the User-Agent header of the requests of the driver
+// to the CloudStack API, with the driver name and version.
+func UserAgent() string {
+	if driverVersion == "" {
+		return DriverName
+	}
+
+	return DriverName + "/" + driverVersion
+}
+
 func GetVersionJSON() (string, error) {
 	info := GetVersion()
 	marshaled, err := json.MarshalIndent(&info, "", "  ")
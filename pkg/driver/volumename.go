@@ -0,0 +1,113 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+)
+
+// Placeholders of the volume name template.
+const (
+	// volumeNamePlaceholder is the name of the volume in the CSI request.
+	volumeNamePlaceholder = "{name}"
+	// pvNamePlaceholder is the name of the PersistentVolume, or the CSI
+	// name if the external-provisioner does not pass it.
+	pvNamePlaceholder = "{pvName}"
+	// offeringPlaceholder is the name of the disk offering, e.g. its tier.
+	offeringPlaceholder = "{offering}"
+)
+
+// maxVolumeNameLength is the maximum length of the name of a CloudStack volume.
+const maxVolumeNameLength = 255
+
+// validateVolumeNameTemplate checks that the names expanded from a template
+// are unique, i.e. that they include the CSI or PersistentVolume name.
+func validateVolumeNameTemplate(template string) error {
+	if template == "" || strings.Contains(template, volumeNamePlaceholder) || strings.Contains(template, pvNamePlaceholder) {
+		return nil
+	}
+
+	return fmt.Errorf("%q contains neither %s nor %s", template, volumeNamePlaceholder, pvNamePlaceholder)
+}
+
+// expandVolumeName expands a volume name template, and checks that the
+// result is a valid CloudStack volume name.
+func expandVolumeName(template, name, pvName, offering string) (string, error) {
+	if pvName == "" {
+		pvName = name
+	}
+	// Offering names are free text, e.g. "Premium SSD".
+	offering = strings.Join(strings.Fields(strings.ToLower(offering)), "-")
+
+	volumeName := strings.NewReplacer(
+		volumeNamePlaceholder, name,
+		pvNamePlaceholder, pvName,
+		offeringPlaceholder, offering,
+	).Replace(template)
+
+	if strings.TrimSpace(volumeName) == "" {
+		return "", errors.New("volume name is empty")
+	}
+	if len(volumeName) > maxVolumeNameLength {
+		return "", fmt.Errorf("volume name %q is longer than %d characters", volumeName, maxVolumeNameLength)
+	}
+	if strings.IndexFunc(volumeName, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("volume name %q contains control characters", volumeName)
+	}
+
+	return volumeName, nil
+}
+
+// volumeName returns the CloudStack name of the volume of a CreateVolume
+// request: its CSI name, or the expansion of the volume name template.
+func (cs *controllerServer) volumeName(ctx context.Context, connector cloud.Interface, req *csi.CreateVolumeRequest) (string, error) {
+	if cs.volumeNameTemplate == "" {
+		return req.GetName(), nil
+	}
+
+	var offeringName string
+	if strings.Contains(cs.volumeNameTemplate, offeringPlaceholder) {
+		diskOfferingID := req.GetParameters()[DiskOfferingKey]
+		offering, err := connector.GetDiskOffering(ctx, diskOfferingID)
+		if errors.Is(err, cloud.ErrNotFound) {
+			return "", status.Errorf(codes.InvalidArgument, "Disk offering %s not found", diskOfferingID)
+		} else if err != nil {
+			return "", status.Errorf(codes.Internal, "Cannot get disk offering %s: %v", diskOfferingID, err)
+		}
+		offeringName = offering.Name
+	}
+
+	volumeName, err := expandVolumeName(cs.volumeNameTemplate, req.GetName(), req.GetParameters()[PVNameKey], offeringName)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid volume name from template %q: %v", cs.volumeNameTemplate, err)
+	}
+
+	return volumeName, nil
+}
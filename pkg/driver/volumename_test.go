@@ -0,0 +1,100 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud"
+	"github.com/cloudstack/cloudstack-csi-driver/pkg/cloud/fake"
+)
+
+func TestExpandVolumeName(t *testing.T) {
+	cases := []struct {
+		name        string
+		template    string
+		pvName      string
+		offering    string
+		expected    string
+		expectedErr bool
+	}{
+		{"offering and PV name", "{offering}-{pvName}", "pvc-1", "Premium SSD", "premium-ssd-pvc-1", false},
+		{"CSI name", "k8s-{name}", "", "", "k8s-csi-1", false},
+		{"PV name defaults to CSI name", "{pvName}", "", "", "csi-1", false},
+		{"too long", "{name}-" + strings.Repeat("x", maxVolumeNameLength), "", "", "", true},
+		{"control characters", "{name}\n", "", "", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := expandVolumeName(c.template, "csi-1", c.pvName, c.offering)
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error: %v, got %v", c.expectedErr, err)
+			}
+			if got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeNameTemplate(t *testing.T) {
+	for template, valid := range map[string]bool{
+		"":                    true,
+		"{offering}-{pvName}": true,
+		"{offering}-{name}":   true,
+		"{offering}":          false,
+	} {
+		if err := validateVolumeNameTemplate(template); (err == nil) != valid {
+			t.Errorf("Template %q: expected valid: %v, got %v", template, valid, err)
+		}
+	}
+}
+
+func TestCreateVolumeNameTemplate(t *testing.T) {
+	ctx := context.Background()
+	for _, connector := range []cloud.Interface{fake.New(), &untaggableConnector{fake.New()}} {
+		cs := NewControllerServer(connector, &Options{VolumeNameTemplate: "{offering}-{pvName}"})
+		req := createVolumeRequest("csi-1", 1, nil, nil)
+		req.Parameters[PVNameKey] = "pvc-1"
+
+		first, err := cs.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		vol, err := connector.GetVolumeByName(ctx, "custom-pvc-1")
+		if err != nil {
+			t.Fatalf("Expected volume to be named from the template, got %v", err)
+		}
+		if vol.ID != first.GetVolume().GetVolumeId() {
+			t.Errorf("Expected volume %s, got %s", first.GetVolume().GetVolumeId(), vol.ID)
+		}
+
+		// Retrying the request returns the same volume, with or without tags.
+		second, err := cs.CreateVolume(ctx, req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if second.GetVolume().GetVolumeId() != first.GetVolume().GetVolumeId() {
+			t.Errorf("Expected the same volume %s, got %s", first.GetVolume().GetVolumeId(), second.GetVolume().GetVolumeId())
+		}
+	}
+}
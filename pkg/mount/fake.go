@@ -46,6 +46,14 @@ func NewFake() Interface {
 	}
 }
 
+func (m *fakeMounter) BindMount(source string, target string, options []string) error {
+	return m.Mount(source, target, "", bindMountOptions(options))
+}
+
+func (m *fakeMounter) CheckVolumeDevice(_ context.Context, _ string, _ string) error {
+	return nil
+}
+
 func (m *fakeMounter) GetBlockSizeBytes(_ string) (int64, error) {
 	return 1073741824, nil
 }
@@ -58,6 +66,12 @@ func (m *fakeMounter) GetDeviceName(mountPath string) (string, int, error) {
 	return mount.GetDeviceNameFromMount(m, mountPath)
 }
 
+func (*fakeMounter) GetFSType(_ string) (string, error) {
+	return "ext4", nil
+}
+
+func (*fakeMounter) WarmUp(_ context.Context) {}
+
 func (*fakeMounter) PathExists(path string) (bool, error) {
 	if _, err := os.Stat(path); os.IsNotExist(err) {
 		return false, nil
@@ -93,8 +107,8 @@ func (*fakeMounter) MakeFile(pathname string) error {
 	return nil
 }
 
-func (m *fakeMounter) GetStatistics(_ string) (volumeStatistics, error) {
-	return volumeStatistics{
+func (m *fakeMounter) GetStatistics(_ string) (VolumeStatistics, error) {
+	return VolumeStatistics{
 		AvailableBytes: 3 * giB,
 		TotalBytes:     10 * giB,
 		UsedBytes:      7 * giB,
@@ -117,6 +131,14 @@ func (m *fakeMounter) NeedResize(_ string, _ string) (bool, error) {
 	return false, nil
 }
 
+func (m *fakeMounter) RepairFilesystem(_ context.Context, _ string, _ string) error {
+	return nil
+}
+
+func (m *fakeMounter) RescanDevice(_ context.Context, _ string) error {
+	return nil
+}
+
 func (m *fakeMounter) Resize(_ string, _ string) (bool, error) {
 	return true, nil
 }
@@ -23,12 +23,17 @@ package mount
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"golang.org/x/sys/unix"
@@ -40,46 +45,115 @@ import (
 
 const (
 	diskIDPath = "/dev/disk/by-id"
+
+	// nvmeDevicePattern matches the NVMe namespaces, and their partitions.
+	nvmeDevicePattern = "/dev/nvme*n*"
+	// sysBlockPath holds the attributes of the block devices.
+	sysBlockPath = "/sys/block"
+
+	// maximum number of candidate devices verified concurrently.
+	deviceScanWorkers = 4
+
+	// devicePlaceholder is replaced by the device path in the readiness command.
+	devicePlaceholder = "{device}"
+
+	// DefaultDevicePathRetries is the default number of rescans when looking
+	// for the device of a volume.
+	DefaultDevicePathRetries = 19
 )
 
+// ErrDeviceMismatch is returned when a device is not the one of a volume.
+var ErrDeviceMismatch = errors.New("device does not belong to the volume")
+
 // Interface defines the set of methods to allow for
 // mount operations on a system.
 type Interface interface { //nolint:interfacebloat
 	mount.Interface
 
+	BindMount(source string, target string, options []string) error
+	CheckVolumeDevice(ctx context.Context, devicePath string, volumeID string) error
 	FormatAndMount(source string, target string, fstype string, options []string) error
+	FormatAndMountSensitiveWithFormatOptions(source string, target string, fstype string, options []string, sensitiveOptions []string, formatOptions []string) error
 	GetBlockSizeBytes(devicePath string) (int64, error)
 	GetDevicePath(ctx context.Context, volumeID string) (string, error)
 	GetDeviceName(mountPath string) (string, int, error)
-	GetStatistics(volumePath string) (volumeStatistics, error)
+	GetFSType(devicePath string) (string, error)
+	GetStatistics(volumePath string) (VolumeStatistics, error)
 	IsBlockDevice(devicePath string) (bool, error)
 	IsCorruptedMnt(err error) bool
 	MakeDir(pathname string) error
 	MakeFile(pathname string) error
 	NeedResize(devicePath string, deviceMountPath string) (bool, error)
 	PathExists(path string) (bool, error)
+	RepairFilesystem(ctx context.Context, devicePath string, fsType string) error
+	RescanDevice(ctx context.Context, devicePath string) error
 	Resize(devicePath, deviceMountPath string) (bool, error)
 	Unpublish(path string) error
 	Unstage(path string) error
+	WarmUp(ctx context.Context)
 }
 
 type mounter struct {
 	*mount.SafeFormatAndMount
+
+	// rootDevice is the disk holding the root filesystem, excluded
+	// from the device scan. Detected from the mount table if empty.
+	rootDevice string
+
+	// readinessCommand is run against a candidate device before accepting
+	// it, if not empty. The device path replaces devicePlaceholder.
+	readinessCommand []string
+
+	// devicePathBackoff bounds the rescans when looking for the device of a volume.
+	devicePathBackoff wait.Backoff
+
+	// devicePathTimeout bounds the time spent looking for the device of
+	// a volume, 0 if only bounded by devicePathBackoff.
+	devicePathTimeout time.Duration
 }
 
-type volumeStatistics struct {
+// Option is an optional setting of the mounter.
+type Option func(*mounter)
+
+// WithDevicePathBackoff sets how long GetDevicePath looks for the device of
+// a volume: at most retries rescans, and at most timeout if not 0.
+func WithDevicePathBackoff(timeout time.Duration, retries int) Option {
+	return func(m *mounter) {
+		m.devicePathBackoff.Steps = retries + 1
+		m.devicePathTimeout = timeout
+	}
+}
+
+// VolumeStatistics holds the capacity and inode usage of a volume.
+type VolumeStatistics struct {
 	AvailableBytes, TotalBytes, UsedBytes    int64
 	AvailableInodes, TotalInodes, UsedInodes int64
 }
 
 // New creates an implementation of the mount.Interface.
-func New() Interface {
-	return &mounter{
-		&mount.SafeFormatAndMount{
+// rootDevice is the disk holding the root filesystem (e.g. /dev/sda);
+// if empty, it is detected from the disk backing /.
+// readinessCommand is an optional command checking that a device is usable,
+// e.g. "dd if={device} of=/dev/null bs=512 count=1 iflag=direct".
+func New(rootDevice, readinessCommand string, options ...Option) Interface {
+	m := &mounter{
+		SafeFormatAndMount: &mount.SafeFormatAndMount{
 			Interface: mount.New(""),
 			Exec:      kexec.New(),
 		},
+		rootDevice:       rootDevice,
+		readinessCommand: strings.Fields(readinessCommand),
+		devicePathBackoff: wait.Backoff{
+			Duration: 2 * time.Second,
+			Factor:   1.5,
+			Steps:    DefaultDevicePathRetries + 1,
+		},
 	}
+	for _, option := range options {
+		option(m)
+	}
+
+	return m
 }
 
 // GetBlockSizeBytes gets the size of the disk in bytes.
@@ -99,14 +173,14 @@ func (m *mounter) GetBlockSizeBytes(devicePath string) (int64, error) {
 
 func (m *mounter) GetDevicePath(ctx context.Context, volumeID string) (string, error) {
 	logger := klog.FromContext(ctx)
-	backoff := wait.Backoff{
-		Duration: 2 * time.Second,
-		Factor:   1.5,
-		Steps:    20,
+	if m.devicePathTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.devicePathTimeout)
+		defer cancel()
 	}
 
 	var devicePath string
-	err := wait.ExponentialBackoffWithContext(ctx, backoff, func(context.Context) (bool, error) {
+	err := wait.ExponentialBackoffWithContext(ctx, m.devicePathBackoff, func(context.Context) (bool, error) {
 		path, err := m.getDevicePathBySerialID(ctx, volumeID)
 		if err != nil {
 			return false, err
@@ -151,9 +225,27 @@ func (m *mounter) getDevicePathBySerialID(ctx context.Context, volumeID string)
 	if vmwareDevicePath != "" {
 		return vmwareDevicePath, nil
 	}
+
+	return m.getDevicePathBySerial(ctx, volumeID)
+}
+
+// getDevicePathBySerial returns the device whose serial is the one set by
+// CloudStack for the volume (KVM), or "" if none.
+func (m *mounter) getDevicePathBySerial(ctx context.Context, volumeID string) (string, error) {
+	logger := klog.FromContext(ctx)
+	serial := DiskUUIDToSerial(volumeID)
+
+	// Try NVMe namespaces (for KVM with NVMe emulation)
+	nvmeDevicePath, err := findNVMeDevice(nvmeDevicePattern, sysBlockPath, serial)
+	if err != nil {
+		logger.V(4).Info("Failed to get NVMe device path", "volumeID", volumeID, "error", err)
+	}
+	if nvmeDevicePath != "" {
+		return nvmeDevicePath, nil
+	}
+
 	// Fall back to standard device paths (for KVM)
 	sourcePathPrefixes := []string{"virtio-", "scsi-", "scsi-0QEMU_QEMU_HARDDISK_"}
-	serial := diskUUIDToSerial(volumeID)
 	for _, prefix := range sourcePathPrefixes {
 		source := filepath.Join(diskIDPath, prefix+serial)
 		_, err := os.Stat(source)
@@ -170,49 +262,197 @@ func (m *mounter) getDevicePathBySerialID(ctx context.Context, volumeID string)
 	return "", nil
 }
 
+// nvmeNamespaceRegexp matches the name of an NVMe namespace, e.g. nvme0n1,
+// but not of its partitions.
+var nvmeNamespaceRegexp = regexp.MustCompile(`^nvme[0-9]+n[0-9]+$`)
+
+// findNVMeDevice returns the NVMe namespace matching devicePattern whose
+// controller serial, or WWID, holds the given disk serial, or "" if none.
+func findNVMeDevice(devicePattern, sysBlock, serial string) (string, error) {
+	devicePaths, err := filepath.Glob(devicePattern)
+	if err != nil {
+		return "", err
+	}
+	hexSerial := hex.EncodeToString([]byte(serial))
+	for _, devicePath := range devicePaths {
+		name := filepath.Base(devicePath)
+		if !nvmeNamespaceRegexp.MatchString(name) {
+			continue
+		}
+		// The serial of the controller is padded with spaces.
+		if b, err := os.ReadFile(filepath.Join(sysBlock, name, "device", "serial")); err == nil && strings.TrimSpace(string(b)) == serial {
+			return devicePath, nil
+		}
+		// The WWID may hold the serial, e.g. nvme.1af4-<hex serial>-<hex model>-00000001.
+		if b, err := os.ReadFile(filepath.Join(sysBlock, name, "wwid")); err == nil {
+			wwid := strings.TrimSpace(string(b))
+			if strings.Contains(wwid, serial) || strings.Contains(wwid, hexSerial) {
+				return devicePath, nil
+			}
+		}
+	}
+
+	return "", nil
+}
+
 func (m *mounter) getDevicePathForXenServer(ctx context.Context, volumeID string) (string, error) {
-	logger := klog.FromContext(ctx)
+	devicePath, ok := m.findVerifiedDevice(ctx, volumeID, candidateDevices("/dev/xvd", m.getRootDevice(ctx, "/dev/xvd")))
+	if !ok {
+		return "", fmt.Errorf("device not found for volume %s", volumeID)
+	}
+	klog.FromContext(ctx).V(4).Info("Found and verified XenServer device", "devicePath", devicePath, "volumeID", volumeID)
+
+	return devicePath, nil
+}
 
-	for i := 'b'; i <= 'z'; i++ {
-		devicePath := fmt.Sprintf("/dev/xvd%c", i)
-		logger.V(5).Info("Checking XenServer device path", "devicePath", devicePath, "volumeID", volumeID)
+func (m *mounter) getDevicePathForVMware(ctx context.Context, volumeID string) (string, error) {
+	devicePath, ok := m.findVerifiedDevice(ctx, volumeID, candidateDevices("/dev/sd", m.getRootDevice(ctx, "/dev/sd")))
+	if !ok {
+		return "", fmt.Errorf("device not found for volume %s", volumeID)
+	}
+	klog.FromContext(ctx).V(4).Info("Found and verified VMware device", "devicePath", devicePath, "volumeID", volumeID)
 
-		if _, err := os.Stat(devicePath); err == nil {
-			isBlock, err := m.IsBlockDevice(devicePath)
-			if err == nil && isBlock {
-				if m.verifyDevice(ctx, devicePath, volumeID) {
-					logger.V(4).Info("Found and verified XenServer device", "devicePath", devicePath, "volumeID", volumeID)
+	return devicePath, nil
+}
 
-					return devicePath, nil
-				}
+// findVerifiedDevice returns the first of the candidate device paths
+// which is an existing, verified block device.
+func (m *mounter) findVerifiedDevice(ctx context.Context, volumeID string, candidates []string) (string, bool) {
+	return findFirst(ctx, candidates, deviceScanWorkers, func(ctx context.Context, devicePath string) bool {
+		klog.FromContext(ctx).V(5).Info("Checking device path", "devicePath", devicePath, "volumeID", volumeID)
+		if _, err := os.Stat(devicePath); err != nil {
+			return false
+		}
+		if isBlock, err := m.IsBlockDevice(devicePath); err != nil || !isBlock {
+			return false
+		}
+
+		return m.verifyDevice(ctx, devicePath, volumeID)
+	})
+}
+
+// findFirst checks the candidates concurrently, with at most workers checks
+// at a time, and returns the first candidate in order for which check returns
+// true, as a serial scan would. Once a candidate matches, the checks of the
+// following candidates are cancelled, or not started.
+func findFirst(ctx context.Context, candidates []string, workers int, check func(context.Context, string) bool) (string, bool) {
+	var (
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		match   = len(candidates)
+		cancels = make([]context.CancelFunc, len(candidates))
+	)
+	// matched records a match, and cancels the checks of the following candidates.
+	matched := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if i >= match {
+			return
+		}
+		match = i
+		for _, cancel := range cancels[i+1:] {
+			if cancel != nil {
+				cancel()
 			}
 		}
 	}
+	// start returns the context of the check of a candidate,
+	// or false if the candidate cannot match anymore.
+	start := func(i int) (context.Context, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if i > match {
+			return nil, false
+		}
+		checkCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+
+		return checkCtx, true
+	}
+
+	sem := make(chan struct{}, workers)
+	for i, candidate := range candidates {
+		sem <- struct{}{}
+		checkCtx, ok := start(i)
+		if !ok {
+			<-sem
+
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if check(checkCtx, candidate) && checkCtx.Err() == nil {
+				matched(i)
+			}
+		}()
+	}
+	wg.Wait()
 
-	return "", fmt.Errorf("device not found for volume %s", volumeID)
+	for _, cancel := range cancels {
+		if cancel != nil {
+			cancel()
+		}
+	}
+	if match == len(candidates) {
+		return "", false
+	}
+
+	return candidates[match], true
 }
 
-func (m *mounter) getDevicePathForVMware(ctx context.Context, volumeID string) (string, error) {
-	logger := klog.FromContext(ctx)
+// partitionRegexp matches a disk or partition device path, capturing the disk.
+var partitionRegexp = regexp.MustCompile(`^(/dev/(?:sd|xvd|vd)[a-z]+)\d*$`)
+
+// getRootDevice returns the disk holding the root filesystem among the
+// devices starting with prefix: the configured one, else the one detected
+// from the mount table, else the first device (prefix+"a").
+func (m *mounter) getRootDevice(ctx context.Context, prefix string) string {
+	if m.rootDevice != "" {
+		return m.rootDevice
+	}
+	defaultDevice := prefix + "a"
+	mountPoints, err := m.List()
+	if err != nil {
+		klog.FromContext(ctx).V(4).Info("Failed to list mount points, assuming default root device", "rootDevice", defaultDevice, "error", err)
+
+		return defaultDevice
+	}
+	if rootDevice := rootDeviceFromMounts(mountPoints); strings.HasPrefix(rootDevice, prefix) {
+		return rootDevice
+	}
 
-	// Loop through /dev/sdb to /dev/sdz (/dev/sda -> the root disk)
-	for i := 'b'; i <= 'z'; i++ {
-		devicePath := fmt.Sprintf("/dev/sd%c", i)
-		logger.V(5).Info("Checking VMware device path", "devicePath", devicePath, "volumeID", volumeID)
+	return defaultDevice
+}
+
+// rootDeviceFromMounts returns the disk backing the / mount point,
+// or an empty string if it is not a plain disk (e.g. overlay, LVM).
+func rootDeviceFromMounts(mountPoints []mount.MountPoint) string {
+	for _, mp := range mountPoints {
+		if mp.Path != "/" {
+			continue
+		}
+		if match := partitionRegexp.FindStringSubmatch(mp.Device); match != nil {
+			return match[1]
+		}
+	}
 
-		if _, err := os.Stat(devicePath); err == nil {
-			isBlock, err := m.IsBlockDevice(devicePath)
-			if err == nil && isBlock {
-				if m.verifyDevice(ctx, devicePath, volumeID) {
-					logger.V(4).Info("Found and verified VMware device", "devicePath", devicePath, "volumeID", volumeID)
+	return ""
+}
 
-					return devicePath, nil
-				}
-			}
+// candidateDevices returns the device paths from prefix+"a" to prefix+"z",
+// except rootDevice.
+func candidateDevices(prefix string, rootDevice string) []string {
+	devices := make([]string, 0, 26)
+	for i := 'a'; i <= 'z'; i++ {
+		devicePath := fmt.Sprintf("%s%c", prefix, i)
+		if devicePath != rootDevice {
+			devices = append(devices, devicePath)
 		}
 	}
 
-	return "", fmt.Errorf("device not found for volume %s", volumeID)
+	return devices
 }
 
 func (m *mounter) verifyDevice(ctx context.Context, devicePath string, volumeID string) bool {
@@ -226,7 +466,7 @@ func (m *mounter) verifyDevice(ctx context.Context, devicePath string, volumeID
 	}
 	logger.V(5).Info("Device size retrieved", "devicePath", devicePath, "volumeID", volumeID, "sizeBytes", size)
 
-	mounted, err := m.isDeviceMounted(devicePath)
+	mounted, err := m.isDeviceMounted(ctx, devicePath)
 	if err != nil {
 		logger.V(4).Info("Failed to check if device is mounted", "devicePath", devicePath, "volumeID", volumeID, "error", err)
 
@@ -238,7 +478,7 @@ func (m *mounter) verifyDevice(ctx context.Context, devicePath string, volumeID
 		return false
 	}
 
-	props, err := m.getDeviceProperties(devicePath)
+	props, err := m.getDeviceProperties(ctx, devicePath)
 	if err != nil {
 		logger.V(4).Info("Failed to get device properties", "devicePath", devicePath, "volumeID", volumeID, "error", err)
 
@@ -246,11 +486,34 @@ func (m *mounter) verifyDevice(ctx context.Context, devicePath string, volumeID
 	}
 	logger.V(5).Info("Device properties retrieved", "devicePath", devicePath, "volumeID", volumeID, "properties", props)
 
+	if err := m.checkDeviceReadiness(ctx, devicePath); err != nil {
+		logger.V(4).Info("Device is not ready", "devicePath", devicePath, "volumeID", volumeID, "error", err)
+
+		return false
+	}
+
 	return true
 }
 
-func (m *mounter) isDeviceMounted(devicePath string) (bool, error) {
-	output, err := m.Exec.Command("grep", devicePath, "/proc/mounts").Output()
+// checkDeviceReadiness runs the readiness command, if any, against a device.
+func (m *mounter) checkDeviceReadiness(ctx context.Context, devicePath string) error {
+	if len(m.readinessCommand) == 0 {
+		return nil
+	}
+	args := make([]string, 0, len(m.readinessCommand)-1)
+	for _, arg := range m.readinessCommand[1:] {
+		args = append(args, strings.ReplaceAll(arg, devicePlaceholder, devicePath))
+	}
+	output, err := m.Exec.CommandContext(ctx, m.readinessCommand[0], args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("readiness command failed: output: %s, err: %w", string(output), err)
+	}
+
+	return nil
+}
+
+func (m *mounter) isDeviceMounted(ctx context.Context, devicePath string) (bool, error) {
+	output, err := m.Exec.CommandContext(ctx, "grep", devicePath, "/proc/mounts").Output()
 	if err != nil {
 		if strings.Contains(err.Error(), "exit status 1") {
 			return false, nil
@@ -262,8 +525,8 @@ func (m *mounter) isDeviceMounted(devicePath string) (bool, error) {
 	return len(output) > 0, nil
 }
 
-func (m *mounter) getDeviceProperties(devicePath string) (map[string]string, error) {
-	output, err := m.Exec.Command("udevadm", "info", "--query=property", devicePath).Output()
+func (m *mounter) getDeviceProperties(ctx context.Context, devicePath string) (map[string]string, error) {
+	output, err := m.Exec.CommandContext(ctx, "udevadm", "info", "--query=property", devicePath).Output()
 	if err != nil {
 		return nil, err
 	}
@@ -308,16 +571,27 @@ func (m *mounter) probeVolume(ctx context.Context) {
 	}
 }
 
+// WarmUp scans the device buses as when looking for the device of a volume,
+// and waits for udev to process the events, so that the first lookup is fast.
+func (m *mounter) WarmUp(ctx context.Context) {
+	m.probeVolume(ctx)
+	if _, err := m.Exec.Command("udevadm", "settle").CombinedOutput(); err != nil {
+		klog.FromContext(ctx).Error(err, "Error running udevadm settle")
+	}
+}
+
 func (m *mounter) GetDeviceName(mountPath string) (string, int, error) {
 	return mount.GetDeviceNameFromMount(m, mountPath)
 }
 
-// diskUUIDToSerial reproduces CloudStack function diskUuidToSerial
+// DiskUUIDToSerial reproduces CloudStack function diskUuidToSerial
 // from https://github.com/apache/cloudstack/blob/0f3f2a0937/plugins/hypervisors/kvm/src/main/java/com/cloud/hypervisor/kvm/resource/LibvirtComputingResource.java#L3000
 //
 // This is what CloudStack do *with KVM hypervisor* to translate
-// a CloudStack volume UUID to libvirt disk serial.
-func diskUUIDToSerial(uuid string) string {
+// a CloudStack volume UUID to libvirt disk serial: the UUID without
+// hyphens, truncated to 20 characters. The device of the volume is then
+// listed in /dev/disk/by-id with the serial, e.g. virtio-<serial>.
+func DiskUUIDToSerial(uuid string) string {
 	uuidWithoutHyphen := strings.ReplaceAll(uuid, "-", "")
 	if len(uuidWithoutHyphen) < 20 {
 		return uuidWithoutHyphen
@@ -355,9 +629,181 @@ func (*mounter) MakeFile(pathname string) error {
 	return nil
 }
 
-// Resize resizes the filesystem of the given devicePath.
+// BindMount bind-mounts source, e.g. the device of a raw block volume,
+// at target, which must exist. Unpublish removes the bind mount.
+func (m *mounter) BindMount(source string, target string, options []string) error {
+	return m.Mount(source, target, "", bindMountOptions(options))
+}
+
+// CheckVolumeDevice returns an error wrapping ErrDeviceMismatch if devicePath
+// is known not to be the device of the volume, i.e. another device has the
+// serial of the volume. Devices found by scanning (VMware, XenServer) have no
+// such serial, and cannot be checked.
+func (m *mounter) CheckVolumeDevice(ctx context.Context, devicePath string, volumeID string) error {
+	expected, err := m.getDevicePathBySerial(ctx, volumeID)
+	if err != nil || expected == "" {
+		return err
+	}
+	if ResolveDevicePath(expected) != ResolveDevicePath(devicePath) {
+		return fmt.Errorf("%w: %s is the device of volume %s, not %s", ErrDeviceMismatch, expected, volumeID, devicePath)
+	}
+
+	return nil
+}
+
+// RescanDevice makes the kernel read the size of a SCSI device again,
+// e.g. after the volume was expanded. The size of virtio devices is updated
+// without a rescan, and nothing is done for them.
+func (m *mounter) RescanDevice(ctx context.Context, devicePath string) error {
+	logger := klog.FromContext(ctx)
+	name := filepath.Base(ResolveDevicePath(devicePath))
+	rescanPath := filepath.Join("/sys/block", name, "device", "rescan")
+	if _, err := os.Stat(rescanPath); err != nil {
+		if os.IsNotExist(err) {
+			logger.V(4).Info("Device cannot be rescanned", "devicePath", devicePath)
+
+			return nil
+		}
+
+		return err
+	}
+
+	logger.V(2).Info("Triggering device rescan", "devicePath", devicePath)
+	if err := os.WriteFile(rescanPath, []byte("1"), 0o200); err != nil { //nolint:gosec
+		return fmt.Errorf("failed to rescan device %s: %w", devicePath, err)
+	}
+
+	return nil
+}
+
+// ResolveDevicePath returns the path of the device a link, e.g. in
+// /dev/disk/by-id, points to, or devicePath itself if it cannot be resolved.
+func ResolveDevicePath(devicePath string) string {
+	resolved, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return devicePath
+	}
+
+	return resolved
+}
+
+// bindMountOptions returns the options of a bind mount.
+func bindMountOptions(options []string) []string {
+	if slices.Contains(options, "bind") {
+		return options
+	}
+
+	return append([]string{"bind"}, options...)
+}
+
+// Resize resizes the filesystem of the given devicePath, mounted at
+// deviceMountPath. XFS filesystems can only be grown online, through their
+// mount point, whereas ext filesystems are resized through their device.
 func (m *mounter) Resize(devicePath, deviceMountPath string) (bool, error) {
-	return mount.NewResizeFs(m.Exec).Resize(devicePath, deviceMountPath)
+	fsType, err := m.GetFSType(devicePath)
+	if err != nil {
+		return false, err
+	}
+
+	var cmd kexec.Cmd
+	switch fsType {
+	case "ext3", "ext4":
+		cmd = m.Exec.Command("resize2fs", devicePath)
+	case "xfs":
+		cmd = m.Exec.Command("xfs_growfs", "-d", deviceMountPath)
+	default:
+		return false, fmt.Errorf("resize of format %q is not supported for device %s mounted at %s", fsType, devicePath, deviceMountPath)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return false, fmt.Errorf("resize of device %s (%s) failed: %w, output: %s", devicePath, fsType, err, string(output))
+	}
+
+	return true, nil
+}
+
+// xfsRepairDirtyLog is the exit code of xfs_repair -n when the log of the
+// filesystem must be replayed, e.g. after an unclean shutdown.
+const xfsRepairDirtyLog = 2
+
+// Exit codes of fsck, which are OR-ed together.
+const (
+	// fsckErrorsUncorrected means errors were left uncorrected.
+	fsckErrorsUncorrected = 4
+	// fsckErrorsCorrected and fsckRebootRequired mean errors were corrected.
+	fsckErrorsCorrected = 1
+	fsckRebootRequired  = 2
+)
+
+// RepairFilesystem checks the filesystem of an unmounted device before it
+// is mounted, e.g. after an unclean shutdown of the node. Ext filesystems are
+// repaired with fsck -a, which only fixes errors safe to fix automatically.
+// XFS filesystems are only checked, with xfs_repair -n, since their log is
+// replayed at mount time: a dirty log is left to the mount. Corruption left
+// unrepaired is returned as a MountError of type HasFilesystemErrors.
+func (m *mounter) RepairFilesystem(ctx context.Context, devicePath string, fsType string) error {
+	logger := klog.FromContext(ctx)
+	switch fsType {
+	case "ext2", "ext3", "ext4":
+		output, err := m.Exec.Command("fsck", "-a", devicePath).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		var exitErr kexec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fmt.Errorf("failed to check filesystem of %s: %w", devicePath, err)
+		}
+		status := exitErr.ExitStatus()
+		if status&^(fsckErrorsCorrected|fsckRebootRequired) == 0 {
+			logger.V(2).Info("Filesystem errors corrected", "devicePath", devicePath, "output", string(output))
+
+			return nil
+		}
+		if status&fsckErrorsUncorrected != 0 {
+			return mount.NewMountError(mount.HasFilesystemErrors,
+				"filesystem of %s has errors fsck -a cannot repair, run fsck manually: %s", devicePath, string(output))
+		}
+
+		return fmt.Errorf("failed to check filesystem of %s: %w, output: %s", devicePath, err, string(output))
+	case "xfs":
+		output, err := m.Exec.Command("xfs_repair", "-n", devicePath).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+		// xfs_repair -n exits with 1 when corruption is detected.
+		var exitErr kexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 1 {
+			return mount.NewMountError(mount.HasFilesystemErrors,
+				"filesystem of %s is corrupted, run xfs_repair manually: %s", devicePath, string(output))
+		}
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == xfsRepairDirtyLog {
+			// The log is replayed by the kernel when mounting.
+			logger.V(2).Info("Filesystem log is dirty, leaving its replay to the mount", "devicePath", devicePath, "output", string(output))
+
+			return nil
+		}
+
+		return fmt.Errorf("failed to check filesystem of %s: %w, output: %s", devicePath, err, string(output))
+	default:
+		return fmt.Errorf("check of format %q is not supported for device %s", fsType, devicePath)
+	}
+}
+
+// GetFSType returns the filesystem type of a device, using blkid, or
+// an empty string if the device is not formatted.
+func (m *mounter) GetFSType(devicePath string) (string, error) {
+	output, err := m.Exec.Command("blkid", "-p", "-s", "TYPE", "-o", "value", devicePath).CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 when no filesystem is found.
+		var exitErr kexec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitStatus() == 2 {
+			return "", nil
+		}
+
+		return "", fmt.Errorf("failed to get filesystem type of %s: %w, output: %s", devicePath, err, string(output))
+	}
+
+	return strings.TrimSpace(string(output)), nil
 }
 
 // NeedResize checks if the filesystem of the given devicePath needs to be resized.
@@ -366,25 +812,25 @@ func (m *mounter) NeedResize(devicePath string, deviceMountPath string) (bool, e
 }
 
 // GetStatistics gathers statistics on the volume.
-func (m *mounter) GetStatistics(volumePath string) (volumeStatistics, error) {
+func (m *mounter) GetStatistics(volumePath string) (VolumeStatistics, error) {
 	isBlock, err := m.IsBlockDevice(volumePath)
 	if err != nil {
-		return volumeStatistics{}, fmt.Errorf("failed to determine if volume %s is block device: %w", volumePath, err)
+		return VolumeStatistics{}, fmt.Errorf("failed to determine if volume %s is block device: %w", volumePath, err)
 	}
 
 	if isBlock {
 		// See http://man7.org/linux/man-pages/man8/blockdev.8.html for details
 		output, err := exec.Command("blockdev", "getsize64", volumePath).CombinedOutput()
 		if err != nil {
-			return volumeStatistics{}, fmt.Errorf("error when getting size of block volume at path %s: output: %s, err: %w", volumePath, string(output), err)
+			return VolumeStatistics{}, fmt.Errorf("error when getting size of block volume at path %s: output: %s, err: %w", volumePath, string(output), err)
 		}
 		strOut := strings.TrimSpace(string(output))
 		gotSizeBytes, err := strconv.ParseInt(strOut, 10, 64)
 		if err != nil {
-			return volumeStatistics{}, fmt.Errorf("failed to parse size %s into int", strOut)
+			return VolumeStatistics{}, fmt.Errorf("failed to parse size %s into int", strOut)
 		}
 
-		return volumeStatistics{
+		return VolumeStatistics{
 			TotalBytes: gotSizeBytes,
 		}, nil
 	}
@@ -393,10 +839,10 @@ func (m *mounter) GetStatistics(volumePath string) (volumeStatistics, error) {
 	// See http://man7.org/linux/man-pages/man2/statfs.2.html for details.
 	err = unix.Statfs(volumePath, &statfs)
 	if err != nil {
-		return volumeStatistics{}, err
+		return VolumeStatistics{}, err
 	}
 
-	volStats := volumeStatistics{
+	volStats := VolumeStatistics{
 		AvailableBytes: int64(statfs.Bavail) * int64(statfs.Bsize),                         //nolint:gosec,unconvert
 		TotalBytes:     int64(statfs.Blocks) * int64(statfs.Bsize),                         //nolint:gosec,unconvert
 		UsedBytes:      (int64(statfs.Blocks) - int64(statfs.Bfree)) * int64(statfs.Bsize), //nolint:gosec,unconvert
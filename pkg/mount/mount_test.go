@@ -0,0 +1,440 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package mount
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"k8s.io/mount-utils"
+	kexec "k8s.io/utils/exec"
+	testingexec "k8s.io/utils/exec/testing"
+)
+
+func TestRootDeviceFromMounts(t *testing.T) {
+	cases := []struct {
+		name        string
+		mountPoints []mount.MountPoint
+		expected    string
+	}{
+		{"first disk", []mount.MountPoint{{Device: "/dev/sda1", Path: "/"}}, "/dev/sda"},
+		{"non-standard disk", []mount.MountPoint{{Device: "/dev/sdc", Path: "/boot"}, {Device: "/dev/xvdb2", Path: "/"}}, "/dev/xvdb"},
+		{"virtio disk", []mount.MountPoint{{Device: "/dev/vda1", Path: "/"}}, "/dev/vda"},
+		{"overlay", []mount.MountPoint{{Device: "overlay", Path: "/"}}, ""},
+		{"lvm", []mount.MountPoint{{Device: "/dev/mapper/vg-root", Path: "/"}}, ""},
+		{"no root", []mount.MountPoint{{Device: "/dev/sda1", Path: "/data"}}, ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := rootDeviceFromMounts(c.mountPoints); got != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, got)
+			}
+		})
+	}
+}
+
+func TestCandidateDevicesNonStandardRoot(t *testing.T) {
+	m := &mounter{
+		SafeFormatAndMount: &mount.SafeFormatAndMount{
+			Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/sdc1", Path: "/"}}),
+		},
+	}
+
+	devices := candidateDevices("/dev/sd", m.getRootDevice(context.Background(), "/dev/sd"))
+	if slices.Contains(devices, "/dev/sdc") {
+		t.Errorf("Expected root device /dev/sdc to be excluded, got %v", devices)
+	}
+	if !slices.Contains(devices, "/dev/sda") || !slices.Contains(devices, "/dev/sdb") {
+		t.Errorf("Expected /dev/sda and /dev/sdb to be scanned, got %v", devices)
+	}
+	if len(devices) != 25 {
+		t.Errorf("Expected 25 devices, got %d", len(devices))
+	}
+
+	// The root disk is not on the XenServer bus: keep excluding the first device.
+	devices = candidateDevices("/dev/xvd", m.getRootDevice(context.Background(), "/dev/xvd"))
+	if slices.Contains(devices, "/dev/xvda") || !slices.Contains(devices, "/dev/xvdc") {
+		t.Errorf("Expected /dev/xvda to be excluded, got %v", devices)
+	}
+}
+
+func TestCandidateDevicesConfiguredRoot(t *testing.T) {
+	m := &mounter{
+		SafeFormatAndMount: &mount.SafeFormatAndMount{
+			Interface: mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/sda1", Path: "/"}}),
+		},
+		rootDevice: "/dev/sdb",
+	}
+
+	devices := candidateDevices("/dev/sd", m.getRootDevice(context.Background(), "/dev/sd"))
+	if slices.Contains(devices, "/dev/sdb") || !slices.Contains(devices, "/dev/sda") {
+		t.Errorf("Expected only the configured root device /dev/sdb to be excluded, got %v", devices)
+	}
+}
+
+func TestFindFirst(t *testing.T) {
+	candidates := make([]string, 0, 100)
+	for i := range 100 {
+		candidates = append(candidates, fmt.Sprintf("/dev/sd%d", i))
+	}
+
+	var (
+		mu        sync.Mutex
+		checked   []string
+		cancelled []string
+	)
+	check := func(ctx context.Context, devicePath string) bool {
+		mu.Lock()
+		checked = append(checked, devicePath)
+		mu.Unlock()
+
+		switch devicePath {
+		case "/dev/sd10":
+			// Slower than the following match, but first in order.
+			time.Sleep(20 * time.Millisecond)
+
+			return true
+		case "/dev/sd11":
+			// Leave time for the following checks to start.
+			time.Sleep(5 * time.Millisecond)
+
+			return true
+		case "/dev/sd12", "/dev/sd13":
+			// Only returns when cancelled.
+			select {
+			case <-ctx.Done():
+				mu.Lock()
+				cancelled = append(cancelled, devicePath)
+				mu.Unlock()
+			case <-time.After(10 * time.Second):
+				t.Errorf("Check of %s not cancelled", devicePath)
+			}
+
+			return true
+		default:
+			return false
+		}
+	}
+
+	devicePath, ok := findFirst(context.Background(), candidates, 4, check)
+	if !ok || devicePath != "/dev/sd10" {
+		t.Fatalf("Expected /dev/sd10, got %q (found: %v)", devicePath, ok)
+	}
+	if len(cancelled) == 0 {
+		t.Error("Expected the checks of the following candidates to be cancelled")
+	}
+	if len(checked) > 14 {
+		t.Errorf("Expected candidates after the match not to be checked, got %v", checked)
+	}
+}
+
+func TestFindFirstNoMatch(t *testing.T) {
+	candidates := []string{"/dev/sdb", "/dev/sdc", "/dev/sdd"}
+	if devicePath, ok := findFirst(context.Background(), candidates, 2, func(context.Context, string) bool { return false }); ok {
+		t.Errorf("Expected no match, got %s", devicePath)
+	}
+}
+
+func TestDiskUUIDToSerial(t *testing.T) {
+	cases := []struct {
+		name     string
+		uuid     string
+		expected string
+	}{
+		{"uuid", "ace9f28b-3081-40c1-8353-4cc3e3014072", "ace9f28b308140c18353"},
+		{"without hyphens", "ace9f28b308140c183534cc3e3014072", "ace9f28b308140c18353"},
+		{"exactly 20 characters", "ace9f28b-3081-40c1-8353", "ace9f28b308140c18353"},
+		{"shorter than 20 characters", "ace9f28b-3081", "ace9f28b3081"},
+		{"empty", "", ""},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if serial := DiskUUIDToSerial(c.uuid); serial != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, serial)
+			}
+		})
+	}
+}
+
+func TestVerifyDeviceReadiness(t *testing.T) {
+	tests := []struct {
+		name       string
+		readyAfter int
+		expected   []bool
+	}{
+		{"ready", 0, []bool{true}},
+		{"not yet ready", 1, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var readinessArgs []string
+			readinessCalls := 0
+			var commands []testingexec.FakeCommandAction
+			for range tt.expected {
+				commands = append(commands,
+					fakeCommand("", nil, "10737418240"),
+					fakeCommand("", nil, ""),
+					fakeCommand("", nil, "DEVNAME=/dev/vdb"),
+					func(cmd string, args ...string) kexec.Cmd {
+						readinessArgs = args
+						readinessCalls++
+						if readinessCalls <= tt.readyAfter {
+							return fakeCommand("dd: error reading '/dev/vdb': Input/output error", testingexec.FakeExitError{Status: 1}, "")(cmd, args...)
+						}
+
+						return fakeCommand("", nil, "")(cmd, args...)
+					},
+				)
+			}
+			m := &mounter{
+				SafeFormatAndMount: &mount.SafeFormatAndMount{
+					Interface: mount.NewFakeMounter(nil),
+					Exec:      &testingexec.FakeExec{CommandScript: commands},
+				},
+				readinessCommand: strings.Fields("dd if={device} of=/dev/null bs=512 count=1"),
+			}
+
+			for i, expected := range tt.expected {
+				if ready := m.verifyDevice(context.Background(), "/dev/vdb", "vol-1"); ready != expected {
+					t.Errorf("Attempt %d: expected verifyDevice to return %t, got %t", i+1, expected, ready)
+				}
+			}
+			if !slices.Contains(readinessArgs, "if=/dev/vdb") {
+				t.Errorf("Expected the device path to be substituted in the readiness command, got %v", readinessArgs)
+			}
+		})
+	}
+}
+
+// fakeCommand returns a command action with the given outputs and error.
+func fakeCommand(combinedOutput string, err error, output string) testingexec.FakeCommandAction {
+	return func(cmd string, args ...string) kexec.Cmd {
+		return testingexec.InitFakeCmd(&testingexec.FakeCmd{
+			OutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(output), nil, err },
+			},
+			CombinedOutputScript: []testingexec.FakeAction{
+				func() ([]byte, []byte, error) { return []byte(combinedOutput), nil, err },
+			},
+		}, cmd, args...)
+	}
+}
+
+func TestGetFSType(t *testing.T) {
+	cases := []struct {
+		name        string
+		output      string
+		err         error
+		expected    string
+		expectedErr bool
+	}{
+		{"xfs", "xfs\n", nil, "xfs", false},
+		{"not formatted", "", testingexec.FakeExitError{Status: 2}, "", false},
+		{"failure", "blkid: error: /dev/vdb: No such file or directory", testingexec.FakeExitError{Status: 4}, "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &mounter{
+				SafeFormatAndMount: &mount.SafeFormatAndMount{
+					Exec: &testingexec.FakeExec{CommandScript: []testingexec.FakeCommandAction{fakeCommand(c.output, c.err, "")}},
+				},
+			}
+
+			fsType, err := m.GetFSType("/dev/vdb")
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error: %v, got %v", c.expectedErr, err)
+			}
+			if fsType != c.expected {
+				t.Errorf("Expected %q, got %q", c.expected, fsType)
+			}
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	cases := []struct {
+		name        string
+		fsType      string
+		expectedCmd []string
+		expectedErr bool
+	}{
+		{"ext4 through device", "ext4", []string{"resize2fs", "/dev/vdb"}, false},
+		{"xfs through mount path", "xfs", []string{"xfs_growfs", "-d", "/mnt/staging"}, false},
+		{"unsupported", "btrfs", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var resizeCmd []string
+			fakeExec := &testingexec.FakeExec{
+				CommandScript: []testingexec.FakeCommandAction{
+					fakeCommand(c.fsType+"\n", nil, ""),
+					func(cmd string, args ...string) kexec.Cmd {
+						resizeCmd = append([]string{cmd}, args...)
+
+						return fakeCommand("", nil, "")(cmd, args...)
+					},
+				},
+			}
+			m := &mounter{SafeFormatAndMount: &mount.SafeFormatAndMount{Exec: fakeExec}}
+
+			resized, err := m.Resize("/dev/vdb", "/mnt/staging")
+			if (err != nil) != c.expectedErr {
+				t.Fatalf("Expected error: %v, got %v", c.expectedErr, err)
+			}
+			if resized != !c.expectedErr {
+				t.Errorf("Expected resized to be %v, got %v", !c.expectedErr, resized)
+			}
+			if !slices.Equal(resizeCmd, c.expectedCmd) {
+				t.Errorf("Expected command %v, got %v", c.expectedCmd, resizeCmd)
+			}
+		})
+	}
+}
+
+func TestFindNVMeDevice(t *testing.T) {
+	const serial = "ace9f28b308140c18353"
+	cases := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			"controller serial",
+			map[string]string{"nvme0n1/device/serial": "other               \n", "nvme1n1/device/serial": serial + "\n"},
+			"nvme1n1",
+		},
+		{
+			"wwid with hex serial",
+			map[string]string{"nvme0n1/wwid": "nvme.1af4-" + hex.EncodeToString([]byte(serial)) + "-51454d55-00000001\n"},
+			"nvme0n1",
+		},
+		{
+			"partitions ignored",
+			map[string]string{"nvme0n1p1/device/serial": serial + "\n"},
+			"",
+		},
+		{
+			"no match",
+			map[string]string{"nvme0n1/device/serial": "other\n"},
+			"",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dev, sys := t.TempDir(), t.TempDir()
+			for path, content := range c.files {
+				name := strings.SplitN(path, "/", 2)[0]
+				if err := os.WriteFile(filepath.Join(dev, name), nil, 0o600); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.MkdirAll(filepath.Dir(filepath.Join(sys, path)), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(sys, path), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			devicePath, err := findNVMeDevice(filepath.Join(dev, "nvme*n*"), sys, serial)
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			expected := ""
+			if c.expected != "" {
+				expected = filepath.Join(dev, c.expected)
+			}
+			if devicePath != expected {
+				t.Errorf("Expected %q, got %q", expected, devicePath)
+			}
+		})
+	}
+}
+
+func TestBindMountOptions(t *testing.T) {
+	cases := []struct {
+		options  []string
+		expected []string
+	}{
+		{nil, []string{"bind"}},
+		{[]string{"ro"}, []string{"bind", "ro"}},
+		{[]string{"bind", "ro"}, []string{"bind", "ro"}},
+	}
+	for _, c := range cases {
+		if got := bindMountOptions(c.options); !slices.Equal(got, c.expected) {
+			t.Errorf("bindMountOptions(%v): expected %v, got %v", c.options, c.expected, got)
+		}
+	}
+}
+
+func TestRepairFilesystem(t *testing.T) {
+	cases := []struct {
+		name           string
+		fsType         string
+		err            error
+		expectedCmd    []string
+		expectErr      bool
+		expectFsErrors bool
+	}{
+		{"ext4 clean", "ext4", nil, []string{"fsck", "-a", "/dev/vdb"}, false, false},
+		{"ext4 corrected", "ext4", testingexec.FakeExitError{Status: 1}, []string{"fsck", "-a", "/dev/vdb"}, false, false},
+		{"ext4 uncorrected", "ext4", testingexec.FakeExitError{Status: 4}, []string{"fsck", "-a", "/dev/vdb"}, true, true},
+		{"ext4 operational error", "ext4", testingexec.FakeExitError{Status: 8}, []string{"fsck", "-a", "/dev/vdb"}, true, false},
+		{"xfs clean", "xfs", nil, []string{"xfs_repair", "-n", "/dev/vdb"}, false, false},
+		{"xfs corrupted", "xfs", testingexec.FakeExitError{Status: 1}, []string{"xfs_repair", "-n", "/dev/vdb"}, true, true},
+		{"xfs dirty log", "xfs", testingexec.FakeExitError{Status: 2}, []string{"xfs_repair", "-n", "/dev/vdb"}, false, false},
+		{"unsupported", "btrfs", nil, nil, true, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var repairCmd []string
+			fakeExec := &testingexec.FakeExec{
+				CommandScript: []testingexec.FakeCommandAction{
+					func(cmd string, args ...string) kexec.Cmd {
+						repairCmd = append([]string{cmd}, args...)
+
+						return fakeCommand("", c.err, "")(cmd, args...)
+					},
+				},
+			}
+			m := &mounter{SafeFormatAndMount: &mount.SafeFormatAndMount{Exec: fakeExec}}
+
+			err := m.RepairFilesystem(context.Background(), "/dev/vdb", c.fsType)
+			if (err != nil) != c.expectErr {
+				t.Fatalf("Expected error: %v, got %v", c.expectErr, err)
+			}
+			var mountErr mount.MountError
+			if isFilesystemErr := errors.As(err, &mountErr) && mountErr.Type == mount.HasFilesystemErrors; isFilesystemErr != c.expectFsErrors {
+				t.Errorf("Expected filesystem errors: %v, got %v", c.expectFsErrors, err)
+			}
+			if !slices.Equal(repairCmd, c.expectedCmd) {
+				t.Errorf("Expected command %v, got %v", c.expectedCmd, repairCmd)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package syncer
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// defaultClassAnnotation marks the default storage class of the cluster.
+const defaultClassAnnotation = "storageclass.kubernetes.io/is-default-class"
+
+// parseKeyValues parses comma-separated key=value pairs, e.g. labels or
+// annotations given on the command line. Keys must be qualified names.
+func parseKeyValues(s string) (map[string]string, error) {
+	m := make(map[string]string)
+	if s == "" {
+		return m, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, _ := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid key %q: %s", key, strings.Join(errs, ", "))
+		}
+		m[key] = value
+	}
+
+	return m, nil
+}
+
+// isDefaultOffering returns true if the storage class of the disk
+// offering, given by name or ID, is the default of the cluster.
+func (s syncer) isDefaultOffering(offeringID, offeringName string) bool {
+	return s.defaultOffering != "" && (s.defaultOffering == offeringID || s.defaultOffering == offeringName)
+}
+
+// storageClassMetadata returns the labels and annotations of the storage
+// class of a disk offering. The label selecting the managed storage classes
+// takes precedence over the extra labels.
+func (s syncer) storageClassMetadata(offeringID, offeringName string) (map[string]string, map[string]string) {
+	labels := make(map[string]string, len(s.extraLabels)+len(s.labelsSet))
+	maps.Copy(labels, s.extraLabels)
+	maps.Copy(labels, s.labelsSet)
+
+	annotations := maps.Clone(s.annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	if s.isDefaultOffering(offeringID, offeringName) {
+		annotations[defaultClassAnnotation] = "true"
+	}
+
+	return labels, annotations
+}
+
+// applyMetadata sets the labels and annotations on an existing storage
+// class, keeping the others. When a default offering is configured, the
+// default class annotation is removed from the classes of other offerings.
+// It returns true if the storage class was changed.
+func applyMetadata(sc *storagev1.StorageClass, labels, annotations map[string]string, manageDefault bool) bool {
+	changed := false
+	if sc.Labels == nil {
+		sc.Labels = make(map[string]string)
+	}
+	for key, value := range labels {
+		if current, ok := sc.Labels[key]; !ok || current != value {
+			sc.Labels[key] = value
+			changed = true
+		}
+	}
+
+	if sc.Annotations == nil {
+		sc.Annotations = make(map[string]string)
+	}
+	for key, value := range annotations {
+		if current, ok := sc.Annotations[key]; !ok || current != value {
+			sc.Annotations[key] = value
+			changed = true
+		}
+	}
+	if _, isDefault := annotations[defaultClassAnnotation]; manageDefault && !isDefault {
+		if _, ok := sc.Annotations[defaultClassAnnotation]; ok {
+			delete(sc.Annotations, defaultClassAnnotation)
+			changed = true
+		}
+	}
+
+	return changed
+}
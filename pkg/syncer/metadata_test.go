@@ -0,0 +1,164 @@
+//
+// Licensed to the Apache Software Foundation (ASF) under one
+// or more contributor license agreements.  See the NOTICE file
+// distributed with this work for additional information
+// regarding copyright ownership.  The ASF licenses this file
+// to you under the Apache License, Version 2.0 (the
+// "License"); you may not use this file except in compliance
+// with the License.  You may obtain a copy of the License at
+//
+//   http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing,
+// software distributed under the License is distributed on an
+// "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+// KIND, either express or implied.  See the License for the
+// specific language governing permissions and limitations
+// under the License.
+//
+
+package syncer
+
+import (
+	"maps"
+	"testing"
+
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseKeyValues(t *testing.T) {
+	cases := []struct {
+		input     string
+		expected  map[string]string
+		shouldErr bool
+	}{
+		{"", map[string]string{}, false},
+		{"tier=gold", map[string]string{"tier": "gold"}, false},
+		{"tier=gold,example.com/team=storage", map[string]string{"tier": "gold", "example.com/team": "storage"}, false},
+		{"flag", map[string]string{"flag": ""}, false},
+		{"=gold", nil, true},
+		{"bad key=gold", nil, true},
+	}
+	for _, c := range cases {
+		t.Run(c.input, func(t *testing.T) {
+			m, err := parseKeyValues(c.input)
+			if (err != nil) != c.shouldErr {
+				t.Fatalf("Expected error %v, got %v", c.shouldErr, err)
+			}
+			if !c.shouldErr && !maps.Equal(m, c.expected) {
+				t.Errorf("Expected %v, got %v", c.expected, m)
+			}
+		})
+	}
+}
+
+func TestStorageClassMetadata(t *testing.T) {
+	s := syncer{
+		labelsSet:       createLabelsSet("app.kubernetes.io/managed-by=syncer"),
+		extraLabels:     map[string]string{"tier": "gold", "app.kubernetes.io/managed-by": "other"},
+		annotations:     map[string]string{"example.com/owner": "storage"},
+		defaultOffering: "Gold",
+	}
+
+	labels, annotations := s.storageClassMetadata("offering-1", "Gold")
+	expectedLabels := map[string]string{"tier": "gold", "app.kubernetes.io/managed-by": "syncer"}
+	if !maps.Equal(labels, expectedLabels) {
+		t.Errorf("Expected labels %v, got %v", expectedLabels, labels)
+	}
+	expectedAnnotations := map[string]string{"example.com/owner": "storage", defaultClassAnnotation: "true"}
+	if !maps.Equal(annotations, expectedAnnotations) {
+		t.Errorf("Expected annotations %v, got %v", expectedAnnotations, annotations)
+	}
+
+	// The default offering may also be given by ID.
+	s.defaultOffering = "offering-1"
+	if _, annotations := s.storageClassMetadata("offering-1", "Gold"); annotations[defaultClassAnnotation] != "true" {
+		t.Errorf("Expected default class by ID, got %v", annotations)
+	}
+	if _, annotations := s.storageClassMetadata("offering-2", "Silver"); annotations[defaultClassAnnotation] != "" {
+		t.Errorf("Expected no default class for another offering, got %v", annotations)
+	}
+	if _, ok := s.annotations[defaultClassAnnotation]; ok {
+		t.Error("Expected configured annotations to be left unchanged")
+	}
+}
+
+func TestApplyMetadata(t *testing.T) {
+	cases := []struct {
+		name                string
+		existingLabels      map[string]string
+		existingAnnotations map[string]string
+		annotations         map[string]string
+		manageDefault       bool
+		expectedChanged     bool
+		expectedAnnotations map[string]string
+	}{
+		{
+			"up to date",
+			map[string]string{"tier": "gold", "other": "label"},
+			map[string]string{"other": "annotation"},
+			map[string]string{},
+			false,
+			false,
+			map[string]string{"other": "annotation"},
+		},
+		{
+			"missing label",
+			map[string]string{},
+			nil,
+			map[string]string{},
+			false,
+			true,
+			map[string]string{},
+		},
+		{
+			"marked as default",
+			map[string]string{"tier": "gold"},
+			nil,
+			map[string]string{defaultClassAnnotation: "true"},
+			true,
+			true,
+			map[string]string{defaultClassAnnotation: "true"},
+		},
+		{
+			"no longer default",
+			map[string]string{"tier": "gold"},
+			map[string]string{defaultClassAnnotation: "true"},
+			map[string]string{},
+			true,
+			true,
+			map[string]string{},
+		},
+		{
+			"default left unmanaged",
+			map[string]string{"tier": "gold"},
+			map[string]string{defaultClassAnnotation: "true"},
+			map[string]string{},
+			false,
+			false,
+			map[string]string{defaultClassAnnotation: "true"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sc := &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "cloudstack-gold",
+					Labels:      c.existingLabels,
+					Annotations: c.existingAnnotations,
+				},
+			}
+			changed := applyMetadata(sc, map[string]string{"tier": "gold"}, c.annotations, c.manageDefault)
+			if changed != c.expectedChanged {
+				t.Errorf("Expected changed %v, got %v", c.expectedChanged, changed)
+			}
+			if sc.Labels["tier"] != "gold" {
+				t.Errorf("Expected label tier=gold, got %v", sc.Labels)
+			}
+			if !maps.Equal(sc.Annotations, c.expectedAnnotations) {
+				t.Errorf("Expected annotations %v, got %v", c.expectedAnnotations, sc.Annotations)
+			}
+		})
+	}
+}
@@ -30,7 +30,6 @@ import (
 	storagev1 "k8s.io/api/storage/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 
 	"github.com/cloudstack/cloudstack-csi-driver/pkg/driver"
 )
@@ -131,6 +130,7 @@ func (s syncer) syncOffering(ctx context.Context, offering *cloudstack.DiskOffer
 		name = offering.Id
 	}
 	log.Printf("Storage class name: %s", name)
+	scLabels, scAnnotations := s.storageClassMetadata(offering.Id, offeringName)
 
 	sc, err := s.k8sClient.StorageV1().StorageClasses().Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
@@ -140,8 +140,9 @@ func (s syncer) syncOffering(ctx context.Context, offering *cloudstack.DiskOffer
 
 			newSc := &storagev1.StorageClass{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:   name,
-					Labels: s.labelsSet,
+					Name:        name,
+					Labels:      scLabels,
+					Annotations: scAnnotations,
 				},
 				Provisioner:          driver.DriverName,
 				VolumeBindingMode:    &volBindingMode,
@@ -180,13 +181,11 @@ func (s syncer) syncOffering(ctx context.Context, offering *cloudstack.DiskOffer
 		return name, err
 	}
 
-	// Update labels if needed
+	// Update labels and annotations if needed
 
-	existingLabels := labels.Set(sc.Labels)
-	if !s.labelsSet.AsSelector().Matches(existingLabels) {
-		log.Printf("Storage class %s misses labels %s: updating...", sc.Name, s.labelsSet.String())
+	if applyMetadata(sc, scLabels, scAnnotations, s.defaultOffering != "") {
+		log.Printf("Storage class %s misses labels or annotations: updating...", sc.Name)
 
-		sc.Labels = labels.Merge(existingLabels, s.labelsSet)
 		_, err = s.k8sClient.StorageV1().StorageClasses().Update(ctx, sc, metav1.UpdateOptions{})
 
 		return name, err
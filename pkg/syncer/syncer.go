@@ -46,6 +46,14 @@ type Config struct {
 	NamePrefix       string
 	Delete           bool
 	VolumeExpansion  bool
+
+	// Labels and Annotations are comma-separated key=value pairs set on
+	// the generated storage classes.
+	Labels      string
+	Annotations string
+	// DefaultOffering is the name or ID of the disk offering whose storage
+	// class is marked as the default of the cluster.
+	DefaultOffering string
 }
 
 // Syncer has a function Run which synchronizes CloudStack
@@ -62,6 +70,9 @@ type syncer struct {
 	namePrefix      string
 	delete          bool
 	volumeExpansion bool
+	extraLabels     map[string]string
+	annotations     map[string]string
+	defaultOffering string
 }
 
 func createK8sClient(kubeconfig, agent string) (*kubernetes.Clientset, error) {
@@ -118,6 +129,14 @@ func New(config Config) (Syncer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("cannot create CloudStack client: %w", err)
 	}
+	extraLabels, err := parseKeyValues(config.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid labels: %w", err)
+	}
+	annotations, err := parseKeyValues(config.Annotations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid annotations: %w", err)
+	}
 
 	return syncer{
 		k8sClient:       k8sClient,
@@ -126,5 +145,8 @@ func New(config Config) (Syncer, error) {
 		namePrefix:      config.NamePrefix,
 		delete:          config.Delete,
 		volumeExpansion: config.VolumeExpansion,
+		extraLabels:     extraLabels,
+		annotations:     annotations,
+		defaultOffering: config.DefaultOffering,
 	}, nil
 }
@@ -36,6 +36,17 @@ import (
 	"github.com/kubernetes-csi/csi-test/v5/pkg/sanity"
 )
 
+// expandedMounter is a fake mounter whose devices have the size volumes
+// are expanded to, as NodeExpandVolume waits for the device to reflect it.
+type expandedMounter struct {
+	mount.Interface
+	size int64
+}
+
+func (m *expandedMounter) GetBlockSizeBytes(_ string) (int64, error) {
+	return m.size, nil
+}
+
 func TestSanity(t *testing.T) {
 	// Setup driver
 	dir, err := ioutil.TempDir("", "sanity-cloudstack-csi")
@@ -66,7 +77,8 @@ func TestSanity(t *testing.T) {
 		Endpoint: endpoint,
 		NodeName: "node",
 	}
-	csiDriver, err := driver.New(ctx, fake.New(), &options, mount.NewFake())
+	mounter := &expandedMounter{Interface: mount.NewFake(), size: config.TestVolumeSize + sanity.DefTestExpandIncrement}
+	csiDriver, err := driver.New(ctx, fake.New(), &options, mounter)
 	if err != nil {
 		t.Fatalf("error creating driver: %v", err)
 	}